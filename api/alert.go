@@ -0,0 +1,33 @@
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Alert is a condition operators should be told about.
+type Alert struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Type       string             `json:"type" bson:"type"`
+	Severity   string             `json:"severity" bson:"severity"`
+	Deployment string             `json:"deployment" bson:"deployment"`
+	Platform   string             `json:"platform" bson:"platform"`
+	Message    string             `json:"message" bson:"message"`
+	Location   *Location          `json:"location,omitempty" bson:"location,omitempty"`
+	Time       time.Time          `json:"time" bson:"time"`
+	// open, acked or resolved
+	State      string     `json:"state" bson:"state"`
+	AckedBy    string     `json:"acked_by,omitempty" bson:"acked_by,omitempty"`
+	AckedAt    *time.Time `json:"acked_at,omitempty" bson:"acked_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty" bson:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	// Steps of its escalation policy sent so far
+	Escalations int `json:"escalations,omitempty" bson:"escalations"`
+	// When it was first sent to channels, unless a suppression held it back
+	NotifiedAt *time.Time `json:"notified_at,omitempty" bson:"notified_at,omitempty"`
+	// The suppression that held it back, and when that ends, if it is to
+	// be sent then
+	SuppressedBy    string     `json:"suppressed_by,omitempty" bson:"suppressed_by,omitempty"`
+	SuppressedUntil *time.Time `json:"suppressed_until,omitempty" bson:"suppressed_until,omitempty"`
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Environment is a record of the conditions at a position and time, such as
+// wind, waves, and currents, measured by a platform's sensors or estimated
+// by a model.
+type Environment struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Deployment string             `json:"deployment" bson:"deployment"`
+	// The platform that measured the conditions; empty for model output
+	Platform  string   `json:"platform,omitempty" bson:"platform,omitempty"`
+	Source    string   `json:"source" bson:"source"`
+	Timestamp string   `json:"timestamp" bson:"timestamp"`
+	Latitude  *float64 `json:"latitude" bson:"latitude"`
+	Longitude *float64 `json:"longitude" bson:"longitude"`
+	// Wind speed in m/s and the direction it blows from in degrees true
+	WindSpeed     *float64 `json:"wind_speed,omitempty" bson:"wind_speed,omitempty"`
+	WindDirection *float64 `json:"wind_direction,omitempty" bson:"wind_direction,omitempty"`
+	// Significant wave height in meters, peak period in seconds, and the
+	// direction waves come from in degrees true
+	WaveHeight    *float64 `json:"wave_height,omitempty" bson:"wave_height,omitempty"`
+	WavePeriod    *float64 `json:"wave_period,omitempty" bson:"wave_period,omitempty"`
+	WaveDirection *float64 `json:"wave_direction,omitempty" bson:"wave_direction,omitempty"`
+	// Current speed in m/s and the direction it flows towards in degrees true
+	CurrentSpeed     *float64 `json:"current_speed,omitempty" bson:"current_speed,omitempty"`
+	CurrentDirection *float64 `json:"current_direction,omitempty" bson:"current_direction,omitempty"`
+	// Any other variables, such as air or sea temperature
+	Data      map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
+	CreatedAt time.Time              `json:"created_at" bson:"created_at"`
+}
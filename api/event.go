@@ -0,0 +1,21 @@
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is something that happened to a platform during a deployment, such
+// as launch, recovery, or the start of a mission segment, logged by the
+// platform or its operators.
+type Event struct {
+	ID         primitive.ObjectID     `json:"id,omitempty" bson:"_id,omitempty"`
+	Deployment string                 `json:"deployment" bson:"deployment" binding:"required"`
+	Platform   string                 `json:"platform,omitempty" bson:"platform,omitempty"`
+	Timestamp  string                 `json:"timestamp" bson:"timestamp"`
+	Type       string                 `json:"type" bson:"type" binding:"required"`
+	Message    string                 `json:"message,omitempty" bson:"message,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt  time.Time              `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Heartbeat reports that a platform is alive, whether or not it has a
+// position fix, e.g. a glider underwater calling in over acoustic comms.
+type Heartbeat struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Deployment string             `json:"deployment" bson:"deployment" binding:"required"`
+	Platform   string             `json:"platform" bson:"platform" binding:"required"`
+	Timestamp  string             `json:"timestamp" bson:"timestamp"`
+	Status     string             `json:"status,omitempty" bson:"status,omitempty"`
+	Message    string             `json:"message,omitempty" bson:"message,omitempty"`
+	Battery    *float64           `json:"battery,omitempty" bson:"battery,omitempty"`
+	Comms      map[string]float64 `json:"comms,omitempty" bson:"comms,omitempty"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,92 @@
+// Package api defines the records the gateway accepts, stores, and returns:
+// position fixes, heartbeats, events, telemetry, environmental conditions, and
+// alerts. They are shared by the gateway and programs that embed it or talk
+// to it.
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Location is a position fix reported by a platform during a deployment.
+type Location struct {
+	ID                primitive.ObjectID     `json:"id,omitempty" bson:"_id,omitempty"`
+	UUID              string                 `json:"uuid,omitempty" bson:"uuid,omitempty"`
+	Deployment        string                 `json:"deployment" bson:"deployment"`
+	Platform          string                 `json:"platform" bson:"platform"`
+	Latitude          float64                `json:"latitude" bson:"latitude"`
+	Longitude         float64                `json:"longitude" bson:"longitude"`
+	Timestamp         string                 `json:"timestamp" bson:"timestamp"`
+	Source            string                 `json:"source" bson:"source"`
+	CRS               string                 `json:"crs,omitempty" bson:"crs,omitempty"`
+	X                 *float64               `json:"x,omitempty" bson:"-"`
+	Y                 *float64               `json:"y,omitempty" bson:"-"`
+	Original          *OriginalPosition      `json:"original,omitempty" bson:"original,omitempty"`
+	Speed             *float64               `json:"speed,omitempty" bson:"speed,omitempty"`
+	Course            *float64               `json:"course,omitempty" bson:"course,omitempty"`
+	Heading           *float64               `json:"heading,omitempty" bson:"heading,omitempty"`
+	Pitch             *float64               `json:"pitch,omitempty" bson:"pitch,omitempty"`
+	Roll              *float64               `json:"roll,omitempty" bson:"roll,omitempty"`
+	QC                *QCResult              `json:"qc,omitempty" bson:"qc,omitempty"`
+	Backfilled        bool                   `json:"backfilled,omitempty" bson:"backfilled,omitempty"`
+	UTM               *UTMCoordinate         `json:"utm,omitempty" bson:"-"`
+	Local             *LocalCoordinate       `json:"local,omitempty" bson:"-"`
+	Smoothed          *SmoothedPosition      `json:"smoothed,omitempty" bson:"-"`
+	AlongTrack        *float64               `json:"along_track_distance,omitempty" bson:"-"`
+	Derived           map[string]interface{} `json:"derived,omitempty" bson:"derived,omitempty"`
+	Data              map[string]interface{} `json:"data,omitempty" bson:"-"`
+	ReceivedAt        string                 `json:"received_at,omitempty" bson:"received_at,omitempty"`
+	ReportedTimestamp string                 `json:"reported_timestamp,omitempty" bson:"reported_timestamp,omitempty"`
+	ClockSkew         *float64               `json:"clock_skew,omitempty" bson:"clock_skew,omitempty"`
+	Latency           *float64               `json:"latency,omitempty" bson:"latency,omitempty"`
+	CommsPath         string                 `json:"comms_path,omitempty" bson:"comms_path,omitempty"`
+	CreatedAt         time.Time              `json:"created_at" bson:"created_at"`
+}
+
+// OriginalPosition preserves coordinates as submitted when they were
+// transformed from another CRS.
+type OriginalPosition struct {
+	CRS       string   `json:"crs" bson:"crs"`
+	Latitude  *float64 `json:"latitude,omitempty" bson:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty" bson:"longitude,omitempty"`
+	X         *float64 `json:"x,omitempty" bson:"x,omitempty"`
+	Y         *float64 `json:"y,omitempty" bson:"y,omitempty"`
+}
+
+// QCResult records the quality checks a fix was flagged by at ingest.
+type QCResult struct {
+	Status string   `json:"status" bson:"status"`
+	Flags  []string `json:"flags" bson:"flags"`
+}
+
+// UTMCoordinate is a position in the UTM zone it falls in.
+type UTMCoordinate struct {
+	Zone       int     `json:"zone"`
+	Hemisphere string  `json:"hemisphere"`
+	Easting    float64 `json:"easting"`
+	Northing   float64 `json:"northing"`
+}
+
+// LocalCoordinate is a position in meters east, north, and up of an origin
+// on a local tangent plane.
+type LocalCoordinate struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// SmoothedPosition is a filtered estimate of a fix's position.
+type SmoothedPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// SetDerived records a value derived from the fix, such as by a hook.
+func (l *Location) SetDerived(name string, value interface{}) {
+	if l.Derived == nil {
+		l.Derived = make(map[string]interface{})
+	}
+	l.Derived[name] = value
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Telemetry is the platform-specific data sent with a fix, stored apart
+// from positions so location queries stay small.
+type Telemetry struct {
+	ID         primitive.ObjectID     `json:"id,omitempty" bson:"_id,omitempty"`
+	Deployment string                 `json:"deployment" bson:"deployment"`
+	Platform   string                 `json:"platform" bson:"platform"`
+	Timestamp  string                 `json:"timestamp" bson:"timestamp"`
+	LocationID primitive.ObjectID     `json:"location_id" bson:"location_id"`
+	Data       map[string]interface{} `json:"data" bson:"data"`
+	CreatedAt  time.Time              `json:"created_at" bson:"created_at"`
+}
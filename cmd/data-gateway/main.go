@@ -0,0 +1,32 @@
+// Command data-gateway runs the gateway as a standalone server, configured
+// from the environment.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"data-gateway/gateway"
+)
+
+func main() {
+	check := flag.Bool("check", false, "check configuration, MongoDB, indexes, clock, and disk space, then exit")
+	flag.Parse()
+	if *check {
+		os.Exit(gateway.New(gateway.Config{}).Check())
+	}
+
+	cfg, err := gateway.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := gateway.New(cfg).Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
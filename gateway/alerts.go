@@ -0,0 +1,520 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	alertQCFlagged         = "qc_flagged"
+	alertPlatformNoFix     = "platform_no_fix"
+	alertPlatformSilent    = "platform_silent"
+	alertPlatformRecovered = "platform_recovered"
+	alertTest              = "test"
+)
+
+// Alert states. Alerts are open until acknowledged by an operator, and
+// resolved once the condition clears or an operator closes them.
+const (
+	alertOpen     = "open"
+	alertAcked    = "acked"
+	alertResolved = "resolved"
+)
+
+// Alerts resolved when an alert of the key's type is raised for the same
+// platform
+var alertResolves = map[string][]string{
+	alertPlatformRecovered: {alertPlatformNoFix, alertPlatformSilent},
+}
+
+var alertSeverities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// Alerts are listed newest first
+var alertOrder = pageOrder{field: "time", desc: true, date: true}
+
+// alertRoute sends alerts matching its conditions to the named channels.
+// Empty conditions match everything; deployment and platform may be glob
+// patterns such as "cruise-*".
+type alertRoute struct {
+	Deployment  string   `json:"deployment"`
+	Platform    string   `json:"platform"`
+	Types       []string `json:"types"`
+	MinSeverity string   `json:"min_severity"`
+	Channels    []string `json:"channels"`
+}
+
+type alertConfig struct {
+	Channels    []channelConfig    `json:"channels"`
+	Routes      []alertRoute       `json:"routes"`
+	Escalations []escalationPolicy `json:"escalations"`
+}
+
+// alertNotifier holds the configured alert channels, the routes that
+// decide which of them each alert is sent to, and the policies escalating
+// alerts left unacknowledged.
+type alertNotifier struct {
+	channels    map[string]notifier
+	routes      []alertRoute
+	escalations []escalationPolicy
+}
+
+func (s *Server) initAlerts() error {
+	// Channels and routing rules are read from a JSON file so they can be
+	// changed without rebuilding
+	configPath := os.Getenv("ALERTS_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading ALERTS_CONFIG: %v", err)
+	}
+	var cfg alertConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing ALERTS_CONFIG: %v", err)
+	}
+
+	for _, ch := range cfg.Channels {
+		if _, dup := s.notifier.channels[ch.Name]; dup {
+			return fmt.Errorf("duplicate alert channel %q", ch.Name)
+		}
+		n, err := newNotifier(ch)
+		if err != nil {
+			return fmt.Errorf("invalid alert channel %q: %v", ch.Name, err)
+		}
+		s.notifier.channels[ch.Name] = n
+	}
+
+	for i, route := range cfg.Routes {
+		if route.MinSeverity != "" {
+			if _, ok := alertSeverities[route.MinSeverity]; !ok {
+				return fmt.Errorf("invalid min_severity %q in alert route %d", route.MinSeverity, i)
+			}
+		}
+		for _, pattern := range []string{route.Deployment, route.Platform} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q in alert route %d", pattern, i)
+			}
+		}
+		if len(route.Channels) == 0 {
+			return fmt.Errorf("alert route %d has no channels", i)
+		}
+		for _, name := range route.Channels {
+			if _, ok := s.notifier.channels[name]; !ok {
+				return fmt.Errorf("alert route %d refers to unknown channel %q", i, name)
+			}
+		}
+	}
+	s.notifier.routes = cfg.Routes
+
+	for i := range cfg.Escalations {
+		if err := cfg.Escalations[i].validate(s.notifier.channels); err != nil {
+			return fmt.Errorf("invalid escalation policy %d: %v", i, err)
+		}
+	}
+	s.notifier.escalations = cfg.Escalations
+
+	return nil
+}
+
+func (r alertRoute) matches(alert api.Alert) bool {
+	if ok, _ := path.Match(r.Deployment, alert.Deployment); r.Deployment != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(r.Platform, alert.Platform); r.Platform != "" && !ok {
+		return false
+	}
+	if len(r.Types) > 0 {
+		found := false
+		for _, t := range r.Types {
+			found = found || t == alert.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.MinSeverity == "" || alertSeverities[alert.Severity] >= alertSeverities[r.MinSeverity]
+}
+
+// raiseAlert delivers an alert to every channel a route sends it to. Delivery
+// happens in the background and failures are logged. Alerts aren't raised at
+// all while the alerts feature is disabled.
+func (s *Server) raiseAlert(alert api.Alert) {
+	if !s.featureEnabled(featureAlerts) {
+		return
+	}
+	if alert.Time.IsZero() {
+		alert.Time = time.Now().UTC()
+	}
+	alert.State = alertOpen
+	if types, ok := alertResolves[alert.Type]; ok {
+		// Nothing is left to act on once the alerts it clears are resolved
+		alert.State, alert.ResolvedAt = alertResolved, &alert.Time
+		s.resolveAlerts(alert.Deployment, alert.Platform, types...)
+	}
+
+	suppression, until, err := s.activeSuppression(context.Background(), alert)
+	if err != nil {
+		// Better sent during quiet hours than lost
+		s.logger.Printf("error checking suppressions of %s alert: %v", alert.Type, err)
+	}
+	var targets map[string]bool
+	if suppression != nil {
+		alert.SuppressedBy = suppression.ID.Hex()
+		if ongoingAlerts[alert.Type] {
+			alert.SuppressedUntil = &until
+		}
+	} else {
+		alert.NotifiedAt = &alert.Time
+		targets = s.alertTargets(&alert)
+	}
+
+	if _, err := s.store.Alerts.InsertOne(context.Background(), alert); err != nil {
+		s.logger.Printf("error storing %s alert: %v", alert.Type, err)
+	}
+	s.notify(alert, targets)
+}
+
+// alertTargets returns the channels an alert is first sent to, when it is
+// raised or a suppression holding it back ends: those of the routes matching
+// it, and the steps of its escalation policy due at once, which it counts as
+// sent.
+func (s *Server) alertTargets(alert *api.Alert) map[string]bool {
+	targets := make(map[string]bool)
+	for _, route := range s.notifier.routes {
+		if route.matches(*alert) {
+			for _, name := range route.Channels {
+				targets[name] = true
+			}
+		}
+	}
+	if policy := s.notifier.escalation(*alert); policy != nil && alert.State == alertOpen {
+		// Steps due at once go out with the routed channels
+		for _, step := range policy.Steps {
+			if step.after > 0 {
+				break
+			}
+			for _, name := range step.Channels {
+				targets[name] = true
+			}
+			alert.Escalations++
+		}
+	}
+	return targets
+}
+
+// notify sends an alert to the named channels in the background, logging
+// failures.
+func (s *Server) notify(alert api.Alert, targets map[string]bool) {
+	for name := range targets {
+		go func(name string, n notifier) {
+			if err := n.Notify(alert); err != nil {
+				s.logger.Printf("error sending %s alert to channel %s: %v", alert.Type, name, err)
+			}
+		}(name, s.notifier.channels[name])
+	}
+}
+
+// resolveAlerts resolves a platform's open and acknowledged alerts of the
+// given types, once the condition they were raised for has cleared.
+func (s *Server) resolveAlerts(deployment, platform string, types ...string) {
+	filter := bson.M{
+		"deployment": deployment,
+		"platform":   platform,
+		"type":       bson.M{"$in": types},
+		"state":      bson.M{"$in": bson.A{alertOpen, alertAcked}},
+	}
+	update := bson.M{"$set": bson.M{"state": alertResolved, "resolved_at": time.Now().UTC()}}
+	if _, err := s.store.Alerts.UpdateMany(context.Background(), filter, update); err != nil {
+		s.logger.Printf("error resolving %s alerts: %v", strings.Join(types, ", "), err)
+	}
+}
+
+// qcAlert builds the alert raised when an ingested fix fails quality checks.
+func qcAlert(location *api.Location) api.Alert {
+	severity := "warning"
+	for _, flag := range location.QC.Flags {
+		if flag == "position_out_of_range" || flag == "speed_exceeds_limit" {
+			severity = "critical"
+		}
+	}
+	// Copy the fix since delivery outlives the request
+	fix := *location
+	return api.Alert{
+		Type:       alertQCFlagged,
+		Severity:   severity,
+		Deployment: location.Deployment,
+		Platform:   location.Platform,
+		Message:    fmt.Sprintf("Fix at %s flagged: %s", location.Timestamp, strings.Join(location.QC.Flags, ", ")),
+		Location:   &fix,
+	}
+}
+
+func (s *Server) handleListAlertChannels(c *gin.Context) {
+	names := make([]string, 0, len(s.notifier.channels))
+	for name := range s.notifier.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	channels := []gin.H{}
+	for _, name := range names {
+		channels = append(channels, gin.H{"name": name, "type": s.notifier.channels[name].Type()})
+	}
+	routes := s.notifier.routes
+	if routes == nil {
+		routes = []alertRoute{}
+	}
+	escalations := s.notifier.escalations
+	if escalations == nil {
+		escalations = []escalationPolicy{}
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels, "routes": routes, "escalations": escalations})
+}
+
+// handleGetAlerts returns the alerts raised for a deployment, newest first.
+func (s *Server) handleGetAlerts(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	for _, field := range []string{"platform", "type", "severity", "state"} {
+		if v := c.Query(field); v != "" {
+			filter[field] = v
+		}
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		t, _ := parseTimestamp(start)
+		timeRange["$gte"] = t
+	}
+	if end != "" {
+		t, _ := parseTimestamp(end)
+		timeRange["$lte"] = t
+	}
+	if len(timeRange) > 0 {
+		filter["time"] = timeRange
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	after, err := alertOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(alertOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Alerts.Find(ctx, scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []api.Alert{}
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	alertOrder.setPageHeaders(c, int64(len(results)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := results[len(results)-1]
+		return last.Time, last.ID
+	})
+
+	for i := range results {
+		localizeAlert(&results[i], loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// localizeAlert converts an alert's times to loc.
+func localizeAlert(alert *api.Alert, loc *time.Location) {
+	alert.Time = alert.Time.In(loc)
+	for _, t := range []*time.Time{alert.AckedAt, alert.ResolvedAt, alert.NotifiedAt, alert.SuppressedUntil} {
+		if t != nil {
+			*t = t.In(loc)
+		}
+	}
+	if alert.Location != nil {
+		localizeLocation(alert.Location, loc)
+	}
+}
+
+// handleAckAlert acknowledges an open alert, recording who took it on.
+func (s *Server) handleAckAlert(c *gin.Context) {
+	s.updateAlertState(c, alertAcked)
+}
+
+// handleResolveAlert closes an alert whose condition won't clear by itself,
+// such as a qc_flagged fix that has been looked at.
+func (s *Server) handleResolveAlert(c *gin.Context) {
+	s.updateAlertState(c, alertResolved)
+}
+
+// updateAlertState moves an alert to the acked or resolved state. Resolved
+// alerts stay resolved, and acknowledging an acknowledged alert leaves it
+// as it was.
+func (s *Server) updateAlertState(c *gin.Context, state string) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid alert id")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	var alert api.Alert
+	err = s.store.Alerts.FindOne(ctx, bson.M{"_id": id}).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "alert not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !canRead(c, alert.Deployment, alert.Platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+
+	// Alerts stored before states were added have none, and count as open
+	settled := bson.A{alertResolved}
+	if state == alertAcked {
+		settled = bson.A{alertAcked, alertResolved}
+	}
+	var by string
+	if cred := requestCredential(c); cred != nil {
+		by = cred.Name
+	}
+	now := time.Now().UTC()
+	set := bson.M{"state": state, "acked_by": by, "acked_at": now}
+	if state == alertResolved {
+		set = bson.M{"state": state, "resolved_by": by, "resolved_at": now}
+	}
+	err = s.store.Alerts.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "state": bson.M{"$nin": settled}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		// Already acknowledged or resolved, perhaps since it was read
+		err = s.store.Alerts.FindOne(ctx, bson.M{"_id": id}).Decode(&alert)
+		if err == nil && alert.State == alertResolved {
+			respondErrorf(c, http.StatusConflict, "alert is already resolved")
+			return
+		}
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	localizeAlert(&alert, loc)
+	c.JSON(http.StatusOK, alert)
+}
+
+// openAlertCounts returns the number of open and acknowledged alerts of each
+// platform matching filter, by platform and state.
+func (s *Server) openAlertCounts(ctx context.Context, filter bson.M) (map[string]map[string]int64, error) {
+	match := bson.M{"state": bson.M{"$in": bson.A{alertOpen, alertAcked}}}
+	for k, v := range filter {
+		match[k] = v
+	}
+	pipeline := bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":   bson.M{"platform": "$platform", "state": "$state"},
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+	cursor, err := s.store.Alerts.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID struct {
+			Platform string `bson:"platform"`
+			State    string `bson:"state"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]map[string]int64)
+	for _, g := range groups {
+		if counts[g.ID.Platform] == nil {
+			counts[g.ID.Platform] = make(map[string]int64)
+		}
+		counts[g.ID.Platform][g.ID.State] = g.Count
+	}
+	return counts, nil
+}
+
+// handleTestAlertChannel sends a test alert straight to one channel,
+// bypassing routing, and reports whether delivery succeeded.
+func (s *Server) handleTestAlertChannel(c *gin.Context) {
+	n, ok := s.notifier.channels[c.Param("name")]
+	if !ok {
+		respondErrorf(c, http.StatusNotFound, "alert channel not found")
+		return
+	}
+
+	alert := api.Alert{
+		Type:     alertTest,
+		Severity: "info",
+		Message:  "Test alert from data-gateway",
+		Time:     time.Now().UTC(),
+	}
+	if err := n.Notify(alert); err != nil {
+		respondError(c, http.StatusBadGateway, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sent": true})
+}
@@ -0,0 +1,200 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// alongTrack accumulates the distance each platform has travelled over
+// fixes added in timestamp order.
+type alongTrack struct {
+	last     map[string][2]float64
+	distance map[string]float64
+}
+
+func newAlongTrack() *alongTrack {
+	return &alongTrack{last: make(map[string][2]float64), distance: make(map[string]float64)}
+}
+
+// add returns the distance in meters the fix's platform has travelled up to
+// the fix.
+func (a *alongTrack) add(location *api.Location) float64 {
+	key := location.Deployment + "/" + location.Platform
+	if last, ok := a.last[key]; ok {
+		a.distance[key] += haversine(last[0], last[1], location.Latitude, location.Longitude)
+	}
+	a.last[key] = [2]float64{location.Latitude, location.Longitude}
+	return a.distance[key]
+}
+
+// parseAlongTrack reads the alongTrack query parameter.
+func parseAlongTrack(c *gin.Context) (bool, error) {
+	v := c.Query("alongTrack")
+	if v == "" {
+		return false, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid alongTrack %q", v)
+	}
+	return on, nil
+}
+
+// alongTrackBefore returns the distances travelled over the fixes a page
+// skips, either the first offset fixes or those up to the cursor it resumes
+// after, so distances on later pages continue from earlier ones.
+func (s *Server) alongTrackBefore(ctx context.Context, filter bson.M, offset int64, after bson.M) (*alongTrack, error) {
+	track := newAlongTrack()
+	if offset == 0 && after == nil {
+		return track, nil
+	}
+	opts := options.Find().
+		SetSort(timestampOrder.sort()).
+		SetProjection(bson.M{"deployment": 1, "platform": 1, "latitude": 1, "longitude": 1})
+	if after != nil {
+		filter = bson.M{"$and": []bson.M{filter, {"$nor": []bson.M{after}}}}
+	} else {
+		opts.SetLimit(offset)
+	}
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return nil, err
+		}
+		track.add(&location)
+	}
+	return track, cursor.Err()
+}
+
+// DistancePosition is where a platform was once it had travelled a given
+// distance along its track.
+type DistancePosition struct {
+	Deployment string  `json:"deployment"`
+	Platform   string  `json:"platform"`
+	Distance   float64 `json:"distance"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Timestamp  string  `json:"timestamp"`
+	// Interpolated between Before and After, unless a fix is at the distance
+	Interpolated bool          `json:"interpolated"`
+	Before       *api.Location `json:"before,omitempty"`
+	After        *api.Location `json:"after,omitempty"`
+}
+
+// handleGetLocationAtDistance finds where a platform was after travelling a
+// distance along its track, measured from its first fix at or after start,
+// interpolating along the great circle between the fixes either side.
+func (s *Server) handleGetLocationAtDistance(c *gin.Context) {
+	deployment, platform := c.Query("deployment"), c.Query("platform")
+	if deployment == "" || platform == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment and platform are required")
+		return
+	}
+	if !canRead(c, deployment, platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	km, err := strconv.ParseFloat(c.Query("km"), 64)
+	if err != nil || !(km >= 0) {
+		respondErrorf(c, http.StatusBadRequest, "km must be a distance in kilometres of at least 0")
+		return
+	}
+	target := km * 1000
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Locations.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	track := newAlongTrack()
+	var prev *api.Location
+	prevDistance := 0.0
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		distance := track.add(&location)
+		if distance < target {
+			prev, prevDistance = &location, distance
+			continue
+		}
+
+		position := DistancePosition{
+			Deployment: deployment,
+			Platform:   platform,
+			Distance:   target,
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			Timestamp:  location.Timestamp,
+			After:      &location,
+		}
+		if distance > target && prev != nil {
+			f := (target - prevDistance) / (distance - prevDistance)
+			position.Latitude, position.Longitude = intermediatePoint(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude, f)
+			t0, err0 := parseTimestamp(prev.Timestamp)
+			t1, err1 := parseTimestamp(location.Timestamp)
+			if err0 == nil && err1 == nil {
+				position.Timestamp = t0.Add(time.Duration(f * float64(t1.Sub(t0)))).UTC().Format(timestampLayout)
+			}
+			position.Interpolated = true
+			position.Before = prev
+		}
+		position.Timestamp = formatTimestamp(position.Timestamp, loc)
+		if position.Before != nil {
+			localizeLocation(position.Before, loc)
+		}
+		localizeLocation(position.After, loc)
+		c.JSON(http.StatusOK, position)
+		return
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if prev == nil {
+		respondErrorf(c, http.StatusNotFound, "no locations found")
+		return
+	}
+	respondErrorf(c, http.StatusNotFound, "platform travelled only %.3f km", prevDistance/1000)
+}
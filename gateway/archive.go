@@ -0,0 +1,559 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// Deployment archives are gzipped tar files of JSON Lines record files, with
+// a manifest listing each file's size and SHA-256 checksum, and the same
+// checksums in sha256sum format for checking without the gateway.
+const (
+	archiveFormat    = "data-gateway-archive"
+	archiveVersion   = 1
+	archiveManifest  = "manifest.json"
+	archiveChecksums = "SHA256SUMS"
+	// Most files an archive may hold, bounding what an import unpacks
+	maxArchiveFiles = 32
+)
+
+// ArchiveManifest describes a deployment archive's contents.
+type ArchiveManifest struct {
+	Format     string        `json:"format"`
+	Version    int           `json:"version"`
+	Deployment string        `json:"deployment"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Files      []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is a file in a deployment archive.
+type ArchiveFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Records int64  `json:"records"`
+}
+
+// ArchivePlatform is a platform's entry in an archive's platform metadata.
+type ArchivePlatform struct {
+	Platform string `json:"platform"`
+	Fixes    int64  `json:"fixes"`
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	// The platform's entry in PLATFORMS_CONFIG, if it has one
+	Settings *platformConfig `json:"settings,omitempty"`
+}
+
+// archiveWriter collects the files of an archive in a temporary directory,
+// noting their sizes and checksums.
+type archiveWriter struct {
+	dir   string
+	files []ArchiveFile
+}
+
+// write creates a file in the archive, filled by fill, which returns how
+// many records it wrote.
+func (a *archiveWriter) write(name string, fill func(w io.Writer) (int64, error)) error {
+	f, err := os.Create(filepath.Join(a.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(f, hash))
+	records, err := fill(buf)
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	a.files = append(a.files, ArchiveFile{Name: name, Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil)), Records: records})
+	return nil
+}
+
+// writeJSON creates a file in the archive holding one JSON document.
+func (a *archiveWriter) writeJSON(name string, v interface{}, records int64) error {
+	return a.write(name, func(w io.Writer) (int64, error) {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return records, enc.Encode(v)
+	})
+}
+
+// archiveSource is a file of a deployment archive and the records it holds.
+type archiveSource struct {
+	name    string
+	coll    store.Collection
+	filter  bson.M
+	sortKey string
+	// Decodes the cursor's current record and writes it as JSON
+	encode func(cursor *mongo.Cursor, enc *json.Encoder) error
+}
+
+func encodeRecord[T any](cursor *mongo.Cursor, enc *json.Encoder) error {
+	var record T
+	if err := cursor.Decode(&record); err != nil {
+		return err
+	}
+	return enc.Encode(record)
+}
+
+// archiveSources lists the record files of a deployment's archive.
+func (s *Server) archiveSources(deployment string) []archiveSource {
+	filter := bson.M{"deployment": deployment}
+	return []archiveSource{
+		{"locations.jsonl", s.store.Locations, filter, "timestamp", encodeRecord[api.Location]},
+		{"telemetry.jsonl", s.store.Telemetry, filter, "timestamp", encodeRecord[api.Telemetry]},
+		{"events.jsonl", s.store.Events, filter, "timestamp", encodeRecord[api.Event]},
+		{"heartbeats.jsonl", s.store.Heartbeats, filter, "timestamp", encodeRecord[api.Heartbeat]},
+		{"environment.jsonl", s.store.Environment, filter, "timestamp", encodeRecord[api.Environment]},
+		{"alerts.jsonl", s.store.Alerts, filter, "time", encodeRecord[api.Alert]},
+		{"waypoints.jsonl", s.store.Waypoints, filter, "platform", encodeRecord[WaypointPlan]},
+		{"survey_plans.jsonl", s.store.SurveyPlans, bson.M{"_id": deployment}, "_id", encodeRecord[SurveyPlan]},
+	}
+}
+
+// exportRecords writes the records of a source to a JSON Lines file in the
+// archive.
+func exportRecords(ctx context.Context, a *archiveWriter, src archiveSource) error {
+	return a.write(src.name, func(w io.Writer) (int64, error) {
+		cursor, err := src.coll.Find(ctx, src.filter, options.Find().SetSort(bson.D{{Key: src.sortKey, Value: 1}}))
+		if err != nil {
+			return 0, err
+		}
+		defer cursor.Close(ctx)
+		enc := json.NewEncoder(w)
+		var n int64
+		for cursor.Next(ctx) {
+			if err := src.encode(cursor, enc); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, cursor.Err()
+	})
+}
+
+// exportDeployment writes every record of a deployment to a.
+func (s *Server) exportDeployment(ctx context.Context, a *archiveWriter, deployment string) error {
+	for _, src := range s.archiveSources(deployment) {
+		if err := exportRecords(ctx, a, src); err != nil {
+			return err
+		}
+	}
+	return s.writeArchivePlatforms(ctx, a, deployment)
+}
+
+// writeArchivePlatforms writes the archive's platform metadata: each
+// platform's fixes and settings.
+func (s *Server) writeArchivePlatforms(ctx context.Context, a *archiveWriter, deployment string) error {
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"deployment": deployment}},
+		bson.M{"$group": bson.M{
+			"_id":   "$platform",
+			"fixes": bson.M{"$sum": 1},
+			"first": bson.M{"$min": "$timestamp"},
+			"last":  bson.M{"$max": "$timestamp"},
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}
+	cursor, err := s.store.Locations.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Platform string `bson:"_id"`
+		Fixes    int64  `bson:"fixes"`
+		First    string `bson:"first"`
+		Last     string `bson:"last"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	list := make([]ArchivePlatform, 0, len(groups))
+	for _, g := range groups {
+		p := ArchivePlatform{Platform: g.Platform, Fixes: g.Fixes, First: g.First, Last: g.Last}
+		if settings := platformSettings(deployment, p.Platform); settings.Platform != "" {
+			p.Settings = &settings
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Platform < list[j].Platform })
+	return a.writeJSON("platforms.json", list, int64(len(list)))
+}
+
+// writeArchive writes the files collected by a, with their manifest and
+// checksums, as a gzipped tar file.
+func writeArchive(w io.Writer, a *archiveWriter, manifest ArchiveManifest) error {
+	manifest.Files = a.files
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var sums strings.Builder
+	for _, f := range a.files {
+		fmt.Fprintf(&sums, "%s  %s\n", f.SHA256, f.Name)
+	}
+	manifestSum := sha256.Sum256(body)
+	fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(manifestSum[:]), archiveManifest)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		header := &tar.Header{Name: manifest.Deployment + "/" + name, Mode: 0644, Size: size, ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err := writeEntry(archiveManifest, int64(len(body)), strings.NewReader(string(body))); err != nil {
+		return err
+	}
+	if err := writeEntry(archiveChecksums, int64(sums.Len()), strings.NewReader(sums.String())); err != nil {
+		return err
+	}
+	for _, f := range a.files {
+		file, err := os.Open(filepath.Join(a.dir, f.Name))
+		if err != nil {
+			return err
+		}
+		err = writeEntry(f.Name, f.Size, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// handleArchiveDeployment exports a deployment as an archive for handing
+// off to a data repository or importing into another gateway.
+func (s *Server) handleArchiveDeployment(c *gin.Context) {
+	deployment := c.Param("deployment")
+	ctx := c.Request.Context()
+	n, err := s.store.Locations.CountDocuments(ctx, bson.M{"deployment": deployment}, options.Count().SetLimit(1))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if n == 0 {
+		respondErrorf(c, http.StatusNotFound, "deployment has no locations")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "archive-")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	a := &archiveWriter{dir: dir}
+	if err := s.exportDeployment(ctx, a, deployment); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	manifest := ArchiveManifest{
+		Format:     archiveFormat,
+		Version:    archiveVersion,
+		Deployment: deployment,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	disableWriteTimeout(c)
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", deployment+".tar.gz"))
+	c.Status(http.StatusOK)
+	if err := writeArchive(c.Writer, a, manifest); err != nil {
+		s.logger.Printf("error writing archive of %s: %v", deployment, err)
+	}
+}
+
+// readArchive unpacks a gzipped tar archive into dir and checks its files
+// against its manifest.
+func readArchive(r io.Reader, dir string) (ArchiveManifest, error) {
+	var manifest ArchiveManifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, fmt.Errorf("archive is not gzipped: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	sums := map[string]string{}
+	sizes := map[string]int64{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("error reading archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Entries are flat files under a directory named for the deployment
+		name := archiveEntryName(header.Name)
+		if name == "" || name == archiveChecksums {
+			continue
+		}
+		if len(sums) == maxArchiveFiles {
+			return manifest, fmt.Errorf("archive holds more than %d files", maxArchiveFiles)
+		}
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return manifest, err
+		}
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, hash), tr)
+		f.Close()
+		if err != nil {
+			return manifest, fmt.Errorf("error reading %s: %v", name, err)
+		}
+		sums[name], sizes[name] = hex.EncodeToString(hash.Sum(nil)), n
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, archiveManifest))
+	if err != nil {
+		return manifest, fmt.Errorf("archive has no %s", archiveManifest)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid %s: %v", archiveManifest, err)
+	}
+	if manifest.Format != archiveFormat || manifest.Version != archiveVersion {
+		return manifest, fmt.Errorf("unsupported archive format %s version %d", manifest.Format, manifest.Version)
+	}
+	for _, f := range manifest.Files {
+		sum, ok := sums[f.Name]
+		if !ok {
+			return manifest, fmt.Errorf("archive is missing %s", f.Name)
+		}
+		if sum != f.SHA256 || sizes[f.Name] != f.Size {
+			return manifest, fmt.Errorf("%s does not match its checksum", f.Name)
+		}
+	}
+	return manifest, nil
+}
+
+// archiveEntryName returns the name of an archive entry within its
+// deployment directory, or "" if it isn't a plain file there.
+func archiveEntryName(entry string) string {
+	name := entry[strings.LastIndex(entry, "/")+1:]
+	if name == "" || strings.Contains(name, `\`) || name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// ArchiveImportResult counts the records imported from an archive.
+type ArchiveImportResult struct {
+	Deployment string           `json:"deployment"`
+	Records    map[string]int64 `json:"records"`
+}
+
+// importRecords inserts the records of a JSON Lines file from an archive,
+// after prepare has checked and adjusted each.
+func importRecords[T any](ctx context.Context, dir, name string, coll store.Collection, prepare func(*T) error, inserted func(batch []T)) (int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var n int64
+	batch := make([]T, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		docs := make([]interface{}, len(batch))
+		for i := range batch {
+			docs[i] = batch[i]
+		}
+		if _, err := coll.InsertMany(ctx, docs); err != nil {
+			return err
+		}
+		if inserted != nil {
+			inserted(batch)
+		}
+		n += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		var record T
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, withCode(codeInvalidRequest, fmt.Errorf("%s record %d: %v", name, n+int64(len(batch))+1, err))
+		}
+		if err := prepare(&record); err != nil {
+			return n, withCode(codeInvalidRequest, fmt.Errorf("%s record %d: %v", name, n+int64(len(batch))+1, err))
+		}
+		batch = append(batch, record)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+// importDeployment stores the records of an unpacked archive.
+func (s *Server) importDeployment(dir string, manifest ArchiveManifest, progress func(done, total int64)) (ArchiveImportResult, error) {
+	ctx := context.Background()
+	deployment := manifest.Deployment
+	result := ArchiveImportResult{Deployment: deployment, Records: map[string]int64{}}
+	var total, done int64
+	for _, f := range manifest.Files {
+		total += f.Records
+	}
+	now := time.Now()
+	check := func(d string) error {
+		if d != deployment {
+			return fmt.Errorf("belongs to deployment %q", d)
+		}
+		return nil
+	}
+	count := func(name string, n int64, err error) error {
+		result.Records[name] = n
+		done += n
+		progress(done, total)
+		return err
+	}
+
+	// Fixes keep their IDs, which telemetry refers to, but are stored as of
+	// now so rollups and the change feed pick them up
+	n, err := importRecords(ctx, dir, "locations.jsonl", s.store.Locations, func(l *api.Location) error {
+		l.CreatedAt = now
+		return check(l.Deployment)
+	}, func(batch []api.Location) {
+		changes := make([]Change, len(batch))
+		for i := range batch {
+			changes[i] = locationChange(changeInsert, &batch[i])
+		}
+		s.recordChanges(ctx, changes...)
+	})
+	s.facetCache.invalidate()
+	if err := count("locations", n, err); err != nil {
+		return result, err
+	}
+	n, err = importRecords(ctx, dir, "telemetry.jsonl", s.store.Telemetry, func(t *api.Telemetry) error {
+		t.CreatedAt = now
+		return check(t.Deployment)
+	}, nil)
+	if err := count("telemetry", n, err); err != nil {
+		return result, err
+	}
+	n, err = importRecords(ctx, dir, "events.jsonl", s.store.Events, func(e *api.Event) error { return check(e.Deployment) }, nil)
+	if err := count("events", n, err); err != nil {
+		return result, err
+	}
+	n, err = importRecords(ctx, dir, "heartbeats.jsonl", s.store.Heartbeats, func(h *api.Heartbeat) error { return check(h.Deployment) }, nil)
+	if err := count("heartbeats", n, err); err != nil {
+		return result, err
+	}
+	n, err = importRecords(ctx, dir, "environment.jsonl", s.store.Environment, func(e *api.Environment) error { return check(e.Deployment) }, nil)
+	if err := count("environment", n, err); err != nil {
+		return result, err
+	}
+	n, err = importRecords(ctx, dir, "alerts.jsonl", s.store.Alerts, func(a *api.Alert) error { return check(a.Deployment) }, nil)
+	if err := count("alerts", n, err); err != nil {
+		return result, err
+	}
+
+	// Plans replace any the receiving gateway already has for the deployment
+	_, err = s.store.Waypoints.DeleteMany(ctx, bson.M{"deployment": deployment})
+	if err == nil {
+		n, err = importRecords(ctx, dir, "waypoints.jsonl", s.store.Waypoints, func(p *WaypointPlan) error { return check(p.Deployment) }, nil)
+	}
+	if err := count("waypoints", n, err); err != nil {
+		return result, err
+	}
+	_, err = s.store.SurveyPlans.DeleteOne(ctx, bson.M{"_id": deployment})
+	if err == nil {
+		n, err = importRecords(ctx, dir, "survey_plans.jsonl", s.store.SurveyPlans, func(p *SurveyPlan) error {
+			p.PolygonLines = nil
+			return check(p.Deployment)
+		}, nil)
+	}
+	if err := count("survey_plans", n, err); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// handleImportArchive imports a deployment archive exported by another
+// gateway. The archive is checked up front and stored by a background job.
+func (s *Server) handleImportArchive(c *gin.Context) {
+	deployment := c.Param("deployment")
+	dir, err := os.MkdirTemp("", "archive-")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	manifest, err := readArchive(c.Request.Body, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if manifest.Deployment != deployment {
+		os.RemoveAll(dir)
+		respondErrorf(c, http.StatusBadRequest, "archive is of deployment %q", manifest.Deployment)
+		return
+	}
+
+	// An import isn't merged into a deployment the gateway already holds
+	ctx := c.Request.Context()
+	for _, coll := range []store.Collection{s.store.Locations, s.store.Events} {
+		err := coll.FindOne(ctx, bson.M{"deployment": deployment}).Err()
+		if err == nil {
+			os.RemoveAll(dir)
+			respondErrorf(c, http.StatusConflict, "deployment already has records; delete them before importing")
+			return
+		} else if err != mongo.ErrNoDocuments {
+			os.RemoveAll(dir)
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	job := s.startJob("archive_import", func(progress func(done, total int64)) (interface{}, error) {
+		defer os.RemoveAll(dir)
+		return s.importDeployment(dir, manifest, progress)
+	})
+	c.JSON(http.StatusAccepted, job)
+}
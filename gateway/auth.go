@@ -0,0 +1,422 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	roleRead  = "read"
+	roleWrite = "write"
+	roleAdmin = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleRead:  1,
+	roleWrite: 2,
+	roleAdmin: 3,
+}
+
+// Grant gives a credential read access to a deployment, optionally limited
+// to some of its platforms.
+type Grant struct {
+	Deployment string   `json:"deployment" bson:"deployment"`
+	Platforms  []string `json:"platforms,omitempty" bson:"platforms,omitempty"`
+}
+
+// Credential is an API key with a role. A credential without grants can read
+// every deployment; one with grants can only read what they cover.
+type Credential struct {
+	ID   primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name string             `json:"name" bson:"name"`
+	Role string             `json:"role" bson:"role"`
+	// Stored encrypted deterministically, so credentials can be found by it
+	KeyHash string `json:"-" bson:"key_hash"`
+	// Who to reach about the credential's use, stored encrypted
+	Contact   string    `json:"contact,omitempty" bson:"contact,omitempty"`
+	Grants    []Grant   `json:"grants" bson:"grants"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// sealCredential returns a credential as it is stored, with its fields
+// encrypted when field encryption is configured.
+func (s *Server) sealCredential(cred Credential) (Credential, error) {
+	var err error
+	if cred.KeyHash, err = s.fieldKeys.seal(cred.KeyHash, true); err != nil {
+		return cred, err
+	}
+	if cred.Contact, err = s.fieldKeys.seal(cred.Contact, false); err != nil {
+		return cred, err
+	}
+	return cred, nil
+}
+
+// openCredential decrypts the fields of a stored credential.
+func (s *Server) openCredential(cred *Credential) error {
+	var err error
+	if cred.KeyHash, err = s.fieldKeys.open(cred.KeyHash); err != nil {
+		return err
+	}
+	cred.Contact, err = s.fieldKeys.open(cred.Contact)
+	return err
+}
+
+func (s *Server) initAuth() error {
+	// Authentication is enabled by configuring a bootstrap admin key
+	key, err := loadSecret("ADMIN_API_KEY", func(value string) error {
+		if value == "" {
+			return errors.New("ADMIN_API_KEY can't be removed while the gateway runs")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.adminKey = key
+	s.authEnabled = s.adminKey.get() != ""
+
+	collectionName := os.Getenv("MONGODB_CREDENTIALS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "credentials"
+	}
+	s.store.Credentials = s.store.Collection(collectionName)
+
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "key_hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if err := s.ensureIndex(s.store.Credentials, indexModel); err != nil {
+		return fmt.Errorf("error creating credential indexes: %v", err)
+	}
+
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// requireRole authenticates the request and rejects credentials below role.
+// It is a no-op when authentication is disabled.
+func (s *Server) requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authEnabled {
+			c.Next()
+			return
+		}
+
+		key := requestKey(c)
+		if key == "" {
+			abortError(c, http.StatusUnauthorized, errors.New("missing API key"))
+			return
+		}
+
+		var cred Credential
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey.get())) == 1 {
+			cred = Credential{Name: "admin", Role: roleAdmin}
+		} else {
+			hashes, err := s.fieldKeys.lookupValues(hashKey(key))
+			if err != nil {
+				abortError(c, http.StatusInternalServerError, err)
+				return
+			}
+			err = s.store.Credentials.FindOne(c.Request.Context(), bson.M{"key_hash": bson.M{"$in": hashes}}).Decode(&cred)
+			if err == mongo.ErrNoDocuments {
+				abortError(c, http.StatusUnauthorized, errors.New("invalid API key"))
+				return
+			} else if err == nil {
+				err = s.openCredential(&cred)
+			}
+			if err != nil {
+				abortError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if roleLevels[cred.Role] < roleLevels[role] {
+			abortError(c, http.StatusForbidden, fmt.Errorf("%s role required", role))
+			return
+		}
+
+		c.Set("credential", &cred)
+		c.Next()
+	}
+}
+
+func requestCredential(c *gin.Context) *Credential {
+	if v, ok := c.Get("credential"); ok {
+		return v.(*Credential)
+	}
+	return nil
+}
+
+// grantFilter returns the Mongo filter matching everything the credential's
+// grants cover, or nil when it is unrestricted.
+func grantFilter(cred *Credential) bson.M {
+	if cred == nil || cred.Role == roleAdmin || len(cred.Grants) == 0 {
+		return nil
+	}
+
+	clauses := make([]bson.M, 0, len(cred.Grants))
+	for _, grant := range cred.Grants {
+		clause := bson.M{"deployment": grant.Deployment}
+		if len(grant.Platforms) > 0 {
+			clause["platform"] = bson.M{"$in": grant.Platforms}
+		}
+		clauses = append(clauses, clause)
+	}
+	return bson.M{"$or": clauses}
+}
+
+// scopedFilter restricts filter to the deployments and platforms the
+// request's credential may read.
+func scopedFilter(c *gin.Context, filter bson.M) bson.M {
+	return restrictFilter(grantFilter(requestCredential(c)), filter)
+}
+
+func restrictFilter(scope, filter bson.M) bson.M {
+	if scope == nil {
+		return filter
+	}
+	return bson.M{"$and": []bson.M{filter, scope}}
+}
+
+// canRead reports whether the request's credential may read the platform.
+// An empty platform checks access to any part of the deployment.
+func canRead(c *gin.Context, deployment, platform string) bool {
+	return grantAllows(requestCredential(c), deployment, platform)
+}
+
+// grantAllows reports whether a credential may read the platform, the way
+// grantFilter restricts queries.
+func grantAllows(cred *Credential, deployment, platform string) bool {
+	if grantFilter(cred) == nil {
+		return true
+	}
+	for _, grant := range cred.Grants {
+		if grant.Deployment != deployment {
+			continue
+		}
+		if platform == "" || len(grant.Platforms) == 0 {
+			return true
+		}
+		for _, p := range grant.Platforms {
+			if p == platform {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Credential administration
+
+type credentialRequest struct {
+	Name    string  `json:"name" binding:"required"`
+	Role    string  `json:"role" binding:"required"`
+	Contact string  `json:"contact"`
+	Grants  []Grant `json:"grants"`
+}
+
+func validateGrants(grants []Grant) error {
+	for _, grant := range grants {
+		if grant.Deployment == "" {
+			return fmt.Errorf("grant deployment is required")
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleListCredentials(c *gin.Context) {
+	cursor, err := s.store.Credentials.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	creds := []Credential{}
+	if err = cursor.All(context.Background(), &creds); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range creds {
+		if err := s.openCredential(&creds[i]); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, creds)
+}
+
+func (s *Server) handleCreateCredential(c *gin.Context) {
+	var req credentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := roleLevels[req.Role]; !ok {
+		respondErrorf(c, http.StatusBadRequest, "invalid role %q", req.Role)
+		return
+	}
+	if err := validateGrants(req.Grants); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	key := hex.EncodeToString(raw)
+
+	cred := Credential{
+		Name:      req.Name,
+		Role:      req.Role,
+		KeyHash:   hashKey(key),
+		Contact:   req.Contact,
+		Grants:    req.Grants,
+		CreatedAt: time.Now(),
+	}
+	if cred.Grants == nil {
+		cred.Grants = []Grant{}
+	}
+
+	stored, err := s.sealCredential(cred)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	result, err := s.store.Credentials.InsertOne(context.Background(), stored)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	cred.ID = result.InsertedID.(primitive.ObjectID)
+
+	// The key is only ever returned here; only its hash is stored
+	c.JSON(http.StatusCreated, gin.H{"credential": cred, "key": key})
+}
+
+func (s *Server) handleUpdateGrants(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid credential id")
+		return
+	}
+
+	var grants []Grant
+	if err := c.ShouldBindJSON(&grants); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateGrants(grants); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if grants == nil {
+		grants = []Grant{}
+	}
+
+	var cred Credential
+	err = s.store.Credentials.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"grants": grants}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&cred)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "credential not found")
+		return
+	} else if err == nil {
+		err = s.openCredential(&cred)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cred)
+}
+
+func (s *Server) handleDeleteCredential(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid credential id")
+		return
+	}
+
+	result, err := s.store.Credentials.DeleteOne(context.Background(), bson.M{"_id": id})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		respondErrorf(c, http.StatusNotFound, "credential not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// handleReencryptCredentials stores every credential again, encrypting its
+// sensitive fields with the current key, so keys rotated out of
+// FIELD_ENCRYPTION_KEYS can be dropped, and credentials stored before
+// encryption was configured are encrypted.
+func (s *Server) handleReencryptCredentials(c *gin.Context) {
+	ctx := c.Request.Context()
+	cursor, err := s.store.Credentials.Find(ctx, bson.M{})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var creds []Credential
+	if err = cursor.All(ctx, &creds); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, cred := range creds {
+		if err := s.openCredential(&cred); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		stored, err := s.sealCredential(cred)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := s.store.Credentials.ReplaceOne(ctx, bson.M{"_id": cred.ID}, stored); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"reencrypted": len(creds), "key_id": s.fieldKeys.currentID()})
+}
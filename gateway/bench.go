@@ -0,0 +1,363 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+const (
+	defaultBenchPlatforms = 10
+	defaultBenchWorkers   = 8
+	maxBenchWorkers       = 256
+	defaultBenchDuration  = 30 * time.Second
+	maxBenchDuration      = 10 * time.Minute
+	// Most latencies kept for percentiles, of requests and of each MongoDB
+	// command; beyond that a random sample of them is kept
+	maxBenchSamples = 100000
+)
+
+// benchRunner tracks whether a benchmark is running, and meanwhile the
+// MongoDB commands the gateway issues.
+type benchRunner struct {
+	mu       sync.Mutex
+	running  bool
+	commands map[string]*benchCommand
+}
+
+// benchCommand tallies one MongoDB command, such as insert.
+type benchCommand struct {
+	failed    int64
+	latencies benchSamples
+}
+
+// benchSamples keeps up to maxBenchSamples values, replacing them at random
+// once full so they stay a uniform sample of all those added.
+type benchSamples struct {
+	count  int64
+	values []float64
+}
+
+func (b *benchSamples) add(v float64) {
+	b.count++
+	if len(b.values) < maxBenchSamples {
+		b.values = append(b.values, v)
+		return
+	}
+	if i := rand.Int63n(b.count); i < maxBenchSamples {
+		b.values[i] = v
+	}
+}
+
+// stats summarizes the sample, counting every value added.
+func (b *benchSamples) stats() *LatencyStats {
+	if len(b.values) == 0 {
+		return nil
+	}
+	stats := latencyStats(b.values)
+	stats.Count = int(b.count)
+	return &stats
+}
+
+// recordBenchCommand tallies a MongoDB command taking d, if a benchmark is
+// running.
+func (s *Server) recordBenchCommand(name string, d time.Duration, failed bool) {
+	b := &s.bench
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.running {
+		return
+	}
+	cmd := b.commands[name]
+	if cmd == nil {
+		cmd = &benchCommand{}
+		b.commands[name] = cmd
+	}
+	if failed {
+		cmd.failed++
+	}
+	cmd.latencies.add(d.Seconds())
+}
+
+type benchRequest struct {
+	Deployment string  `json:"deployment" binding:"required"`
+	Platforms  int     `json:"platforms"`
+	Workers    int     `json:"workers"`
+	Rate       float64 `json:"rate"`
+	Duration   string  `json:"duration"`
+	Origin     *origin `json:"origin"`
+}
+
+// BenchCommand summarizes a MongoDB command issued during a benchmark.
+type BenchCommand struct {
+	Command string `json:"command"`
+	Count   int64  `json:"count"`
+	Failed  int64  `json:"failed"`
+	// Commands a second over the benchmark
+	Rate    float64       `json:"rate"`
+	Latency *LatencyStats `json:"latency,omitempty"`
+}
+
+type benchResult struct {
+	Deployment string  `json:"deployment"`
+	Platforms  int     `json:"platforms"`
+	Workers    int     `json:"workers"`
+	TargetRate float64 `json:"target_rate,omitempty"`
+	Elapsed    string  `json:"elapsed"`
+	Sent       int64   `json:"sent"`
+	Accepted   int64   `json:"accepted"`
+	Failed     int64   `json:"failed"`
+	// Responses by status code
+	Statuses map[string]int64 `json:"statuses"`
+	// Fixes accepted a second
+	Throughput float64        `json:"throughput"`
+	Latency    *LatencyStats  `json:"latency,omitempty"`
+	Mongo      []BenchCommand `json:"mongo"`
+}
+
+// handleBench drives ingest load through the gateway's own API for a while,
+// for sizing hardware: workers submit fixes for a test deployment, as fast
+// as they can or at a target rate, and the job reports the throughput
+// achieved, the latency of the submissions, and the MongoDB commands issued
+// meanwhile. Requests are served in process, so the network isn't measured.
+func (s *Server) handleBench(c *gin.Context) {
+	var req benchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if ok, _ := path.Match(syntheticDeployments, req.Deployment); !ok {
+		respondErrorf(c, http.StatusBadRequest, "benchmarks can only write to deployments matching %q", syntheticDeployments)
+		return
+	}
+	platforms, workers := defaultBenchPlatforms, defaultBenchWorkers
+	if req.Platforms != 0 {
+		platforms = req.Platforms
+	}
+	if req.Workers != 0 {
+		workers = req.Workers
+	}
+	if platforms < 1 || platforms > maxSyntheticPlatforms {
+		respondErrorf(c, http.StatusBadRequest, "platforms must be between 1 and %d", maxSyntheticPlatforms)
+		return
+	}
+	if workers < 1 || workers > maxBenchWorkers {
+		respondErrorf(c, http.StatusBadRequest, "workers must be between 1 and %d", maxBenchWorkers)
+		return
+	}
+	if req.Rate < 0 {
+		respondErrorf(c, http.StatusBadRequest, "rate must not be negative")
+		return
+	}
+	duration := defaultBenchDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxBenchDuration {
+			respondErrorf(c, http.StatusBadRequest, "duration must be positive and at most %s", maxBenchDuration)
+			return
+		}
+		duration = d
+	}
+	o := deploymentOrigins[req.Deployment]
+	if req.Origin != nil {
+		o = *req.Origin
+	}
+	if o.Latitude < -80 || o.Latitude > 80 || o.Longitude < -180 || o.Longitude > 180 {
+		respondErrorf(c, http.StatusBadRequest, "origin must be within 80 degrees of the equator")
+		return
+	}
+
+	b := &s.bench
+	b.mu.Lock()
+	if b.running {
+		b.mu.Unlock()
+		respondErrorf(c, http.StatusConflict, "a benchmark is already running")
+		return
+	}
+	b.running = true
+	b.commands = make(map[string]*benchCommand)
+	b.mu.Unlock()
+
+	// Submissions authenticate as the caller, from the caller's address
+	template, _ := http.NewRequest(http.MethodPost, "/api/data", nil)
+	template.Header.Set("Content-Type", "application/json")
+	for _, name := range []string{"X-API-Key", "Authorization"} {
+		if v := c.GetHeader(name); v != "" {
+			template.Header.Set(name, v)
+		}
+	}
+	template.RemoteAddr = c.Request.RemoteAddr
+
+	run := benchRun{
+		result: benchResult{
+			Deployment: req.Deployment,
+			Platforms:  platforms,
+			Workers:    workers,
+			TargetRate: req.Rate,
+			Statuses:   make(map[string]int64),
+			Mongo:      []BenchCommand{},
+		},
+		origin:   o,
+		template: template,
+		handler:  s.Handler(),
+	}
+	job := s.startJob("bench", func(progress func(done, total int64)) (interface{}, error) {
+		defer func() {
+			b.mu.Lock()
+			b.running = false
+			b.mu.Unlock()
+		}()
+		run.run(context.Background(), duration, progress)
+
+		b.mu.Lock()
+		elapsed := run.elapsed.Seconds()
+		for name, cmd := range b.commands {
+			run.result.Mongo = append(run.result.Mongo, BenchCommand{
+				Command: name,
+				Count:   cmd.latencies.count,
+				Failed:  cmd.failed,
+				Rate:    math.Round(float64(cmd.latencies.count)/elapsed*10) / 10,
+				Latency: cmd.latencies.stats(),
+			})
+		}
+		b.mu.Unlock()
+		sort.Slice(run.result.Mongo, func(i, j int) bool {
+			return run.result.Mongo[i].Count > run.result.Mongo[j].Count
+		})
+		return run.result, nil
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// benchRun is a benchmark in progress.
+type benchRun struct {
+	origin   origin
+	template *http.Request
+	handler  http.Handler
+
+	sent    int64
+	elapsed time.Duration
+
+	mu        sync.Mutex
+	result    benchResult
+	latencies benchSamples
+}
+
+// run submits fixes from the workers until duration is up.
+func (r *benchRun) run(ctx context.Context, duration time.Duration, progress func(done, total int64)) {
+	start := time.Now()
+	deadline := start.Add(duration)
+	rate := r.result.TargetRate
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+				progress(int64(time.Since(start)/time.Second), int64(duration/time.Second))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < r.result.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&r.sent, 1) - 1
+				if rate > 0 {
+					// Submission i is due i/rate seconds in
+					at := start.Add(time.Duration(float64(i) / rate * float64(time.Second)))
+					if !at.Before(deadline) || !sleep(ctx, time.Until(at)) {
+						atomic.AddInt64(&r.sent, -1)
+						return
+					}
+				} else if !time.Now().Before(deadline) {
+					atomic.AddInt64(&r.sent, -1)
+					return
+				}
+				r.submit(i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	progress(int64(duration/time.Second), int64(duration/time.Second))
+
+	r.elapsed = time.Since(start)
+	r.result.Elapsed = r.elapsed.Round(time.Millisecond).String()
+	r.result.Sent = r.sent
+	r.result.Throughput = math.Round(float64(r.result.Accepted)/r.elapsed.Seconds()*10) / 10
+	r.result.Latency = r.latencies.stats()
+}
+
+// submit posts the ith fix, for platforms in turn.
+func (r *benchRun) submit(i int64) {
+	// Platforms wander within a kilometer or so of the origin
+	lat, lon := fromLocal(r.origin, api.LocalCoordinate{X: rand.NormFloat64() * 500, Y: rand.NormFloat64() * 500})
+	body, _ := json.Marshal(api.Location{
+		Deployment: r.result.Deployment,
+		Platform:   fmt.Sprintf("bench-%02d", i%int64(r.result.Platforms)+1),
+		Latitude:   lat,
+		Longitude:  normalizeLongitude(lon),
+		Timestamp:  time.Now().UTC().Format(timestampLayout),
+		Source:     "bench",
+	})
+	req := r.template.Clone(context.Background())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	w := &benchWriter{header: make(http.Header), status: http.StatusOK}
+
+	sent := time.Now()
+	r.handler.ServeHTTP(w, req)
+	took := time.Since(sent)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies.add(took.Seconds())
+	r.result.Statuses[strconv.Itoa(w.status)]++
+	if w.status == http.StatusOK {
+		r.result.Accepted++
+	} else {
+		r.result.Failed++
+	}
+}
+
+// benchWriter discards a response, keeping its status.
+type benchWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+func (w *benchWriter) Header() http.Header { return w.header }
+
+func (w *benchWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return len(data), nil
+}
+
+func (w *benchWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+}
@@ -0,0 +1,352 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+type bulkFilter struct {
+	Deployment string `json:"deployment"`
+	Platform   string `json:"platform"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	Q          string `json:"q"`
+}
+
+// positionOffset shifts positions by a constant number of degrees, such as
+// to correct a fixed antenna offset. It is not a datum correction: the
+// difference between datums varies with position.
+type positionOffset struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type bulkUpdateRequest struct {
+	Filter          bulkFilter      `json:"filter"`
+	Deployment      string          `json:"deployment"`
+	Platform        string          `json:"platform"`
+	TimestampOffset string          `json:"timestamp_offset"`
+	PositionOffset  *positionOffset `json:"position_offset"`
+	// The geographic CRS positions were reported in but stored as WGS84,
+	// converted the way ingest converts fixes declaring it
+	CRS    string `json:"crs"`
+	DryRun bool   `json:"dry_run"`
+}
+
+type bulkUpdateResult struct {
+	Matched  int64 `json:"matched"`
+	Modified int64 `json:"modified"`
+	// Fixes converted from the request's CRS
+	Converted int64 `json:"converted,omitempty"`
+}
+
+func (f bulkFilter) toMongo() (bson.M, error) {
+	if f.Deployment == "" {
+		return nil, fmt.Errorf("filter.deployment is required")
+	}
+
+	filter := bson.M{"deployment": f.Deployment}
+	if f.Platform != "" {
+		filter["platform"] = f.Platform
+	}
+
+	timeRange := bson.M{}
+	if f.Start != "" {
+		ts, err := normalizeTimestamp(f.Start, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter.start: %v", err)
+		}
+		timeRange["$gte"] = ts
+	}
+	if f.End != "" {
+		ts, err := normalizeTimestamp(f.End, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter.end: %v", err)
+		}
+		timeRange["$lte"] = ts
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	if f.Q != "" {
+		queryFilter, err := parseQuery(f.Q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter.q: %v", err)
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+
+	return filter, nil
+}
+
+// datumCorrection returns the CRS the request converts positions from, or
+// nil if it doesn't.
+func (req bulkUpdateRequest) datumCorrection() (*CRS, error) {
+	if req.CRS == "" {
+		return nil, nil
+	}
+	crs, err := parseCRS(req.CRS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid crs: %v", err)
+	}
+	if crs.Projected {
+		return nil, fmt.Errorf("crs %s is projected; stored positions can only be converted from a geographic CRS", crs.Name)
+	}
+	if crs.IsWGS84() {
+		return nil, fmt.Errorf("crs %s needs no conversion to WGS84", crs.Name)
+	}
+	return &crs, nil
+}
+
+// correctDatum converts a fix stored as WGS84 from the CRS it was reported
+// in, keeping the position as stored in original like ingest does. Fixes
+// already converted at ingest are left alone, and false is returned.
+func correctDatum(crs *CRS, location *api.Location) bool {
+	if location.Original != nil {
+		return false
+	}
+	lat, lon := location.Latitude, location.Longitude
+	location.Original = &api.OriginalPosition{CRS: crs.Name, Latitude: &lat, Longitude: &lon}
+	location.Latitude, location.Longitude = crs.ToWGS84(lat, lon)
+	location.CRS = crs.Name
+	return true
+}
+
+// buildUpdatePipeline translates the requested transformations, other than
+// datum corrections, into an aggregation pipeline update, so each document
+// is rewritten server-side. It is empty if the request only corrects the
+// datum.
+func (req bulkUpdateRequest) buildUpdatePipeline() (bson.A, error) {
+	set := bson.M{}
+
+	if req.Deployment != "" {
+		set["deployment"] = req.Deployment
+	}
+	if req.Platform != "" {
+		set["platform"] = req.Platform
+	}
+
+	if req.TimestampOffset != "" {
+		offset, err := time.ParseDuration(req.TimestampOffset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp_offset %q", req.TimestampOffset)
+		}
+		set["timestamp"] = bson.M{"$dateToString": bson.M{
+			"format": "%Y-%m-%dT%H:%M:%S.%LZ",
+			"date": bson.M{"$add": bson.A{
+				bson.M{"$dateFromString": bson.M{"dateString": "$timestamp"}},
+				offset.Milliseconds(),
+			}},
+		}}
+		// Shifting a fix's timestamp changes how late it arrived
+		set["latency"] = bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": "$latency"}, "missing"}},
+			"$$REMOVE",
+			bson.M{"$subtract": bson.A{"$latency", offset.Seconds()}},
+		}}
+	}
+
+	if req.PositionOffset != nil {
+		set["latitude"] = bson.M{"$add": bson.A{"$latitude", req.PositionOffset.Latitude}}
+		set["longitude"] = bson.M{"$add": bson.A{"$longitude", req.PositionOffset.Longitude}}
+	}
+
+	if len(set) == 0 {
+		if req.CRS != "" {
+			return bson.A{}, nil
+		}
+		return nil, fmt.Errorf("no transformation requested")
+	}
+	return bson.A{bson.M{"$set": set}}, nil
+}
+
+// movedBuckets lists the hours a bucket's fixes occupy before and after the
+// update.
+func (req bulkUpdateRequest) movedBuckets(b rollupBucket) []rollupBucket {
+	after := b
+	if req.Deployment != "" {
+		after.Deployment = req.Deployment
+	}
+	if req.Platform != "" {
+		after.Platform = req.Platform
+	}
+	buckets := []rollupBucket{b, after}
+
+	if offset, err := time.ParseDuration(req.TimestampOffset); err == nil && offset != 0 {
+		hour, err := time.Parse("2006-01-02T15", b.Hour)
+		if err != nil {
+			return buckets
+		}
+		// An hour shifted by a partial hour straddles two hours
+		shifted := hour.Add(offset)
+		buckets[1].Hour = shifted.Truncate(time.Hour).Format("2006-01-02T15")
+		if shifted.Truncate(time.Hour) != shifted {
+			next := buckets[1]
+			next.Hour = shifted.Truncate(time.Hour).Add(time.Hour).Format("2006-01-02T15")
+			buckets = append(buckets, next)
+		}
+	}
+	return buckets
+}
+
+// handleBulkUpdate applies a constrained set of transformations to the
+// locations matching a filter. Dry runs report the matched documents and a
+// preview of the change without writing.
+func (s *Server) handleBulkUpdate(c *gin.Context) {
+	var req bulkUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	filter, err := req.Filter.toMongo()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	pipeline, err := req.buildUpdatePipeline()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	crs, err := req.datumCorrection()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.DryRun {
+		ctx := context.Background()
+		matched, err := s.store.Locations.CountDocuments(ctx, filter)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Preview the first few documents through the same pipeline
+		preview := append(bson.A{
+			bson.M{"$match": filter},
+			bson.M{"$sort": bson.M{"timestamp": 1}},
+			bson.M{"$limit": 10},
+		}, pipeline...)
+		cursor, err := s.store.Locations.Aggregate(ctx, preview)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		after := []api.Location{}
+		if err = cursor.All(ctx, &after); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if crs != nil {
+			for i := range after {
+				correctDatum(crs, &after[i])
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "matched": matched, "preview": after})
+		return
+	}
+
+	job := s.startJob("bulk_update", func(progress func(done, total int64)) (interface{}, error) {
+		ctx := context.Background()
+
+		// Note the hours being changed so rollups can follow the fixes
+		var buckets []rollupBucket
+		if rollupsEnabled {
+			matched, err := s.rollupBucketsMatching(ctx, filter)
+			if err != nil {
+				return nil, err
+			}
+			buckets = matched
+		}
+		// Telemetry copies its fix's deployment, platform, and timestamp, and
+		// the change feed lists every fix updated
+		ids, err := s.locationIDs(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		result := bulkUpdateResult{Matched: int64(len(ids))}
+		if len(pipeline) > 0 {
+			updated, err := s.store.Locations.UpdateMany(ctx, filter, pipeline, options.Update())
+			if err != nil {
+				return nil, err
+			}
+			result.Matched, result.Modified = updated.MatchedCount, updated.ModifiedCount
+			if result.Modified > 0 {
+				s.facetCache.invalidate()
+			}
+			if err := s.syncTelemetry(ctx, ids, pipeline); err != nil {
+				return nil, err
+			}
+		}
+		if crs != nil {
+			if result.Converted, err = s.correctDatums(ctx, ids, crs); err != nil {
+				return nil, err
+			}
+			if len(pipeline) == 0 {
+				result.Modified = result.Converted
+			}
+		}
+		if err := s.recordUpdated(ctx, ids); err != nil {
+			return nil, err
+		}
+		for _, b := range buckets {
+			for _, moved := range req.movedBuckets(b) {
+				if err := s.markRollupsDirty(ctx, moved.Deployment, moved.Platform, moved.Hour); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return result, nil
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// correctDatums converts the fixes with the given IDs from the CRS they were
+// reported in, returning how many were converted.
+func (s *Server) correctDatums(ctx context.Context, ids []primitive.ObjectID, crs *CRS) (int64, error) {
+	var converted int64
+	for start := 0; start < len(ids); start += importBatchSize {
+		batch := ids[start:min(start+importBatchSize, len(ids))]
+		opts := options.Find().SetProjection(bson.M{"latitude": 1, "longitude": 1, "original": 1})
+		cursor, err := s.store.Locations.Find(ctx, bson.M{"_id": bson.M{"$in": batch}}, opts)
+		if err != nil {
+			return converted, err
+		}
+		var locations []api.Location
+		if err := cursor.All(ctx, &locations); err != nil {
+			return converted, err
+		}
+		for i := range locations {
+			location := &locations[i]
+			if !correctDatum(crs, location) {
+				continue
+			}
+			update := bson.M{"$set": bson.M{
+				"latitude":  location.Latitude,
+				"longitude": location.Longitude,
+				"crs":       location.CRS,
+				"original":  location.Original,
+			}}
+			if _, err := s.store.Locations.UpdateOne(ctx, bson.M{"_id": location.ID}, update); err != nil {
+				return converted, err
+			}
+			converted++
+		}
+	}
+	return converted, nil
+}
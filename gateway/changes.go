@@ -0,0 +1,248 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	changeInsert = "insert"
+	changeUpdate = "update"
+	changeDelete = "delete"
+	changePrune  = "prune"
+
+	changeSequenceID = "change_sequence"
+	// A change numbered but not yet visible after this long is taken to
+	// have failed, and the feed moves past it
+	changeGapTimeout = 30 * time.Second
+	// Default for how long changes are kept for mirrors to catch up
+	defaultChangeRetention = 30 * 24 * time.Hour
+)
+
+// Change is an entry in the change feed: a fix inserted, updated, or
+// deleted, or the fixes pruned by the data lifecycle, numbered in the order
+// they were made.
+type Change struct {
+	Seq        int64              `json:"seq" bson:"seq"`
+	Type       string             `json:"type" bson:"type"`
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"location_id,omitempty"`
+	Deployment string             `json:"deployment,omitempty" bson:"deployment,omitempty"`
+	Platform   string             `json:"platform,omitempty" bson:"platform,omitempty"`
+	// Fixes with timestamps before this were pruned
+	Before string    `json:"before,omitempty" bson:"before,omitempty"`
+	Time   time.Time `json:"time" bson:"time"`
+	// The fix as it is now, for inserts and updates; omitted if it has
+	// since been deleted
+	Location *api.Location `json:"location,omitempty" bson:"-"`
+}
+
+func (s *Server) initChanges() error {
+	collectionName := os.Getenv("MONGODB_CHANGES_COLLECTION")
+	if collectionName == "" {
+		collectionName = "changes"
+	}
+	s.store.Changes = s.store.Collection(collectionName)
+
+	retention, err := parseRetention("CHANGES_RETENTION", defaultChangeRetention)
+	if err != nil {
+		return err
+	}
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "time", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds()))},
+	}
+	for _, model := range indexes {
+		if err := s.ensureIndex(s.store.Changes, model); err != nil {
+			return fmt.Errorf("error creating change feed indexes: %v", err)
+		}
+	}
+	return nil
+}
+
+// locationChange returns the change made to a fix.
+func locationChange(kind string, location *api.Location) Change {
+	return Change{Type: kind, ID: location.ID, Deployment: location.Deployment, Platform: location.Platform}
+}
+
+// recordChanges numbers changes and adds them to the feed. A failure is
+// logged rather than returned, as the changes have already been made.
+func (s *Server) recordChanges(ctx context.Context, changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	update := bson.M{"$inc": bson.M{"seq": int64(len(changes))}}
+	if err := s.store.Settings.FindOneAndUpdate(ctx, bson.M{"_id": changeSequenceID}, update, opts).Decode(&counter); err != nil {
+		s.logger.Printf("error numbering %d changes: %v", len(changes), err)
+		return
+	}
+
+	now := time.Now().UTC()
+	docs := make([]interface{}, len(changes))
+	for i := range changes {
+		changes[i].Seq = counter.Seq - int64(len(changes)-1-i)
+		changes[i].Time = now
+		docs[i] = changes[i]
+	}
+	if _, err := s.store.Changes.InsertMany(ctx, docs); err != nil {
+		s.logger.Printf("error recording changes %d to %d: %v", changes[0].Seq, counter.Seq, err)
+	}
+}
+
+// recordUpdated adds updates of the given fixes to the change feed, as
+// they are after the update.
+func (s *Server) recordUpdated(ctx context.Context, ids []primitive.ObjectID) error {
+	for start := 0; start < len(ids); start += importBatchSize {
+		batch := ids[start:min(start+importBatchSize, len(ids))]
+		opts := options.Find().SetProjection(bson.M{"deployment": 1, "platform": 1})
+		cursor, err := s.store.Locations.Find(ctx, bson.M{"_id": bson.M{"$in": batch}}, opts)
+		if err != nil {
+			return err
+		}
+		var locations []api.Location
+		if err := cursor.All(ctx, &locations); err != nil {
+			return err
+		}
+		changes := make([]Change, len(locations))
+		for i := range locations {
+			changes[i] = locationChange(changeUpdate, &locations[i])
+		}
+		s.recordChanges(ctx, changes...)
+	}
+	return nil
+}
+
+// handleGetChanges returns the changes after a sequence number, for mirrors
+// to replicate incrementally. Changes are returned in sequence with none
+// missing, so a change numbered but not yet written holds back those after
+// it until it is, or changeGapTimeout passes.
+func (s *Server) handleGetChanges(c *gin.Context) {
+	var since int64
+	if v := c.Query("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			respondErrorf(c, http.StatusBadRequest, "since must be a sequence number")
+			return
+		}
+		since = n
+	}
+	limit, _, _, err := s.parseLimit(c.Query("limit"), "")
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	// A mirror further behind than the feed's retention has to resync
+	if since > 0 {
+		var oldest Change
+		err := s.store.Changes.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: 1}})).Decode(&oldest)
+		if err == nil && oldest.Seq > since+1 {
+			respondErrorf(c, http.StatusGone, "changes after %d are no longer kept; the oldest is %d", since, oldest.Seq)
+			return
+		} else if err != nil && err != mongo.ErrNoDocuments {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	filter := bson.M{"seq": bson.M{"$gt": since}}
+	if deployment := c.Query("deployment"); deployment != "" {
+		// Pruning applies to every deployment
+		filter["$or"] = []bson.M{{"deployment": deployment}, {"type": changePrune}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(limit + 1)
+	cursor, err := s.store.Changes.Find(ctx, filter, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var found []Change
+	if err := cursor.All(ctx, &found); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	more := int64(len(found)) > limit
+	if more {
+		found = found[:limit]
+	}
+
+	// Stop at the first missing change still being written. Filtering by
+	// deployment leaves gaps for other deployments' changes, so gaps are
+	// checked against the unfiltered feed.
+	next := since
+	gapCutoff := time.Now().Add(-changeGapTimeout)
+	for i, change := range found {
+		if change.Seq != next+1 && change.Time.After(gapCutoff) {
+			n, err := s.store.Changes.CountDocuments(ctx, bson.M{"seq": bson.M{"$gt": next, "$lt": change.Seq}})
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if n < change.Seq-next-1 {
+				found, more = found[:i], true
+				break
+			}
+		}
+		next = change.Seq
+	}
+
+	// Changes to fixes the credential can't read are left out, but still
+	// advance the cursor
+	changes := []Change{}
+	var ids []primitive.ObjectID
+	for _, change := range found {
+		if change.Type != changePrune && !canRead(c, change.Deployment, change.Platform) {
+			continue
+		}
+		if change.Type == changeInsert || change.Type == changeUpdate {
+			ids = append(ids, change.ID)
+		}
+		change.Time = change.Time.In(loc)
+		changes = append(changes, change)
+	}
+	if len(ids) > 0 {
+		cursor, err := s.store.Locations.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		var locations []api.Location
+		if err := cursor.All(ctx, &locations); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		byID := make(map[primitive.ObjectID]*api.Location, len(locations))
+		for i := range locations {
+			localizeLocation(&locations[i], loc)
+			byID[locations[i].ID] = &locations[i]
+		}
+		for i := range changes {
+			if changes[i].Type == changeInsert || changes[i].Type == changeUpdate {
+				changes[i].Location = byID[changes[i].ID]
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"changes": changes, "next": next, "more": more})
+}
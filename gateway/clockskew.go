@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"data-gateway/api"
+)
+
+// What to do with a fix whose timestamp is further from its receipt time
+// than the clock skew tolerance
+const (
+	skewFlag    = "flag"
+	skewCorrect = "correct"
+	skewReject  = "reject"
+)
+
+// Clock skew checks are disabled while the tolerance is zero
+var clockSkewTolerance time.Duration
+var clockSkewAction = skewFlag
+
+func initClockSkew() error {
+	if v := os.Getenv("CLOCK_SKEW_TOLERANCE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid CLOCK_SKEW_TOLERANCE %q", v)
+		}
+		clockSkewTolerance = d
+	}
+
+	if v := os.Getenv("CLOCK_SKEW_ACTION"); v != "" {
+		if v != skewFlag && v != skewCorrect && v != skewReject {
+			return fmt.Errorf("invalid CLOCK_SKEW_ACTION %q (expected flag, correct, or reject)", v)
+		}
+		clockSkewAction = v
+	}
+	return nil
+}
+
+// checkClockSkew compares a live fix's timestamp with the time it was
+// received, recording the skew if it exceeds the platform's tolerance and,
+// depending on CLOCK_SKEW_ACTION, replacing the timestamp with the receipt
+// time or rejecting the fix. It reports whether the fix was skewed.
+func checkClockSkew(location *api.Location) (bool, error) {
+	tolerance := platformSettings(location.Deployment, location.Platform).clockSkewToleranceFor()
+	if tolerance == 0 || location.ReceivedAt == "" {
+		return false, nil
+	}
+	t, err := parseTimestamp(location.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	received, err := parseTimestamp(location.ReceivedAt)
+	if err != nil {
+		return false, err
+	}
+
+	skew := t.Sub(received)
+	if skew.Abs() <= tolerance {
+		return false, nil
+	}
+	seconds := math.Round(skew.Seconds()*1000) / 1000
+	location.ClockSkew = &seconds
+
+	switch clockSkewAction {
+	case skewReject:
+		return true, fmt.Errorf("timestamp %s is %s off the time it was received, beyond the clock skew tolerance of %s", location.Timestamp, skew.Abs().Round(time.Second), tolerance)
+	case skewCorrect:
+		location.ReportedTimestamp = location.Timestamp
+		location.Timestamp = location.ReceivedAt
+	}
+	return true, nil
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Comms paths are free-form, but short identifiers such as iridium,
+// cellular, wifi, or acoustic
+var commsPathPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Label for fixes received without a comms path
+const commsPathUnknown = "unknown"
+
+// CommsPathStats summarizes the live fixes delivered over one comms path.
+// Gaps are attributed both to the path whose message preceded the gap and to
+// the path whose message ended it.
+type CommsPathStats struct {
+	Path       string        `json:"path"`
+	Messages   int           `json:"messages"`
+	Platforms  []string      `json:"platforms"`
+	Latency    *LatencyStats `json:"latency,omitempty"`
+	GapsAfter  int           `json:"gaps_after"`
+	GapsEnded  int           `json:"gaps_ended"`
+	GapSeconds float64       `json:"gap_seconds"`
+
+	latencies []float64
+	platforms map[string]bool
+}
+
+// resolveCommsPath picks the comms path for a submission: the one in its
+// body, or else the X-Comms-Path header, which relays can add without
+// breaking the body's signature.
+func resolveCommsPath(c *gin.Context, path string) (string, error) {
+	if path == "" {
+		path = c.GetHeader("X-Comms-Path")
+	}
+	if path == "" {
+		return "", nil
+	}
+	path = strings.ToLower(strings.TrimSpace(path))
+	if !commsPathPattern.MatchString(path) {
+		return "", fmt.Errorf("invalid comms_path %q", path)
+	}
+	return path, nil
+}
+
+// handleGetCommsStats compares the comms paths that delivered a deployment's
+// live fixes: how many messages each carried, how late they arrived, and how
+// often a gap in reporting followed or was ended by one of its messages.
+func (s *Server) handleGetCommsStats(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{
+		"deployment":  deployment,
+		"received_at": bson.M{"$exists": true},
+		"backfilled":  bson.M{"$ne": true},
+	}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	minGap := 5 * time.Minute
+	if v := c.Query("minGap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid minGap %q", v)
+			return
+		}
+		minGap = d
+	}
+
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"_id": 0, "platform": 1, "timestamp": 1, "comms_path": 1, "latency": 1})
+	ctx := c.Request.Context()
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	byPath := make(map[string]*CommsPathStats)
+	stats := func(path string) *CommsPathStats {
+		if path == "" {
+			path = commsPathUnknown
+		}
+		if byPath[path] == nil {
+			byPath[path] = &CommsPathStats{Path: path, platforms: make(map[string]bool)}
+		}
+		return byPath[path]
+	}
+
+	var prevPlatform, prevPath string
+	var prevTime time.Time
+	for cursor.Next(ctx) {
+		var fix struct {
+			Platform  string   `bson:"platform"`
+			Timestamp string   `bson:"timestamp"`
+			CommsPath string   `bson:"comms_path"`
+			Latency   *float64 `bson:"latency"`
+		}
+		if err := cursor.Decode(&fix); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		t, err := parseTimestamp(fix.Timestamp)
+		if err != nil {
+			continue
+		}
+
+		ps := stats(fix.CommsPath)
+		ps.Messages++
+		ps.platforms[fix.Platform] = true
+		if fix.Latency != nil {
+			ps.latencies = append(ps.latencies, *fix.Latency)
+		}
+
+		if fix.Platform == prevPlatform {
+			if d := t.Sub(prevTime); d > minGap {
+				before := stats(prevPath)
+				before.GapsAfter++
+				before.GapSeconds += d.Seconds()
+				ps.GapsEnded++
+			}
+		}
+		prevPlatform, prevPath, prevTime = fix.Platform, fix.CommsPath, t
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	paths := make([]CommsPathStats, 0, len(byPath))
+	for _, ps := range byPath {
+		for platform := range ps.platforms {
+			ps.Platforms = append(ps.Platforms, platform)
+		}
+		sort.Strings(ps.Platforms)
+		if len(ps.latencies) > 0 {
+			latency := latencyStats(ps.latencies)
+			ps.Latency = &latency
+		}
+		paths = append(paths, *ps)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Messages > paths[j].Messages })
+
+	c.JSON(http.StatusOK, gin.H{"min_gap": minGap.String(), "paths": paths})
+}
@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+type origin struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+var deploymentOrigins map[string]origin
+
+func initOrigins() error {
+	// Origins are configured as deployment=lat,lon pairs separated by semicolons
+	deploymentOrigins = make(map[string]origin)
+	v := os.Getenv("DEPLOYMENT_ORIGINS")
+	if v == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(v, ";") {
+		deployment, coords, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || deployment == "" {
+			return fmt.Errorf("invalid DEPLOYMENT_ORIGINS entry %q (expected deployment=lat,lon)", entry)
+		}
+		o, err := parseOrigin(coords)
+		if err != nil {
+			return fmt.Errorf("invalid DEPLOYMENT_ORIGINS entry %q: %v", entry, err)
+		}
+		deploymentOrigins[deployment] = o
+	}
+	return nil
+}
+
+func parseOrigin(value string) (origin, error) {
+	latStr, lonStr, ok := strings.Cut(value, ",")
+	if !ok {
+		return origin{}, fmt.Errorf("expected lat,lon")
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return origin{}, fmt.Errorf("invalid coordinates %q", value)
+	}
+	return origin{Latitude: lat, Longitude: lon}, nil
+}
+
+// utmZone returns the UTM zone for a position, including the Norway and
+// Svalbard exceptions.
+func utmZone(lat, lon float64) int {
+	lon = normalizeLongitude(lon)
+	zone := int(math.Floor((lon+180)/6)) + 1
+	if zone > 60 {
+		zone = 60
+	}
+
+	if lat >= 56 && lat < 64 && lon >= 3 && lon < 12 {
+		return 32
+	}
+	if lat >= 72 && lat < 84 {
+		switch {
+		case lon >= 0 && lon < 9:
+			return 31
+		case lon >= 9 && lon < 21:
+			return 33
+		case lon >= 21 && lon < 33:
+			return 35
+		case lon >= 33 && lon < 42:
+			return 37
+		}
+	}
+	return zone
+}
+
+func toUTM(lat, lon float64) api.UTMCoordinate {
+	zone := utmZone(lat, lon)
+	south := lat < 0
+	easting, northing := utmProjection(zone, south).forward(ellipsoids["WGS84"], lat, lon)
+
+	hemisphere := "N"
+	if south {
+		hemisphere = "S"
+	}
+	return api.UTMCoordinate{Zone: zone, Hemisphere: hemisphere, Easting: easting, Northing: northing}
+}
+
+// toLocal returns the east/north/up offset of a position from the origin.
+func toLocal(o origin, lat, lon float64) api.LocalCoordinate {
+	e := ellipsoids["WGS84"]
+	x0, y0, z0 := geodeticToECEF(e, o.Latitude, o.Longitude, 0)
+	x, y, z := geodeticToECEF(e, lat, lon, 0)
+	dx, dy, dz := x-x0, y-y0, z-z0
+
+	phi, lambda := toRadians(o.Latitude), toRadians(o.Longitude)
+	sinPhi, cosPhi := math.Sin(phi), math.Cos(phi)
+	sinLambda, cosLambda := math.Sin(lambda), math.Cos(lambda)
+
+	return api.LocalCoordinate{
+		X: -sinLambda*dx + cosLambda*dy,
+		Y: -sinPhi*cosLambda*dx - sinPhi*sinLambda*dy + cosPhi*dz,
+		Z: cosPhi*cosLambda*dx + cosPhi*sinLambda*dy + sinPhi*dz,
+	}
+}
+
+// coordinateOptions selects additional coordinate systems for query output.
+type coordinateOptions struct {
+	utm    bool
+	local  bool
+	origin *origin // nil means use the deployment's configured origin
+}
+
+// parseCoordinateOptions reads the coords parameter (a comma-separated list
+// of utm and local) and the optional origin=lat,lon override.
+func parseCoordinateOptions(c *gin.Context) (coordinateOptions, error) {
+	var opts coordinateOptions
+	if v := c.Query("coords"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			switch strings.TrimSpace(name) {
+			case "utm":
+				opts.utm = true
+			case "local":
+				opts.local = true
+			default:
+				return opts, fmt.Errorf("unknown coords %q (expected utm or local)", name)
+			}
+		}
+	}
+
+	if v := c.Query("origin"); v != "" {
+		o, err := parseOrigin(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid origin: %v", err)
+		}
+		opts.origin = &o
+	}
+
+	return opts, nil
+}
+
+// localOrigin returns the origin to use for a deployment.
+func (opts coordinateOptions) localOrigin(deployment string) (origin, error) {
+	if opts.origin != nil {
+		return *opts.origin, nil
+	}
+	o, ok := deploymentOrigins[deployment]
+	if !ok {
+		return origin{}, fmt.Errorf("no origin configured for deployment %q; pass origin=lat,lon", deployment)
+	}
+	return o, nil
+}
+
+func (opts coordinateOptions) apply(location *api.Location) error {
+	if opts.utm {
+		utm := toUTM(location.Latitude, location.Longitude)
+		location.UTM = &utm
+	}
+	if opts.local {
+		o, err := opts.localOrigin(location.Deployment)
+		if err != nil {
+			return err
+		}
+		local := toLocal(o, location.Latitude, location.Longitude)
+		location.Local = &local
+	}
+	return nil
+}
+
+// applyDoc adds the requested coordinates to a projected result document,
+// provided it carries the fields they are computed from.
+func (opts coordinateOptions) applyDoc(doc map[string]interface{}) error {
+	lat, okLat := doc["latitude"].(float64)
+	lon, okLon := doc["longitude"].(float64)
+	if !okLat || !okLon {
+		return nil
+	}
+
+	if opts.utm {
+		doc["utm"] = toUTM(lat, lon)
+	}
+	if opts.local {
+		deployment, _ := doc["deployment"].(string)
+		o, err := opts.localOrigin(deployment)
+		if err != nil {
+			return err
+		}
+		doc["local"] = toLocal(o, lat, lon)
+	}
+	return nil
+}
+
+// fromLocal converts an east/north/up offset from the origin back to a
+// geographic position.
+func fromLocal(o origin, local api.LocalCoordinate) (lat, lon float64) {
+	e := ellipsoids["WGS84"]
+	x0, y0, z0 := geodeticToECEF(e, o.Latitude, o.Longitude, 0)
+
+	phi, lambda := toRadians(o.Latitude), toRadians(o.Longitude)
+	sinPhi, cosPhi := math.Sin(phi), math.Cos(phi)
+	sinLambda, cosLambda := math.Sin(lambda), math.Cos(lambda)
+
+	dx := -sinLambda*local.X - sinPhi*cosLambda*local.Y + cosPhi*cosLambda*local.Z
+	dy := cosLambda*local.X - sinPhi*sinLambda*local.Y + cosPhi*sinLambda*local.Z
+	dz := cosPhi*local.Y + sinPhi*local.Z
+
+	lat, lon, _ = ecefToGeodetic(e, x0+dx, y0+dy, z0+dz)
+	return lat, lon
+}
@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// CrossTrackSample is a fix's position relative to a reference line.
+type CrossTrackSample struct {
+	Timestamp string  `json:"timestamp"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Distance from the line, positive to the right of it
+	CrossTrack float64 `json:"cross_track"`
+	// Distance along the line to the point nearest the fix
+	AlongTrack float64 `json:"along_track"`
+	// Whether the nearest point lies between the line's ends rather than
+	// beyond them
+	OnLine bool `json:"on_line"`
+}
+
+// CrossTrackStats summarizes the cross-track error of the fixes alongside
+// the line.
+type CrossTrackStats struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	RMS    float64 `json:"rms"`
+	MaxAbs float64 `json:"max_abs"`
+}
+
+// referenceLine is a line of [longitude, latitude] positions on a plane
+// tangent at its start, against which tracks are measured.
+type referenceLine struct {
+	origin  origin
+	points  [][2]float64
+	offsets []float64
+	length  float64
+}
+
+func newReferenceLine(coordinates [][2]float64) *referenceLine {
+	line := &referenceLine{origin: origin{Latitude: coordinates[0][1], Longitude: coordinates[0][0]}}
+	for i, p := range coordinates {
+		local := toLocal(line.origin, p[1], p[0])
+		point := [2]float64{local.X, local.Y}
+		if i > 0 {
+			prev := line.points[len(line.points)-1]
+			line.length += math.Hypot(point[0]-prev[0], point[1]-prev[1])
+		}
+		line.points = append(line.points, point)
+		line.offsets = append(line.offsets, line.length)
+	}
+	return line
+}
+
+// measure returns a position's signed distance from the nearest point on
+// the line, the distance along the line to that point, and whether it lies
+// between the line's ends.
+func (l *referenceLine) measure(lat, lon float64) (cross, along float64, onLine bool) {
+	local := toLocal(l.origin, lat, lon)
+	best := math.Inf(1)
+	for i := 1; i < len(l.points); i++ {
+		a, b := l.points[i-1], l.points[i]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		dx, dy = dx/length, dy/length
+		t := (local.X-a[0])*dx + (local.Y-a[1])*dy
+		// Only the first and last segments extend past the line's ends
+		clamped := t
+		if i > 1 {
+			clamped = math.Max(clamped, 0)
+		}
+		if i < len(l.points)-1 {
+			clamped = math.Min(clamped, length)
+		}
+		px, py := a[0]+clamped*dx, a[1]+clamped*dy
+		if d := math.Hypot(local.X-px, local.Y-py); d < best {
+			best = d
+			// Right of the line is clockwise from its direction
+			cross = (local.X-a[0])*dy - (local.Y-a[1])*dx
+			along = l.offsets[i-1] + clamped
+			onLine = along >= 0 && along <= l.length
+		}
+	}
+	return cross, along, onLine
+}
+
+func (s *Server) handleGetCrossTrack(c *gin.Context) {
+	deployment, platform := c.Query("deployment"), c.Query("platform")
+	if deployment == "" || platform == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment and platform are required")
+		return
+	}
+	if !canRead(c, deployment, platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// The reference is a line of the deployment's survey plan, or the
+	// line between two points
+	ctx := c.Request.Context()
+	var coordinates [][2]float64
+	if name := c.Query("line"); name != "" {
+		plan, err := s.surveyPlan(ctx, deployment)
+		if err == mongo.ErrNoDocuments {
+			respondErrorf(c, http.StatusNotFound, "no survey plan for deployment")
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		for _, line := range plan.allLines() {
+			if line.Name == name {
+				coordinates = line.Coordinates
+			}
+		}
+		if coordinates == nil {
+			respondErrorf(c, http.StatusNotFound, "survey plan has no line %q", name)
+			return
+		}
+	} else {
+		from, err1 := parseOrigin(c.Query("from"))
+		to, err2 := parseOrigin(c.Query("to"))
+		if err1 != nil || err2 != nil {
+			respondErrorf(c, http.StatusBadRequest, "a survey plan line or from and to positions (lat,lon) are required")
+			return
+		}
+		coordinates = [][2]float64{{from.Longitude, from.Latitude}, {to.Longitude, to.Latitude}}
+	}
+	line := newReferenceLine(coordinates)
+	if line.length == 0 {
+		respondErrorf(c, http.StatusBadRequest, "reference line has no length")
+		return
+	}
+
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	// Fetch one extra fix to detect series exceeding the limit
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"timestamp": 1, "latitude": 1, "longitude": 1}).
+		SetLimit(s.maxResultLimit + 1)
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var locations []api.Location
+	if err := cursor.All(ctx, &locations); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(locations)) > s.maxResultLimit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(s.maxResultLimit))
+		return
+	}
+
+	samples := make([]CrossTrackSample, len(locations))
+	var stats CrossTrackStats
+	sumSquares := 0.0
+	for i, location := range locations {
+		cross, along, onLine := line.measure(location.Latitude, location.Longitude)
+		samples[i] = CrossTrackSample{
+			Timestamp:  formatTimestamp(location.Timestamp, loc),
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			CrossTrack: cross,
+			AlongTrack: along,
+			OnLine:     onLine,
+		}
+		if onLine {
+			stats.Count++
+			stats.Mean += cross
+			sumSquares += cross * cross
+			stats.MaxAbs = math.Max(stats.MaxAbs, math.Abs(cross))
+		}
+	}
+	if stats.Count > 0 {
+		stats.Mean /= float64(stats.Count)
+		stats.RMS = math.Sqrt(sumSquares / float64(stats.Count))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployment": deployment,
+		"platform":   platform,
+		"length":     line.length,
+		"stats":      stats,
+		"samples":    samples,
+	})
+}
@@ -0,0 +1,353 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Coordinate reference system support. Incoming positions may be declared in
+// another geodetic datum or a transverse Mercator grid; they are transformed
+// to WGS84 on ingest using a seven-parameter Helmert shift, matching PROJ's
+// +towgs84 behaviour.
+
+const crsWGS84 = "WGS84"
+
+type ellipsoid struct {
+	a float64 // semi-major axis in meters
+	f float64 // flattening
+}
+
+var ellipsoids = map[string]ellipsoid{
+	"WGS84":  {a: 6378137, f: 1 / 298.257223563},
+	"GRS80":  {a: 6378137, f: 1 / 298.257222101},
+	"clrk66": {a: 6378206.4, f: 1 - 6356583.8/6378206.4},
+	"intl":   {a: 6378388, f: 1 / 297.0},
+	"airy":   {a: 6377563.396, f: 1 - 6356256.909/6377563.396},
+}
+
+// helmert holds +towgs84 parameters: translations in meters, rotations in
+// arc-seconds (position vector convention), and scale in parts per million.
+type helmert [7]float64
+
+type datum struct {
+	ellps   string
+	towgs84 helmert
+}
+
+var datums = map[string]datum{
+	"WGS84":  {ellps: "WGS84"},
+	"NAD83":  {ellps: "GRS80"},
+	"ETRS89": {ellps: "GRS80"},
+	"GDA94":  {ellps: "GRS80"},
+	"NAD27":  {ellps: "clrk66", towgs84: helmert{-8, 160, 176}},
+	"ED50":   {ellps: "intl", towgs84: helmert{-87, -98, -121}},
+	"OSGB36": {ellps: "airy", towgs84: helmert{446.448, -125.157, 542.06, 0.15, 0.247, 0.842, -20.489}},
+}
+
+var epsgGeographic = map[int]string{
+	4326: "WGS84",
+	4269: "NAD83",
+	4258: "ETRS89",
+	4283: "GDA94",
+	4267: "NAD27",
+	4230: "ED50",
+	4277: "OSGB36",
+}
+
+// transverseMercator describes a transverse Mercator grid.
+type transverseMercator struct {
+	lat0, lon0 float64 // origin in degrees
+	k0         float64
+	x0, y0     float64 // false easting and northing in meters
+}
+
+// CRS is a parsed coordinate reference system.
+type CRS struct {
+	Name      string
+	Datum     datum
+	Projected bool
+	TM        transverseMercator
+}
+
+// parseCRS accepts datum names (WGS84, NAD83, ...), EPSG codes for the
+// supported datums and their UTM zones, and PROJ strings using longlat,
+// tmerc, or utm projections.
+func parseCRS(name string) (CRS, error) {
+	if name == "" {
+		name = crsWGS84
+	}
+
+	if d, ok := datums[strings.ToUpper(name)]; ok {
+		return CRS{Name: strings.ToUpper(name), Datum: d}, nil
+	}
+
+	if code, ok := strings.CutPrefix(strings.ToUpper(name), "EPSG:"); ok {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return CRS{}, fmt.Errorf("invalid EPSG code %q", name)
+		}
+		return epsgCRS(n)
+	}
+
+	if strings.HasPrefix(name, "+proj=") {
+		return parseProj(name)
+	}
+
+	return CRS{}, fmt.Errorf("unsupported CRS %q", name)
+}
+
+func epsgCRS(code int) (CRS, error) {
+	name := fmt.Sprintf("EPSG:%d", code)
+	if datumName, ok := epsgGeographic[code]; ok {
+		return CRS{Name: name, Datum: datums[datumName]}, nil
+	}
+
+	// UTM zones: WGS84 north (326zz) and south (327zz), NAD83 north (269zz)
+	switch {
+	case code >= 32601 && code <= 32660:
+		return CRS{Name: name, Datum: datums["WGS84"], Projected: true, TM: utmProjection(code-32600, false)}, nil
+	case code >= 32701 && code <= 32760:
+		return CRS{Name: name, Datum: datums["WGS84"], Projected: true, TM: utmProjection(code-32700, true)}, nil
+	case code >= 26901 && code <= 26923:
+		return CRS{Name: name, Datum: datums["NAD83"], Projected: true, TM: utmProjection(code-26900, false)}, nil
+	}
+
+	return CRS{}, fmt.Errorf("unsupported EPSG code %d", code)
+}
+
+func utmProjection(zone int, south bool) transverseMercator {
+	tm := transverseMercator{lon0: float64(zone)*6 - 183, k0: 0.9996, x0: 500000}
+	if south {
+		tm.y0 = 10000000
+	}
+	return tm
+}
+
+func parseProj(def string) (CRS, error) {
+	params := make(map[string]string)
+	for _, token := range strings.Fields(def) {
+		key, value, _ := strings.Cut(strings.TrimPrefix(token, "+"), "=")
+		params[key] = value
+	}
+
+	crs := CRS{Name: def, Datum: datums["WGS84"]}
+
+	if name, ok := params["datum"]; ok {
+		d, ok := datums[strings.ToUpper(name)]
+		if !ok {
+			return CRS{}, fmt.Errorf("unsupported datum %q", name)
+		}
+		crs.Datum = d
+	}
+	if name, ok := params["ellps"]; ok {
+		if _, ok := ellipsoids[name]; !ok {
+			return CRS{}, fmt.Errorf("unsupported ellipsoid %q", name)
+		}
+		crs.Datum.ellps = name
+	}
+	if v, ok := params["towgs84"]; ok {
+		parts := strings.Split(v, ",")
+		if len(parts) != 3 && len(parts) != 7 {
+			return CRS{}, fmt.Errorf("towgs84 needs 3 or 7 parameters")
+		}
+		crs.Datum.towgs84 = helmert{}
+		for i, part := range parts {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return CRS{}, fmt.Errorf("invalid towgs84 parameter %q", part)
+			}
+			crs.Datum.towgs84[i] = n
+		}
+	}
+	if units, ok := params["units"]; ok && units != "m" {
+		return CRS{}, fmt.Errorf("unsupported units %q", units)
+	}
+
+	num := func(key string, def float64) (float64, error) {
+		v, ok := params[key]
+		if !ok {
+			return def, nil
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid +%s %q", key, v)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch params["proj"] {
+	case "longlat", "latlong":
+	case "utm":
+		zone, err := strconv.Atoi(params["zone"])
+		if err != nil || zone < 1 || zone > 60 {
+			return CRS{}, fmt.Errorf("utm requires +zone between 1 and 60")
+		}
+		_, south := params["south"]
+		crs.Projected = true
+		crs.TM = utmProjection(zone, south)
+	case "tmerc":
+		crs.Projected = true
+		if crs.TM.lat0, err = num("lat_0", 0); err != nil {
+			return CRS{}, err
+		}
+		if crs.TM.lon0, err = num("lon_0", 0); err != nil {
+			return CRS{}, err
+		}
+		k, err := num("k", 1)
+		if err != nil {
+			return CRS{}, err
+		}
+		if crs.TM.k0, err = num("k_0", k); err != nil {
+			return CRS{}, err
+		}
+		if crs.TM.x0, err = num("x_0", 0); err != nil {
+			return CRS{}, err
+		}
+		if crs.TM.y0, err = num("y_0", 0); err != nil {
+			return CRS{}, err
+		}
+	default:
+		return CRS{}, fmt.Errorf("unsupported projection %q", params["proj"])
+	}
+
+	return crs, nil
+}
+
+// IsWGS84 reports whether coordinates in this CRS need no transformation.
+func (crs CRS) IsWGS84() bool {
+	return !crs.Projected && crs.Datum.towgs84 == (helmert{}) && ellipsoids[crs.Datum.ellps] == ellipsoids["WGS84"]
+}
+
+// ToWGS84 converts a geographic position (latitude and longitude in degrees)
+// or, for projected systems, grid coordinates (x and y in meters) to WGS84.
+func (crs CRS) ToWGS84(latOrY, lonOrX float64) (lat, lon float64) {
+	e := ellipsoids[crs.Datum.ellps]
+
+	lat, lon = latOrY, lonOrX
+	if crs.Projected {
+		lat, lon = crs.TM.inverse(e, lonOrX, latOrY)
+	}
+
+	if crs.Datum.towgs84 == (helmert{}) && e == ellipsoids["WGS84"] {
+		return lat, lon
+	}
+
+	x, y, z := geodeticToECEF(e, lat, lon, 0)
+	x, y, z = crs.Datum.towgs84.apply(x, y, z)
+	lat, lon, _ = ecefToGeodetic(ellipsoids["WGS84"], x, y, z)
+	return lat, lon
+}
+
+func geodeticToECEF(e ellipsoid, lat, lon, h float64) (x, y, z float64) {
+	phi, lambda := toRadians(lat), toRadians(lon)
+	e2 := e.f * (2 - e.f)
+	n := e.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	x = (n + h) * math.Cos(phi) * math.Cos(lambda)
+	y = (n + h) * math.Cos(phi) * math.Sin(lambda)
+	z = (n*(1-e2) + h) * math.Sin(phi)
+	return x, y, z
+}
+
+func ecefToGeodetic(e ellipsoid, x, y, z float64) (lat, lon, h float64) {
+	e2 := e.f * (2 - e.f)
+	p := math.Hypot(x, y)
+	lon = math.Atan2(y, x)
+
+	// Iterate on latitude; converges to well below a millimeter in a few steps
+	phi := math.Atan2(z, p*(1-e2))
+	var n float64
+	for i := 0; i < 10; i++ {
+		n = e.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+		h = p/math.Cos(phi) - n
+		next := math.Atan2(z, p*(1-e2*n/(n+h)))
+		if math.Abs(next-phi) < 1e-12 {
+			phi = next
+			break
+		}
+		phi = next
+	}
+	return toDegrees(phi), toDegrees(lon), h
+}
+
+func (t helmert) apply(x, y, z float64) (float64, float64, float64) {
+	const arcsec = math.Pi / (180 * 3600)
+	rx, ry, rz := t[3]*arcsec, t[4]*arcsec, t[5]*arcsec
+	s := 1 + t[6]*1e-6
+	return t[0] + s*(x-rz*y+ry*z),
+		t[1] + s*(rz*x+y-rx*z),
+		t[2] + s*(-ry*x+rx*y+z)
+}
+
+// Transverse Mercator using the Krüger series to third order in n, accurate
+// to well under a millimeter within a UTM zone.
+
+type tmSeries struct {
+	n, A               float64
+	alpha, beta, delta [3]float64
+	eccentricityFactor float64
+}
+
+func newTMSeries(e ellipsoid) tmSeries {
+	n := e.f / (2 - e.f)
+	n2, n3 := n*n, n*n*n
+	return tmSeries{
+		n:                  n,
+		A:                  e.a / (1 + n) * (1 + n2/4 + n2*n2/64),
+		alpha:              [3]float64{n/2 - 2*n2/3 + 5*n3/16, 13*n2/48 - 3*n3/5, 61 * n3 / 240},
+		beta:               [3]float64{n/2 - 2*n2/3 + 37*n3/96, n2/48 + n3/15, 17 * n3 / 480},
+		delta:              [3]float64{2*n - 2*n2/3 - 2*n3, 7*n2/3 - 8*n3/5, 56 * n3 / 15},
+		eccentricityFactor: 2 * math.Sqrt(n) / (1 + n),
+	}
+}
+
+// project returns unscaled (xi, eta) for a point relative to the central meridian.
+func (s tmSeries) project(lat, dLon float64) (xi, eta float64) {
+	phi, lambda := toRadians(lat), toRadians(dLon)
+	t := math.Sinh(math.Atanh(math.Sin(phi)) - s.eccentricityFactor*math.Atanh(s.eccentricityFactor*math.Sin(phi)))
+	xiP := math.Atan2(t, math.Cos(lambda))
+	etaP := math.Atanh(math.Sin(lambda) / math.Sqrt(1+t*t))
+
+	xi, eta = xiP, etaP
+	for j := 1; j <= 3; j++ {
+		a := s.alpha[j-1]
+		xi += a * math.Sin(2*float64(j)*xiP) * math.Cosh(2*float64(j)*etaP)
+		eta += a * math.Cos(2*float64(j)*xiP) * math.Sinh(2*float64(j)*etaP)
+	}
+	return xi, eta
+}
+
+func (tm transverseMercator) forward(e ellipsoid, lat, lon float64) (x, y float64) {
+	s := newTMSeries(e)
+	xi, eta := s.project(lat, normalizeLongitude(lon-tm.lon0))
+	xi0, _ := s.project(tm.lat0, 0)
+	x = tm.x0 + tm.k0*s.A*eta
+	y = tm.y0 + tm.k0*s.A*(xi-xi0)
+	return x, y
+}
+
+func (tm transverseMercator) inverse(e ellipsoid, x, y float64) (lat, lon float64) {
+	s := newTMSeries(e)
+	xi0, _ := s.project(tm.lat0, 0)
+	xi := (y-tm.y0)/(tm.k0*s.A) + xi0
+	eta := (x - tm.x0) / (tm.k0 * s.A)
+
+	xiP, etaP := xi, eta
+	for j := 1; j <= 3; j++ {
+		b := s.beta[j-1]
+		xiP -= b * math.Sin(2*float64(j)*xi) * math.Cosh(2*float64(j)*eta)
+		etaP -= b * math.Cos(2*float64(j)*xi) * math.Sinh(2*float64(j)*eta)
+	}
+
+	chi := math.Asin(math.Sin(xiP) / math.Cosh(etaP))
+	phi := chi
+	for j := 1; j <= 3; j++ {
+		phi += s.delta[j-1] * math.Sin(2*float64(j)*chi)
+	}
+
+	lat = toDegrees(phi)
+	lon = normalizeLongitude(tm.lon0 + toDegrees(math.Atan2(math.Sinh(etaP), math.Cos(xiP))))
+	return lat, lon
+}
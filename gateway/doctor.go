@@ -0,0 +1,355 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"data-gateway/store"
+)
+
+const (
+	findingOK      = "ok"
+	findingWarning = "warning"
+	findingError   = "error"
+)
+
+var findingRank = map[string]int{findingOK: 0, findingWarning: 1, findingError: 2}
+
+// Finding is the outcome of one self-check.
+type Finding struct {
+	Check   string      `json:"check"`
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// DoctorReport collects the findings of a self-check run.
+type DoctorReport struct {
+	Status    string    `json:"status"`
+	Findings  []Finding `json:"findings"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (r *DoctorReport) add(f Finding) {
+	r.Findings = append(r.Findings, f)
+	if findingRank[f.Status] > findingRank[r.Status] {
+		r.Status = f.Status
+	}
+}
+
+// requiredIndex is an index the gateway creates at startup.
+type requiredIndex struct {
+	collection store.Collection
+	model      mongo.IndexModel
+}
+
+// checkOnly is set by --check so startup inspects the database without
+// changing it.
+var checkOnly bool
+
+// ensureIndex creates an index and records it for the index check.
+func (s *Server) ensureIndex(coll store.Collection, model mongo.IndexModel) error {
+	s.requiredIndexes = append(s.requiredIndexes, requiredIndex{collection: coll, model: model})
+	if checkOnly {
+		return nil
+	}
+	return coll.CreateIndex(context.Background(), model)
+}
+
+// Thresholds for the clock and disk checks
+const (
+	clockSkewWarning = 2 * time.Second
+	clockSkewError   = 30 * time.Second
+	diskFreeWarning  = 0.10
+	diskFreeError    = 0.02
+)
+
+// runDoctor checks the database and the host. Configuration is validated at
+// startup, so a running gateway only reports on what can change underneath it.
+func (s *Server) runDoctor(ctx context.Context, report *DoctorReport) {
+	if !s.authEnabled {
+		report.add(Finding{Check: "config", Status: findingWarning, Message: "authentication is disabled; set ADMIN_API_KEY to require API keys"})
+	}
+	s.signatures.mu.RLock()
+	signing, required := len(s.signatures.secrets) > 0, s.signatures.required
+	s.signatures.mu.RUnlock()
+	if signing && !required {
+		report.add(Finding{Check: "config", Status: findingWarning, Message: "INGEST_HMAC_REQUIRED is off, so platforms without a secret can post unsigned fixes"})
+	}
+
+	if !s.checkMongo(ctx, report) {
+		return
+	}
+	s.checkClock(ctx, report)
+	s.checkWriteConcern(ctx, report)
+	s.checkIndexes(ctx, report)
+	s.checkFieldEncryption(ctx, report)
+	s.checkQueryPlans(report)
+	s.checkCollectionStats(ctx, report)
+	checkDisk(report, s.tilesDir)
+}
+
+func (s *Server) checkMongo(ctx context.Context, report *DoctorReport) bool {
+	start := time.Now()
+	if s.store.Client() == nil {
+		report.add(Finding{Check: "mongodb", Status: findingWarning, Message: "using an in-memory store; records are lost when the gateway stops"})
+		return false
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.store.Ping(pingCtx); err != nil {
+		report.add(Finding{Check: "mongodb", Status: findingError, Message: fmt.Sprintf("cannot reach MongoDB: %v; check MONGODB_URI and that the server is running", err)})
+		return false
+	}
+	latency := time.Since(start)
+
+	var info struct {
+		Version string `bson:"version"`
+	}
+	s.store.DB().RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+
+	f := Finding{Check: "mongodb", Status: findingOK, Message: fmt.Sprintf("connected to MongoDB %s in %s", info.Version, latency.Round(time.Millisecond)),
+		Detail: gin.H{"version": info.Version, "ping_ms": latency.Milliseconds()}}
+	if latency > 500*time.Millisecond {
+		f.Status = findingWarning
+		f.Message += "; high latency will slow every request"
+	}
+	report.add(f)
+	return true
+}
+
+// checkClock compares the local clock with MongoDB's. Fix timestamps are
+// judged against the gateway's clock, so skew makes QC flag fixes as future
+// or backfilled.
+func (s *Server) checkClock(ctx context.Context, report *DoctorReport) {
+	before := time.Now()
+	var hello struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	err := s.store.DB().RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	after := time.Now()
+	if err != nil || hello.LocalTime.IsZero() {
+		report.add(Finding{Check: "clock", Status: findingWarning, Message: "could not read MongoDB server time to compare clocks"})
+		return
+	}
+
+	// Assume the server read its clock halfway through the round trip
+	local := before.Add(after.Sub(before) / 2)
+	skew := local.Sub(hello.LocalTime)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	f := Finding{Check: "clock", Status: findingOK, Message: fmt.Sprintf("clock is within %s of MongoDB", skew.Round(time.Millisecond)),
+		Detail: gin.H{"skew_ms": skew.Milliseconds()}}
+	switch {
+	case skew > clockSkewError:
+		f.Status = findingError
+		f.Message = fmt.Sprintf("clock differs from MongoDB by %s; check NTP on both hosts", skew.Round(time.Second))
+	case skew > clockSkewWarning:
+		f.Status = findingWarning
+		f.Message = fmt.Sprintf("clock differs from MongoDB by %s; check NTP on both hosts", skew.Round(time.Millisecond))
+	}
+	report.add(f)
+}
+
+func (s *Server) checkIndexes(ctx context.Context, report *DoctorReport) {
+	for _, required := range s.requiredIndexes {
+		coll := required.collection.Name()
+		existing, err := required.collection.IndexKeys(ctx)
+		if err != nil {
+			report.add(Finding{Check: "indexes", Status: findingError, Message: fmt.Sprintf("cannot list indexes on %s: %v", coll, err)})
+			continue
+		}
+
+		want := required.model.Keys.(bson.D)
+		found := false
+		for _, index := range existing {
+			found = found || sameIndexKeys(index, want)
+		}
+
+		keys := make([]string, len(want))
+		for i, e := range want {
+			keys[i] = fmt.Sprintf("%s: %v", e.Key, e.Value)
+		}
+		if found {
+			report.add(Finding{Check: "indexes", Status: findingOK, Message: fmt.Sprintf("%s has index {%s}", coll, strings.Join(keys, ", "))})
+		} else {
+			report.add(Finding{Check: "indexes", Status: findingError, Message: fmt.Sprintf("%s is missing index {%s}; start the gateway once to create it", coll, strings.Join(keys, ", "))})
+		}
+	}
+}
+
+// checkFieldEncryption reports credentials whose key hashes aren't
+// encrypted with the current key, or can't be decrypted at all.
+func (s *Server) checkFieldEncryption(ctx context.Context, report *DoctorReport) {
+	cursor, err := s.store.Credentials.Find(ctx, bson.M{})
+	if err != nil {
+		report.add(Finding{Check: "encryption", Status: findingError, Message: fmt.Sprintf("cannot read credentials: %v", err)})
+		return
+	}
+	var creds []bson.M
+	if err := cursor.All(ctx, &creds); err != nil {
+		report.add(Finding{Check: "encryption", Status: findingError, Message: fmt.Sprintf("cannot read credentials: %v", err)})
+		return
+	}
+
+	current := ""
+	if id := s.fieldKeys.currentID(); id != "" {
+		current = sealedPrefix + id + ":"
+	}
+	var stale, unreadable int
+	for _, cred := range creds {
+		hash, _ := cred["key_hash"].(string)
+		if _, err := s.fieldKeys.open(hash); err != nil {
+			unreadable++
+		} else if current != "" && !strings.HasPrefix(hash, current) {
+			stale++
+		}
+	}
+	switch {
+	case unreadable > 0:
+		report.add(Finding{Check: "encryption", Status: findingError, Message: fmt.Sprintf("%d credentials are encrypted with keys missing from FIELD_ENCRYPTION_KEYS and can't be used", unreadable)})
+	case stale > 0:
+		report.add(Finding{Check: "encryption", Status: findingWarning, Message: fmt.Sprintf("%d credentials aren't encrypted with the current key %s; POST /admin/credentials/reencrypt before removing older keys", stale, s.fieldKeys.currentID())})
+	case current != "":
+		report.add(Finding{Check: "encryption", Status: findingOK, Message: fmt.Sprintf("credentials are encrypted with key %s", s.fieldKeys.currentID())})
+	}
+}
+
+func sameIndexKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) checkCollectionStats(ctx context.Context, report *DoctorReport) {
+	cursor, err := s.store.Locations.Aggregate(ctx, []bson.M{{"$collStats": bson.M{"storageStats": bson.M{}}}})
+	if err != nil {
+		report.add(Finding{Check: "collections", Status: findingWarning, Message: fmt.Sprintf("cannot read stats for %s: %v", s.store.Locations.Name(), err)})
+		return
+	}
+	var stats []struct {
+		StorageStats struct {
+			Count          int64 `bson:"count"`
+			Size           int64 `bson:"size"`
+			StorageSize    int64 `bson:"storageSize"`
+			TotalIndexSize int64 `bson:"totalIndexSize"`
+		} `bson:"storageStats"`
+	}
+	if err := cursor.All(ctx, &stats); err != nil || len(stats) == 0 {
+		report.add(Finding{Check: "collections", Status: findingWarning, Message: fmt.Sprintf("cannot read stats for %s", s.store.Locations.Name())})
+		return
+	}
+
+	storage := stats[0].StorageStats
+	f := Finding{Check: "collections", Status: findingOK,
+		Message: fmt.Sprintf("%s holds %d locations in %s (%s of indexes)", s.store.Locations.Name(), storage.Count, formatBytes(storage.StorageSize), formatBytes(storage.TotalIndexSize)),
+		Detail:  gin.H{"count": storage.Count, "size_bytes": storage.Size, "storage_bytes": storage.StorageSize, "index_bytes": storage.TotalIndexSize}}
+	if storage.Count == 0 {
+		f.Message = fmt.Sprintf("%s is empty; check MONGODB_DATABASE and MONGODB_COLLECTION if data was expected", s.store.Locations.Name())
+	}
+	report.add(f)
+}
+
+// checkDisk reports free space on the directories the gateway writes to:
+// the temp directory, and the tile cache if there is one.
+func checkDisk(report *DoctorReport, tilesDir string) {
+	dirs := [][2]string{{"temp", os.TempDir()}}
+	if tilesDir != "" {
+		dirs = append(dirs, [2]string{"tiles", tilesDir})
+	}
+
+	for _, d := range dirs {
+		name, dir := d[0], d[1]
+		free, total, err := diskSpace(dir)
+		if err != nil {
+			report.add(Finding{Check: "disk", Status: findingWarning, Message: fmt.Sprintf("cannot check free space for %s directory %s: %v", name, dir, err)})
+			continue
+		}
+		ratio := float64(free) / float64(total)
+		f := Finding{Check: "disk", Status: findingOK,
+			Message: fmt.Sprintf("%s directory %s has %s free (%.0f%%)", name, dir, formatBytes(int64(free)), ratio*100),
+			Detail:  gin.H{"directory": dir, "free_bytes": free, "total_bytes": total}}
+		switch {
+		case ratio < diskFreeError:
+			f.Status = findingError
+		case ratio < diskFreeWarning:
+			f.Status = findingWarning
+		}
+		report.add(f)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Check validates the configuration and dependencies the way startup
+// does, prints the findings, and returns the process exit code.
+func (s *Server) Check() int {
+	checkOnly = true
+	report := DoctorReport{Status: findingOK, Findings: []Finding{}, CheckedAt: time.Now().UTC()}
+
+	for _, step := range s.configSteps() {
+		if err := step.init(); err != nil {
+			report.add(Finding{Check: "config", Status: findingError, Message: fmt.Sprintf("%s: %v", step.name, err)})
+		}
+	}
+	if _, err := ConfigFromEnv(); err != nil {
+		report.add(Finding{Check: "config", Status: findingError, Message: err.Error()})
+	}
+
+	if err := s.initDB(); err != nil {
+		report.add(Finding{Check: "mongodb", Status: findingError, Message: fmt.Sprintf("%v; check MONGODB_URI and that the server is running", err)})
+	} else {
+		if s.cfg.Store == nil {
+			defer s.store.Close(context.Background())
+		}
+		for _, step := range s.databaseSteps() {
+			if err := step.init(); err != nil {
+				report.add(Finding{Check: "config", Status: findingError, Message: err.Error()})
+			}
+		}
+		s.runDoctor(context.Background(), &report)
+	}
+
+	for _, f := range report.Findings {
+		fmt.Printf("%-8s %-12s %s\n", f.Status, f.Check, f.Message)
+	}
+	fmt.Printf("\noverall: %s\n", report.Status)
+
+	if report.Status == findingError {
+		return 1
+	}
+	return 0
+}
+
+func (s *Server) handleDoctor(c *gin.Context) {
+	report := DoctorReport{Status: findingOK, Findings: []Finding{}, CheckedAt: time.Now().UTC()}
+	s.runDoctor(c.Request.Context(), &report)
+	c.JSON(http.StatusOK, report)
+}
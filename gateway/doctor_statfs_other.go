@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package gateway
+
+import "fmt"
+
+func diskSpace(dir string) (free, total uint64, err error) {
+	return 0, 0, fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,294 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const alertLowEndurance = "low_endurance"
+
+// Telemetry key battery voltage is read from unless a platform sets
+// battery_field
+const defaultBatteryField = "battery_voltage"
+
+const defaultEnduranceWindow = 6 * time.Hour
+
+// Fewest readings, and shortest span of them, a discharge rate is fitted to
+const (
+	minEnduranceSamples = 3
+	minEnduranceSpan    = 10 * time.Minute
+)
+
+// How long before the latest reading the discharge rate is fitted over
+var enduranceWindow = defaultEnduranceWindow
+
+func initEndurance() error {
+	d, err := envDuration("ENDURANCE_WINDOW", defaultEnduranceWindow)
+	if err != nil {
+		return err
+	}
+	if d < minEnduranceSpan {
+		return fmt.Errorf("invalid ENDURANCE_WINDOW %q (expected at least %s)", d, minEnduranceSpan)
+	}
+	enduranceWindow = d
+	return nil
+}
+
+// Endurance states
+const (
+	enduranceOK = "ok"
+	// Below the platform's low_endurance
+	enduranceLow = "low"
+	// Voltage holding steady or rising, so there is no end in sight
+	enduranceCharging = "charging"
+	// Too few readings to fit a rate to
+	enduranceUnknown = "unknown"
+)
+
+// Endurance is how much longer a platform's battery is expected to last at
+// its recent discharge rate.
+type Endurance struct {
+	Deployment string `json:"deployment"`
+	Platform   string `json:"platform"`
+	State      string `json:"state"`
+	// Telemetry key the voltage is read from
+	Field string `json:"field"`
+	// Latest reading, and when it was taken
+	Voltage   *float64 `json:"voltage,omitempty"`
+	Timestamp string   `json:"timestamp,omitempty"`
+	// Voltage the platform is out of power at
+	EmptyVoltage float64 `json:"empty_voltage"`
+	// Volts lost per hour, fitted over the window
+	DischargeRate    *float64 `json:"discharge_rate,omitempty"`
+	Remaining        string   `json:"remaining,omitempty"`
+	RemainingSeconds *float64 `json:"remaining_seconds,omitempty"`
+	EmptyAt          string   `json:"empty_at,omitempty"`
+	Samples          int      `json:"samples"`
+	Window           string   `json:"window"`
+	LowEndurance     string   `json:"low_endurance,omitempty"`
+}
+
+// estimateEndurance fits a line to a platform's battery voltage over the
+// window before its latest reading, and projects when it reaches the
+// platform's empty voltage. It returns nil for platforms without an
+// empty_voltage, or without readings in the last statusWatchWindow.
+func (s *Server) estimateEndurance(ctx context.Context, deployment, platform string, now time.Time) (*Endurance, error) {
+	settings := platformSettings(deployment, platform)
+	if settings.EmptyVoltage == nil {
+		return nil, nil
+	}
+	field := settings.BatteryField
+	if field == "" {
+		field = defaultBatteryField
+	}
+	since := now.Add(-statusWatchWindow).UTC().Format(timestampLayout)
+	filter := bson.M{
+		"deployment":    deployment,
+		"platform":      platform,
+		"timestamp":     bson.M{"$gte": since},
+		"data." + field: bson.M{"$exists": true},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetProjection(bson.M{"timestamp": 1, "data." + field: 1})
+	cursor, err := s.store.Telemetry.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	e := &Endurance{
+		Deployment:   deployment,
+		Platform:     platform,
+		State:        enduranceUnknown,
+		Field:        field,
+		EmptyVoltage: *settings.EmptyVoltage,
+		Window:       enduranceWindow.String(),
+	}
+	if settings.lowEndurance > 0 {
+		e.LowEndurance = settings.lowEndurance.String()
+	}
+
+	// Least squares over hours since the latest reading, going back
+	var latest time.Time
+	var n, sumX, sumY, sumXX, sumXY float64
+	var earliest float64
+	for cursor.Next(ctx) {
+		var record api.Telemetry
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		v, ok := numericValue(record.Data[field])
+		if !ok {
+			continue
+		}
+		t, err := parseTimestamp(record.Timestamp)
+		if err != nil {
+			continue
+		}
+		if e.Voltage == nil {
+			e.Voltage, e.Timestamp, latest = &v, record.Timestamp, t
+		}
+		if latest.Sub(t) > enduranceWindow {
+			break
+		}
+		x := t.Sub(latest).Hours()
+		n++
+		sumX += x
+		sumY += v
+		sumXX += x * x
+		sumXY += x * v
+		earliest = x
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if e.Voltage == nil {
+		return nil, nil
+	}
+	e.Samples = int(n)
+	if n < minEnduranceSamples || -earliest < minEnduranceSpan.Hours() || n*sumXX == sumX*sumX {
+		return e, nil
+	}
+
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	rate := -slope
+	e.DischargeRate = &rate
+	if rate <= 0 {
+		e.State = enduranceCharging
+		return e, nil
+	}
+	// From the fitted voltage now, which smooths out noise in the latest
+	// reading
+	fitted := (sumY - slope*sumX) / n
+	hours := math.Max(0, (fitted-e.EmptyVoltage)/rate)
+	emptyAt := latest.Add(time.Duration(hours * float64(time.Hour)))
+	// Counted from now, as time has passed since the latest reading
+	remaining := emptyAt.Sub(now).Round(time.Minute)
+	if remaining < 0 {
+		remaining = 0
+	}
+	seconds := remaining.Seconds()
+	e.Remaining, e.RemainingSeconds = remaining.String(), &seconds
+	e.EmptyAt = emptyAt.UTC().Format(timestampLayout)
+
+	e.State = enduranceOK
+	if settings.lowEndurance > 0 && remaining < settings.lowEndurance {
+		e.State = enduranceLow
+	}
+	return e, nil
+}
+
+// localize formats an estimate's timestamps in loc.
+func (e *Endurance) localize(loc *time.Location) {
+	if e.Timestamp != "" {
+		e.Timestamp = formatTimestamp(e.Timestamp, loc)
+	}
+	if e.EmptyAt != "" {
+		e.EmptyAt = formatTimestamp(e.EmptyAt, loc)
+	}
+}
+
+// handleGetEndurance estimates the endurance of each platform in a
+// deployment with an empty_voltage configured.
+func (s *Server) handleGetEndurance(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	var platforms []string
+	if platform := c.Query("platform"); platform != "" {
+		if !canRead(c, deployment, platform) {
+			respondErrorf(c, http.StatusForbidden, "access to platform denied")
+			return
+		}
+		platforms = []string{platform}
+	} else {
+		since := now.Add(-statusWatchWindow).UTC().Format(timestampLayout)
+		values, err := s.store.Telemetry.Distinct(ctx, "platform", scopedFilter(c, bson.M{"deployment": deployment, "timestamp": bson.M{"$gte": since}}))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		for _, v := range values {
+			if platform, ok := v.(string); ok {
+				platforms = append(platforms, platform)
+			}
+		}
+	}
+
+	estimates := []Endurance{}
+	for _, platform := range platforms {
+		e, err := s.estimateEndurance(ctx, deployment, platform, now)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if e != nil {
+			e.localize(loc)
+			estimates = append(estimates, *e)
+		}
+	}
+	c.JSON(http.StatusOK, estimates)
+}
+
+// checkEndurance raises a low_endurance alert when a platform's estimate
+// falls below its low_endurance. As with platform states, the states are
+// saved between checks, and those seen on the first check are recorded
+// without alerting.
+func (s *Server) checkEndurance(ctx context.Context, statuses []PlatformStatus, now time.Time) error {
+	previous, err := s.loadWatchedStates(ctx, enduranceStatesDocumentID)
+	if err != nil {
+		return err
+	}
+	first := previous == nil
+	states := []watchedState{}
+
+	for _, ps := range statuses {
+		if platformSettings(ps.Deployment, ps.Platform).lowEndurance == 0 {
+			continue
+		}
+		e, err := s.estimateEndurance(ctx, ps.Deployment, ps.Platform, now)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			continue
+		}
+		key := ps.Deployment + "/" + ps.Platform
+		states = append(states, watchedState{Deployment: ps.Deployment, Platform: ps.Platform, State: e.State})
+		if previous[key] == enduranceLow && (e.State == enduranceOK || e.State == enduranceCharging) {
+			s.resolveAlerts(ps.Deployment, ps.Platform, alertLowEndurance)
+		}
+		if first || e.State != enduranceLow || previous[key] == enduranceLow {
+			continue
+		}
+		s.raiseAlert(api.Alert{
+			Deployment: ps.Deployment,
+			Platform:   ps.Platform,
+			Type:       alertLowEndurance,
+			Severity:   "warning",
+			Message:    fmt.Sprintf("%s has about %s of battery left at %.2f V, losing %.3f V an hour", ps.Platform, e.Remaining, *e.Voltage, *e.DischargeRate),
+			Location:   ps.LastFix,
+		})
+	}
+	return s.saveWatchedStates(ctx, enduranceStatesDocumentID, states)
+}
@@ -0,0 +1,375 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	// Most environmental records accepted in one request, e.g. one time step
+	// of a model grid
+	maxEnvironmentBatch = 10000
+	// A platform is taken to be at its last fix for this long when it has
+	// not reported since
+	positionMaxAge = 10 * time.Minute
+	// Defaults for how far in time and distance conditions may be from a
+	// platform to describe its surroundings
+	defaultConditionsWindow = time.Hour
+	defaultConditionsRadius = 25.0 // km
+)
+
+// positionAt returns where a platform was at time ts, interpolated between
+// its fixes either side, or its last fix if that is recent enough.
+func (s *Server) positionAt(ctx context.Context, deployment, platform, ts string) (lat, lon float64, err error) {
+	before, after, err := s.findAdjacent(ctx, deployment, platform, ts, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if before == nil {
+		return 0, 0, fmt.Errorf("no position for platform %q at %s", platform, ts)
+	}
+	t, _ := parseTimestamp(ts)
+	if after != nil {
+		if lat, lon, ok := interpolatePosition(*before, *after, t); ok {
+			return lat, lon, nil
+		}
+	} else if t0, err := parseTimestamp(before.Timestamp); err != nil || t.Sub(t0) > positionMaxAge {
+		return 0, 0, fmt.Errorf("no position for platform %q within %s of %s", platform, positionMaxAge, ts)
+	}
+	return before.Latitude, before.Longitude, nil
+}
+
+// handlePostEnvironment stores one environmental record or an array of
+// them. Records without a position take their platform's position at their
+// timestamp.
+func (s *Server) handlePostEnvironment(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	var records []api.Environment
+	single := !bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+	if single {
+		records = make([]api.Environment, 1)
+		err = json.Unmarshal(body, &records[0])
+	} else {
+		err = json.Unmarshal(body, &records)
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(records) == 0 || len(records) > maxEnvironmentBatch {
+		respondErrorf(c, http.StatusBadRequest, "send between 1 and %d records", maxEnvironmentBatch)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	ctx := c.Request.Context()
+	now := time.Now()
+	docs := make([]interface{}, len(records))
+	for i := range records {
+		record := &records[i]
+		if err := s.prepareEnvironment(ctx, record, now, loc); err != nil {
+			if !single {
+				err = fmt.Errorf("record %d: %v", i+1, err)
+			}
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		docs[i] = record
+	}
+
+	result, err := s.store.Environment.InsertMany(ctx, docs)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if single {
+		records[0].ID = result.InsertedIDs[0].(primitive.ObjectID)
+		records[0].Timestamp = formatTimestamp(records[0].Timestamp, loc)
+		c.JSON(http.StatusOK, records[0])
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"inserted": len(result.InsertedIDs)})
+}
+
+// prepareEnvironment validates a record and fills in its timestamp and
+// position.
+func (s *Server) prepareEnvironment(ctx context.Context, record *api.Environment, now time.Time, loc *time.Location) error {
+	if record.Deployment == "" {
+		return fmt.Errorf("deployment is required")
+	}
+	if record.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	record.ID = primitive.NilObjectID
+	record.CreatedAt = now
+	if record.Timestamp == "" {
+		record.Timestamp = now.UTC().Format(timestampLayout)
+	} else {
+		ts, err := normalizeTimestamp(record.Timestamp, loc)
+		if err != nil {
+			return err
+		}
+		record.Timestamp = ts
+	}
+
+	switch {
+	case record.Latitude != nil && record.Longitude != nil:
+		if !(*record.Latitude >= -90 && *record.Latitude <= 90 && *record.Longitude >= -180 && *record.Longitude <= 180) {
+			return fmt.Errorf("invalid position")
+		}
+	case record.Latitude != nil || record.Longitude != nil:
+		return fmt.Errorf("latitude and longitude must be sent together")
+	case record.Platform == "":
+		return fmt.Errorf("a position or a platform to take it from is required")
+	default:
+		lat, lon, err := s.positionAt(ctx, record.Deployment, record.Platform, record.Timestamp)
+		if err != nil {
+			return err
+		}
+		record.Latitude, record.Longitude = &lat, &lon
+	}
+	return nil
+}
+
+func (s *Server) handleGetEnvironment(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+	if source := c.Query("source"); source != "" {
+		filter["source"] = source
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	if q := c.Query("q"); q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid query: %v", err)
+			return
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	after, err := timestampOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(timestampOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Environment.Find(ctx, scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []api.Environment{}
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	timestampOrder.setPageHeaders(c, int64(len(results)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := results[len(results)-1]
+		return last.Timestamp, last.ID
+	})
+
+	for i := range results {
+		results[i].Timestamp = formatTimestamp(results[i].Timestamp, loc)
+		results[i].CreatedAt = results[i].CreatedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// Conditions is the environmental record from one source that best
+// describes a platform's surroundings at a time.
+type Conditions struct {
+	Source string           `json:"source"`
+	Record *api.Environment `json:"record"`
+	// Distance in meters from the platform
+	Distance float64 `json:"distance"`
+	// Seconds the record is after (positive) or before the time asked about
+	Offset float64 `json:"offset"`
+}
+
+// handleGetConditions returns the conditions at a platform's position at a
+// time: for each source, the record nearest in time within the window, and
+// of those the one nearest the platform within the radius.
+func (s *Server) handleGetConditions(c *gin.Context) {
+	deployment, platform := c.Query("deployment"), c.Query("platform")
+	if deployment == "" || platform == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment and platform are required")
+		return
+	}
+	if !canRead(c, deployment, platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	at := time.Now().UTC()
+	if v := c.Query("at"); v != "" {
+		if at, err = parseTimestampIn(v, loc); err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid at: %v", err)
+			return
+		}
+	}
+	window := defaultConditionsWindow
+	if v := c.Query("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid window %q", v)
+			return
+		}
+		window = d
+	}
+	radius := defaultConditionsRadius
+	if v := c.Query("radius"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f > 0) {
+			respondErrorf(c, http.StatusBadRequest, "radius must be a positive distance in kilometres")
+			return
+		}
+		radius = f
+	}
+	radius *= 1000
+
+	ctx := c.Request.Context()
+	ts := at.UTC().Format(timestampLayout)
+	lat, lon, err := s.positionAt(ctx, deployment, platform, ts)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	// Narrow by latitude in the query, which holds across the antimeridian,
+	// and by distance once fetched
+	dLat := toDegrees(radius / earthRadiusMeters)
+	filter := bson.M{
+		"deployment": deployment,
+		"timestamp": bson.M{
+			"$gte": at.Add(-window).UTC().Format(timestampLayout),
+			"$lte": at.Add(window).UTC().Format(timestampLayout),
+		},
+		"latitude": bson.M{"$gte": lat - dLat, "$lte": lat + dLat},
+	}
+	opts := options.Find().SetLimit(s.maxResultLimit + 1)
+	cursor, err := s.store.Environment.Find(ctx, filter, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var records []api.Environment
+	if err := cursor.All(ctx, &records); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(records)) > s.maxResultLimit {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, "too many records near the platform; use a smaller window or radius")
+		return
+	}
+
+	best := map[string]*Conditions{}
+	for i := range records {
+		record := &records[i]
+		if record.Latitude == nil || record.Longitude == nil {
+			continue
+		}
+		t, err := parseTimestamp(record.Timestamp)
+		if err != nil {
+			continue
+		}
+		distance := haversine(lat, lon, *record.Latitude, *record.Longitude)
+		if distance > radius {
+			continue
+		}
+		offset := t.Sub(at).Seconds()
+		current, ok := best[record.Source]
+		if ok {
+			dt, currentDT := math.Abs(offset), math.Abs(current.Offset)
+			if dt > currentDT || (dt == currentDT && distance >= current.Distance) {
+				continue
+			}
+		}
+		best[record.Source] = &Conditions{Source: record.Source, Record: record, Distance: distance, Offset: offset}
+	}
+
+	conditions := make([]Conditions, 0, len(best))
+	for _, cond := range best {
+		cond.Record.Timestamp = formatTimestamp(cond.Record.Timestamp, loc)
+		cond.Record.CreatedAt = cond.Record.CreatedAt.In(loc)
+		conditions = append(conditions, *cond)
+	}
+	sort.Slice(conditions, func(i, j int) bool { return conditions[i].Source < conditions[j].Source })
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployment": deployment,
+		"platform":   platform,
+		"at":         at.In(loc).Format(timestampLayout),
+		"latitude":   lat,
+		"longitude":  lon,
+		"conditions": conditions,
+	})
+}
@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Error codes clients can branch on. Codes are stable; messages may change.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidField     = "invalid_field"
+	codeUnauthenticated  = "unauthenticated"
+	codeInvalidSignature = "invalid_signature"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeGone             = "gone"
+	codeTooManyResults   = "too_many_results"
+	codeBodyTooLarge     = "body_too_large"
+	codeRejected         = "rejected"
+	codeInternal         = "internal"
+	codeUpstream         = "upstream_failed"
+	codeUnavailable      = "unavailable"
+)
+
+// statusCodes are the codes of errors that don't carry their own.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthenticated,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusConflict:              codeConflict,
+	http.StatusGone:                  codeGone,
+	http.StatusRequestEntityTooLarge: codeTooManyResults,
+	http.StatusUnprocessableEntity:   codeRejected,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusBadGateway:            codeUpstream,
+	http.StatusServiceUnavailable:    codeUnavailable,
+}
+
+// APIError is the body of every error response.
+type APIError struct {
+	// What went wrong, for people; clients should branch on Code
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	// The fields of the request body that failed validation
+	Fields []FieldError `json:"fields,omitempty"`
+	// Further detail particular to the code
+	Details map[string]interface{} `json:"details,omitempty"`
+	// Identifies the request in the gateway's log
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// FieldError is a request body field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// codedError is an error with a code more specific than its status's.
+type codedError struct {
+	code    string
+	err     error
+	details map[string]interface{}
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode gives err a code more specific than the status it's returned
+// with.
+func withCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+const requestIDKey = "request_id"
+
+// Request IDs accepted from clients and proxies
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID gives each request an ID, taken from its X-Request-ID header
+// if it has a usable one, and returns it in the X-Request-ID header. Internal
+// errors are logged with it, since clients are only told the ID.
+func (s *Server) requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = primitive.NewObjectID().Hex()
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+
+		c.Next()
+
+		for _, err := range c.Errors.ByType(gin.ErrorTypePrivate) {
+			s.logger.Printf("request %s: %s %s: %v", id, c.Request.Method, c.Request.URL.Path, err.Err)
+		}
+	}
+}
+
+// newAPIError describes err for a client. Internal errors are recorded to be
+// logged and described only by their code, so database and other internal
+// details aren't shown to clients.
+func newAPIError(c *gin.Context, status int, err error) APIError {
+	body := describeError(status, err)
+	body.RequestID = c.GetString(requestIDKey)
+	if status == http.StatusInternalServerError {
+		c.Error(err)
+	}
+	return body
+}
+
+// describeError is newAPIError for an error reported other than in a
+// response, such as in ingest statistics, leaving the caller to log
+// internal errors.
+func describeError(status int, err error) APIError {
+	body := APIError{Error: err.Error(), Code: statusCodes[status]}
+	if body.Code == "" {
+		body.Code = codeInvalidRequest
+		if status >= http.StatusInternalServerError {
+			body.Code = codeInternal
+		}
+	}
+
+	var coded *codedError
+	var invalid validator.ValidationErrors
+	var syntax *json.SyntaxError
+	var mistyped *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &coded):
+		body.Code, body.Details = coded.code, coded.details
+	case errors.As(err, &invalid):
+		body.Code = codeInvalidField
+		for _, fe := range invalid {
+			body.Fields = append(body.Fields, FieldError{Field: fieldPath(fe), Message: fieldMessage(fe)})
+		}
+		body.Error = body.Fields[0].Field + " " + body.Fields[0].Message
+		if len(body.Fields) > 1 {
+			body.Error = fmt.Sprintf("%s, and %d more invalid fields", body.Error, len(body.Fields)-1)
+		}
+	case errors.As(err, &mistyped):
+		body.Code = codeInvalidJSON
+		if mistyped.Field != "" {
+			message := fmt.Sprintf("must be a %s", mistyped.Type)
+			body.Fields = []FieldError{{Field: mistyped.Field, Message: message}}
+			body.Error = fmt.Sprintf("%s %s", mistyped.Field, message)
+		}
+	case errors.As(err, &syntax), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		body.Code = codeInvalidJSON
+		body.Error = fmt.Sprintf("malformed JSON: %v", err)
+	}
+
+	if status == http.StatusInternalServerError {
+		body.Error = http.StatusText(status)
+		body.Fields = nil
+	}
+	return body
+}
+
+// respondError responds with err as an APIError.
+func respondError(c *gin.Context, status int, err error) {
+	c.JSON(status, newAPIError(c, status, err))
+}
+
+// respondErrorf responds with a formatted message as an APIError.
+func respondErrorf(c *gin.Context, status int, format string, args ...interface{}) {
+	respondError(c, status, fmt.Errorf(format, args...))
+}
+
+// abortError responds with err as an APIError and stops the handler chain.
+func abortError(c *gin.Context, status int, err error) {
+	c.AbortWithStatusJSON(status, newAPIError(c, status, err))
+}
+
+// fieldPath returns where a validation error is in the request body, by
+// JSON names, such as samples[2].timestamp.
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	// Drop the struct's own name
+	if _, rest, ok := strings.Cut(ns, "."); ok {
+		return rest
+	}
+	return ns
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", fe.Param())
+	case "min", "gte":
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max", "lte":
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	}
+	return fmt.Sprintf("failed the %s check", fe.Tag())
+}
+
+func init() {
+	// Report validation errors by the fields' JSON names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
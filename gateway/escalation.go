@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"data-gateway/api"
+)
+
+// escalationPolicy sends alerts matching its conditions to more channels
+// the longer they go unacknowledged. Conditions are as for routes.
+type escalationPolicy struct {
+	Deployment  string           `json:"deployment"`
+	Platform    string           `json:"platform"`
+	Types       []string         `json:"types"`
+	MinSeverity string           `json:"min_severity"`
+	Steps       []escalationStep `json:"steps"`
+}
+
+// escalationStep sends an alert to its channels once it has been open for
+// After, such as "15m".
+type escalationStep struct {
+	After    string   `json:"after"`
+	Channels []string `json:"channels"`
+
+	after time.Duration
+}
+
+// How often open alerts are checked for escalation steps falling due
+const escalationInterval = 15 * time.Second
+
+// How long after its last step falls due an alert is still escalated, so a
+// gateway that was down catches up when it restarts
+const escalationCatchUp = 24 * time.Hour
+
+func (p *escalationPolicy) validate(channels map[string]notifier) error {
+	if p.MinSeverity != "" {
+		if _, ok := alertSeverities[p.MinSeverity]; !ok {
+			return fmt.Errorf("invalid min_severity %q", p.MinSeverity)
+		}
+	}
+	for _, pattern := range []string{p.Deployment, p.Platform} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		if step.After != "" {
+			d, err := time.ParseDuration(step.After)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid after %q in step %d", step.After, i)
+			}
+			step.after = d
+		}
+		if i > 0 && step.after < p.Steps[i-1].after {
+			return fmt.Errorf("step %d is due before step %d", i, i-1)
+		}
+		if len(step.Channels) == 0 {
+			return fmt.Errorf("step %d has no channels", i)
+		}
+		for _, name := range step.Channels {
+			if _, ok := channels[name]; !ok {
+				return fmt.Errorf("step %d refers to unknown channel %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *escalationPolicy) matches(alert api.Alert) bool {
+	return alertRoute{Deployment: p.Deployment, Platform: p.Platform, Types: p.Types, MinSeverity: p.MinSeverity}.matches(alert)
+}
+
+// escalation returns the first policy matching an alert, or nil.
+func (n *alertNotifier) escalation(alert api.Alert) *escalationPolicy {
+	for i := range n.escalations {
+		if n.escalations[i].matches(alert) {
+			return &n.escalations[i]
+		}
+	}
+	return nil
+}
+
+// runEscalations sends alerts held back by suppressions once they end, and
+// the escalation steps of open alerts as they fall due.
+func (s *Server) runEscalations(ctx context.Context) {
+	if len(s.notifier.routes) == 0 && len(s.notifier.escalations) == 0 {
+		return
+	}
+	for sleep(ctx, escalationInterval) {
+		if !s.leading() || !s.featureEnabled(featureAlerts) {
+			continue
+		}
+		now := time.Now().UTC()
+		if err := s.releaseSuppressedAlerts(ctx, now); err != nil {
+			s.logger.Printf("error releasing suppressed alerts: %v", err)
+		}
+		if len(s.notifier.escalations) == 0 {
+			continue
+		}
+		if err := s.escalateAlerts(ctx, now); err != nil {
+			s.logger.Printf("error escalating alerts: %v", err)
+		}
+	}
+}
+
+func (s *Server) escalateAlerts(ctx context.Context, now time.Time) error {
+	var longest time.Duration
+	steps := 0
+	for _, policy := range s.notifier.escalations {
+		longest = max(longest, policy.Steps[len(policy.Steps)-1].after)
+		steps = max(steps, len(policy.Steps))
+	}
+	filter := bson.M{
+		"state":       alertOpen,
+		"escalations": bson.M{"$lt": steps},
+		"notified_at": bson.M{"$gte": now.Add(-longest - escalationCatchUp)},
+	}
+	cursor, err := s.store.Alerts.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var alerts []api.Alert
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return err
+	}
+
+	for _, alert := range alerts {
+		policy := s.notifier.escalation(alert)
+		if policy == nil {
+			continue
+		}
+		targets := make(map[string]bool)
+		sent := alert.Escalations
+		for ; sent < len(policy.Steps) && !alert.NotifiedAt.Add(policy.Steps[sent].after).After(now); sent++ {
+			for _, name := range policy.Steps[sent].Channels {
+				targets[name] = true
+			}
+		}
+		if sent == alert.Escalations {
+			continue
+		}
+		// Only while still open, in case it was acknowledged meanwhile
+		result, err := s.store.Alerts.UpdateOne(ctx,
+			bson.M{"_id": alert.ID, "state": alertOpen, "escalations": alert.Escalations},
+			bson.M{"$set": bson.M{"escalations": sent}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		alert.Escalations = sent
+		s.notify(alert, targets)
+	}
+	return nil
+}
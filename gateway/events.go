@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+func (s *Server) handlePostEvent(c *gin.Context) {
+	var event api.Event
+	if err := c.ShouldBindJSON(&event); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	event.CreatedAt = time.Now()
+	if event.Timestamp == "" {
+		event.Timestamp = event.CreatedAt.UTC().Format(timestampLayout)
+	} else if event.Timestamp, err = normalizeTimestamp(event.Timestamp, loc); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := s.store.Events.InsertOne(context.Background(), event)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	event.ID = result.InsertedID.(primitive.ObjectID)
+
+	event.Timestamp = formatTimestamp(event.Timestamp, loc)
+	c.JSON(http.StatusOK, event)
+}
+
+func (s *Server) handleGetEvents(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	filter := eventFilter(deployment, c.Query("platform"), c.Query("type"), start, end)
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	after, err := timestampOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(timestampOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Events.Find(ctx, scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []api.Event{}
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	timestampOrder.setPageHeaders(c, int64(len(results)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := results[len(results)-1]
+		return last.Timestamp, last.ID
+	})
+
+	for i := range results {
+		results[i].Timestamp = formatTimestamp(results[i].Timestamp, loc)
+		results[i].CreatedAt = results[i].CreatedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// eventFilter matches a deployment's events, of a platform and type and
+// between stored timestamps start and end where they aren't empty.
+func eventFilter(deployment, platform, eventType, start, end string) bson.M {
+	filter := bson.M{"deployment": deployment}
+	if platform != "" {
+		filter["platform"] = platform
+	}
+	if eventType != "" {
+		filter["type"] = eventType
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	return filter
+}
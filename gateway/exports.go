@@ -0,0 +1,550 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export statuses
+const (
+	exportQueued    = "queued"
+	exportRunning   = "running"
+	exportSucceeded = "succeeded"
+	exportFailed    = "failed"
+)
+
+const defaultExportWorkers = 2
+
+// Records read at once. Each page is its own short query, so no cursor is
+// held open for the length of an export.
+const exportPageSize = 10000
+
+var exportsDir string
+var exportWorkers = defaultExportWorkers
+
+// The instance exports are built on, which holds their files
+var exportHost string
+
+// Export is a deployment archive built in the background, file by file,
+// so large deployments don't hold a request open. Progress is saved after
+// each page of records, and an export interrupted by a restart carries on
+// where it stopped.
+type Export struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Deployment string             `json:"deployment" bson:"deployment"`
+	Status     string             `json:"status" bson:"status"`
+	Error      string             `json:"error,omitempty" bson:"error,omitempty"`
+	Files      []ExportFile       `json:"files" bson:"files"`
+	// Size of the finished archive
+	Size       int64      `json:"size,omitempty" bson:"size,omitempty"`
+	Host       string     `json:"host" bson:"host"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" bson:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// ExportFile is the progress of an export through one archive file.
+type ExportFile struct {
+	Name    string `json:"name" bson:"name"`
+	Records int64  `json:"records" bson:"records"`
+	// Records expected, counted when the export was started
+	Total int64 `json:"total" bson:"total"`
+	Done  bool  `json:"done" bson:"done"`
+	// Bytes written as of the last saved page, and the last record in them
+	Size   int64       `json:"-" bson:"size"`
+	LastID interface{} `json:"-" bson:"last_id,omitempty"`
+}
+
+// exportTask is an archive file of an export, for a worker to write.
+type exportTask struct {
+	export *Export
+	file   int
+}
+
+// exportRunner tracks the exports this instance is building.
+type exportRunner struct {
+	// Lasts as long as the server, for the exports requests start
+	ctx   context.Context
+	tasks chan exportTask
+
+	mu sync.Mutex
+	// Files of each export not yet written
+	remaining map[primitive.ObjectID]int
+	// Serializes saving progress, so a stale save can't overwrite a newer
+	saveMu sync.Mutex
+}
+
+func (s *Server) initExports() error {
+	collectionName := os.Getenv("MONGODB_EXPORTS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "exports"
+	}
+	s.store.Exports = s.store.Collection(collectionName)
+
+	exportsDir = os.Getenv("EXPORTS_DIR")
+	if exportsDir == "" {
+		exportsDir = filepath.Join(os.TempDir(), "data-gateway-exports")
+	}
+	if err := os.MkdirAll(exportsDir, 0755); err != nil {
+		return fmt.Errorf("error creating EXPORTS_DIR: %v", err)
+	}
+	exportWorkers = defaultExportWorkers
+	if v := os.Getenv("EXPORT_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid EXPORT_WORKERS %q", v)
+		}
+		exportWorkers = n
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error reading host name for exports: %v", err)
+	}
+	exportHost = host
+
+	if err := s.ensureIndex(s.store.Exports, mongo.IndexModel{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "created_at", Value: -1}}}); err != nil {
+		return fmt.Errorf("error creating export indexes: %v", err)
+	}
+	s.exports.tasks = make(chan exportTask)
+	s.exports.remaining = make(map[primitive.ObjectID]int)
+	return nil
+}
+
+// startExports starts the export workers, and resumes the exports this
+// instance was building when it last stopped.
+func (s *Server) startExports(ctx context.Context) {
+	s.exports.ctx = ctx
+	for i := 0; i < exportWorkers; i++ {
+		go s.exportWorker(ctx)
+	}
+	go s.resumeExports(ctx)
+}
+
+func (s *Server) resumeExports(ctx context.Context) {
+	filter := bson.M{"host": exportHost, "status": bson.M{"$in": bson.A{exportQueued, exportRunning}}}
+	cursor, err := s.store.Exports.Find(ctx, filter)
+	if err != nil {
+		s.logger.Printf("error finding interrupted exports: %v", err)
+		return
+	}
+	var interrupted []Export
+	if err := cursor.All(ctx, &interrupted); err != nil {
+		s.logger.Printf("error finding interrupted exports: %v", err)
+		return
+	}
+	for i := range interrupted {
+		s.logger.Printf("Resuming export %s of %s", interrupted[i].ID.Hex(), interrupted[i].Deployment)
+		s.queueExport(ctx, &interrupted[i])
+	}
+}
+
+// queueExport hands the files an export has still to write to the workers.
+func (s *Server) queueExport(ctx context.Context, export *Export) {
+	var pending []int
+	for i, f := range export.Files {
+		if !f.Done {
+			pending = append(pending, i)
+		}
+	}
+	s.exports.mu.Lock()
+	s.exports.remaining[export.ID] = len(pending)
+	s.exports.mu.Unlock()
+	if len(pending) == 0 {
+		go s.finishExport(ctx, export)
+		return
+	}
+	go func() {
+		for _, i := range pending {
+			select {
+			case s.exports.tasks <- exportTask{export: export, file: i}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) exportWorker(ctx context.Context) {
+	for {
+		var task exportTask
+		select {
+		case <-ctx.Done():
+			return
+		case task = <-s.exports.tasks:
+		}
+		export := task.export
+
+		s.exports.mu.Lock()
+		status := export.Status
+		if status == exportQueued {
+			export.Status = exportRunning
+		}
+		s.exports.mu.Unlock()
+		if status == exportFailed {
+			continue
+		}
+
+		err := s.exportFile(ctx, export, task.file)
+		if ctx.Err() != nil {
+			// Resumed at the next start
+			return
+		}
+		if err != nil {
+			s.exports.mu.Lock()
+			name := export.Files[task.file].Name
+			s.exports.mu.Unlock()
+			s.failExport(ctx, export, fmt.Errorf("error writing %s: %v", name, err))
+			continue
+		}
+
+		s.exports.mu.Lock()
+		s.exports.remaining[export.ID]--
+		finished := s.exports.remaining[export.ID] == 0
+		s.exports.mu.Unlock()
+		if finished {
+			s.finishExport(ctx, export)
+		}
+	}
+}
+
+func exportPath(export *Export, name string) string {
+	return filepath.Join(exportsDir, export.ID.Hex(), name)
+}
+
+// exportFile writes an archive file a page of records at a time, from
+// where the export's saved progress says it got to.
+func (s *Server) exportFile(ctx context.Context, export *Export, i int) error {
+	s.exports.mu.Lock()
+	progress := export.Files[i]
+	s.exports.mu.Unlock()
+	var src archiveSource
+	for _, candidate := range s.archiveSources(export.Deployment) {
+		if candidate.name == progress.Name {
+			src = candidate
+		}
+	}
+	if src.coll == nil {
+		return fmt.Errorf("unknown archive file")
+	}
+
+	path := exportPath(export, progress.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < progress.Size {
+		// The file was lost, so start it again
+		progress.Size, progress.Records, progress.LastID = 0, 0, nil
+	}
+	// Drop anything written after the last saved page
+	if err := f.Truncate(progress.Size); err != nil {
+		return err
+	}
+	if _, err := f.Seek(progress.Size, io.SeekStart); err != nil {
+		return err
+	}
+
+	for !progress.Done {
+		filter := src.filter
+		if progress.LastID != nil {
+			filter = bson.M{"$and": bson.A{src.filter, bson.M{"_id": bson.M{"$gt": progress.LastID}}}}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(exportPageSize)
+		cursor, err := src.coll.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		buf := bufio.NewWriter(f)
+		enc := json.NewEncoder(buf)
+		var n int64
+		for cursor.Next(ctx) {
+			if err := src.encode(cursor, enc); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			var id interface{}
+			if err := cursor.Current.Lookup("_id").Unmarshal(&id); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			progress.LastID = id
+			n++
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+
+		if progress.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		progress.Records += n
+		progress.Done = n < exportPageSize
+		s.saveExport(ctx, export, func() { export.Files[i] = progress })
+	}
+	return nil
+}
+
+// saveExport applies update to the export and saves it. A failure to save
+// is logged, costing only the progress made since the last save.
+func (s *Server) saveExport(ctx context.Context, export *Export, update func()) {
+	s.exports.saveMu.Lock()
+	defer s.exports.saveMu.Unlock()
+	s.exports.mu.Lock()
+	update()
+	export.UpdatedAt = time.Now().UTC()
+	snapshot := *export
+	snapshot.Files = append([]ExportFile(nil), export.Files...)
+	s.exports.mu.Unlock()
+
+	if _, err := s.store.Exports.ReplaceOne(ctx, bson.M{"_id": snapshot.ID}, snapshot); err != nil {
+		s.logger.Printf("error saving export %s: %v", snapshot.ID.Hex(), err)
+	}
+}
+
+func (s *Server) failExport(ctx context.Context, export *Export, err error) {
+	s.logger.Printf("export %s of %s failed: %v", export.ID.Hex(), export.Deployment, err)
+	now := time.Now().UTC()
+	s.saveExport(ctx, export, func() {
+		export.Status, export.Error, export.FinishedAt = exportFailed, err.Error(), &now
+	})
+	s.exports.mu.Lock()
+	delete(s.exports.remaining, export.ID)
+	s.exports.mu.Unlock()
+}
+
+// finishExport packs an export's files, with their manifest and platform
+// metadata, into the archive, and removes the files.
+func (s *Server) finishExport(ctx context.Context, export *Export) {
+	dir := filepath.Join(exportsDir, export.ID.Hex())
+	a := &archiveWriter{dir: dir}
+	s.exports.mu.Lock()
+	files := append([]ExportFile(nil), export.Files...)
+	s.exports.mu.Unlock()
+	for _, f := range files {
+		file, err := hashExportFile(exportPath(export, f.Name))
+		if err != nil {
+			s.failExport(ctx, export, err)
+			return
+		}
+		file.Name, file.Records = f.Name, f.Records
+		a.files = append(a.files, file)
+	}
+	if err := s.writeArchivePlatforms(ctx, a, export.Deployment); err != nil {
+		s.failExport(ctx, export, fmt.Errorf("error writing platforms.json: %v", err))
+		return
+	}
+
+	manifest := ArchiveManifest{
+		Format:     archiveFormat,
+		Version:    archiveVersion,
+		Deployment: export.Deployment,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	path := exportPath(export, export.Deployment+".tar.gz")
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		s.failExport(ctx, export, err)
+		return
+	}
+	err = writeArchive(out, a, manifest)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		s.failExport(ctx, export, fmt.Errorf("error writing archive: %v", err))
+		return
+	}
+	for _, f := range a.files {
+		os.Remove(filepath.Join(dir, f.Name))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		s.failExport(ctx, export, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	s.saveExport(ctx, export, func() {
+		export.Status, export.Size, export.FinishedAt = exportSucceeded, info.Size(), &now
+	})
+	s.exports.mu.Lock()
+	delete(s.exports.remaining, export.ID)
+	s.exports.mu.Unlock()
+	s.logger.Printf("Export %s of %s finished (%d bytes)", export.ID.Hex(), export.Deployment, info.Size())
+}
+
+func hashExportFile(path string) (ArchiveFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ArchiveFile{}, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return ArchiveFile{}, err
+	}
+	return ArchiveFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// handleCreateExport starts building a deployment's archive in the
+// background.
+func (s *Server) handleCreateExport(c *gin.Context) {
+	deployment := c.Param("deployment")
+	ctx := c.Request.Context()
+	n, err := s.store.Locations.CountDocuments(ctx, bson.M{"deployment": deployment}, options.Count().SetLimit(1))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if n == 0 {
+		respondErrorf(c, http.StatusNotFound, "deployment has no locations")
+		return
+	}
+
+	now := time.Now().UTC()
+	export := &Export{
+		ID:         primitive.NewObjectID(),
+		Deployment: deployment,
+		Status:     exportQueued,
+		Host:       exportHost,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	for _, src := range s.archiveSources(deployment) {
+		total, err := src.coll.CountDocuments(ctx, src.filter)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		export.Files = append(export.Files, ExportFile{Name: src.name, Total: total})
+	}
+	if _, err := s.store.Exports.InsertOne(ctx, export); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	snapshot := *export
+	s.queueExport(s.exports.ctx, export)
+	c.JSON(http.StatusAccepted, snapshot)
+}
+
+// findExport loads the export named in the request, responding with an
+// error if there isn't one.
+func (s *Server) findExport(c *gin.Context) (*Export, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid export id")
+		return nil, false
+	}
+	var export Export
+	err = s.store.Exports.FindOne(c.Request.Context(), bson.M{"_id": id}).Decode(&export)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "export not found")
+		return nil, false
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return &export, true
+}
+
+func (s *Server) handleGetExports(c *gin.Context) {
+	filter := bson.M{}
+	if deployment := c.Query("deployment"); deployment != "" {
+		filter["deployment"] = deployment
+	}
+	cursor, err := s.store.Exports.Find(c.Request.Context(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	exports := []Export{}
+	if err := cursor.All(c.Request.Context(), &exports); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, exports)
+}
+
+func (s *Server) handleGetExport(c *gin.Context) {
+	if export, ok := s.findExport(c); ok {
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+func (s *Server) handleDownloadExport(c *gin.Context) {
+	export, ok := s.findExport(c)
+	if !ok {
+		return
+	}
+	if export.Status != exportSucceeded {
+		respondErrorf(c, http.StatusConflict, "export is %s", export.Status)
+		return
+	}
+	if export.Host != exportHost {
+		respondErrorf(c, http.StatusConflict, "export is held by %s", export.Host)
+		return
+	}
+	disableWriteTimeout(c)
+	c.FileAttachment(exportPath(export, export.Deployment+".tar.gz"), export.Deployment+".tar.gz")
+}
+
+// handleDeleteExport removes a finished or failed export and its archive.
+func (s *Server) handleDeleteExport(c *gin.Context) {
+	export, ok := s.findExport(c)
+	if !ok {
+		return
+	}
+	if export.Status == exportQueued || export.Status == exportRunning {
+		respondErrorf(c, http.StatusConflict, "export is %s", export.Status)
+		return
+	}
+	if export.Host == exportHost {
+		if err := os.RemoveAll(filepath.Join(exportsDir, export.ID.Hex())); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if _, err := s.store.Exports.DeleteOne(c.Request.Context(), bson.M{"_id": export.ID}); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// How long the deployments and platforms with stored fixes are cached.
+// Writes through this gateway update the cache at once; the lifetime bounds
+// how long writes from other gateways sharing the database go unseen.
+// Caching is disabled while it is zero.
+var facetCacheTTL = time.Minute
+
+func initFacetCache() error {
+	if v := os.Getenv("FACET_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid FACET_CACHE_TTL %q", v)
+		}
+		facetCacheTTL = d
+	}
+	return nil
+}
+
+// facetCache holds the platforms with stored fixes in each deployment, so
+// listing deployments and platforms doesn't scan the locations collection
+// on every dashboard load. Fixes stored add to it; deleting or moving fixes
+// may empty a platform, so drops it to be reloaded.
+type facetCache struct {
+	mu sync.Mutex
+	// Platforms by deployment; nil until loaded
+	platforms map[string]map[string]bool
+	loadedAt  time.Time
+	// Counts invalidations, so a load that overlapped one isn't kept
+	generation int
+}
+
+// added records that a fix was stored for the platform.
+func (f *facetCache) added(deployment, platform string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.platforms == nil {
+		return
+	}
+	if f.platforms[deployment] == nil {
+		f.platforms[deployment] = make(map[string]bool)
+	}
+	f.platforms[deployment][platform] = true
+}
+
+// invalidate drops the cache after fixes were deleted or moved.
+func (f *facetCache) invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.platforms = nil
+	f.generation++
+}
+
+// facets returns the platforms by deployment, loading them with one pass
+// over the locations collection if they aren't cached. The result must not
+// be modified.
+func (s *Server) facets(ctx context.Context) (map[string]map[string]bool, error) {
+	f := &s.facetCache
+	f.mu.Lock()
+	if f.platforms != nil && time.Since(f.loadedAt) < facetCacheTTL {
+		platforms := copyFacets(f.platforms)
+		f.mu.Unlock()
+		return platforms, nil
+	}
+	generation := f.generation
+	f.mu.Unlock()
+
+	// Sorting on the index prefix lets MongoDB answer from the index
+	cursor, err := s.store.Locations.Aggregate(ctx, []bson.M{
+		{"$sort": bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}}},
+		{"$group": bson.M{"_id": bson.M{"deployment": "$deployment", "platform": "$platform"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pairs []struct {
+		ID struct {
+			Deployment string `bson:"deployment"`
+			Platform   string `bson:"platform"`
+		} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &pairs); err != nil {
+		return nil, err
+	}
+	platforms := make(map[string]map[string]bool)
+	for _, p := range pairs {
+		if platforms[p.ID.Deployment] == nil {
+			platforms[p.ID.Deployment] = make(map[string]bool)
+		}
+		platforms[p.ID.Deployment][p.ID.Platform] = true
+	}
+
+	f.mu.Lock()
+	if facetCacheTTL > 0 && f.generation == generation {
+		f.platforms = platforms
+		f.loadedAt = time.Now()
+		platforms = copyFacets(platforms)
+	}
+	f.mu.Unlock()
+	return platforms, nil
+}
+
+func copyFacets(platforms map[string]map[string]bool) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(platforms))
+	for deployment, set := range platforms {
+		out[deployment] = make(map[string]bool, len(set))
+		for platform := range set {
+			out[deployment][platform] = true
+		}
+	}
+	return out
+}
+
+// deployments lists the deployments with fixes the credential may read, in
+// order.
+func (s *Server) deployments(ctx context.Context, cred *Credential) ([]string, error) {
+	facets, err := s.facets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deployments := []string{}
+	for deployment, platforms := range facets {
+		for platform := range platforms {
+			if grantAllows(cred, deployment, platform) {
+				deployments = append(deployments, deployment)
+				break
+			}
+		}
+	}
+	sort.Strings(deployments)
+	return deployments, nil
+}
+
+// platforms lists the platforms with fixes in a deployment that the
+// credential may read, in order.
+func (s *Server) platforms(ctx context.Context, deployment string, cred *Credential) ([]string, error) {
+	facets, err := s.facets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	platforms := []string{}
+	for platform := range facets[deployment] {
+		if grantAllows(cred, deployment, platform) {
+			platforms = append(platforms, platform)
+		}
+	}
+	sort.Strings(platforms)
+	return platforms, nil
+}
@@ -0,0 +1,200 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Subsystems that can be switched off, so instances run from the same
+// binary, such as ship and shore, can offer different surface areas
+const (
+	featureAlerts  = "alerts"
+	featureGraphQL = "graphql"
+	featureRender  = "render"
+	featureReports = "reports"
+	featureStream  = "stream"
+	featureTiles   = "tiles"
+)
+
+var featureDescriptions = map[string]string{
+	featureAlerts:  "Raising, storing and sending alerts",
+	featureGraphQL: "The /graphql endpoint",
+	featureRender:  "Track images from /api/render",
+	featureReports: "Scheduled reports and the /api/reports endpoints",
+	featureStream:  "Live and replayed fixes from /api/stream and /api/replay",
+	featureTiles:   "Basemap tiles from /tiles/basemap",
+}
+
+// Feature is whether a subsystem is enabled: by default as configured with
+// FEATURES_DISABLED, unless an admin has overridden it.
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	// Set through PUT /admin/features
+	Override *bool `json:"override,omitempty"`
+}
+
+// featureSettings are the overrides an admin has set, stored so they
+// survive restarts and are shared by every gateway instance.
+type featureSettings struct {
+	Overrides map[string]bool `bson:"overrides"`
+	UpdatedAt time.Time       `bson:"updated_at"`
+}
+
+const featuresDocumentID = "features"
+
+// featureState is which features a server has switched off.
+type featureState struct {
+	mu sync.RWMutex
+	// Features disabled by FEATURES_DISABLED
+	disabled  map[string]bool
+	overrides map[string]bool
+}
+
+func (s *Server) initFeatures() error {
+	disabled := map[string]bool{}
+	if v := os.Getenv("FEATURES_DISABLED"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := featureDescriptions[name]; !ok {
+				return fmt.Errorf("invalid FEATURES_DISABLED: unknown feature %q", name)
+			}
+			disabled[name] = true
+		}
+	}
+	s.features.mu.Lock()
+	s.features.disabled = disabled
+	s.features.mu.Unlock()
+	return nil
+}
+
+func (s *Server) initFeatureOverrides() error {
+	if err := s.loadFeatures(context.Background()); err != nil {
+		return fmt.Errorf("error loading feature overrides: %v", err)
+	}
+	return nil
+}
+
+// loadFeatures reads the stored overrides. Overrides of features this
+// version doesn't have are ignored.
+func (s *Server) loadFeatures(ctx context.Context) error {
+	var settings featureSettings
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": featuresDocumentID}).Decode(&settings)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	overrides := map[string]bool{}
+	for name, enabled := range settings.Overrides {
+		if _, ok := featureDescriptions[name]; ok {
+			overrides[name] = enabled
+		}
+	}
+
+	s.features.mu.Lock()
+	s.features.overrides = overrides
+	s.features.mu.Unlock()
+	return nil
+}
+
+func (s *Server) featureEnabled(name string) bool {
+	s.features.mu.RLock()
+	defer s.features.mu.RUnlock()
+	if enabled, ok := s.features.overrides[name]; ok {
+		return enabled
+	}
+	return !s.features.disabled[name]
+}
+
+func (s *Server) featureList() []Feature {
+	s.features.mu.RLock()
+	defer s.features.mu.RUnlock()
+	list := make([]Feature, 0, len(featureDescriptions))
+	for name, description := range featureDescriptions {
+		f := Feature{Name: name, Description: description, Default: !s.features.disabled[name]}
+		f.Enabled = f.Default
+		if enabled, ok := s.features.overrides[name]; ok {
+			f.Enabled, f.Override = enabled, &enabled
+		}
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// requireFeature answers requests for a disabled feature's endpoints as if
+// they didn't exist.
+func (s *Server) requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.featureEnabled(name) {
+			err := &codedError{code: codeNotFound, err: fmt.Errorf("feature %s is disabled", name), details: map[string]interface{}{"feature": name}}
+			abortError(c, http.StatusNotFound, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) handleGetFeatures(c *gin.Context) {
+	c.JSON(http.StatusOK, s.featureList())
+}
+
+// handleSetFeatures overrides whether features are enabled. A feature set
+// to null goes back to its default; features left out are unchanged.
+func (s *Server) handleSetFeatures(c *gin.Context) {
+	var req map[string]*bool
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	for name := range req {
+		if _, ok := featureDescriptions[name]; !ok {
+			respondErrorf(c, http.StatusBadRequest, "unknown feature %q", name)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	if err := s.loadFeatures(ctx); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	s.features.mu.RLock()
+	overrides := make(map[string]bool, len(s.features.overrides))
+	for name, enabled := range s.features.overrides {
+		overrides[name] = enabled
+	}
+	s.features.mu.RUnlock()
+	for name, enabled := range req {
+		if enabled == nil {
+			delete(overrides, name)
+		} else {
+			overrides[name] = *enabled
+		}
+	}
+
+	settings := featureSettings{Overrides: overrides, UpdatedAt: time.Now().UTC()}
+	_, err := s.store.Settings.ReplaceOne(ctx, bson.M{"_id": featuresDocumentID}, settings, options.Replace().SetUpsert(true))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.features.mu.Lock()
+	s.features.overrides = overrides
+	s.features.mu.Unlock()
+
+	c.JSON(http.StatusOK, s.featureList())
+}
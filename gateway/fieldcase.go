@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How response fields are named
+const (
+	caseSnake = "snake"
+	caseCamel = "camel"
+)
+
+var responseCase = caseSnake
+
+// Fields whose objects are keyed by names platforms chose or by values, such
+// as comms paths and QC flags, which are left as they are
+var verbatimFields = map[string]bool{
+	"data":      true,
+	"details":   true,
+	"comms":     true,
+	"qc_flags":  true,
+	"records":   true,
+	"fields":    true,
+	"params":    true,
+	"variables": true,
+}
+
+// Paths whose responses are shaped by the request rather than the gateway
+var uncasedPaths = map[string]bool{"/graphql": true}
+
+const responseCaseKey = "response_case"
+
+func initResponseCase() error {
+	if v := os.Getenv("RESPONSE_FIELD_CASE"); v != "" {
+		if v != caseSnake && v != caseCamel {
+			return fmt.Errorf("invalid RESPONSE_FIELD_CASE %q (expected snake or camel)", v)
+		}
+		responseCase = v
+	}
+	return nil
+}
+
+// fieldCase renames the fields of JSON responses to camelCase when the
+// request's case parameter, or RESPONSE_FIELD_CASE, asks for it. Responses
+// that aren't JSON pass through as they are; streaming handlers rename the
+// fields of each value they send with casedValue.
+func fieldCase() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fieldCase := responseCase
+		if v := c.Query("case"); v != "" {
+			if v != caseSnake && v != caseCamel {
+				abortError(c, http.StatusBadRequest, fmt.Errorf("invalid case %q (expected snake or camel)", v))
+				return
+			}
+			fieldCase = v
+		}
+		if fieldCase != caseCamel || uncasedPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		c.Set(responseCaseKey, caseCamel)
+		w := &caseWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if w.buffering {
+			body, err := camelJSON(w.body.Bytes())
+			if err != nil {
+				// Better the fields as named than no response
+				body = w.body.Bytes()
+			}
+			w.ResponseWriter.Write(body)
+		}
+	}
+}
+
+// caseWriter holds back a JSON response body so its fields can be renamed
+// once it is complete.
+type caseWriter struct {
+	gin.ResponseWriter
+	decided   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (w *caseWriter) decide() {
+	if !w.decided {
+		w.decided = true
+		w.buffering = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+		if w.buffering {
+			// Renaming changes the length
+			w.Header().Del("Content-Length")
+		}
+	}
+}
+
+func (w *caseWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.buffering {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *caseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *caseWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Unwrap lets http.ResponseController reach the connection, for streaming
+// handlers.
+func (w *caseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// casedValue returns v with its fields named as the response's are, for
+// handlers that encode values themselves.
+func casedValue(c *gin.Context, v interface{}) interface{} {
+	if c.GetString(responseCaseKey) != caseCamel {
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	cased, err := camelJSON(data)
+	if err != nil {
+		return v
+	}
+	return json.RawMessage(cased)
+}
+
+// camelJSON renames the fields of a JSON document to camelCase, keeping
+// their order and values.
+func camelJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		if err := copyCamel(dec, &out, false); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// copyCamel copies the next JSON value from dec to out, renaming object
+// keys unless verbatim.
+func copyCamel(dec *json.Decoder, out *bytes.Buffer, verbatim bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			out.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				if err := copyCamel(dec, out, verbatim); err != nil {
+					return err
+				}
+			}
+			out.WriteByte(']')
+		} else {
+			out.WriteByte('{')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := tok.(string)
+				name := key
+				if !verbatim {
+					name = camelCase(key)
+				}
+				writeJSONString(out, name)
+				out.WriteByte(':')
+				if err := copyCamel(dec, out, verbatim || verbatimFields[key]); err != nil {
+					return err
+				}
+			}
+			out.WriteByte('}')
+		}
+		// The closing delimiter
+		_, err := dec.Token()
+		return err
+	case string:
+		writeJSONString(out, tok)
+	case json.Number:
+		out.WriteString(tok.String())
+	case bool:
+		fmt.Fprint(out, tok)
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+func writeJSONString(out *bytes.Buffer, s string) {
+	data, _ := json.Marshal(s)
+	out.Write(data)
+}
+
+// camelCase converts a snake_case name to camelCase.
+func camelCase(name string) string {
+	if !strings.Contains(name, "_") {
+		return name
+	}
+	parts := strings.Split(name, "_")
+	var b strings.Builder
+	b.WriteString(parts[0])
+	for _, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
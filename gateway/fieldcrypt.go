@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of encrypted field values, followed by the key ID and the sealed
+// value. Values without it were stored before encryption was configured.
+const sealedPrefix = "enc1:"
+
+// fieldKey is a key fields are encrypted with, named by an ID stored with
+// each value so keys can be rotated.
+type fieldKey struct {
+	id   string
+	aead cipher.AEAD
+	// Derives the nonces of deterministically encrypted values
+	nonceKey []byte
+}
+
+// fieldKeyring holds the keys for field encryption, the first encrypting
+// new values; it is empty if field encryption isn't configured.
+type fieldKeyring []*fieldKey
+
+func (s *Server) initFieldEncryption() error {
+	spec := os.Getenv("FIELD_ENCRYPTION_KEYS")
+	if path := os.Getenv("FIELD_ENCRYPTION_KEYS_FILE"); path != "" {
+		if spec != "" {
+			return fmt.Errorf("set FIELD_ENCRYPTION_KEYS or FIELD_ENCRYPTION_KEYS_FILE, not both")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading FIELD_ENCRYPTION_KEYS_FILE: %v", err)
+		}
+		spec = string(data)
+	}
+
+	keys, err := parseFieldKeys(spec)
+	if err != nil {
+		return fmt.Errorf("invalid field encryption keys: %v", err)
+	}
+	s.fieldKeys = keys
+	return nil
+}
+
+// parseFieldKeys reads keys written as id:base64, separated by commas or
+// newlines, each 32 random bytes.
+func parseFieldKeys(spec string) (fieldKeyring, error) {
+	var keys fieldKeyring
+	ids := make(map[string]bool)
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || strings.ContainsAny(id, ": ") {
+			return nil, fmt.Errorf("expected id:base64 key, got %q", entry)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		ids[id] = true
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, base64 encoded", id)
+		}
+
+		block, err := aes.NewCipher(deriveKey(secret, "encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &fieldKey{id: id, aead: aead, nonceKey: deriveKey(secret, "nonce")})
+	}
+	return keys, nil
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// seal encrypts a value with key. Deterministic encryption gives the same
+// value the same ciphertext, so it can be looked up, at the cost of showing
+// which records share a value.
+func (key *fieldKey) seal(plain string, deterministic bool) (string, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, key.nonceKey)
+		mac.Write([]byte(plain))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(plain), []byte(key.id))
+	return sealedPrefix + key.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// seal encrypts a value with the current key, if there is one.
+func (keys fieldKeyring) seal(plain string, deterministic bool) (string, error) {
+	if len(keys) == 0 || plain == "" {
+		return plain, nil
+	}
+	return keys[0].seal(plain, deterministic)
+}
+
+// currentID returns the ID of the key new values are encrypted with, or ""
+// if there is none.
+func (keys fieldKeyring) currentID() string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0].id
+}
+
+// open decrypts a stored value, passing values stored before encryption
+// was configured through as they are.
+func (keys fieldKeyring) open(stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	id, encoded, _ := strings.Cut(rest, ":")
+	for _, key := range keys {
+		if key.id != id {
+			continue
+		}
+		sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return "", errors.New("malformed encrypted field")
+		}
+		n := key.aead.NonceSize()
+		plain, err := key.aead.Open(nil, sealed[:n], sealed[n:], []byte(id))
+		if err != nil {
+			return "", fmt.Errorf("error decrypting field with key %q: %v", id, err)
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("field is encrypted with key %q, which isn't configured", id)
+}
+
+// lookupValues returns the values a deterministically encrypted field
+// holding plain may be stored as: under each key, and as it is if it was
+// stored before encryption was configured.
+func (keys fieldKeyring) lookupValues(plain string) ([]string, error) {
+	values := []string{plain}
+	for _, key := range keys {
+		sealed, err := key.seal(plain, true)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, sealed)
+	}
+	return values, nil
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// locationFields lists the Location fields that clients may select with ?fields=.
+var locationFields = map[string]bool{
+	"id":          true,
+	"uuid":        true,
+	"deployment":  true,
+	"platform":    true,
+	"latitude":    true,
+	"longitude":   true,
+	"timestamp":   true,
+	"source":      true,
+	"crs":         true,
+	"original":    true,
+	"speed":       true,
+	"course":      true,
+	"heading":     true,
+	"pitch":       true,
+	"roll":        true,
+	"qc":          true,
+	"backfilled":  true,
+	"received_at": true,
+	"latency":     true,
+	"comms_path":  true,
+	"created_at":  true,
+}
+
+// withPageFields adds the _id and timestamp pages are ordered by to a
+// projection, returning those that weren't selected, to be removed from the
+// results.
+func withPageFields(projection bson.D) (bson.D, []string) {
+	var unselected []string
+	fields := bson.D{}
+	hasTimestamp := false
+	for _, e := range projection {
+		switch e.Key {
+		case "_id":
+			unselected = append(unselected, "_id")
+			continue
+		case "timestamp":
+			hasTimestamp = true
+		}
+		fields = append(fields, e)
+	}
+	if !hasTimestamp {
+		fields = append(fields, bson.E{Key: "timestamp", Value: 1})
+		unselected = append(unselected, "timestamp")
+	}
+	return fields, unselected
+}
+
+// parseFields turns a comma-separated field list into a Mongo projection.
+// It returns a nil projection when no fields were requested.
+func parseFields(param string) (bson.D, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	projection := bson.D{}
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !locationFields[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if seen[field] {
+			continue
+		}
+		seen[field] = true
+		if field == "id" {
+			continue
+		}
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("no fields selected")
+	}
+	// Mongo includes _id unless it is explicitly excluded
+	if !seen["id"] {
+		projection = append(projection, bson.E{Key: "_id", Value: 0})
+	}
+	return projection, nil
+}
@@ -0,0 +1,24 @@
+package gateway_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"data-gateway/gatewaytest"
+)
+
+// TestFixtures replays the recorded requests in testdata/fixtures through
+// the gateway and checks what it stores against their golden files.
+func TestFixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/fixtures/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			gatewaytest.Replay(t, path)
+		})
+	}
+}
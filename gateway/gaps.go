@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Gap is an interval during which a platform did not report for longer than
+// the requested threshold.
+type Gap struct {
+	Deployment string        `json:"deployment"`
+	Platform   string        `json:"platform"`
+	Start      string        `json:"start"`
+	End        string        `json:"end"`
+	Duration   string        `json:"duration"`
+	Seconds    float64       `json:"seconds"`
+	Before     *api.Location `json:"before,omitempty"`
+	After      *api.Location `json:"after,omitempty"`
+
+	// The fix ending the gap, where the next page of gaps starts
+	afterID primitive.ObjectID
+}
+
+// Gaps are listed by platform, then by the fix ending them
+const gapOrder = "platform,end,_id"
+
+// gapCursor marks the gap a page ended with, by its platform and the fix
+// ending it.
+type gapCursor struct {
+	Platform  string             `json:"p"`
+	Timestamp string             `json:"v"`
+	ID        primitive.ObjectID `json:"id"`
+}
+
+func (g Gap) cursor() string {
+	data, _ := json.Marshal(gapCursor{Platform: g.Platform, Timestamp: g.End, ID: g.afterID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseGapCursor(v string) (*gapCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid after cursor")
+	}
+	var cur gapCursor
+	if err := json.Unmarshal(data, &cur); err != nil || cur.Platform == "" {
+		return nil, fmt.Errorf("invalid after cursor")
+	}
+	return &cur, nil
+}
+
+// findGaps scans a platform's fixes in timestamp order and returns every
+// interval between consecutive fixes longer than minGap, starting from the
+// fix ending the gap from, if given, and stopping after max gaps unless max
+// is zero. Fixes with unparseable timestamps are skipped.
+func (s *Server) findGaps(ctx context.Context, deployment, platform string, minGap time.Duration, withPositions bool, from *gapCursor, max int64) ([]Gap, error) {
+	opts := options.Find().SetSort(timestampOrder.sort())
+	if !withPositions {
+		opts.SetProjection(bson.M{"timestamp": 1})
+	}
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	if from != nil {
+		// The scan starts at the fix ending the gap, which starts the next
+		// gap if any does
+		filter = bson.M{"$and": []bson.M{filter, {"$or": []bson.M{
+			{"timestamp": bson.M{"$gt": from.Timestamp}},
+			{"timestamp": from.Timestamp, "_id": bson.M{"$gte": from.ID}},
+		}}}}
+	}
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	gaps := []Gap{}
+	var prev *api.Location
+	var prevTime time.Time
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return nil, err
+		}
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+
+		if prev != nil {
+			if d := t.Sub(prevTime); d > minGap {
+				gap := Gap{
+					Deployment: deployment,
+					Platform:   platform,
+					Start:      prev.Timestamp,
+					End:        location.Timestamp,
+					Duration:   d.String(),
+					Seconds:    d.Seconds(),
+					afterID:    location.ID,
+				}
+				if withPositions {
+					before, after := *prev, location
+					gap.Before = &before
+					gap.After = &after
+				}
+				gaps = append(gaps, gap)
+				if max > 0 && int64(len(gaps)) == max {
+					break
+				}
+			}
+		}
+
+		current := location
+		prev = &current
+		prevTime = t
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return gaps, nil
+}
+
+func (s *Server) handleGetGaps(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	minGap := 5 * time.Minute
+	if v := c.Query("minGap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid minGap %q", v)
+			return
+		}
+		minGap = d
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	var from *gapCursor
+	if v := c.Query("after"); v != "" {
+		if offset > 0 {
+			respondErrorf(c, http.StatusBadRequest, "after cannot be combined with offset")
+			return
+		}
+		if from, err = parseGapCursor(v); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+
+	// Check every platform in the deployment unless one was requested
+	var platforms []string
+	if platform := c.Query("platform"); platform != "" {
+		if !canRead(c, deployment, platform) {
+			respondErrorf(c, http.StatusForbidden, "access to platform denied")
+			return
+		}
+		platforms = []string{platform}
+	} else {
+		var err error
+		if platforms, err = s.platforms(ctx, deployment, requestCredential(c)); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	sort.Strings(platforms)
+
+	// Without a limit given, one more gap than the default is looked for, to
+	// tell whether there are more than it allows
+	want := offset + limit
+	if !explicitLimit {
+		want++
+	}
+	gaps := []Gap{}
+	for _, platform := range platforms {
+		if from != nil && platform < from.Platform {
+			continue
+		}
+		start := from
+		if from != nil && platform != from.Platform {
+			start = nil
+		}
+		platformGaps, err := s.findGaps(ctx, deployment, platform, minGap, true, start, want-int64(len(gaps)))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		gaps = append(gaps, platformGaps...)
+		if int64(len(gaps)) >= want {
+			break
+		}
+	}
+	if int64(len(gaps)) > offset {
+		gaps = gaps[offset:]
+	} else {
+		gaps = gaps[:0]
+	}
+	if int64(len(gaps)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	c.Header("X-Sort-Order", gapOrder)
+	if explicitLimit && len(gaps) > 0 && int64(len(gaps)) == limit {
+		c.Header("X-Next-Cursor", gaps[len(gaps)-1].cursor())
+	}
+	for i := range gaps {
+		gaps[i].Start = formatTimestamp(gaps[i].Start, loc)
+		gaps[i].End = formatTimestamp(gaps[i].End, loc)
+		localizeLocation(gaps[i].Before, loc)
+		localizeLocation(gaps[i].After, loc)
+	}
+
+	c.JSON(http.StatusOK, gaps)
+}
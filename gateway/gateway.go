@@ -0,0 +1,1060 @@
+// Package gateway is the data gateway: it accepts position fixes and other
+// reports from robotic platforms, stores them in MongoDB, and serves them
+// back over HTTP. cmd/data-gateway runs it on its own; other programs can
+// embed it with New(cfg).Run(ctx).
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// initDB connects to MongoDB, unless the gateway was given a store, and
+// opens the collections.
+func (s *Server) initDB() error {
+	if s.store != nil {
+		return s.openCollections()
+	}
+
+	// The URI carries the credentials, so a rotated one is connected to
+	// and swapped in while the gateway runs
+	uri, err := loadSecret("MONGODB_URI", func(value string) error {
+		client, err := s.connectMongo(value)
+		if err != nil {
+			return err
+		}
+		s.store.Reconnect(client)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	client, err := s.connectMongo(uri.get())
+	if err != nil {
+		return err
+	}
+
+	dbName := os.Getenv("MONGODB_DATABASE")
+	if dbName == "" {
+		dbName = "robotics"
+	}
+	s.store = store.NewMongo(client, client.Database(dbName))
+	return s.openCollections()
+}
+
+// connectMongo connects to MongoDB at uri, or the default local server.
+func (s *Server) connectMongo(uri string) (*mongo.Client, error) {
+	if uri == "" {
+		uri = "mongodb://localhost:27017"
+	}
+	clientOptions := options.Client().ApplyURI(uri).SetMonitor(s.commandMonitor()).SetPoolMonitor(s.poolMonitor())
+	applyWriteConcern(clientOptions)
+	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MongoDB: %v", err)
+	}
+
+	// Check the connection
+	if err := client.Ping(context.Background(), nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("error pinging MongoDB: %v", err)
+	}
+	s.writeConcern, s.retryWrites = clientOptions.WriteConcern, clientOptions.RetryWrites
+	return client, nil
+}
+
+// ingestRequest is a submitted fix that has been through the ingest
+// pipeline and is ready to store.
+type ingestRequest struct {
+	location api.Location
+	// The stored fix being replaced in upsert mode
+	existing *api.Location
+	// The stored fix with the same UUID, when this is a resend
+	duplicate *api.Location
+	tz        *time.Location
+	warnings  []string
+	// The payload as received, and the format to parse it again from
+	raw       []byte
+	rawFormat string
+	// Webhooks to publish the fix to through the outbox, once it is stored
+	publish []string
+	// Whether the fix was recovered from a log after the fact, so is stored
+	// as backfill without checking its timestamp against its receipt
+	backfill bool
+	// Releases the platform's write lock, once the fix is stored
+	unlock func()
+}
+
+// release lets other writes of the platform's fixes proceed.
+func (req *ingestRequest) release() {
+	if req.unlock != nil {
+		req.unlock()
+		req.unlock = nil
+	}
+}
+
+// prepareIngest parses, authenticates, normalizes, and checks a submitted
+// fix. Errors come with the status to respond with, and the fix as far as it
+// was parsed. In a dry run, hooks are told not to act on the fix.
+func (s *Server) prepareIngest(c *gin.Context, dryRun bool) (*ingestRequest, int, error) {
+	req := &ingestRequest{}
+	location := &req.location
+	if err := c.ShouldBindBodyWith(location, binding.JSON); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	location.ReceivedAt = time.Now().UTC().Format(timestampLayout)
+	var err error
+	if location.CommsPath, err = resolveCommsPath(c, location.CommsPath); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+
+	// Authenticate payloads relayed through untrusted infrastructure
+	body, _ := c.Get(gin.BodyBytesKey)
+	if err := s.verifySignature(location.Platform, body.([]byte), c.GetHeader("X-Signature")); err != nil {
+		return req, http.StatusUnauthorized, err
+	}
+	req.raw, req.rawFormat = body.([]byte), payloadFormatLocation
+
+	if req.tz, err = requestTimezone(c); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+
+	if err := normalizeLocation(location, req.tz); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+
+	upsert, err := parseIngestMode(c)
+	if err != nil {
+		return req, http.StatusBadRequest, err
+	}
+
+	ctx := context.Background()
+	if dryRun {
+		ctx = withDryRun(ctx)
+	}
+	if status, err := s.processIngest(ctx, req, upsert); err != nil {
+		return req, status, err
+	}
+	return req, http.StatusOK, nil
+}
+
+func parseIngestMode(c *gin.Context) (upsert bool, err error) {
+	mode := c.DefaultQuery("mode", "insert")
+	if mode != "insert" && mode != "upsert" {
+		return false, fmt.Errorf("invalid mode %q (expected insert or upsert)", mode)
+	}
+	return mode == "upsert", nil
+}
+
+// processIngest runs a normalized fix through the checks and enrichment
+// that precede storage. Unless in a dry run, the platform is locked against
+// other writes until the caller releases the request, after storing it; on
+// error it is released already.
+func (s *Server) processIngest(ctx context.Context, req *ingestRequest, upsert bool) (status int, err error) {
+	location := &req.location
+	if !IsDryRun(ctx) {
+		req.unlock = s.platformLocks.lock(location.Deployment, location.Platform)
+		defer func() {
+			if err != nil {
+				req.release()
+			}
+		}()
+	}
+
+	// A fix sent again with the UUID of a stored fix is a resend, which is
+	// acknowledged with the stored fix unless upserting
+	if err := checkUUID(location); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if location.UUID != "" {
+		match, err := s.findByUUID(ctx, location.UUID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if match != nil && (match.Deployment != location.Deployment || match.Platform != location.Platform) {
+			return http.StatusConflict, fmt.Errorf("uuid %s belongs to a fix of %s/%s", location.UUID, match.Deployment, match.Platform)
+		}
+		if match != nil && !upsert {
+			req.duplicate = match
+			return http.StatusOK, nil
+		}
+		if match != nil {
+			req.existing = match
+			location.ID = match.ID
+		}
+	}
+
+	// Correct the timestamp first, so the fix is matched and derived at
+	// the corrected time
+	skewed := false
+	if !req.backfill {
+		if skewed, err = checkClockSkew(location); err != nil {
+			return http.StatusUnprocessableEntity, err
+		}
+		recordLatency(location)
+	}
+
+	// In upsert mode a fix replaces any existing one with the same
+	// deployment, platform, and timestamp, e.g. post-processed GPS
+	// replacing its real-time counterpart
+	if upsert && req.existing == nil {
+		var match api.Location
+		err := s.store.Locations.FindOne(ctx, bson.M{
+			"deployment": location.Deployment,
+			"platform":   location.Platform,
+			"timestamp":  location.Timestamp,
+		}).Decode(&match)
+		if err == nil {
+			req.existing = &match
+			location.ID = match.ID
+			if location.UUID == "" {
+				location.UUID = match.UUID
+			}
+		} else if err != mongo.ErrNoDocuments {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if location.UUID == "" && idStrategy == idStrategyUUID {
+		location.UUID = newUUID()
+	}
+
+	if err := s.deriveFields(ctx, location); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if req.backfill {
+		location.Backfilled = true
+	}
+	if skewed {
+		location.QC.Flags = append(location.QC.Flags, "clock_skew")
+		location.QC.Status = qcFlagged
+	}
+	if err := s.applyRules(location); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	warnings, err := runHooks(withOutbox(ctx, &req.publish), location)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	req.warnings = warnings
+	return http.StatusOK, nil
+}
+
+func (s *Server) handlePostLocation(c *gin.Context) {
+	req, status, err := s.prepareIngest(c, false)
+	if err != nil {
+		s.countIngest(c, &req.location, requestBodySize(c), status, err)
+		respondError(c, status, err)
+		return
+	}
+	defer req.release()
+
+	location, result, err := s.storeIngest(context.Background(), req)
+	s.countIngest(c, &req.location, requestBodySize(c), http.StatusInternalServerError, err)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("X-Ingest-Result", result)
+
+	// Acknowledge with the record as stored so clients can verify and reference it
+	localizeLocation(&location, req.tz)
+	c.JSON(http.StatusOK, location)
+}
+
+// storeIngest stores a processed fix, inserting it or replacing the fix it
+// upserts, and passes it on to stream subscribers, alerts, and towed
+// platforms. It returns the stored fix and whether it was inserted, updated,
+// or already stored under its UUID.
+func (s *Server) storeIngest(ctx context.Context, req *ingestRequest) (api.Location, string, error) {
+	var location api.Location
+	var result string
+	var err error
+	if len(req.publish) == 0 && len(req.location.Data) == 0 && req.existing == nil {
+		location, result, err = s.writeLocation(ctx, req)
+	} else {
+		// The fix is only stored with its telemetry and outbox entries
+		_, err = s.store.WithTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			if location, result, err = s.writeLocation(ctx, req); err != nil || result == "duplicate" {
+				return err
+			}
+			if len(location.Data) > 0 || req.existing != nil {
+				if err := s.storeTelemetry(ctx, &location); err != nil {
+					return fmt.Errorf("error storing telemetry: %v", err)
+				}
+			}
+			return s.enqueueOutbox(ctx, &location, req.publish)
+		})
+	}
+	if err != nil || result == "duplicate" {
+		return location, result, err
+	}
+	s.finishIngest(ctx, req, &location)
+	return location, result, nil
+}
+
+// writeLocation inserts a processed fix, or replaces the fix it upserts.
+func (s *Server) writeLocation(ctx context.Context, req *ingestRequest) (api.Location, string, error) {
+	if req.duplicate != nil {
+		return *req.duplicate, "duplicate", nil
+	}
+	location := req.location
+	location.CreatedAt = time.Now()
+
+	result := "inserted"
+	if req.existing != nil {
+		if _, err := s.store.Locations.ReplaceOne(ctx, bson.M{"_id": req.existing.ID}, location); err != nil {
+			return location, "", err
+		}
+		result = "updated"
+	} else {
+		res, err := s.store.Locations.InsertOne(ctx, location)
+		// Another gateway stored a resend of the fix first
+		if mongo.IsDuplicateKeyError(err) && location.UUID != "" {
+			if match, findErr := s.findByUUID(ctx, location.UUID); findErr == nil && match != nil {
+				return *match, "duplicate", nil
+			}
+		}
+		if err != nil {
+			return location, "", err
+		}
+		location.ID = res.InsertedID.(primitive.ObjectID)
+	}
+	return location, result, nil
+}
+
+// finishIngest records a newly stored fix in the change feed, and passes it
+// on to stream subscribers, alerts, and towed platforms.
+func (s *Server) finishIngest(ctx context.Context, req *ingestRequest, location *api.Location) {
+	if req.existing != nil {
+		s.recordChanges(ctx, locationChange(changeUpdate, location))
+	} else {
+		s.facetCache.added(location.Deployment, location.Platform)
+		s.recordChanges(ctx, locationChange(changeInsert, location))
+	}
+
+	event := streamEvent{Type: eventLocation, Location: *location}
+	if location.Backfilled {
+		event.Type = eventBackfill
+	}
+	s.publishStream(event)
+
+	if location.QC.Status == qcFlagged {
+		s.raiseAlert(qcAlert(location))
+	}
+
+	s.storeRawPayload(ctx, req, location)
+	if !req.backfill {
+		s.storeTowedFixes(ctx, location)
+	}
+}
+
+// handleValidateLocation runs a submission through the ingest pipeline
+// without storing it, and reports what would be stored. Submissions that
+// would be refused get 200 with valid set to false and the status the
+// ingest endpoint would respond with.
+func (s *Server) handleValidateLocation(c *gin.Context) {
+	req, status, err := s.prepareIngest(c, true)
+	if err != nil {
+		if status >= http.StatusInternalServerError {
+			respondError(c, status, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": false, "status": status, "error": err.Error(), "warnings": []string{}})
+		return
+	}
+
+	if req.duplicate != nil {
+		location := *req.duplicate
+		warnings := []string{fmt.Sprintf("would not be stored, as stored fix %s has the same uuid", location.ID.Hex())}
+		localizeLocation(&location, req.tz)
+		c.JSON(http.StatusOK, gin.H{"valid": true, "status": http.StatusOK, "result": "duplicate", "warnings": warnings, "location": location})
+		return
+	}
+
+	location := req.location
+	warnings := []string{}
+	result := "inserted"
+	if req.existing != nil {
+		result = "updated"
+		warnings = append(warnings, fmt.Sprintf("would replace stored fix %s", req.existing.ID.Hex()))
+	}
+	if location.QC != nil {
+		for _, flag := range location.QC.Flags {
+			warnings = append(warnings, fmt.Sprintf("flagged by quality check %s", flag))
+		}
+	}
+	if location.ReportedTimestamp != "" {
+		warnings = append(warnings, fmt.Sprintf("timestamp corrected for clock skew from %s", formatTimestamp(location.ReportedTimestamp, req.tz)))
+	}
+	if location.Backfilled {
+		warnings = append(warnings, fmt.Sprintf("received more than %s after its timestamp, so would be stored as backfill", s.lateDataThreshold))
+	}
+	warnings = append(warnings, req.warnings...)
+
+	localizeLocation(&location, req.tz)
+	c.JSON(http.StatusOK, gin.H{"valid": true, "status": http.StatusOK, "result": result, "warnings": warnings, "location": location})
+}
+
+// normalizeLocation brings a submitted location into its stored form: UTC
+// timestamps and WGS84 coordinates. Fields the gateway computes are cleared,
+// so what is stored is worked out from the fix as reported, whatever the
+// client sent for them.
+func normalizeLocation(location *api.Location, loc *time.Location) error {
+	clearComputedFields(location)
+	var err error
+
+	// Store timestamps in UTC regardless of the offset they were sent with
+	location.Timestamp, err = normalizeTimestamp(location.Timestamp, loc)
+	if err != nil {
+		return err
+	}
+
+	crs, err := parseCRS(location.CRS)
+	if err != nil {
+		return err
+	}
+	location.CRS = crs.Name
+
+	// Transform to WGS84, keeping the coordinates as submitted
+	if crs.Projected {
+		if location.X == nil || location.Y == nil {
+			return fmt.Errorf("x and y are required for projected CRS %s", crs.Name)
+		}
+		location.Original = &api.OriginalPosition{CRS: crs.Name, X: location.X, Y: location.Y}
+		location.Latitude, location.Longitude = crs.ToWGS84(*location.Y, *location.X)
+	} else if !crs.IsWGS84() {
+		lat, lon := location.Latitude, location.Longitude
+		location.Original = &api.OriginalPosition{CRS: crs.Name, Latitude: &lat, Longitude: &lon}
+		location.Latitude, location.Longitude = crs.ToWGS84(lat, lon)
+	}
+	location.X, location.Y = nil, nil
+
+	return normalizeAttitude(location)
+}
+
+// clearComputedFields drops whatever a client sent for the fields the
+// gateway sets itself as a fix is stored or returned.
+func clearComputedFields(location *api.Location) {
+	location.ID = primitive.NilObjectID
+	location.Original = nil
+	location.Speed, location.Course = nil, nil
+	location.QC, location.Backfilled = nil, false
+	location.UTM, location.Local, location.Smoothed, location.AlongTrack = nil, nil, nil, nil
+	location.Derived = nil
+	location.ReportedTimestamp, location.ClockSkew = "", nil
+	location.Latency = nil
+	location.CreatedAt = time.Time{}
+}
+
+// normalizeAttitude checks a reported heading, pitch, and roll, all in
+// degrees, wrapping the heading into [0, 360).
+func normalizeAttitude(location *api.Location) error {
+	if h := location.Heading; h != nil {
+		heading := math.Mod(math.Mod(*h, 360)+360, 360)
+		location.Heading = &heading
+	}
+	if p := location.Pitch; p != nil && !(*p >= -90 && *p <= 90) {
+		return fmt.Errorf("pitch must be between -90 and 90")
+	}
+	if r := location.Roll; r != nil && !(*r >= -180 && *r <= 180) {
+		return fmt.Errorf("roll must be between -180 and 180")
+	}
+	return nil
+}
+
+func (s *Server) handleGetLocations(c *gin.Context) {
+	deployment := c.Query("deployment")
+	platform := c.Query("platform")
+
+	filter := bson.M{}
+	if deployment != "" {
+		filter["deployment"] = deployment
+	}
+	if platform != "" {
+		filter["platform"] = platform
+	}
+
+	if q := c.Query("q"); q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid query: %v", err)
+			return
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+
+	projection, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid fields: %v", err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	coords, err := parseCoordinateOptions(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	smooth, err := parseSmoothOptions(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if smooth.method != "" && projection != nil {
+		respondErrorf(c, http.StatusBadRequest, "smooth cannot be combined with fields")
+		return
+	}
+
+	withAlongTrack, err := parseAlongTrack(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if withAlongTrack && projection != nil {
+		respondErrorf(c, http.StatusBadRequest, "alongTrack cannot be combined with fields")
+		return
+	}
+
+	sample, err := s.parseSample(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if sample > 0 && withAlongTrack {
+		respondErrorf(c, http.StatusBadRequest, "sample cannot be combined with alongTrack")
+		return
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	after, err := timestampOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(timestampOrder.sort()).SetSkip(offset)
+	var total int64
+	switch {
+	case sample > 0:
+		// Every match is read to spread the sample over them, so the limit
+		// only applies to the sample
+		total, err = s.store.Locations.CountDocuments(c.Request.Context(), scopedFilter(c, filter))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("X-Sampled-From", strconv.FormatInt(total, 10))
+		limit = sample
+	case explicitLimit:
+		opts.SetLimit(limit)
+	default:
+		// Fetch one extra document to detect queries exceeding the default limit
+		opts.SetLimit(limit + 1)
+	}
+	// Pages are resumed by timestamp and _id, whether or not they were selected
+	var unselected []string
+	if projection != nil {
+		projection, unselected = withPageFields(projection)
+		opts.SetProjection(projection)
+	}
+	cursor, err := s.store.Locations.Find(c.Request.Context(), scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(c.Request.Context())
+
+	// Return only the selected fields rather than zero values for the rest
+	if projection != nil {
+		var docs []bson.M
+		if sample > 0 {
+			docs, err = sampleCursor[bson.M](c.Request.Context(), cursor, total, sample)
+		} else {
+			err = cursor.All(c.Request.Context(), &docs)
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if int64(len(docs)) > limit {
+			respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+			return
+		}
+		timestampOrder.setPageHeaders(c, int64(len(docs)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+			last := docs[len(docs)-1]
+			id, _ := last["_id"].(primitive.ObjectID)
+			return last["timestamp"], id
+		})
+		for _, doc := range docs {
+			for _, field := range unselected {
+				delete(doc, field)
+			}
+			if id, ok := doc["_id"]; ok {
+				doc["id"] = id
+				delete(doc, "_id")
+			}
+			if ts, ok := doc["timestamp"].(string); ok {
+				doc["timestamp"] = formatTimestamp(ts, loc)
+			}
+			if createdAt, ok := doc["created_at"].(primitive.DateTime); ok {
+				doc["created_at"] = createdAt.Time().In(loc)
+			}
+			if err := coords.applyDoc(doc); err != nil {
+				respondError(c, http.StatusBadRequest, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, docs)
+		return
+	}
+
+	var locations []api.Location
+	if sample > 0 {
+		locations, err = sampleCursor[api.Location](c.Request.Context(), cursor, total, sample)
+	} else {
+		err = cursor.All(c.Request.Context(), &locations)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(locations)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	timestampOrder.setPageHeaders(c, int64(len(locations)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := locations[len(locations)-1]
+		return last.Timestamp, last.ID
+	})
+	if withAlongTrack {
+		track, err := s.alongTrackBefore(c.Request.Context(), scopedFilter(c, filter), offset, after)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		for i := range locations {
+			distance := track.add(&locations[i])
+			locations[i].AlongTrack = &distance
+		}
+	}
+	smoothLocations(locations, smooth)
+	for i := range locations {
+		localizeLocation(&locations[i], loc)
+		if err := coords.apply(&locations[i]); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+func (s *Server) handleGetLocation(c *gin.Context) {
+	filter, err := locationIDFilter(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var location api.Location
+	err = s.store.Locations.FindOne(c.Request.Context(), scopedFilter(c, filter)).Decode(&location)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "location not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	localizeLocation(&location, loc)
+	c.JSON(http.StatusOK, location)
+}
+
+func (s *Server) handlePutLocation(c *gin.Context) {
+	filter, err := locationIDFilter(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var location api.Location
+	if err := c.ShouldBindJSON(&location); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := normalizeLocation(&location, loc); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := context.Background()
+	var existing api.Location
+	err = s.store.Locations.FindOne(ctx, filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "location not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if status, err := s.replaceLocation(ctx, &existing, &location); err != nil {
+		respondError(c, status, err)
+		return
+	}
+
+	localizeLocation(&location, loc)
+	c.JSON(http.StatusOK, location)
+}
+
+// replaceLocation replaces a stored fix with a corrected version of it,
+// deriving fields and applying rules as on ingest. Errors come with the
+// status to respond with.
+func (s *Server) replaceLocation(ctx context.Context, existing, location *api.Location) (int, error) {
+	unlock := s.platformLocks.lock(location.Deployment, location.Platform)
+	defer unlock()
+
+	if status, err := s.reprocessLocation(ctx, existing, location); err != nil {
+		return status, err
+	}
+	if err := s.storeReplacement(ctx, existing, location); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// reprocessLocation readies a corrected version of a stored fix to replace
+// it, deriving fields and applying rules as on ingest.
+func (s *Server) reprocessLocation(ctx context.Context, existing, location *api.Location) (int, error) {
+	// Identity and receipt are facts about the stored fix, not something to
+	// edit
+	location.ID, location.UUID = existing.ID, existing.UUID
+	location.ReceivedAt, location.CommsPath = existing.ReceivedAt, existing.CommsPath
+	location.ReportedTimestamp, location.ClockSkew = existing.ReportedTimestamp, existing.ClockSkew
+	location.Latency = nil
+	if existing.Latency != nil {
+		recordLatency(location)
+	}
+	if err := s.deriveFields(ctx, location); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := s.applyRules(location); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	location.CreatedAt = existing.CreatedAt
+	return http.StatusOK, nil
+}
+
+// storeReplacement replaces a stored fix with a reprocessed version of it.
+func (s *Server) storeReplacement(ctx context.Context, existing, location *api.Location) error {
+	if _, err := s.store.Locations.ReplaceOne(ctx, bson.M{"_id": existing.ID}, location); err != nil {
+		return err
+	}
+	s.recordChanges(ctx, locationChange(changeUpdate, location))
+	if err := s.markRollupsDirty(ctx, existing.Deployment, existing.Platform, existing.Timestamp); err != nil {
+		return err
+	}
+	if err := s.markRollupsDirty(ctx, location.Deployment, location.Platform, location.Timestamp); err != nil {
+		return err
+	}
+	if location.Deployment != existing.Deployment || location.Platform != existing.Platform {
+		s.facetCache.invalidate()
+	}
+	return nil
+}
+
+func (s *Server) handleDeleteLocation(c *gin.Context) {
+	filter, err := locationIDFilter(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var deleted api.Location
+	err = s.store.Locations.FindOneAndDelete(context.Background(), filter).Decode(&deleted)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "location not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	s.recordChanges(context.Background(), locationChange(changeDelete, &deleted))
+	if err := s.markRollupsDirty(context.Background(), deleted.Deployment, deleted.Platform, deleted.Timestamp); err != nil {
+		s.logger.Printf("error marking rollups for location %s for recomputation: %v", deleted.ID.Hex(), err)
+	}
+	s.facetCache.invalidate()
+	if _, err := s.store.Telemetry.DeleteOne(context.Background(), bson.M{"location_id": deleted.ID}); err != nil {
+		s.logger.Printf("error deleting telemetry for location %s: %v", deleted.ID.Hex(), err)
+	}
+	if _, err := s.store.RawPayloads.DeleteMany(context.Background(), bson.M{"location_id": deleted.ID}); err != nil {
+		s.logger.Printf("error deleting raw payloads for location %s: %v", deleted.ID.Hex(), err)
+	}
+	if _, err := s.store.LocationVersions.DeleteMany(context.Background(), bson.M{"location_id": deleted.ID}); err != nil {
+		s.logger.Printf("error deleting versions of location %s: %v", deleted.ID.Hex(), err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func (s *Server) handleGetDeployments(c *gin.Context) {
+	deployments, err := s.deployments(c.Request.Context(), requestCredential(c))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(deployments)) > s.maxResultLimit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(s.maxResultLimit))
+		return
+	}
+
+	c.JSON(http.StatusOK, deployments)
+}
+
+func (s *Server) handleGetPlatforms(c *gin.Context) {
+	deployment := c.Param("deployment")
+	platforms, err := s.platforms(c.Request.Context(), deployment, requestCredential(c))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(platforms)) > s.maxResultLimit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(s.maxResultLimit))
+		return
+	}
+
+	c.JSON(http.StatusOK, platforms)
+}
+
+type startupStep struct {
+	name string
+	init func() error
+}
+
+// configSteps is the configuration checked before connecting to MongoDB.
+func (s *Server) configSteps() []startupStep {
+	return []startupStep{
+		{"secrets", initSecrets},
+		{"limits", s.initLimits},
+		{"signatures", s.initSignatures},
+		{"origins", initOrigins},
+		{"qc", s.initQC},
+		{"smtp", initSMTP},
+		{"alerts", s.initAlerts},
+		{"rules", s.initRules},
+		{"hooks", initHooks},
+		{"tows", initTows},
+		{"usbl", initUSBL},
+		{"tiles", s.initTiles},
+		{"platforms", initPlatforms},
+		{"endurance", initEndurance},
+		{"test data", initSynthetic},
+		{"clock skew", initClockSkew},
+		{"facet cache", initFacetCache},
+		{"index advisor", initIndexAdvisor},
+		{"id strategy", initIDStrategy},
+		{"response case", initResponseCase},
+		{"response memory", initResponseMemory},
+		{"write concern", initWriteConcern},
+		{"features", s.initFeatures},
+		{"network policy", initNetworkPolicy},
+		{"field encryption", s.initFieldEncryption},
+		{"mdns", initMDNS},
+		{"ha", initHA},
+		{"stream fanout", initStreamFanout},
+		{"stream", initStream},
+		{"analytics reads", initAnalyticsReads},
+	}
+}
+
+// databaseSteps is the setup that needs the database.
+func (s *Server) databaseSteps() []startupStep {
+	return []startupStep{
+		{"auth", s.initAuth},
+		{"mode", s.initMode},
+		{"features", s.initFeatureOverrides},
+		{"changes", s.initChanges},
+		{"raw payloads", s.initRawPayloads},
+		{"reprocessing", s.initReprocessing},
+		{"reports", s.initReports},
+		{"survey plans", s.initSurveyPlans},
+		{"waypoints", s.initWaypoints},
+		{"heartbeats", initHeartbeats},
+		{"rollups", s.initRollups},
+		{"lifecycle", s.initLifecycle},
+		{"stream events", s.initStreamEvents},
+		{"exports", s.initExports},
+		{"suppressions", s.initSuppressions},
+		{"outbox", s.initOutbox},
+		{"leader election", s.initLeader},
+	}
+}
+
+// router returns the gateway's routes.
+func (s *Server) router() *gin.Engine {
+	r := gin.Default()
+	trustProxies(r)
+	r.Use(s.requestID())
+	r.Use(separateSurfaces())
+	r.Use(fieldCase())
+	r.Use(limitBody(s.cfg.MaxBodyBytes))
+	r.Use(s.enforceMode())
+	r.Use(s.serverTiming())
+	r.GET("/healthz", s.handleHealthz)
+
+	ingestNet, apiNet, adminNet := allowNetwork(groupIngest), allowNetwork(groupAPI), allowNetwork(groupAdmin)
+	r.POST("/api/data", ingestNet, s.requireRole(roleWrite), s.handlePostLocation)
+	r.POST("/api/data/validate", ingestNet, s.requireRole(roleWrite), s.handleValidateLocation)
+	r.POST("/api/data/usbl", ingestNet, s.requireRole(roleWrite), s.handlePostUSBL)
+	r.POST("/api/data/stream", ingestNet, s.requireRole(roleWrite), s.handleStreamLocations)
+	r.POST("/api/data/message", ingestNet, s.requireRole(roleWrite), s.handlePostMessage)
+	r.POST("/api/heartbeat", ingestNet, s.requireRole(roleWrite), s.handlePostHeartbeat)
+	r.POST("/api/events", ingestNet, s.requireRole(roleWrite), s.handlePostEvent)
+	r.POST("/api/environment", ingestNet, s.requireRole(roleWrite), s.handlePostEnvironment)
+
+	read := r.Group("", apiNet, s.requireRole(roleRead))
+	analytics := analyticalReads()
+	read.GET("/api/locations", s.handleGetLocations)
+	read.GET("/api/locations/at-distance", s.handleGetLocationAtDistance)
+	read.GET("/api/locations/poll", s.handlePollLocations)
+	read.GET("/api/locations/:id", s.handleGetLocation)
+	read.GET("/api/locations/:id/raw", s.handleGetRawPayload)
+	read.GET("/api/locations/:id/raw/payload", s.handleDownloadRawPayload)
+	read.GET("/api/locations/:id/versions", s.handleGetLocationVersions)
+	read.POST("/api/match", s.handleMatch)
+	read.GET("/api/deployments", s.handleGetDeployments)
+	read.GET("/api/deployments/:deployment/summary", analytics, s.handleGetDeploymentSummary)
+	read.GET("/api/platforms/:deployment", s.handleGetPlatforms)
+	read.GET("/api/gaps", analytics, s.handleGetGaps)
+	read.GET("/api/integrity", analytics, s.handleGetIntegrity)
+	read.POST("/api/integrity/compare", analytics, s.handleCompareIntegrity)
+	read.GET("/api/tracks", analytics, s.handleGetTracks)
+	read.GET("/api/stats", analytics, s.handleGetStats)
+	read.GET("/api/heatmap", analytics, s.handleGetHeatmap)
+	read.GET("/api/hexbins", analytics, s.handleGetHexbins)
+	read.GET("/api/timeseries", analytics, s.handleGetTimeseries)
+	read.GET("/api/replay", s.requireFeature(featureStream), s.handleReplay)
+	read.GET("/api/stream", s.requireFeature(featureStream), s.handleStream)
+	read.GET("/api/changes", s.handleGetChanges)
+	read.GET("/api/snapshot", analytics, s.handleGetSnapshot)
+	read.GET("/api/status", s.handleGetStatus)
+	read.GET("/api/endurance", s.handleGetEndurance)
+	read.GET("/api/latency", analytics, s.handleGetLatency)
+	read.GET("/api/comms", analytics, s.handleGetCommsStats)
+	read.GET("/api/ingest/stats", s.handleGetIngestStats)
+	read.GET("/api/telemetry", s.handleGetTelemetry)
+	read.GET("/api/events", s.handleGetEvents)
+	read.GET("/api/environment", s.handleGetEnvironment)
+	read.GET("/api/environment/conditions", s.handleGetConditions)
+	read.GET("/api/alerts", s.handleGetAlerts)
+	read.GET("/api/suppressions", s.handleGetSuppressions)
+	read.GET("/api/heartbeats", s.handleGetHeartbeats)
+	read.GET("/api/render/track.png", s.requireFeature(featureRender), analytics, s.handleRenderTrack)
+	read.GET("/api/rollups/:resolution", analytics, s.handleGetRollups)
+	read.GET("/api/reports", s.requireFeature(featureReports), s.handleGetReports)
+	read.GET("/api/reports/:id", s.requireFeature(featureReports), s.handleGetReport)
+	read.GET("/api/plans/:deployment", s.handleGetSurveyPlan)
+	read.GET("/api/coverage", analytics, s.handleGetCoverage)
+	read.GET("/api/crosstrack", analytics, s.handleGetCrossTrack)
+	read.GET("/api/waypoints/:deployment", s.handleGetWaypointPlans)
+	read.GET("/api/waypoints/:deployment/:platform", s.handleGetWaypointPlan)
+	read.GET("/api/waypoints/:deployment/:platform/progress", s.handleGetWaypointProgress)
+	read.GET("/graphql", s.requireFeature(featureGraphQL), s.handleGraphQL)
+	read.POST("/graphql", s.requireFeature(featureGraphQL), s.handleGraphQL)
+
+	r.POST("/api/import/log", ingestNet, s.requireRole(roleWrite), s.handleImportLog)
+	r.POST("/api/reports", apiNet, s.requireRole(roleWrite), s.requireFeature(featureReports), analytics, s.handleCreateReport)
+	r.POST("/api/alerts/:id/ack", apiNet, s.requireRole(roleWrite), s.handleAckAlert)
+	r.POST("/api/alerts/:id/resolve", apiNet, s.requireRole(roleWrite), s.handleResolveAlert)
+	r.POST("/api/suppressions", apiNet, s.requireRole(roleWrite), s.handleCreateSuppression)
+	r.DELETE("/api/suppressions/:id", apiNet, s.requireRole(roleWrite), s.handleDeleteSuppression)
+	r.PUT("/api/plans/:deployment", apiNet, s.requireRole(roleWrite), s.handlePutSurveyPlan)
+	r.DELETE("/api/plans/:deployment", apiNet, s.requireRole(roleWrite), s.handleDeleteSurveyPlan)
+	r.PUT("/api/waypoints/:deployment/:platform", apiNet, s.requireRole(roleWrite), s.handlePutWaypointPlan)
+	r.DELETE("/api/waypoints/:deployment/:platform", apiNet, s.requireRole(roleWrite), s.handleDeleteWaypointPlan)
+	r.PATCH("/api/locations", adminNet, s.requireRole(roleAdmin), s.handleBulkUpdate)
+	r.POST("/api/deployments/:deployment/archive", adminNet, s.requireRole(roleAdmin), s.handleArchiveDeployment)
+	r.PUT("/api/deployments/:deployment/archive", adminNet, s.requireRole(roleAdmin), s.handleImportArchive)
+	r.POST("/api/deployments/:deployment/exports", adminNet, s.requireRole(roleAdmin), analytics, s.handleCreateExport)
+	r.GET("/api/exports", adminNet, s.requireRole(roleAdmin), s.handleGetExports)
+	r.GET("/api/exports/:id", adminNet, s.requireRole(roleAdmin), s.handleGetExport)
+	r.GET("/api/exports/:id/download", adminNet, s.requireRole(roleAdmin), s.handleDownloadExport)
+	r.DELETE("/api/exports/:id", adminNet, s.requireRole(roleAdmin), s.handleDeleteExport)
+	r.PUT("/api/locations/:id", adminNet, s.requireRole(roleAdmin), s.handlePutLocation)
+	r.DELETE("/api/locations/:id", adminNet, s.requireRole(roleAdmin), s.handleDeleteLocation)
+	r.POST("/api/locations/:id/reparse", adminNet, s.requireRole(roleAdmin), s.handleReparseLocation)
+	r.POST("/api/reparse", adminNet, s.requireRole(roleAdmin), s.handleReparse)
+	r.GET("/api/jobs/:id", apiNet, s.requireRole(roleWrite), s.handleGetJob)
+
+	admin := r.Group("/admin", adminNet, s.requireRole(roleAdmin))
+	admin.GET("/credentials", s.handleListCredentials)
+	admin.POST("/credentials", s.handleCreateCredential)
+	admin.PUT("/credentials/:id/grants", s.handleUpdateGrants)
+	admin.DELETE("/credentials/:id", s.handleDeleteCredential)
+	admin.POST("/credentials/reencrypt", s.handleReencryptCredentials)
+	admin.GET("/doctor", s.handleDoctor)
+	admin.GET("/runtime", s.handleGetRuntime)
+	admin.GET("/outbox", s.handleGetOutbox)
+	admin.GET("/debug/pprof/*profile", adminListenerOnly(), handlePprof)
+	admin.GET("/debug/vars", adminListenerOnly(), handleExpvar)
+	admin.GET("/logs/stream", s.handleStreamLogs)
+	admin.GET("/lifecycle", s.handleGetLifecycle)
+	admin.POST("/lifecycle/run", s.handleRunLifecycle)
+	admin.POST("/rollups/rebuild", s.handleRebuildRollups)
+	admin.POST("/testdata", s.handleGenerateTestData)
+	admin.POST("/bench", s.handleBench)
+	admin.GET("/reparsed", s.handleGetReparsed)
+	admin.GET("/ha", s.handleGetHA)
+	admin.GET("/mode", s.handleGetMode)
+	admin.PUT("/mode", s.handleSetMode)
+	admin.GET("/features", s.handleGetFeatures)
+	admin.PUT("/features", s.handleSetFeatures)
+	admin.GET("/rules", s.handleGetRules)
+	admin.POST("/rules/reload", s.handleReloadRules)
+	admin.GET("/alerts/channels", s.handleListAlertChannels)
+	admin.POST("/alerts/channels/:name/test", s.handleTestAlertChannel)
+
+	if s.tilesDir != "" {
+		r.GET("/tiles/basemap/:z/:x/:y", apiNet, s.requireFeature(featureTiles), s.handleGetTile)
+	}
+
+	return r
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import "math"
+
+const earthRadiusMeters = 6371008.8
+
+func toRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// haversine returns the great-circle distance in meters between two points.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func toDegrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// normalizeLongitude wraps a longitude into [-180, 180).
+func normalizeLongitude(lon float64) float64 {
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon - 180
+}
+
+// initialBearing returns the initial great-circle bearing in degrees true
+// from the first point to the second.
+func initialBearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := toRadians(lat1), toRadians(lat2)
+	dLon := toRadians(lon2 - lon1)
+	y := math.Sin(dLon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLon)
+	return math.Mod(toDegrees(math.Atan2(y, x))+360, 360)
+}
+
+// destinationPoint returns the point reached by travelling distance meters
+// from a starting point along a great circle with the given initial bearing.
+func destinationPoint(lat, lon, bearing, distance float64) (float64, float64) {
+	phi1, lambda1 := toRadians(lat), toRadians(lon)
+	theta := toRadians(bearing)
+	delta := distance / earthRadiusMeters
+
+	phi2 := math.Asin(math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta))
+	lambda2 := lambda1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi1), math.Cos(delta)-math.Sin(phi1)*math.Sin(phi2))
+	return toDegrees(phi2), normalizeLongitude(toDegrees(lambda2))
+}
+
+// intermediatePoint returns the point a fraction f of the way from the
+// first point to the second along the great circle between them.
+func intermediatePoint(lat1, lon1, lat2, lon2, f float64) (float64, float64) {
+	phi1, lambda1 := toRadians(lat1), toRadians(lon1)
+	phi2, lambda2 := toRadians(lat2), toRadians(lon2)
+	delta := haversine(lat1, lon1, lat2, lon2) / earthRadiusMeters
+	if math.Sin(delta) == 0 {
+		return lat1, lon1
+	}
+	a := math.Sin((1-f)*delta) / math.Sin(delta)
+	b := math.Sin(f*delta) / math.Sin(delta)
+	x := a*math.Cos(phi1)*math.Cos(lambda1) + b*math.Cos(phi2)*math.Cos(lambda2)
+	y := a*math.Cos(phi1)*math.Sin(lambda1) + b*math.Cos(phi2)*math.Sin(lambda2)
+	z := a*math.Sin(phi1) + b*math.Sin(phi2)
+	return toDegrees(math.Atan2(z, math.Hypot(x, y))), normalizeLongitude(toDegrees(math.Atan2(y, x)))
+}
+
+// densifyLine adds points along the great circle between consecutive
+// [longitude, latitude] positions further apart than maxSpacing meters, so
+// the line follows the path a vessel took rather than a straight line on
+// the map's projection.
+func densifyLine(line [][2]float64, maxSpacing float64) [][2]float64 {
+	if len(line) < 2 {
+		return line
+	}
+	out := [][2]float64{line[0]}
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		n := math.Ceil(haversine(a[1], a[0], b[1], b[0]) / maxSpacing)
+		for k := 1.0; k < n; k++ {
+			lat, lon := intermediatePoint(a[1], a[0], b[1], b[0], k/n)
+			out = append(out, [2]float64{lon, lat})
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// splitAntimeridian splits a line of [longitude, latitude] positions where
+// it crosses the antimeridian, ending one part at one side and starting the
+// next on the other, so maps don't draw the crossing the long way round.
+// Consecutive positions more than 180 degrees of longitude apart are taken
+// to cross it.
+func splitAntimeridian(line [][2]float64) [][][2]float64 {
+	parts := [][][2]float64{{}}
+	for i, p := range line {
+		if i > 0 {
+			prev := line[i-1]
+			if dLon := p[0] - prev[0]; math.Abs(dLon) > 180 {
+				edge := 180.0
+				if dLon > 0 {
+					// Heading west, leaving at -180
+					edge = -180
+				}
+				lat := antimeridianLatitude(prev[1], prev[0], p[1], p[0])
+				last := len(parts) - 1
+				parts[last] = append(parts[last], [2]float64{edge, lat})
+				parts = append(parts, [][2]float64{{-edge, lat}})
+			}
+		}
+		parts[len(parts)-1] = append(parts[len(parts)-1], p)
+	}
+	return parts
+}
+
+// antimeridianLatitude returns the latitude at which the great circle
+// between two points on either side of the antimeridian crosses it.
+func antimeridianLatitude(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, lambda1 := toRadians(lat1), toRadians(lon1)
+	phi2, lambda2 := toRadians(lat2), toRadians(lon2)
+	denominator := math.Cos(phi1) * math.Cos(phi2) * math.Sin(lambda1-lambda2)
+	if math.Abs(denominator) < 1e-12 {
+		// Along a meridian, over a pole; fall back to interpolating linearly
+		return (lat1 + lat2) / 2
+	}
+	numerator := math.Sin(phi1)*math.Cos(phi2)*math.Sin(math.Pi-lambda2) -
+		math.Sin(phi2)*math.Cos(phi1)*math.Sin(math.Pi-lambda1)
+	return toDegrees(math.Atan(numerator / denominator))
+}
+
+// crossTrackDistance returns how far in meters a point is from the great
+// circle through two others, positive to the right of the direction from
+// the first to the second.
+func crossTrackDistance(lat, lon, lat1, lon1, lat2, lon2 float64) float64 {
+	delta13 := haversine(lat1, lon1, lat, lon) / earthRadiusMeters
+	theta13 := toRadians(initialBearing(lat1, lon1, lat, lon))
+	theta12 := toRadians(initialBearing(lat1, lon1, lat2, lon2))
+	return math.Asin(math.Sin(delta13)*math.Sin(theta13-theta12)) * earthRadiusMeters
+}
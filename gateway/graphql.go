@@ -0,0 +1,1125 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// A minimal GraphQL facade over the REST data model. It supports query
+// operations with nested selections, aliases, arguments, and variables, and
+// subscriptions to live fixes, served as server-sent events. Fragments,
+// directives, and mutations are not supported.
+//
+//	type Query {
+//	  deployments: [String!]!
+//	  platforms(deployment: String!): [String!]!
+//	  locations(deployment: String, platform: String, q: String, limit: Int, offset: Int, after: String): [Location!]!
+//	  stats(deployment: String!, platform: String, start: String, end: String, units: String): Stats!
+//	  events(deployment: String!, platform: String, type: String, start: String, end: String, limit: Int, offset: Int, after: String): [Event!]!
+//	}
+//
+//	type Subscription {
+//	  locations(deployment: String, platform: String, q: String): Location!
+//	}
+//
+//	type Location {
+//	  deployment: String!
+//	  platform: String!
+//	  latitude: Float!
+//	  longitude: Float!
+//	  timestamp: String!
+//	  source: String!
+//	  crs: String
+//	  id: ID!
+//	  speed: Float
+//	  # Course over ground, derived from the previous fix
+//	  course: Float
+//	  # Heading reported by the platform's attitude sensors
+//	  heading: Float
+//	  pitch: Float
+//	  roll: Float
+//	  backfilled: Boolean!
+//	  created_at: String!
+//	  # Pass as after to fetch the locations following this one
+//	  cursor: String!
+//	}
+//
+//	type Stats {
+//	  units: Units!
+//	  source: String!
+//	  platforms: [PlatformStats!]!
+//	}
+//
+//	type Units {
+//	  system: String!
+//	  speed: String!
+//	  distance: String!
+//	}
+//
+//	type PlatformStats {
+//	  deployment: String!
+//	  platform: String!
+//	  count: Int!
+//	  first_timestamp: String!
+//	  last_timestamp: String!
+//	  distance: Float!
+//	  average_speed: Float!
+//	  max_speed: Float!
+//	}
+//
+//	type Event {
+//	  id: ID!
+//	  deployment: String!
+//	  platform: String
+//	  timestamp: String!
+//	  type: String!
+//	  message: String
+//	  details: JSON
+//	  created_at: String!
+//	  # Pass as after to fetch the events following this one
+//	  cursor: String!
+//	}
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlField struct {
+	alias     string
+	name      string
+	args      map[string]gqlValue
+	selection []gqlField
+}
+
+type gqlValue struct {
+	variable string
+	literal  interface{}
+}
+
+type gqlOperation struct {
+	kind      string
+	name      string
+	selection []gqlField
+}
+
+func (s *Server) handleGraphQL(c *gin.Context) {
+	var req gqlRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		// Subscriptions opened with EventSource can only be sent as GET
+		if v := c.Query("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": fmt.Sprintf("invalid variables: %v", err)}}})
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": err.Error()}}})
+		return
+	}
+
+	ops, err := parseGraphQL(req.Query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": err.Error()}}})
+		return
+	}
+
+	op, err := selectOperation(ops, req.OperationName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": err.Error()}}})
+		return
+	}
+	switch op.kind {
+	case "subscription":
+		s.serveSubscription(c, op, req.Variables)
+		return
+	case "mutation":
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gin.H{{"message": fmt.Sprintf("%s operations are not supported", op.kind)}}})
+		return
+	}
+
+	data := make(map[string]interface{})
+	var errs []gin.H
+	for _, field := range op.selection {
+		value, err := s.resolveQueryField(c.Request.Context(), field, req.Variables, requestCredential(c))
+		if err != nil {
+			errs = append(errs, gin.H{"message": gqlErrorMessage(c, err), "path": []string{field.key()}})
+			data[field.key()] = nil
+			continue
+		}
+		data[field.key()] = value
+	}
+
+	resp := gin.H{"data": data}
+	if len(errs) > 0 {
+		resp["errors"] = errs
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// gqlErrorMessage describes a resolver's error for the client. Like internal
+// errors elsewhere, database failures are logged rather than shown.
+func gqlErrorMessage(c *gin.Context, err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) && coded.code == codeInternal {
+		c.Error(err)
+		return http.StatusText(http.StatusInternalServerError)
+	}
+	return err.Error()
+}
+
+func selectOperation(ops []gqlOperation, name string) (gqlOperation, error) {
+	if name == "" {
+		if len(ops) != 1 {
+			return gqlOperation{}, fmt.Errorf("operationName is required when the document contains multiple operations")
+		}
+		return ops[0], nil
+	}
+	for _, op := range ops {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return gqlOperation{}, fmt.Errorf("unknown operation %q", name)
+}
+
+func (f gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+func (s *Server) resolveQueryField(ctx context.Context, field gqlField, vars map[string]interface{}, cred *Credential) (interface{}, error) {
+	args := field.resolveArgs(vars)
+
+	switch field.name {
+	case "__typename":
+		return "Query", nil
+	case "deployments":
+		if len(field.selection) > 0 {
+			return nil, fmt.Errorf("field %q must not have a selection", field.name)
+		}
+		deployments, err := s.deployments(ctx, cred)
+		if err != nil {
+			return nil, withCode(codeInternal, err)
+		}
+		return deployments, nil
+	case "platforms":
+		if len(field.selection) > 0 {
+			return nil, fmt.Errorf("field %q must not have a selection", field.name)
+		}
+		deployment, ok := args["deployment"].(string)
+		if !ok {
+			return nil, fmt.Errorf("argument \"deployment\" of type String! is required")
+		}
+		platforms, err := s.platforms(ctx, deployment, cred)
+		if err != nil {
+			return nil, withCode(codeInternal, err)
+		}
+		return platforms, nil
+	case "locations":
+		return s.resolveLocations(ctx, field, args, grantFilter(cred))
+	case "stats":
+		return s.resolveStats(ctx, field, args, cred)
+	case "events":
+		return s.resolveEvents(ctx, field, args, grantFilter(cred))
+	}
+	return nil, fmt.Errorf("cannot query field %q on type \"Query\"", field.name)
+}
+
+// stringArg returns a String argument, or "" if it wasn't given.
+func stringArg(args map[string]interface{}, name string) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return "", nil
+	}
+	value, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q must be a String", name)
+	}
+	return value, nil
+}
+
+// timeRangeArgs reads the start and end arguments as stored timestamps, in
+// UTC unless they carry an offset; either may be empty.
+func timeRangeArgs(args map[string]interface{}) (start, end string, err error) {
+	for _, arg := range []struct {
+		name  string
+		value *string
+	}{{"start", &start}, {"end", &end}} {
+		v, err := stringArg(args, arg.name)
+		if err != nil {
+			return "", "", err
+		}
+		if v == "" {
+			continue
+		}
+		if *arg.value, err = normalizeTimestamp(v, time.UTC); err != nil {
+			return "", "", fmt.Errorf("invalid %s: %v", arg.name, err)
+		}
+	}
+	return start, end, nil
+}
+
+// pageArgs reads the limit, offset, and after arguments of a paginated
+// field into opts, which pages in timestampOrder like the REST endpoints. It
+// returns the limit and the filter for the results after the cursor, if one
+// was given.
+func (s *Server) pageArgs(args map[string]interface{}, opts *options.FindOptions) (int64, bson.M, error) {
+	opts.SetSort(timestampOrder.sort())
+	limit := s.defaultResultLimit
+	explicitLimit := false
+	if v, ok := args["limit"]; ok && v != nil {
+		n, ok := v.(int64)
+		if !ok || n <= 0 {
+			return 0, nil, fmt.Errorf("argument \"limit\" must be a positive Int")
+		}
+		if n > s.maxResultLimit {
+			return 0, nil, fmt.Errorf("limit %d exceeds the maximum of %d; narrow the query or paginate with after", n, s.maxResultLimit)
+		}
+		limit = n
+		explicitLimit = true
+	}
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+	var offset int64
+	if v, ok := args["offset"]; ok && v != nil {
+		n, ok := v.(int64)
+		if !ok || n < 0 {
+			return 0, nil, fmt.Errorf("argument \"offset\" must be a non-negative Int")
+		}
+		offset = n
+		opts.SetSkip(n)
+	}
+	cursor, err := stringArg(args, "after")
+	if err != nil {
+		return 0, nil, err
+	}
+	after, err := timestampOrder.afterCursor(cursor, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	return limit, after, nil
+}
+
+// selectObject resolves the subfields selected from an object of the type.
+func selectObject(field gqlField, typeName string, resolve func(sub gqlField) (interface{}, error)) (map[string]interface{}, error) {
+	if len(field.selection) == 0 {
+		return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", field.name, typeName)
+	}
+	item := make(map[string]interface{}, len(field.selection))
+	for _, sub := range field.selection {
+		if sub.name == "__typename" {
+			item[sub.key()] = typeName
+			continue
+		}
+		value, err := resolve(sub)
+		if err != nil {
+			return nil, err
+		}
+		item[sub.key()] = value
+	}
+	return item, nil
+}
+
+// locationsFilter builds the filter of the locations query and
+// subscription from their arguments.
+func locationsFilter(args map[string]interface{}) (bson.M, error) {
+	filter := bson.M{}
+	for _, name := range []string{"deployment", "platform"} {
+		value, err := stringArg(args, name)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			filter[name] = value
+		}
+	}
+	q, err := stringArg(args, "q")
+	if err != nil {
+		return nil, err
+	}
+	if q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %v", err)
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+	return filter, nil
+}
+
+func (s *Server) resolveLocations(ctx context.Context, field gqlField, args map[string]interface{}, scope bson.M) (interface{}, error) {
+	if len(field.selection) == 0 {
+		return nil, fmt.Errorf("field \"locations\" of type [Location!]! must have a selection of subfields")
+	}
+
+	filter, err := locationsFilter(args)
+	if err != nil {
+		return nil, err
+	}
+	// Locations are paged in the same total order as the REST endpoints
+	opts := options.Find()
+	limit, after, err := s.pageArgs(args, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.store.Locations.Find(ctx, restrictFilter(scope, afterFilter(filter, after)), opts)
+	if err != nil {
+		return nil, withCode(codeInternal, err)
+	}
+	defer cursor.Close(ctx)
+
+	var locations []api.Location
+	if err = cursor.All(ctx, &locations); err != nil {
+		return nil, withCode(codeInternal, err)
+	}
+	if int64(len(locations)) > limit {
+		return nil, tooManyResultsError(limit)
+	}
+
+	result := make([]map[string]interface{}, 0, len(locations))
+	for _, location := range locations {
+		item, err := selectObject(field, "Location", func(sub gqlField) (interface{}, error) {
+			return locationField(location, sub)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func locationField(location api.Location, field gqlField) (interface{}, error) {
+	if len(field.selection) > 0 {
+		return nil, fmt.Errorf("field %q must not have a selection", field.name)
+	}
+	switch field.name {
+	case "__typename":
+		return "Location", nil
+	case "deployment":
+		return location.Deployment, nil
+	case "platform":
+		return location.Platform, nil
+	case "latitude":
+		return location.Latitude, nil
+	case "longitude":
+		return location.Longitude, nil
+	case "timestamp":
+		return location.Timestamp, nil
+	case "source":
+		return location.Source, nil
+	case "crs":
+		return location.CRS, nil
+	case "id":
+		return location.ID.Hex(), nil
+	case "speed":
+		return location.Speed, nil
+	case "course":
+		return location.Course, nil
+	case "heading":
+		return location.Heading, nil
+	case "pitch":
+		return location.Pitch, nil
+	case "roll":
+		return location.Roll, nil
+	case "backfilled":
+		return location.Backfilled, nil
+	case "created_at":
+		return location.CreatedAt, nil
+	case "cursor":
+		return timestampOrder.cursor(location.Timestamp, location.ID), nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type \"Location\"", field.name)
+}
+
+// resolveStats computes stats the way GET /api/stats does, limited to what
+// the credential may read.
+func (s *Server) resolveStats(ctx context.Context, field gqlField, args map[string]interface{}, cred *Credential) (interface{}, error) {
+	deployment, err := stringArg(args, "deployment")
+	if err != nil {
+		return nil, err
+	}
+	if deployment == "" {
+		return nil, fmt.Errorf("argument \"deployment\" of type String! is required")
+	}
+	platform, err := stringArg(args, "platform")
+	if err != nil {
+		return nil, err
+	}
+	unitsName, err := stringArg(args, "units")
+	if err != nil {
+		return nil, err
+	}
+	units, err := parseUnits(unitsName)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := timeRangeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	// Check the selection before computing anything
+	if _, err := statsField(StatsResponse{Platforms: []PlatformStats{{}}}, field); err != nil {
+		return nil, err
+	}
+
+	resp, status, err := s.deploymentStats(ctx, cred, deployment, platform, start, end, units)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			return nil, withCode(codeInternal, err)
+		}
+		return nil, err
+	}
+	return statsField(resp, field)
+}
+
+func statsField(resp StatsResponse, field gqlField) (interface{}, error) {
+	return selectObject(field, "Stats", func(sub gqlField) (interface{}, error) {
+		switch sub.name {
+		case "source":
+			return leafField(sub, resp.Source)
+		case "units":
+			return selectObject(sub, "Units", func(sub gqlField) (interface{}, error) {
+				switch sub.name {
+				case "system":
+					return leafField(sub, resp.Units.Name)
+				case "speed":
+					return leafField(sub, resp.Units.SpeedUnit)
+				case "distance":
+					return leafField(sub, resp.Units.DistanceUnit)
+				}
+				return nil, fmt.Errorf("cannot query field %q on type \"Units\"", sub.name)
+			})
+		case "platforms":
+			result := make([]map[string]interface{}, 0, len(resp.Platforms))
+			for _, stats := range resp.Platforms {
+				item, err := selectObject(sub, "PlatformStats", func(sub gqlField) (interface{}, error) {
+					return platformStatsField(stats, sub)
+				})
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, item)
+			}
+			return result, nil
+		}
+		return nil, fmt.Errorf("cannot query field %q on type \"Stats\"", sub.name)
+	})
+}
+
+func platformStatsField(stats PlatformStats, field gqlField) (interface{}, error) {
+	switch field.name {
+	case "deployment":
+		return leafField(field, stats.Deployment)
+	case "platform":
+		return leafField(field, stats.Platform)
+	case "count":
+		return leafField(field, stats.Count)
+	case "first_timestamp":
+		return leafField(field, stats.FirstTimestamp)
+	case "last_timestamp":
+		return leafField(field, stats.LastTimestamp)
+	case "distance":
+		return leafField(field, stats.Distance)
+	case "average_speed":
+		return leafField(field, stats.AverageSpeed)
+	case "max_speed":
+		return leafField(field, stats.MaxSpeed)
+	}
+	return nil, fmt.Errorf("cannot query field %q on type \"PlatformStats\"", field.name)
+}
+
+// leafField returns the value of a field that can't have a selection.
+func leafField(field gqlField, value interface{}) (interface{}, error) {
+	if len(field.selection) > 0 {
+		return nil, fmt.Errorf("field %q must not have a selection", field.name)
+	}
+	return value, nil
+}
+
+// resolveEvents lists a deployment's events the way GET /api/events does.
+func (s *Server) resolveEvents(ctx context.Context, field gqlField, args map[string]interface{}, scope bson.M) (interface{}, error) {
+	if len(field.selection) == 0 {
+		return nil, fmt.Errorf("field \"events\" of type [Event!]! must have a selection of subfields")
+	}
+	deployment, err := stringArg(args, "deployment")
+	if err != nil {
+		return nil, err
+	}
+	if deployment == "" {
+		return nil, fmt.Errorf("argument \"deployment\" of type String! is required")
+	}
+	platform, err := stringArg(args, "platform")
+	if err != nil {
+		return nil, err
+	}
+	eventType, err := stringArg(args, "type")
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := timeRangeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find()
+	limit, after, err := s.pageArgs(args, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := eventFilter(deployment, platform, eventType, start, end)
+	cursor, err := s.store.Events.Find(ctx, restrictFilter(scope, afterFilter(filter, after)), opts)
+	if err != nil {
+		return nil, withCode(codeInternal, err)
+	}
+	defer cursor.Close(ctx)
+
+	var events []api.Event
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, withCode(codeInternal, err)
+	}
+	if int64(len(events)) > limit {
+		return nil, tooManyResultsError(limit)
+	}
+
+	result := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		item, err := selectObject(field, "Event", func(sub gqlField) (interface{}, error) {
+			return eventField(event, sub)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func eventField(event api.Event, field gqlField) (interface{}, error) {
+	switch field.name {
+	case "id":
+		return leafField(field, event.ID.Hex())
+	case "deployment":
+		return leafField(field, event.Deployment)
+	case "platform":
+		return leafField(field, event.Platform)
+	case "timestamp":
+		return leafField(field, event.Timestamp)
+	case "type":
+		return leafField(field, event.Type)
+	case "message":
+		return leafField(field, event.Message)
+	case "details":
+		return leafField(field, event.Details)
+	case "created_at":
+		return leafField(field, event.CreatedAt)
+	case "cursor":
+		return leafField(field, timestampOrder.cursor(event.Timestamp, event.ID))
+	}
+	return nil, fmt.Errorf("cannot query field %q on type \"Event\"", field.name)
+}
+
+// serveSubscription sends a subscription's results as server-sent events,
+// following the GraphQL over SSE protocol: a next event with each fix
+// published to the stream hub that the subscription matches and the
+// credential may read, and a complete event if the gateway ends the
+// subscription, such as when the client falls too far behind.
+func (s *Server) serveSubscription(c *gin.Context, op gqlOperation, vars map[string]interface{}) {
+	fail := func(status int, err error) {
+		c.JSON(status, gin.H{"errors": []gin.H{{"message": err.Error()}}})
+	}
+	if len(op.selection) != 1 {
+		fail(http.StatusBadRequest, fmt.Errorf("a subscription must select exactly one field"))
+		return
+	}
+	field := op.selection[0]
+	if field.name != "locations" {
+		fail(http.StatusBadRequest, fmt.Errorf("cannot query field %q on type \"Subscription\"", field.name))
+		return
+	}
+	if !s.featureEnabled(featureStream) {
+		fail(http.StatusNotFound, fmt.Errorf("feature %s is disabled", featureStream))
+		return
+	}
+	filter, err := locationsFilter(field.resolveArgs(vars))
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	resolve := func(location api.Location) (map[string]interface{}, error) {
+		return selectObject(field, "Location", func(sub gqlField) (interface{}, error) {
+			return locationField(location, sub)
+		})
+	}
+	// Check the selection before subscribing
+	if _, err := resolve(api.Location{}); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	cred := requestCredential(c)
+
+	sub := s.hub.subscribe()
+	defer s.hub.unsubscribe(sub)
+
+	disableWriteTimeout(c)
+	rc := http.NewResponseController(c.Writer)
+	write := func(w io.Writer, format string, args ...interface{}) {
+		if streamWriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		}
+		fmt.Fprintf(w, format, args...)
+	}
+	next := func(w io.Writer, payload gin.H) {
+		data, _ := json.Marshal(payload)
+		write(w, "event: next\ndata: %s\n\n", data)
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	var heartbeat <-chan time.Time
+	if streamHeartbeat > 0 {
+		ticker := time.NewTicker(streamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-sub.evicted:
+			next(w, gin.H{"errors": []gin.H{{
+				"message":    fmt.Sprintf("more than %d events were waiting to be sent", streamBuffer),
+				"extensions": gin.H{"code": "slow_consumer"},
+			}}})
+			write(w, "event: complete\ndata:\n\n")
+			return false
+		case <-heartbeat:
+			// A comment, which clients ignore, keeps proxies from closing
+			// a quiet stream
+			write(w, ":\n\n")
+			return true
+		case event := <-sub.events:
+			location := event.Location
+			if !matchQuery(filter, &location) || !grantAllows(cred, location.Deployment, location.Platform) {
+				return true
+			}
+			item, err := resolve(location)
+			if err != nil {
+				return true
+			}
+			next(w, gin.H{"data": gin.H{field.key(): item}})
+			return true
+		}
+	})
+}
+
+func (f gqlField) resolveArgs(vars map[string]interface{}) map[string]interface{} {
+	args := make(map[string]interface{}, len(f.args))
+	for name, value := range f.args {
+		if value.variable != "" {
+			v, ok := vars[value.variable]
+			if !ok {
+				continue
+			}
+			// JSON numbers decode as float64; treat integral values as Int
+			if n, ok := v.(float64); ok && n == float64(int64(n)) {
+				v = int64(n)
+			}
+			args[name] = v
+			continue
+		}
+		args[name] = value.literal
+	}
+	return args
+}
+
+// GraphQL document parsing
+
+// Deepest nesting of selection sets and lists a query may have, which keeps
+// the recursive parser well within the stack
+const maxGraphQLDepth = 32
+
+type gqlParser struct {
+	src string
+	pos int
+	// Selection sets and lists open at pos
+	depth int
+}
+
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+
+	p := &gqlParser{src: src}
+	var ops []gqlOperation
+	for {
+		p.skipIgnored()
+		if p.pos >= len(p.src) {
+			break
+		}
+		op, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) skipIgnored() {
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		switch {
+		case ch == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case ch == ',' || unicode.IsSpace(rune(ch)):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	p.skipIgnored()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) consume(ch byte) error {
+	if p.peek() != ch {
+		return p.errorf("expected %q", ch)
+	}
+	p.pos++
+	return nil
+}
+
+// enter opens a nested selection set or list, failing once the query is
+// nested too deep.
+func (p *gqlParser) enter() error {
+	if p.depth >= maxGraphQLDepth {
+		return p.errorf("query is nested more than %d levels deep", maxGraphQLDepth)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *gqlParser) parseName() (string, error) {
+	p.skipIgnored()
+	start := p.pos
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		if ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (p.pos > start && ch >= '0' && ch <= '9') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if start == p.pos {
+		return "", p.errorf("expected name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *gqlParser) parseOperation() (gqlOperation, error) {
+	op := gqlOperation{kind: "query"}
+
+	if p.peek() != '{' {
+		kind, err := p.parseName()
+		if err != nil {
+			return op, err
+		}
+		switch kind {
+		case "query", "mutation", "subscription":
+			op.kind = kind
+		case "fragment":
+			return op, p.errorf("fragments are not supported")
+		default:
+			return op, p.errorf("unexpected %q", kind)
+		}
+
+		if ch := p.peek(); ch != '{' && ch != '(' {
+			if op.name, err = p.parseName(); err != nil {
+				return op, err
+			}
+		}
+		if p.peek() == '(' {
+			if err := p.skipVariableDefinitions(); err != nil {
+				return op, err
+			}
+		}
+	}
+
+	selection, err := p.parseSelectionSet()
+	if err != nil {
+		return op, err
+	}
+	op.selection = selection
+	return op, nil
+}
+
+// skipVariableDefinitions skips over the declared variable types; variable
+// values are type-checked by the resolvers instead.
+func (p *gqlParser) skipVariableDefinitions() error {
+	depth := 0
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return nil
+			}
+		}
+		p.pos++
+	}
+	return p.errorf("unterminated variable definitions")
+}
+
+func (p *gqlParser) parseSelectionSet() ([]gqlField, error) {
+	if err := p.consume('{'); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+
+	var fields []gqlField
+	for p.peek() != '}' {
+		if p.peek() == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+		if p.peek() == '.' {
+			return nil, p.errorf("fragments are not supported")
+		}
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.pos++
+
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) parseField() (gqlField, error) {
+	var field gqlField
+
+	name, err := p.parseName()
+	if err != nil {
+		return field, err
+	}
+	if p.peek() == ':' {
+		p.pos++
+		field.alias = name
+		if name, err = p.parseName(); err != nil {
+			return field, err
+		}
+	}
+	field.name = name
+
+	if p.peek() == '(' {
+		p.pos++
+		field.args = make(map[string]gqlValue)
+		for p.peek() != ')' {
+			argName, err := p.parseName()
+			if err != nil {
+				return field, err
+			}
+			if err := p.consume(':'); err != nil {
+				return field, err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return field, err
+			}
+			field.args[argName] = value
+		}
+		p.pos++
+	}
+
+	if p.peek() == '@' {
+		return field, p.errorf("directives are not supported")
+	}
+
+	if p.peek() == '{' {
+		if field.selection, err = p.parseSelectionSet(); err != nil {
+			return field, err
+		}
+	}
+	return field, nil
+}
+
+func (p *gqlParser) parseValue() (gqlValue, error) {
+	ch := p.peek()
+	switch {
+	case ch == '$':
+		p.pos++
+		name, err := p.parseName()
+		if err != nil {
+			return gqlValue{}, err
+		}
+		return gqlValue{variable: name}, nil
+	case ch == '"':
+		s, err := p.parseString()
+		return gqlValue{literal: s}, err
+	case ch == '-' || (ch >= '0' && ch <= '9'):
+		start := p.pos
+		p.pos++
+		isFloat := false
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c >= '0' && c <= '9' {
+				p.pos++
+			} else if c == '.' || c == 'e' || c == 'E' || ((c == '+' || c == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')) {
+				isFloat = true
+				p.pos++
+			} else {
+				break
+			}
+		}
+		text := p.src[start:p.pos]
+		if !isFloat {
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return gqlValue{}, p.errorf("invalid Int %q", text)
+			}
+			return gqlValue{literal: n}, nil
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return gqlValue{}, p.errorf("invalid Float %q", text)
+		}
+		return gqlValue{literal: f}, nil
+	case ch == '[':
+		p.pos++
+		if err := p.enter(); err != nil {
+			return gqlValue{}, err
+		}
+		defer func() { p.depth-- }()
+		var list []interface{}
+		for p.peek() != ']' {
+			if p.peek() == 0 {
+				return gqlValue{}, p.errorf("unterminated list")
+			}
+			item, err := p.parseValue()
+			if err != nil {
+				return gqlValue{}, err
+			}
+			if item.variable != "" {
+				return gqlValue{}, p.errorf("variables inside lists are not supported")
+			}
+			list = append(list, item.literal)
+		}
+		p.pos++
+		return gqlValue{literal: list}, nil
+	}
+
+	name, err := p.parseName()
+	if err != nil {
+		return gqlValue{}, err
+	}
+	switch name {
+	case "true":
+		return gqlValue{literal: true}, nil
+	case "false":
+		return gqlValue{literal: false}, nil
+	case "null":
+		return gqlValue{literal: nil}, nil
+	}
+	// Enum values are passed through as strings
+	return gqlValue{literal: name}, nil
+}
+
+func (p *gqlParser) parseString() (string, error) {
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		switch ch {
+		case '"':
+			p.pos++
+			return sb.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			p.pos++
+			switch esc := p.src[p.pos]; esc {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if p.pos+4 >= len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos+1:p.pos+5], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				sb.WriteByte(esc)
+			}
+			p.pos++
+		case '\n':
+			return "", p.errorf("unterminated string")
+		default:
+			sb.WriteByte(ch)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
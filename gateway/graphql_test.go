@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQLDepth(t *testing.T) {
+	nested := func(open, close string, depth int) string {
+		return strings.Repeat(open, depth) + strings.Repeat(close, depth)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"selections at the limit", "{" + strings.Repeat("a{", maxGraphQLDepth-1) + "b" + strings.Repeat("}", maxGraphQLDepth), true},
+		{"selections past the limit", "{" + strings.Repeat("a{", maxGraphQLDepth) + "b" + strings.Repeat("}", maxGraphQLDepth+1), false},
+		{"lists past the limit", "{a(b: " + nested("[", "]", maxGraphQLDepth) + ")}", false},
+		{"selections millions deep", nested("{a", "}", 3000000), false},
+		{"lists millions deep", "{a(b: " + nested("[", "]", 3000000) + ")}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), "nested more than")) {
+				t.Fatalf("got %v, want nesting error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// Platform states, from the age of its latest fix and heartbeat
+const (
+	platformOK     = "ok"
+	platformNoFix  = "no_fix"
+	platformSilent = "silent"
+)
+
+// How recent a platform's latest fix is for its expected reporting interval,
+// for coloring displays
+const (
+	freshnessFresh = "fresh"
+	freshnessLate  = "late"
+	freshnessStale = "stale"
+)
+
+// PlatformStatus combines a platform's latest fix and heartbeat.
+type PlatformStatus struct {
+	Deployment       string         `json:"deployment"`
+	Platform         string         `json:"platform"`
+	State            string         `json:"state"`
+	Freshness        string         `json:"freshness"`
+	ExpectedInterval string         `json:"expected_interval,omitempty"`
+	StaleAfter       string         `json:"stale_after"`
+	LastFix          *api.Location  `json:"last_fix"`
+	LastHeartbeat    *api.Heartbeat `json:"last_heartbeat"`
+	// For platforms with an empty_voltage
+	Endurance *Endurance `json:"endurance,omitempty"`
+	// Alerts not yet resolved, by whether they have been acknowledged
+	OpenAlerts  int64 `json:"open_alerts"`
+	AckedAlerts int64 `json:"acked_alerts"`
+
+	staleAfter time.Duration
+}
+
+// A platform without a fix or heartbeat for this long is no longer ok
+var platformStaleAfter = 15 * time.Minute
+
+// Platforms not heard from for this long are no longer watched for alerts
+const statusWatchWindow = 24 * time.Hour
+
+func initHeartbeats() error {
+	if v := os.Getenv("PLATFORM_STALE_AFTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid PLATFORM_STALE_AFTER %q", v)
+		}
+		platformStaleAfter = d
+	}
+	return nil
+}
+
+func (s *Server) handlePostHeartbeat(c *gin.Context) {
+	var hb api.Heartbeat
+	if err := c.ShouldBindBodyWith(&hb, binding.JSON); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	body, _ := c.Get(gin.BodyBytesKey)
+	if err := s.verifySignature(hb.Platform, body.([]byte), c.GetHeader("X-Signature")); err != nil {
+		respondError(c, http.StatusUnauthorized, err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	// Platforms without a clock fix may leave the time to the gateway
+	hb.CreatedAt = time.Now()
+	if hb.Timestamp == "" {
+		hb.Timestamp = hb.CreatedAt.UTC().Format(timestampLayout)
+	} else if hb.Timestamp, err = normalizeTimestamp(hb.Timestamp, loc); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if hb.Battery != nil && (*hb.Battery < 0 || *hb.Battery > 100) {
+		respondErrorf(c, http.StatusBadRequest, "battery must be a percentage between 0 and 100")
+		return
+	}
+
+	result, err := s.store.Heartbeats.InsertOne(context.Background(), hb)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	hb.ID = result.InsertedID.(primitive.ObjectID)
+
+	hb.Timestamp = formatTimestamp(hb.Timestamp, loc)
+	c.JSON(http.StatusOK, hb)
+}
+
+func (s *Server) handleGetHeartbeats(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	after, err := timestampOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(timestampOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Heartbeats.Find(ctx, scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []api.Heartbeat{}
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	timestampOrder.setPageHeaders(c, int64(len(results)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := results[len(results)-1]
+		return last.Timestamp, last.ID
+	})
+
+	for i := range results {
+		results[i].Timestamp = formatTimestamp(results[i].Timestamp, loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// platformStatuses finds the latest live fix and heartbeat of each platform
+// matching filter, and classifies the platform by their age at now.
+func (s *Server) platformStatuses(ctx context.Context, filter bson.M, now time.Time) ([]PlatformStatus, error) {
+	latest := func(coll store.Collection, match bson.M) (*mongo.Cursor, error) {
+		return coll.Aggregate(ctx, []bson.M{
+			{"$match": match},
+			{"$sort": bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "timestamp", Value: -1}}},
+			{"$group": bson.M{"_id": bson.M{"deployment": "$deployment", "platform": "$platform"}, "latest": bson.M{"$first": "$$ROOT"}}},
+		})
+	}
+
+	fixFilter := bson.M{"backfilled": bson.M{"$ne": true}}
+	for k, v := range filter {
+		fixFilter[k] = v
+	}
+	cursor, err := latest(s.store.Locations, fixFilter)
+	if err != nil {
+		return nil, err
+	}
+	var fixes []struct {
+		Latest api.Location `bson:"latest"`
+	}
+	if err := cursor.All(ctx, &fixes); err != nil {
+		return nil, err
+	}
+
+	cursor, err = latest(s.store.Heartbeats, filter)
+	if err != nil {
+		return nil, err
+	}
+	var beats []struct {
+		Latest api.Heartbeat `bson:"latest"`
+	}
+	if err := cursor.All(ctx, &beats); err != nil {
+		return nil, err
+	}
+
+	type key struct{ deployment, platform string }
+	byPlatform := make(map[key]*PlatformStatus)
+	var order []key
+	status := func(deployment, platform string) *PlatformStatus {
+		k := key{deployment, platform}
+		if byPlatform[k] == nil {
+			byPlatform[k] = &PlatformStatus{Deployment: deployment, Platform: platform}
+			order = append(order, k)
+		}
+		return byPlatform[k]
+	}
+	for i := range fixes {
+		fix := &fixes[i].Latest
+		status(fix.Deployment, fix.Platform).LastFix = fix
+	}
+	for i := range beats {
+		hb := &beats[i].Latest
+		status(hb.Deployment, hb.Platform).LastHeartbeat = hb
+	}
+
+	statuses := make([]PlatformStatus, 0, len(order))
+	for _, k := range order {
+		ps := byPlatform[k]
+		ps.classify(now)
+		statuses = append(statuses, *ps)
+	}
+	return statuses, nil
+}
+
+// classify sets a platform's state and freshness from the age of its latest
+// fix and heartbeat, judged against the platform's expected interval.
+func (s *PlatformStatus) classify(now time.Time) {
+	settings := platformSettings(s.Deployment, s.Platform)
+	s.staleAfter = settings.staleAfterFor()
+	s.StaleAfter = s.staleAfter.String()
+	if settings.expectedInterval > 0 {
+		s.ExpectedInterval = settings.expectedInterval.String()
+	}
+
+	cutoff := now.Add(-s.staleAfter).UTC().Format(timestampLayout)
+	switch {
+	case s.LastFix != nil && s.LastFix.Timestamp >= cutoff:
+		s.State = platformOK
+	case s.LastHeartbeat != nil && s.LastHeartbeat.Timestamp >= cutoff:
+		s.State = platformNoFix
+	default:
+		s.State = platformSilent
+	}
+
+	s.Freshness = freshnessStale
+	if s.State == platformOK {
+		s.Freshness = freshnessFresh
+		late := time.Duration(lateFactor * float64(settings.expectedInterval))
+		if t, err := parseTimestamp(s.LastFix.Timestamp); err == nil && late > 0 && now.Sub(t) > late {
+			s.Freshness = freshnessLate
+		}
+	}
+}
+
+func (s *Server) handleGetStatus(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	units, err := parseUnits(c.Query("units"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	statuses, err := s.platformStatuses(c.Request.Context(), scopedFilter(c, filter), now)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	alerts, err := s.openAlertCounts(c.Request.Context(), scopedFilter(c, filter))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	// Across the deployment, including platforms no longer reporting
+	var openAlerts int64
+	for _, counts := range alerts {
+		openAlerts += counts[alertOpen]
+	}
+	for i := range statuses {
+		ps := &statuses[i]
+		ps.OpenAlerts, ps.AckedAlerts = alerts[ps.Platform][alertOpen], alerts[ps.Platform][alertAcked]
+		if ps.Endurance, err = s.estimateEndurance(c.Request.Context(), ps.Deployment, ps.Platform, now); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if ps.Endurance != nil {
+			ps.Endurance.localize(loc)
+		}
+		if ps.LastFix != nil {
+			localizeLocation(ps.LastFix, loc)
+			if ps.LastFix.Speed != nil {
+				speed := units.Speed(*ps.LastFix.Speed)
+				ps.LastFix.Speed = &speed
+			}
+		}
+		if ps.LastHeartbeat != nil {
+			ps.LastHeartbeat.Timestamp = formatTimestamp(ps.LastHeartbeat.Timestamp, loc)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stale_after": platformStaleAfter.String(), "units": units, "open_alerts": openAlerts, "platforms": statuses})
+}
+
+// How often platform states are checked for alerts
+const statusWatchInterval = time.Minute
+
+// Settings documents holding the states alerts were last raised from
+const (
+	platformStatesDocumentID  = "platform_states"
+	enduranceStatesDocumentID = "endurance_states"
+)
+
+// watchedState is a platform's state at the last check for alerts.
+type watchedState struct {
+	Deployment string `bson:"deployment"`
+	Platform   string `bson:"platform"`
+	State      string `bson:"state"`
+}
+
+// loadWatchedStates reads the states saved under id by the last check, by
+// deployment/platform, or nil if there hasn't been one.
+func (s *Server) loadWatchedStates(ctx context.Context, id string) (map[string]string, error) {
+	var doc struct {
+		States []watchedState `bson:"states"`
+	}
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(doc.States))
+	for _, st := range doc.States {
+		states[st.Deployment+"/"+st.Platform] = st.State
+	}
+	return states, nil
+}
+
+func (s *Server) saveWatchedStates(ctx context.Context, id string, states []watchedState) error {
+	update := bson.M{"$set": bson.M{"states": states}}
+	_, err := s.store.Settings.UpdateOne(ctx, bson.M{"_id": id}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// watchPlatformStatus raises alerts when platforms change state. The states
+// alerts were raised from are saved in the settings collection, so neither a
+// restart nor a standby taking over repeats or misses an alert. States seen
+// on the very first check are recorded without alerting.
+func (s *Server) watchPlatformStatus(ctx context.Context) {
+	if len(s.notifier.routes) == 0 && len(s.notifier.escalations) == 0 {
+		return
+	}
+	for {
+		if s.leading() {
+			if err := s.checkPlatformStatus(ctx); err != nil {
+				s.logger.Printf("error checking platform status: %v", err)
+			}
+		}
+		if !sleep(ctx, statusWatchInterval) {
+			return
+		}
+	}
+}
+
+func (s *Server) checkPlatformStatus(ctx context.Context) error {
+	// Keep watching platforms long enough to see slow reporters go silent
+	window := statusWatchWindow
+	if d := 2 * longestStaleAfter(); d > window {
+		window = d
+	}
+	now := time.Now()
+	since := now.Add(-window).UTC().Format(timestampLayout)
+	statuses, err := s.platformStatuses(ctx, bson.M{"timestamp": bson.M{"$gte": since}}, now)
+	if err != nil {
+		return err
+	}
+
+	previous, err := s.loadWatchedStates(ctx, platformStatesDocumentID)
+	if err != nil {
+		return err
+	}
+	first := previous == nil
+	states := make([]watchedState, 0, len(statuses))
+
+	for _, ps := range statuses {
+		key := ps.Deployment + "/" + ps.Platform
+		states = append(states, watchedState{Deployment: ps.Deployment, Platform: ps.Platform, State: ps.State})
+		if first || previous[key] == ps.State {
+			continue
+		}
+		// Platforms appearing for the first time are only news if not ok
+		if previous[key] == "" && ps.State == platformOK {
+			continue
+		}
+		s.raiseAlert(platformStatusAlert(ps, previous[key]))
+	}
+	if err := s.saveWatchedStates(ctx, platformStatesDocumentID, states); err != nil {
+		return err
+	}
+	return s.checkEndurance(ctx, statuses, now)
+}
+
+func platformStatusAlert(s PlatformStatus, previous string) api.Alert {
+	alert := api.Alert{Deployment: s.Deployment, Platform: s.Platform, Location: s.LastFix}
+	switch s.State {
+	case platformOK:
+		alert.Type, alert.Severity = alertPlatformRecovered, "info"
+		alert.Message = fmt.Sprintf("%s is reporting positions again", s.Platform)
+	case platformNoFix:
+		alert.Type, alert.Severity = alertPlatformNoFix, "warning"
+		alert.Message = fmt.Sprintf("%s is alive but has not reported a position for %s", s.Platform, s.staleAfter)
+		if s.LastHeartbeat != nil && s.LastHeartbeat.Battery != nil {
+			alert.Message += fmt.Sprintf(" (battery %.0f%%)", *s.LastHeartbeat.Battery)
+		}
+	default:
+		alert.Type, alert.Severity = alertPlatformSilent, "critical"
+		alert.Message = fmt.Sprintf("%s has sent no position or heartbeat for %s", s.Platform, s.staleAfter)
+	}
+	return alert
+}
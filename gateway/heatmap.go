@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const defaultHeatmapCell = 0.01
+
+// HeatmapCell counts the fixes falling in one grid cell, given by its centre.
+type HeatmapCell struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int64   `json:"count"`
+}
+
+type HeatmapResponse struct {
+	CellSize float64       `json:"cell_size"`
+	Source   string        `json:"source"`
+	Cells    []HeatmapCell `json:"cells"`
+}
+
+// handleGetHeatmap counts fixes on a latitude/longitude grid. Long ranges are
+// counted from rollup centroids weighted by their fix counts, which places
+// each minute's fixes in a single cell.
+func (s *Server) handleGetHeatmap(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		if !canRead(c, deployment, platform) {
+			respondErrorf(c, http.StatusForbidden, "access to platform denied")
+			return
+		}
+		filter["platform"] = platform
+	}
+
+	cell := defaultHeatmapCell
+	if v := c.Query("cell"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 10 {
+			respondErrorf(c, http.StatusBadRequest, "cell must be a size in degrees between 0 and 10")
+			return
+		}
+		cell = f
+	}
+
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	source, coll, weight := sourceRaw, s.store.Locations, interface{}(1)
+	if useRollups(start, end) {
+		// Fall back to hours where the minute tier has been pruned
+		if minuteRetention > 0 && (start == "" || start < time.Now().UTC().Add(-minuteRetention).Format(timestampLayout)) {
+			source, coll, weight = sourceRollups, s.store.HourlyRollups, "$count"
+			if start != "" {
+				start = start[:13] + ":00:00.000Z"
+			}
+		} else {
+			source, coll, weight = sourceRollups, s.store.MinuteRollups, "$count"
+			if start != "" {
+				start = start[:16] + ":00.000Z"
+			}
+		}
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := coll.Aggregate(ctx, []bson.M{
+		{"$match": scopedFilter(c, filter)},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"lat": bson.M{"$floor": bson.M{"$divide": bson.A{"$latitude", cell}}},
+				"lon": bson.M{"$floor": bson.M{"$divide": bson.A{"$longitude", cell}}},
+			},
+			"count": bson.M{"$sum": weight},
+		}},
+		{"$limit": s.maxResultLimit + 1},
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var groups []struct {
+		ID struct {
+			Lat float64 `bson:"lat"`
+			Lon float64 `bson:"lon"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(groups)) > s.maxResultLimit {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, "heatmap has more than %d cells; use a larger cell or narrow the query", s.maxResultLimit)
+		return
+	}
+
+	resp := HeatmapResponse{CellSize: cell, Source: source, Cells: make([]HeatmapCell, len(groups))}
+	for i, g := range groups {
+		resp.Cells[i] = HeatmapCell{
+			Latitude:  roundCoordinate((g.ID.Lat + 0.5) * cell),
+			Longitude: roundCoordinate((g.ID.Lon + 0.5) * cell),
+			Count:     g.Count,
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// roundCoordinate trims floating point noise from computed cell centres.
+func roundCoordinate(v float64) float64 {
+	return math.Round(v*1e9) / 1e9
+}
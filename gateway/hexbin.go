@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uber/h3-go/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Hexbins are H3 cells, from resolution 0, with edges of about 1100 km, to
+// 15, of half a metre, each about a seventh the area of the one before.
+const (
+	minHexbinResolution     = 0
+	maxHexbinResolution     = 15
+	defaultHexbinResolution = 9
+)
+
+// HexbinCell sums the fixes falling in one H3 cell, given by its index and
+// its centre.
+type HexbinCell struct {
+	H3Index   string  `json:"h3_index"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int64   `json:"count"`
+	// Time platforms spent in the cell, counting each interval between a
+	// platform's fixes, up to the segment gap, towards the cell of the first
+	DwellSeconds float64 `json:"dwell_seconds"`
+	// Mean derived speed of the fixes with one, in m/s
+	MeanSpeed *float64 `json:"mean_speed,omitempty"`
+
+	speedSum   float64
+	speedCount int64
+}
+
+type HexbinResponse struct {
+	Deployment string `json:"deployment"`
+	Resolution int    `json:"resolution"`
+	// Average edge length of cells at the resolution, in metres
+	EdgeLength float64      `json:"edge_length"`
+	SegmentGap string       `json:"segment_gap"`
+	Cells      []HexbinCell `json:"cells"`
+}
+
+// hexbinPolygon returns a cell's outline as a closed GeoJSON ring.
+func hexbinPolygon(cell h3.Cell) [][2]float64 {
+	boundary := cell.Boundary()
+	ring := make([][2]float64, 0, len(boundary)+1)
+	for _, v := range boundary {
+		ring = append(ring, [2]float64{roundCoordinate(v.Lng), roundCoordinate(v.Lat)})
+	}
+	return append(ring, ring[0])
+}
+
+// handleGetHexbins sums a deployment's fixes over H3 cells: how many fall in
+// each, how long platforms spent there, and how fast they went, for
+// coverage and effort analysis.
+func (s *Server) handleGetHexbins(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		if !canRead(c, deployment, platform) {
+			respondErrorf(c, http.StatusForbidden, "access to platform denied")
+			return
+		}
+		filter["platform"] = platform
+	}
+
+	resolution := defaultHexbinResolution
+	if v := c.Query("resolution"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minHexbinResolution || n > maxHexbinResolution {
+			respondErrorf(c, http.StatusBadRequest, "resolution must be between %d and %d", minHexbinResolution, maxHexbinResolution)
+			return
+		}
+		resolution = n
+	}
+	segmentGap := defaultSegmentGap
+	if v := c.Query("segmentGap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid segmentGap %q", v)
+			return
+		}
+		segmentGap = d
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "geojson" {
+		respondErrorf(c, http.StatusBadRequest, "format must be json or geojson")
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1, "speed": 1})
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	cells := map[h3.Cell]*HexbinCell{}
+	var order []h3.Cell
+	var prev *HexbinCell
+	var prevPlatform string
+	var prevTime time.Time
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		key := h3.LatLngToCell(h3.NewLatLng(location.Latitude, location.Longitude), resolution)
+		cell, ok := cells[key]
+		if !ok {
+			if int64(len(cells)) >= s.maxResultLimit {
+				respondErrorf(c, http.StatusRequestEntityTooLarge, "hexbins have more than %d cells; use a coarser resolution or narrow the query", s.maxResultLimit)
+				return
+			}
+			cell = &HexbinCell{H3Index: key.String()}
+			cells[key] = cell
+			order = append(order, key)
+		}
+		cell.Count++
+		if location.Speed != nil {
+			cell.speedSum += *location.Speed
+			cell.speedCount++
+		}
+		if prev != nil && location.Platform == prevPlatform {
+			if dt := t.Sub(prevTime); dt <= segmentGap {
+				prev.DwellSeconds += dt.Seconds()
+			}
+		}
+		prev, prevPlatform, prevTime = cell, location.Platform, t
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := HexbinResponse{
+		Deployment: deployment,
+		Resolution: resolution,
+		EdgeLength: math.Round(h3.HexagonEdgeLengthAvgM(resolution)*1000) / 1000,
+		SegmentGap: segmentGap.String(),
+		Cells:      make([]HexbinCell, len(order)),
+	}
+	for i, key := range order {
+		cell := cells[key]
+		centre := key.LatLng()
+		cell.Latitude, cell.Longitude = roundCoordinate(centre.Lat), roundCoordinate(centre.Lng)
+		if cell.speedCount > 0 {
+			mean := cell.speedSum / float64(cell.speedCount)
+			cell.MeanSpeed = &mean
+		}
+		resp.Cells[i] = *cell
+	}
+
+	if format == "geojson" {
+		features := make([]gin.H, 0, len(resp.Cells))
+		for i, cell := range resp.Cells {
+			features = append(features, gin.H{
+				"type":     "Feature",
+				"geometry": gin.H{"type": "Polygon", "coordinates": [][][2]float64{hexbinPolygon(order[i])}},
+				"properties": gin.H{
+					"h3_index":      cell.H3Index,
+					"count":         cell.Count,
+					"dwell_seconds": cell.DwellSeconds,
+					"mean_speed":    cell.MeanSpeed,
+				},
+			})
+		}
+		var body responseBody
+		defer body.Close()
+		if err := encodeList(&body, gin.H{"type": "FeatureCollection"}, "features", features); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		body.send(c, http.StatusOK, "application/geo+json")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
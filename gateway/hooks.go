@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"data-gateway/api"
+)
+
+// HookFunc runs on a fix before it is stored. It may add derived fields with
+// SetDerived, or act on the fix elsewhere.
+type HookFunc func(ctx context.Context, location *api.Location) error
+
+// HookFactory builds a hook from its configured parameters, rejecting
+// invalid ones at startup.
+type HookFactory func(params map[string]string) (HookFunc, error)
+
+// hookRegistry holds the hooks that can be configured, by name.
+var hookRegistry = map[string]HookFactory{}
+
+// RegisterHook makes a hook available to HOOKS_CONFIG by name. Programs
+// embedding the gateway register custom hooks from an init function:
+//
+//	func init() { gateway.RegisterHook("tide", newTideHook) }
+func RegisterHook(name string, factory HookFactory) {
+	if _, dup := hookRegistry[name]; dup {
+		panic(fmt.Sprintf("hook %q registered twice", name))
+	}
+	hookRegistry[name] = factory
+}
+
+// hookConfig attaches a registered hook to the deployments matching a glob
+// pattern. A required hook that fails rejects the fix; other failures are
+// logged and the fix is stored without that hook's fields.
+type hookConfig struct {
+	Hook       string            `json:"hook"`
+	Deployment string            `json:"deployment"`
+	Params     map[string]string `json:"params"`
+	Required   bool              `json:"required"`
+}
+
+type configuredHook struct {
+	hookConfig
+	run HookFunc
+}
+
+// Longest time all hooks together may spend on one fix
+const hookTimeout = 5 * time.Second
+
+var hooks []configuredHook
+
+func initHooks() error {
+	configPath := os.Getenv("HOOKS_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading HOOKS_CONFIG: %v", err)
+	}
+	var cfg struct {
+		Hooks []hookConfig `json:"hooks"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing HOOKS_CONFIG: %v", err)
+	}
+
+	for i, hc := range cfg.Hooks {
+		factory, ok := hookRegistry[hc.Hook]
+		if !ok {
+			return fmt.Errorf("hook %d: unknown hook %q", i, hc.Hook)
+		}
+		if _, err := path.Match(hc.Deployment, ""); err != nil {
+			return fmt.Errorf("hook %d: invalid deployment pattern %q", i, hc.Deployment)
+		}
+		run, err := factory(hc.Params)
+		if err != nil {
+			return fmt.Errorf("hook %d (%s): %v", i, hc.Hook, err)
+		}
+		hooks = append(hooks, configuredHook{hookConfig: hc, run: run})
+	}
+	return nil
+}
+
+type dryRunKey struct{}
+
+// withDryRun marks a context as belonging to a fix that won't be stored.
+// Hooks with side effects should check IsDryRun and skip them.
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun reports whether a hook is running on a fix that won't be stored.
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// runHooks runs the hooks configured for the fix's deployment in order. It
+// returns the failures of hooks that aren't required as warnings.
+func runHooks(ctx context.Context, location *api.Location) ([]string, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	var warnings []string
+	for _, h := range hooks {
+		if ok, _ := path.Match(h.Deployment, location.Deployment); h.Deployment != "" && !ok {
+			continue
+		}
+		if err := h.run(ctx, location); err != nil {
+			if h.Required {
+				return warnings, fmt.Errorf("hook %s failed: %v", h.Hook, err)
+			}
+			log.Printf("hook %s failed for %s/%s at %s: %v", h.Hook, location.Deployment, location.Platform, location.Timestamp, err)
+			warnings = append(warnings, fmt.Sprintf("hook %s failed: %v", h.Hook, err))
+		}
+	}
+	return warnings, nil
+}
+
+// Built-in hooks
+
+func init() {
+	RegisterHook("solar_elevation", newSolarElevationHook)
+	RegisterHook("webhook", newWebhookHook)
+}
+
+// newSolarElevationHook adds the sun's elevation above the horizon at the
+// fix, in degrees, e.g. to separate day and night imagery.
+func newSolarElevationHook(params map[string]string) (HookFunc, error) {
+	return func(ctx context.Context, location *api.Location) error {
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			return err
+		}
+		location.SetDerived("solar_elevation", math.Round(solarElevation(t, location.Latitude, location.Longitude)*100)/100)
+		return nil
+	}, nil
+}
+
+// solarElevation approximates the sun's elevation in degrees, to within about
+// a degree.
+func solarElevation(t time.Time, lat, lon float64) float64 {
+	// Days since J2000.0
+	d := float64(t.Unix())/86400 - 10957.5
+
+	meanAnomaly := toRadians(357.529 + 0.98560028*d)
+	meanLongitude := 280.459 + 0.98564736*d
+	eclipticLongitude := toRadians(meanLongitude + 1.915*math.Sin(meanAnomaly) + 0.020*math.Sin(2*meanAnomaly))
+	obliquity := toRadians(23.439 - 0.00000036*d)
+
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(eclipticLongitude))
+	rightAscension := math.Atan2(math.Cos(obliquity)*math.Sin(eclipticLongitude), math.Cos(eclipticLongitude))
+
+	siderealDegrees := 280.46061837 + 360.98564736629*d
+	hourAngle := toRadians(siderealDegrees+lon) - rightAscension
+
+	phi := toRadians(lat)
+	return toDegrees(math.Asin(math.Sin(phi)*math.Sin(declination) + math.Cos(phi)*math.Cos(declination)*math.Cos(hourAngle)))
+}
+
+// newWebhookHook posts each fix as JSON to a URL in the background, through
+// the outbox for fixes ingested through the API. Fixes backfilled from logs
+// are skipped unless backfill is "true".
+func newWebhookHook(params map[string]string) (HookFunc, error) {
+	url := os.Expand(params["url"], os.Getenv)
+	if url == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	backfill := false
+	if v := params["backfill"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backfill %q", v)
+		}
+		backfill = b
+	}
+
+	return func(ctx context.Context, location *api.Location) error {
+		if IsDryRun(ctx) || (location.Backfilled && !backfill) {
+			return nil
+		}
+		// Fixes ingested through the API are delivered from the outbox once
+		// stored, and others straight away
+		if publishThroughOutbox(ctx, url) {
+			return nil
+		}
+		body, err := json.Marshal(location)
+		if err != nil {
+			return err
+		}
+		// Delivery must not hold up ingest
+		go func() {
+			resp, err := notifierClient.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("error posting fix to webhook hook: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("webhook hook returned %s", resp.Status)
+			}
+		}()
+		return nil
+	}, nil
+}
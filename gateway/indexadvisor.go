@@ -0,0 +1,378 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Fraction of queries whose shape the index advisor samples; zero disables
+// it
+var indexAdvisorSampleRate = 0.01
+
+// How long a shape's plan is trusted before it is explained again, so
+// indexes created since are noticed
+const indexAdvisorRecheck = time.Hour
+
+func initIndexAdvisor() error {
+	if v := os.Getenv("INDEX_ADVISOR_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid INDEX_ADVISOR_SAMPLE_RATE %q (expected a fraction between 0 and 1)", v)
+		}
+		indexAdvisorSampleRate = rate
+	}
+	return nil
+}
+
+// QueryShape is a query filter and sort with the values left out, such as
+// {deployment: eq, timestamp: range} sorted by {timestamp: 1}, and how
+// MongoDB plans it.
+type QueryShape struct {
+	Collection string `json:"collection"`
+	Shape      string `json:"shape"`
+	// Whether the winning plan scans the whole collection
+	CollectionScan bool `json:"collection_scan"`
+	// An index that would serve the shape, if it scans the collection
+	Recommended string    `json:"recommended_index,omitempty"`
+	Sampled     int64     `json:"sampled"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+
+	explainedAt time.Time
+	explaining  bool
+}
+
+// indexAdvisor samples the queries the gateway sends, explains each new
+// shape once, and remembers the shapes that scan a whole collection, so
+// queries added by new features that no index serves show up in the doctor
+// report and the log rather than as slowly growing latency.
+type indexAdvisor struct {
+	mu     sync.Mutex
+	shapes map[string]*QueryShape
+}
+
+// filterField is how a query constrains one field.
+type filterField struct {
+	name string
+	// eq, in, range, or other
+	kind string
+}
+
+// commandMonitor times commands for requests that ask for it and samples
+// them for the index advisor.
+func (s *Server) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: s.sampleQuery,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			timingMonitor.Succeeded(ctx, e)
+			s.recordBenchCommand(e.CommandName, e.Duration, false)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			timingMonitor.Failed(ctx, e)
+			s.recordBenchCommand(e.CommandName, e.Duration, true)
+		},
+	}
+}
+
+// sampleQuery records the shape of a sampled read, explaining it in the
+// background if it's new or its plan is out of date.
+func (s *Server) sampleQuery(ctx context.Context, e *event.CommandStartedEvent) {
+	if indexAdvisorSampleRate == 0 || rand.Float64() >= indexAdvisorSampleRate {
+		return
+	}
+	collection, filter, sortSpec, ok := queryOf(e.CommandName, e.Command)
+	if !ok || len(filter) == 0 {
+		return
+	}
+	fields, ok := shapeFields(filter)
+	if !ok {
+		return
+	}
+	shape := describeShape(fields, sortSpec)
+	key := collection + " " + shape
+
+	a := &s.advisor
+	now := time.Now()
+	a.mu.Lock()
+	if a.shapes == nil {
+		a.shapes = make(map[string]*QueryShape)
+	}
+	qs := a.shapes[key]
+	if qs == nil {
+		qs = &QueryShape{Collection: collection, Shape: shape, FirstSeen: now}
+		a.shapes[key] = qs
+	}
+	qs.Sampled++
+	qs.LastSeen = now
+	explain := !qs.explaining && now.Sub(qs.explainedAt) > indexAdvisorRecheck
+	if explain {
+		qs.explaining = true
+	}
+	a.mu.Unlock()
+
+	if explain {
+		go s.explainShape(e.DatabaseName, qs, filter, sortSpec, fields)
+	}
+}
+
+// explainShape asks MongoDB how it would run a sampled query, and logs a
+// recommendation the first time a shape turns out to scan the collection.
+func (s *Server) explainShape(database string, qs *QueryShape, filter, sortSpec bson.D, fields []filterField) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	find := bson.D{{Key: "find", Value: qs.Collection}, {Key: "filter", Value: filter}}
+	if len(sortSpec) > 0 {
+		find = append(find, bson.E{Key: "sort", Value: sortSpec})
+	}
+	var plan bson.M
+	err := s.store.Client().Database(database).RunCommand(ctx, bson.D{
+		{Key: "explain", Value: find},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}).Decode(&plan)
+
+	a := &s.advisor
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	qs.explaining = false
+	if err != nil {
+		s.logger.Printf("index advisor: error explaining %s query %s: %v", qs.Collection, qs.Shape, err)
+		return
+	}
+	wasScan := qs.CollectionScan && !qs.explainedAt.IsZero()
+	qs.explainedAt = time.Now()
+	qs.CollectionScan = hasStage(plan, "COLLSCAN")
+	qs.Recommended = ""
+	if qs.CollectionScan {
+		qs.Recommended = recommendIndex(fields, sortSpec)
+		if !wasScan {
+			s.logger.Printf("index advisor: %s queries shaped %s scan the whole collection; consider creating index %s", qs.Collection, qs.Shape, qs.Recommended)
+		}
+	}
+}
+
+// queryShapes returns the sampled shapes, those scanning a collection
+// first, then most sampled.
+func (s *Server) queryShapes() []QueryShape {
+	a := &s.advisor
+	a.mu.Lock()
+	shapes := make([]QueryShape, 0, len(a.shapes))
+	for _, qs := range a.shapes {
+		if !qs.explainedAt.IsZero() {
+			shapes = append(shapes, *qs)
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(shapes, func(i, j int) bool {
+		if shapes[i].CollectionScan != shapes[j].CollectionScan {
+			return shapes[i].CollectionScan
+		}
+		return shapes[i].Sampled > shapes[j].Sampled
+	})
+	return shapes
+}
+
+// queryOf extracts the collection, filter, and sort of a read command. For
+// aggregations they come from a leading $match and a $sort following it.
+func queryOf(name string, cmd bson.Raw) (collection string, filter, sortSpec bson.D, ok bool) {
+	var fields struct {
+		Filter   bson.D   `bson:"filter"`
+		Query    bson.D   `bson:"query"`
+		Sort     bson.D   `bson:"sort"`
+		Pipeline []bson.D `bson:"pipeline"`
+	}
+	collection, _ = cmd.Lookup(name).StringValueOK()
+	if collection == "" || bson.Unmarshal(cmd, &fields) != nil {
+		return "", nil, nil, false
+	}
+
+	switch name {
+	case "find":
+		return collection, fields.Filter, fields.Sort, true
+	case "count", "distinct":
+		return collection, fields.Query, nil, true
+	case "aggregate":
+		if len(fields.Pipeline) == 0 || len(fields.Pipeline[0]) != 1 || fields.Pipeline[0][0].Key != "$match" {
+			return "", nil, nil, false
+		}
+		filter, _ = fields.Pipeline[0][0].Value.(bson.D)
+		if len(fields.Pipeline) > 1 && len(fields.Pipeline[1]) == 1 && fields.Pipeline[1][0].Key == "$sort" {
+			sortSpec, _ = fields.Pipeline[1][0].Value.(bson.D)
+		}
+		return collection, filter, sortSpec, true
+	}
+	return "", nil, nil, false
+}
+
+// shapeFields lists the fields a filter constrains and how. Filters with
+// $or or $nor are left out: each branch needs its own index.
+func shapeFields(filter bson.D) ([]filterField, bool) {
+	byName := make(map[string]string)
+	var walk func(d bson.D) bool
+	walk = func(d bson.D) bool {
+		for _, e := range d {
+			switch e.Key {
+			case "$and":
+				clauses, _ := e.Value.(bson.A)
+				for _, clause := range clauses {
+					if c, ok := clause.(bson.D); !ok || !walk(c) {
+						return false
+					}
+				}
+				continue
+			case "$or", "$nor", "$expr", "$where", "$text":
+				return false
+			}
+			kind := predicateKind(e.Value)
+			// A field constrained twice is as selective as its best constraint
+			if prev, seen := byName[e.Key]; !seen || kindRank[kind] < kindRank[prev] {
+				byName[e.Key] = kind
+			}
+		}
+		return true
+	}
+	if !walk(filter) {
+		return nil, false
+	}
+
+	fields := make([]filterField, 0, len(byName))
+	for name, kind := range byName {
+		fields = append(fields, filterField{name, kind})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields, true
+}
+
+// Order of predicate kinds in a recommended index: equality, then sort,
+// then ranges
+var kindRank = map[string]int{"eq": 0, "in": 1, "range": 2, "other": 3}
+
+func predicateKind(v interface{}) string {
+	d, ok := v.(bson.D)
+	if !ok || len(d) == 0 || !strings.HasPrefix(d[0].Key, "$") {
+		return "eq"
+	}
+	kind := ""
+	for _, op := range d {
+		k := "other"
+		switch op.Key {
+		case "$eq":
+			k = "eq"
+		case "$in":
+			k = "in"
+		case "$gt", "$gte", "$lt", "$lte":
+			k = "range"
+		}
+		if kind == "" || kindRank[k] < kindRank[kind] {
+			kind = k
+		}
+	}
+	return kind
+}
+
+func describeShape(fields []filterField, sortSpec bson.D) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f.name + ": " + f.kind
+	}
+	shape := "{" + strings.Join(parts, ", ") + "}"
+	if len(sortSpec) > 0 {
+		shape += " sorted by " + describeKeys(sortSpec)
+	}
+	return shape
+}
+
+func describeKeys(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for i, e := range keys {
+		parts[i] = fmt.Sprintf("%s: %v", e.Key, e.Value)
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// recommendIndex suggests an index for a shape following the equality,
+// sort, range rule: fields matched exactly lead, so the sort can be read
+// from the index, and range fields follow.
+func recommendIndex(fields []filterField, sortSpec bson.D) string {
+	var keys bson.D
+	added := make(map[string]bool)
+	add := func(name string, dir interface{}) {
+		if !added[name] {
+			added[name] = true
+			keys = append(keys, bson.E{Key: name, Value: dir})
+		}
+	}
+	for _, kind := range []string{"eq", "in"} {
+		for _, f := range fields {
+			if f.kind == kind {
+				add(f.name, 1)
+			}
+		}
+	}
+	for _, e := range sortSpec {
+		add(e.Key, e.Value)
+	}
+	for _, kind := range []string{"range", "other"} {
+		for _, f := range fields {
+			if f.kind == kind {
+				add(f.name, 1)
+			}
+		}
+	}
+	return describeKeys(keys)
+}
+
+// hasStage reports whether an explain plan contains the stage anywhere.
+func hasStage(v interface{}, stage string) bool {
+	switch v := v.(type) {
+	case bson.M:
+		if v["stage"] == stage {
+			return true
+		}
+		for _, x := range v {
+			if hasStage(x, stage) {
+				return true
+			}
+		}
+	case bson.A:
+		for _, x := range v {
+			if hasStage(x, stage) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkQueryPlans reports sampled query shapes that no index serves.
+func (s *Server) checkQueryPlans(report *DoctorReport) {
+	if indexAdvisorSampleRate == 0 {
+		return
+	}
+	shapes := s.queryShapes()
+	scans := 0
+	for _, qs := range shapes {
+		if !qs.CollectionScan {
+			continue
+		}
+		scans++
+		report.add(Finding{Check: "query plans", Status: findingWarning,
+			Message: fmt.Sprintf("%s queries shaped %s scan the whole collection; consider creating index %s", qs.Collection, qs.Shape, qs.Recommended),
+			Detail:  qs})
+	}
+	if len(shapes) == 0 {
+		report.add(Finding{Check: "query plans", Status: findingOK, Message: "no queries sampled yet"})
+	} else if scans == 0 {
+		report.add(Finding{Check: "query plans", Status: findingOK, Message: fmt.Sprintf("all %d sampled query shapes use an index", len(shapes))})
+	}
+}
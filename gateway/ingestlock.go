@@ -0,0 +1,47 @@
+package gateway
+
+import "sync"
+
+// platformLocks serializes writes of a platform's fixes. Deriving speed and
+// heading reads the platform's previous fix, and an upsert looks for the fix
+// it replaces, so two fixes from one platform stored at once, such as copies
+// arriving over two comms paths, could both be derived from the same fix or
+// both be inserted. Different platforms don't wait for each other.
+type platformLocks struct {
+	mu    sync.Mutex
+	locks map[string]*platformLock
+}
+
+type platformLock struct {
+	sync.Mutex
+	// Holders and waiters, so the lock is dropped once nobody needs it
+	refs int
+}
+
+// lock blocks until no other write holds the platform, and returns the
+// function that releases it.
+func (l *platformLocks) lock(deployment, platform string) (unlock func()) {
+	key := deployment + "/" + platform
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*platformLock)
+	}
+	pl := l.locks[key]
+	if pl == nil {
+		pl = &platformLock{}
+		l.locks[key] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+// ingestClient identifies a stream of submissions: the credential that
+// sent them, and the platform, source, and comms path they were for.
+type ingestClient struct {
+	credential string
+	deployment string
+	platform   string
+	source     string
+	commsPath  string
+}
+
+// IngestStats counts the fixes one client has submitted for a platform over
+// one source and comms path since the gateway started, for telling which of
+// a platform's links is delivering.
+type IngestStats struct {
+	Credential string `json:"credential,omitempty"`
+	Deployment string `json:"deployment,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	Source     string `json:"source,omitempty"`
+	CommsPath  string `json:"comms_path,omitempty"`
+	// Fixes accepted, including resends of fixes already stored
+	Records int64 `json:"records"`
+	// Size of the submissions, stored or not
+	Bytes int64 `json:"bytes"`
+	// Submissions refused or failing to store
+	Errors   int64     `json:"errors"`
+	LastSeen time.Time `json:"last_seen"`
+	// The latest failure as the client was told of it, so internal errors
+	// are only described by their code
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorCode string     `json:"last_error_code,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ingestStats tallies submissions per client in memory.
+type ingestStats struct {
+	mu      sync.Mutex
+	clients map[ingestClient]*IngestStats
+}
+
+// countIngest tallies a submission of size bytes, with the fix as far as it
+// was parsed and the error it failed with, if any, and the status it was
+// responded to with.
+func (s *Server) countIngest(c *gin.Context, location *api.Location, bytes int, status int, err error) {
+	key := ingestClient{}
+	if cred := requestCredential(c); cred != nil {
+		key.credential = cred.Name
+	}
+	if location != nil {
+		key.deployment, key.platform, key.source = location.Deployment, location.Platform, location.Source
+		key.commsPath = location.CommsPath
+	}
+	if key.commsPath == "" {
+		key.commsPath = c.GetHeader("X-Comms-Path")
+	}
+
+	if err != nil {
+		from := ""
+		if key.credential != "" {
+			from = " from " + key.credential
+		}
+		s.logger.Printf("submission for %s/%s%s rejected: %v", key.deployment, key.platform, from, err)
+	}
+
+	st := &s.ingestStats
+	now := time.Now().UTC()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.clients == nil {
+		st.clients = make(map[ingestClient]*IngestStats)
+	}
+	stats := st.clients[key]
+	if stats == nil {
+		stats = &IngestStats{
+			Credential: key.credential,
+			Deployment: key.deployment,
+			Platform:   key.platform,
+			Source:     key.source,
+			CommsPath:  key.commsPath,
+		}
+		st.clients[key] = stats
+	}
+	stats.Bytes += int64(bytes)
+	stats.LastSeen = now
+	if err != nil {
+		public := describeError(status, err)
+		stats.Errors++
+		stats.LastError, stats.LastErrorCode = public.Error, public.Code
+		stats.LastErrorAt = &now
+	} else {
+		stats.Records++
+	}
+}
+
+// requestBodySize returns the size of a request body already read by
+// binding, or its declared size.
+func requestBodySize(c *gin.Context) int {
+	if body, ok := c.Get(gin.BodyBytesKey); ok {
+		return len(body.([]byte))
+	}
+	return int(max(c.Request.ContentLength, 0))
+}
+
+// handleGetIngestStats lists what each client has submitted for the
+// platforms the caller may read, most recently seen first.
+func (s *Server) handleGetIngestStats(c *gin.Context) {
+	deployment := c.Query("deployment")
+	platform := c.Query("platform")
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	st := &s.ingestStats
+	stats := []IngestStats{}
+	st.mu.Lock()
+	for _, client := range st.clients {
+		if deployment != "" && client.Deployment != deployment {
+			continue
+		}
+		if platform != "" && client.Platform != platform {
+			continue
+		}
+		if !canRead(c, client.Deployment, client.Platform) {
+			continue
+		}
+		stats = append(stats, *client)
+	}
+	st.mu.Unlock()
+
+	for i := range stats {
+		stats[i].LastSeen = stats[i].LastSeen.In(loc)
+		if stats[i].LastErrorAt != nil {
+			t := stats[i].LastErrorAt.In(loc)
+			stats[i].LastErrorAt = &t
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].LastSeen.After(stats[j].LastSeen) })
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+// Longest line accepted by the ingest stream when HTTP_MAX_BODY_BYTES is 0
+const maxStreamLine = 1 << 20
+
+// streamLineResult reports the outcome of one line of a streamed ingest,
+// with the status POST /api/data would have responded with.
+type streamLineResult struct {
+	Line     int      `json:"line"`
+	Status   int      `json:"status"`
+	Result   string   `json:"result,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// streamSummary ends the response of a streamed ingest.
+type streamSummary struct {
+	Done     bool `json:"done"`
+	Lines    int  `json:"lines"`
+	Inserted int  `json:"inserted"`
+	Updated  int  `json:"updated"`
+	// Lines resending a fix already stored under its UUID
+	Duplicate int    `json:"duplicate"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleStreamLocations ingests fixes sent as newline-delimited JSON, one
+// per line, as they arrive, and streams back a result per line, so a relay
+// can pipe a long backlog through a single request. A line that fails
+// doesn't stop the lines after it.
+func (s *Server) handleStreamLocations(c *gin.Context) {
+	tz, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	upsert, err := parseIngestMode(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Results are written while the body is still being read
+	if err := http.NewResponseController(c.Writer).EnableFullDuplex(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	disableReadTimeout(c)
+	disableWriteTimeout(c)
+
+	maxLine := int(s.cfg.MaxBodyBytes)
+	if maxLine <= 0 {
+		maxLine = maxStreamLine
+	}
+	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	var summary streamSummary
+	for scanner.Scan() {
+		summary.Lines++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		result, location := s.ingestStreamLine(c, line, tz, upsert)
+		result.Line = summary.Lines
+		switch {
+		case result.Error != "":
+			summary.Failed++
+		case result.Result == "updated":
+			summary.Updated++
+		case result.Result == "duplicate":
+			summary.Duplicate++
+		default:
+			summary.Inserted++
+		}
+		// The line's error is already as the client was told it
+		var lineErr error
+		if result.Error != "" {
+			lineErr = withCode(result.Code, errors.New(result.Error))
+		}
+		s.countIngest(c, location, len(scanner.Bytes())+1, result.Status, lineErr)
+		if err := enc.Encode(casedValue(c, result)); err != nil {
+			// The client has gone; the lines it sent have been stored
+			return
+		}
+		c.Writer.Flush()
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("line %d exceeds %d bytes", summary.Lines+1, maxLine)
+		}
+		summary.Error = err.Error()
+	} else {
+		summary.Done = true
+	}
+	enc.Encode(casedValue(c, summary))
+	c.Writer.Flush()
+}
+
+// ingestStreamLine runs one line of a streamed ingest through the pipeline
+// POST /api/data uses and stores it, returning the fix as far as it was
+// parsed.
+func (s *Server) ingestStreamLine(c *gin.Context, line []byte, tz *time.Location, upsert bool) (streamLineResult, *api.Location) {
+	// The scanner reuses its buffer for the next line
+	req := &ingestRequest{tz: tz, raw: bytes.Clone(line), rawFormat: payloadFormatLocation}
+	fail := func(status int, err error) (streamLineResult, *api.Location) {
+		body := newAPIError(c, status, err)
+		return streamLineResult{Status: status, Code: body.Code, Error: body.Error}, &req.location
+	}
+
+	location := &req.location
+	if err := json.Unmarshal(line, location); err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	location.ReceivedAt = time.Now().UTC().Format(timestampLayout)
+	var err error
+	if location.CommsPath, err = resolveCommsPath(c, location.CommsPath); err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	// A signature covers a whole request, so signed platforms can't stream
+	if err := s.verifySignature(location.Platform, line, ""); err != nil {
+		return fail(http.StatusUnauthorized, fmt.Errorf("%w; signed fixes must be posted to /api/data", err))
+	}
+	if err := normalizeLocation(location, tz); err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+
+	ctx := context.Background()
+	if status, err := s.processIngest(ctx, req, upsert); err != nil {
+		return fail(status, err)
+	}
+	defer req.release()
+	stored, result, err := s.storeIngest(ctx, req)
+	if err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	return streamLineResult{Status: http.StatusOK, Result: result, ID: stored.ID.Hex(), Warnings: req.warnings}, &stored
+}
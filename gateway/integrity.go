@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// integrityAlgorithm names how integrity hashes are computed, so reports
+// from gateways hashing differently aren't compared.
+const integrityAlgorithm = "sha256-v1"
+
+// IntegrityReport summarizes a deployment's fixes as counts and content
+// hashes per day and platform, for checking two copies hold the same fixes.
+type IntegrityReport struct {
+	Deployment string `json:"deployment" binding:"required"`
+	Platform   string `json:"platform,omitempty"`
+	Start      string `json:"start,omitempty"`
+	End        string `json:"end,omitempty"`
+	Algorithm  string `json:"algorithm"`
+	Count      int64  `json:"count"`
+	// Hash of every day's hash, changing if any fix does
+	Hash string         `json:"hash"`
+	Days []IntegrityDay `json:"days"`
+}
+
+// IntegrityDay is the count and content hash of one platform's fixes on
+// one UTC day.
+type IntegrityDay struct {
+	Date     string `json:"date"`
+	Platform string `json:"platform"`
+	Count    int64  `json:"count"`
+	Hash     string `json:"hash"`
+}
+
+// IntegrityDifference is a day and platform whose fixes differ between two
+// reports. A side without any fixes that day has a count of zero and no hash.
+type IntegrityDifference struct {
+	Date        string `json:"date"`
+	Platform    string `json:"platform"`
+	LocalCount  int64  `json:"local_count"`
+	RemoteCount int64  `json:"remote_count"`
+	LocalHash   string `json:"local_hash,omitempty"`
+	RemoteHash  string `json:"remote_hash,omitempty"`
+}
+
+// fixDigest hashes what a platform reported in a fix. IDs and when the fix
+// was received and stored are left out, as they differ between copies.
+func fixDigest(location *api.Location) [sha256.Size]byte {
+	float := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	fields := []string{
+		location.Platform,
+		location.Timestamp,
+		float(&location.Latitude),
+		float(&location.Longitude),
+		location.Source,
+		float(location.Speed),
+		float(location.Course),
+		float(location.Heading),
+		float(location.Pitch),
+		float(location.Roll),
+	}
+	return sha256.Sum256([]byte(strings.Join(fields, "\x1f")))
+}
+
+// integrityReport computes the report for the fixes matching the report's
+// deployment, platform, and time range.
+func (s *Server) integrityReport(ctx context.Context, c *gin.Context, report *IntegrityReport) error {
+	filter := bson.M{"deployment": report.Deployment}
+	if report.Platform != "" {
+		filter["platform"] = report.Platform
+	}
+	if report.Start != "" || report.End != "" {
+		ts := bson.M{}
+		if report.Start != "" {
+			ts["$gte"] = report.Start
+		}
+		if report.End != "" {
+			ts["$lte"] = report.End
+		}
+		filter["timestamp"] = ts
+	}
+	opts := options.Find().SetProjection(bson.M{
+		"platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1, "source": 1,
+		"speed": 1, "course": 1, "heading": 1, "pitch": 1, "roll": 1,
+	})
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	// Fixes are hashed individually and their digests sorted, so the hash
+	// doesn't depend on the order fixes were stored in
+	type key struct{ date, platform string }
+	digests := map[key][][sha256.Size]byte{}
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return err
+		}
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		k := key{t.UTC().Format("2006-01-02"), location.Platform}
+		digests[k] = append(digests[k], fixDigest(&location))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	report.Algorithm = integrityAlgorithm
+	report.Count = 0
+	report.Days = make([]IntegrityDay, 0, len(digests))
+	for k, ds := range digests {
+		sort.Slice(ds, func(i, j int) bool { return string(ds[i][:]) < string(ds[j][:]) })
+		h := sha256.New()
+		for _, d := range ds {
+			h.Write(d[:])
+		}
+		report.Days = append(report.Days, IntegrityDay{Date: k.date, Platform: k.platform, Count: int64(len(ds)), Hash: hex.EncodeToString(h.Sum(nil))})
+		report.Count += int64(len(ds))
+	}
+	sort.Slice(report.Days, func(i, j int) bool {
+		a, b := report.Days[i], report.Days[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return a.Platform < b.Platform
+	})
+	h := sha256.New()
+	for _, day := range report.Days {
+		fmt.Fprintf(h, "%s %s %d %s\n", day.Date, day.Platform, day.Count, day.Hash)
+	}
+	report.Hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (s *Server) handleGetIntegrity(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	report := IntegrityReport{Deployment: deployment, Platform: c.Query("platform"), Start: start, End: end}
+	if err := s.integrityReport(c.Request.Context(), c, &report); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// handleCompareIntegrity compares another gateway's integrity report with
+// this gateway's fixes over the same deployment, platform, and time range.
+func (s *Server) handleCompareIntegrity(c *gin.Context) {
+	var remote IntegrityReport
+	if err := c.ShouldBindJSON(&remote); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if remote.Algorithm != integrityAlgorithm {
+		respondErrorf(c, http.StatusBadRequest, "reports hashed with %q can't be compared with %q", remote.Algorithm, integrityAlgorithm)
+		return
+	}
+	for _, v := range []*string{&remote.Start, &remote.End} {
+		if *v == "" {
+			continue
+		}
+		ts, err := normalizeTimestamp(*v, time.UTC)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		*v = ts
+	}
+
+	local := IntegrityReport{Deployment: remote.Deployment, Platform: remote.Platform, Start: remote.Start, End: remote.End}
+	if err := s.integrityReport(c.Request.Context(), c, &local); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	type key struct{ date, platform string }
+	differences := map[key]*IntegrityDifference{}
+	for _, day := range local.Days {
+		differences[key{day.Date, day.Platform}] = &IntegrityDifference{Date: day.Date, Platform: day.Platform, LocalCount: day.Count, LocalHash: day.Hash}
+	}
+	for _, day := range remote.Days {
+		k := key{day.Date, day.Platform}
+		d, ok := differences[k]
+		if !ok {
+			d = &IntegrityDifference{Date: day.Date, Platform: day.Platform}
+			differences[k] = d
+		}
+		d.RemoteCount, d.RemoteHash = day.Count, day.Hash
+	}
+	result := []IntegrityDifference{}
+	for _, d := range differences {
+		if d.LocalCount != d.RemoteCount || d.LocalHash != d.RemoteHash {
+			result = append(result, *d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Date != result[j].Date {
+			return result[i].Date < result[j].Date
+		}
+		return result[i].Platform < result[j].Platform
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployment":  local.Deployment,
+		"identical":   len(result) == 0,
+		"local":       gin.H{"count": local.Count, "hash": local.Hash},
+		"remote":      gin.H{"count": remote.Count, "hash": remote.Hash},
+		"differences": result,
+	})
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job tracks a background operation started by an admin request.
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Status     string      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	ErrorCode  string      `json:"error_code,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Progress   *Progress   `json:"progress,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// Progress reports how far a job has got through its work.
+type Progress struct {
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// How long a finished job can still be looked up
+const jobRetention = time.Hour
+
+// jobRegistry holds a server's background jobs, until an hour after they
+// finish.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// prune drops jobs that finished longer ago than jobRetention. The caller
+// holds mu.
+func (r *jobRegistry) prune(now time.Time) {
+	for id, job := range r.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > jobRetention {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// startJob runs fn in the background and returns the job tracking it. fn may
+// report its progress through the function it is passed. A job that fails
+// with a coded error keeps its message; other errors are internal, so are
+// logged and the job only describes them by their code.
+func (s *Server) startJob(jobType string, fn func(progress func(done, total int64)) (interface{}, error)) Job {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+
+	job := &Job{
+		ID:        hex.EncodeToString(raw),
+		Type:      jobType,
+		Status:    jobRunning,
+		CreatedAt: time.Now(),
+	}
+
+	jobs := &s.jobs
+	jobs.mu.Lock()
+	jobs.prune(job.CreatedAt)
+	if jobs.jobs == nil {
+		jobs.jobs = make(map[string]*Job)
+	}
+	jobs.jobs[job.ID] = job
+	snapshot := *job
+	jobs.mu.Unlock()
+
+	progress := func(done, total int64) {
+		jobs.mu.Lock()
+		job.Progress = &Progress{Done: done, Total: total}
+		jobs.mu.Unlock()
+	}
+
+	go func() {
+		result, err := fn(progress)
+
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Result = result
+		if err != nil {
+			job.Status = jobFailed
+			var coded *codedError
+			if errors.As(err, &coded) && coded.code != codeInternal {
+				job.Error, job.ErrorCode = err.Error(), coded.code
+			} else {
+				s.logger.Printf("job %s (%s) failed: %v", job.ID, job.Type, err)
+				public := describeError(http.StatusInternalServerError, err)
+				job.Error, job.ErrorCode = public.Error, public.Code
+			}
+		} else {
+			job.Status = jobSucceeded
+		}
+	}()
+
+	return snapshot
+}
+
+func (s *Server) handleGetJob(c *gin.Context) {
+	s.jobs.mu.Lock()
+	s.jobs.prune(time.Now())
+	job, ok := s.jobs.jobs[c.Param("id")]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	s.jobs.mu.Unlock()
+
+	if !ok {
+		respondErrorf(c, http.StatusNotFound, "job not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// LatencyStats summarizes how long a platform's fixes took to reach the
+// gateway, in seconds.
+type LatencyStats struct {
+	Deployment string  `json:"deployment,omitempty"`
+	Platform   string  `json:"platform,omitempty"`
+	Count      int     `json:"count"`
+	Mean       float64 `json:"mean"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	P50        float64 `json:"p50"`
+	P90        float64 `json:"p90"`
+	P99        float64 `json:"p99"`
+}
+
+// recordLatency sets a live fix's latency from its timestamp and receipt
+// time. Fixes from platforms with skewed clocks get none, as their
+// timestamps can't be trusted.
+func recordLatency(location *api.Location) {
+	location.Latency = nil
+	if location.ReceivedAt == "" || location.ClockSkew != nil {
+		return
+	}
+	t, err := parseTimestamp(location.Timestamp)
+	if err != nil {
+		return
+	}
+	received, err := parseTimestamp(location.ReceivedAt)
+	if err != nil {
+		return
+	}
+	latency := math.Round(received.Sub(t).Seconds()*1000) / 1000
+	location.Latency = &latency
+}
+
+// latencyStats summarizes a set of latencies.
+func latencyStats(latencies []float64) LatencyStats {
+	sort.Float64s(latencies)
+	var sum float64
+	for _, l := range latencies {
+		sum += l
+	}
+	n := len(latencies)
+	// Nearest-rank percentiles
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(n))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return latencies[i]
+	}
+	return LatencyStats{
+		Count: n,
+		Mean:  math.Round(sum/float64(n)*1000) / 1000,
+		Min:   latencies[0],
+		Max:   latencies[n-1],
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+	}
+}
+
+// handleGetLatency reports the distribution of end-to-end latency, from a
+// fix's timestamp to its receipt, for each platform in a deployment.
+func (s *Server) handleGetLatency(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment, "latency": bson.M{"$exists": true}}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}}).
+		SetProjection(bson.M{"_id": 0, "platform": 1, "latency": 1})
+	ctx := c.Request.Context()
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	stats := []LatencyStats{}
+	var platform string
+	var latencies []float64
+	flush := func() {
+		if len(latencies) == 0 {
+			return
+		}
+		ls := latencyStats(latencies)
+		ls.Deployment, ls.Platform = deployment, platform
+		stats = append(stats, ls)
+		latencies = nil
+	}
+	for cursor.Next(ctx) {
+		var fix struct {
+			Platform string  `bson:"platform"`
+			Latency  float64 `bson:"latency"`
+		}
+		if err := cursor.Decode(&fix); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if fix.Platform != platform {
+			flush()
+			platform = fix.Platform
+		}
+		latencies = append(latencies, fix.Latency)
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	flush()
+
+	c.JSON(http.StatusOK, gin.H{"platforms": stats})
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// In HA mode, instances sharing a database take turns holding a lease
+// stored in the settings collection, and only the holder runs background
+// jobs: scheduled reports, rollups, the data lifecycle, and platform status
+// alerts. Every instance serves requests.
+
+const leaderDocumentID = "leader"
+
+const defaultLeaseTTL = 15 * time.Second
+
+var haEnabled bool
+var haLeaseTTL = defaultLeaseTTL
+
+// HA_INSTANCE_ID, or the host name and process ID, naming the holder of the
+// lease
+var haInstance string
+
+// leaderLease is the lease document.
+type leaderLease struct {
+	Holder    string    `json:"holder" bson:"holder"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	RenewedAt time.Time `json:"renewed_at" bson:"renewed_at"`
+}
+
+// leaderState is whether this instance holds the lease.
+type leaderState struct {
+	// HA_INSTANCE_ID when the server was set up
+	instance string
+
+	mu sync.Mutex
+	// When the lease this instance holds runs out; zero if it doesn't hold it
+	until time.Time
+	since time.Time
+}
+
+func initHA() error {
+	haEnabled = os.Getenv("HA_ENABLED") == "true"
+	ttl, err := envDuration("HA_LEASE_TTL", defaultLeaseTTL)
+	if err != nil {
+		return err
+	}
+	if ttl < 3*time.Second {
+		return fmt.Errorf("invalid HA_LEASE_TTL %q (expected at least 3s)", os.Getenv("HA_LEASE_TTL"))
+	}
+	haLeaseTTL = ttl
+
+	haInstance = os.Getenv("HA_INSTANCE_ID")
+	if haInstance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("error reading host name for HA_INSTANCE_ID: %v", err)
+		}
+		haInstance = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return nil
+}
+
+// initLeader tries for the lease at startup, so the first instance up
+// starts its jobs straight away.
+func (s *Server) initLeader() error {
+	if !haEnabled {
+		return nil
+	}
+	s.leader.instance = haInstance
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.renewLease(ctx); err != nil {
+		return fmt.Errorf("error acquiring leader lease: %v", err)
+	}
+	return nil
+}
+
+// leading reports whether this instance should run background jobs: always
+// outside HA mode, and otherwise while it holds an unexpired lease.
+func (s *Server) leading() bool {
+	if !haEnabled {
+		return true
+	}
+	s.leader.mu.Lock()
+	defer s.leader.mu.Unlock()
+	return time.Now().Before(s.leader.until)
+}
+
+// runLeaderElection renews or tries for the lease three times a lease
+// period, and gives it up when ctx is done so the standby takes over at
+// once.
+func (s *Server) runLeaderElection(ctx context.Context) {
+	if !haEnabled {
+		return
+	}
+	for sleep(ctx, haLeaseTTL/3) {
+		renewCtx, cancel := context.WithTimeout(ctx, haLeaseTTL/3)
+		if err := s.renewLease(renewCtx); err != nil {
+			s.logger.Printf("error renewing leader lease: %v", err)
+		}
+		cancel()
+	}
+
+	s.leader.mu.Lock()
+	held := !s.leader.until.IsZero()
+	s.leader.until = time.Time{}
+	s.leader.mu.Unlock()
+	if held {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := s.store.Settings.DeleteOne(releaseCtx, bson.M{"_id": leaderDocumentID, "holder": s.leader.instance}); err != nil {
+			s.logger.Printf("error releasing leader lease: %v", err)
+		}
+	}
+}
+
+// renewLease extends the lease if this instance holds it, or takes it if
+// it has expired. The lease is counted from before the write, so this
+// instance stops leading before any other can take over.
+func (s *Server) renewLease(ctx context.Context) error {
+	now := time.Now().UTC()
+	until := now.Add(haLeaseTTL)
+	filter := bson.M{
+		"_id": leaderDocumentID,
+		"$or": bson.A{
+			bson.M{"holder": s.leader.instance},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": leaderLease{Holder: s.leader.instance, ExpiresAt: until, RenewedAt: now}}
+	_, err := s.store.Settings.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	// Another instance holds the lease, so the upsert collides with it
+	held := err == nil
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		// Keep leading until the lease runs out, in case the database is
+		// only briefly unreachable
+		return err
+	}
+
+	s.leader.mu.Lock()
+	defer s.leader.mu.Unlock()
+	was := !s.leader.until.IsZero() && now.Before(s.leader.until)
+	switch {
+	case held && !was:
+		s.leader.since = now
+		s.logger.Printf("Acquired leader lease as %s; running background jobs", s.leader.instance)
+	case !held && was:
+		s.logger.Printf("Lost leader lease; %s is standing by", s.leader.instance)
+	}
+	if held {
+		s.leader.until = until
+	} else {
+		s.leader.until = time.Time{}
+	}
+	return nil
+}
+
+// HAStatus is this instance's part in an HA pair.
+type HAStatus struct {
+	Enabled  bool   `json:"enabled"`
+	Instance string `json:"instance,omitempty"`
+	// leader or standby
+	Role        string       `json:"role,omitempty"`
+	LeaderSince *time.Time   `json:"leader_since,omitempty"`
+	Lease       *leaderLease `json:"lease,omitempty"`
+}
+
+func (s *Server) haRole() string {
+	if s.leading() {
+		return "leader"
+	}
+	return "standby"
+}
+
+func (s *Server) handleGetHA(c *gin.Context) {
+	status := HAStatus{Enabled: haEnabled}
+	if !haEnabled {
+		c.JSON(http.StatusOK, status)
+		return
+	}
+	status.Instance, status.Role = s.leader.instance, s.haRole()
+	if status.Role == "leader" {
+		s.leader.mu.Lock()
+		since := s.leader.since
+		s.leader.mu.Unlock()
+		status.LeaderSince = &since
+	}
+	var lease leaderLease
+	err := s.store.Settings.FindOne(c.Request.Context(), bson.M{"_id": leaderDocumentID}).Decode(&lease)
+	if err != nil && err != mongo.ErrNoDocuments {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err == nil {
+		status.Lease = &lease
+	}
+	c.JSON(http.StatusOK, status)
+}
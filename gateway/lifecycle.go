@@ -0,0 +1,475 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// DailySummary summarizes a platform's fixes over one UTC day.
+type DailySummary struct {
+	Deployment     string       `json:"deployment" bson:"deployment"`
+	Platform       string       `json:"platform" bson:"platform"`
+	Date           string       `json:"date" bson:"date"`
+	Count          int64        `json:"count" bson:"count"`
+	FirstTimestamp string       `json:"first_timestamp" bson:"first_timestamp"`
+	LastTimestamp  string       `json:"last_timestamp" bson:"last_timestamp"`
+	Distance       float64      `json:"distance" bson:"distance"`
+	Bounds         ReportBounds `json:"bounds" bson:"bounds"`
+	Flagged        int64        `json:"flagged" bson:"flagged"`
+}
+
+// lifecycleState records how far rollups have got, in the settings
+// collection.
+type lifecycleState struct {
+	RolledUpTo string    `json:"rolled_up_to" bson:"rolled_up_to"`
+	LastRun    time.Time `json:"last_run" bson:"last_run"`
+}
+
+// LifecycleResult reports what one lifecycle run did.
+type LifecycleResult struct {
+	RolledUpTo      string `json:"rolled_up_to"`
+	DailySummaries  int64  `json:"daily_summaries"`
+	RecomputedDays  int64  `json:"recomputed_days"`
+	PrunedRaw       int64  `json:"pruned_raw"`
+	PrunedTelemetry int64  `json:"pruned_telemetry"`
+	PrunedMinute    int64  `json:"pruned_minute"`
+}
+
+const lifecycleDocumentID = "lifecycle"
+
+var lifecycleEnabled bool
+var lifecycleInterval = time.Hour
+var rawRetention time.Duration
+var minuteRetention time.Duration
+
+func (s *Server) initLifecycle() error {
+	dailyName := os.Getenv("MONGODB_DAILY_COLLECTION")
+	if dailyName == "" {
+		dailyName = s.store.Locations.Name() + "_daily"
+	}
+	s.store.DailySummaries = s.store.Collection(dailyName)
+
+	if v := os.Getenv("LIFECYCLE_ENABLED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid LIFECYCLE_ENABLED %q", v)
+		}
+		lifecycleEnabled = b
+	}
+	if !lifecycleEnabled {
+		return nil
+	}
+	// The minute tier is maintained by rollup runs
+	if !rollupsEnabled {
+		return fmt.Errorf("LIFECYCLE_ENABLED requires ROLLUPS_ENABLED")
+	}
+
+	var err error
+	if lifecycleInterval, err = parseRetention("LIFECYCLE_INTERVAL", lifecycleInterval); err != nil {
+		return err
+	}
+	if rawRetention, err = parseRetention("LIFECYCLE_RAW_RETENTION", 0); err != nil {
+		return err
+	}
+	if minuteRetention, err = parseRetention("LIFECYCLE_MINUTE_RETENTION", 0); err != nil {
+		return err
+	}
+	// Days are rolled up once complete, so raw data must outlive a full day
+	if rawRetention > 0 && rawRetention < 48*time.Hour {
+		return fmt.Errorf("LIFECYCLE_RAW_RETENTION must be at least 2d")
+	}
+	if minuteRetention > 0 && rawRetention > 0 && minuteRetention < rawRetention {
+		return fmt.Errorf("LIFECYCLE_MINUTE_RETENTION must not be shorter than LIFECYCLE_RAW_RETENTION")
+	}
+
+	indexes := []struct {
+		coll  store.Collection
+		model mongo.IndexModel
+	}{
+		{s.store.Locations, mongo.IndexModel{Keys: bson.D{{Key: "timestamp", Value: 1}}}},
+		{s.store.DailySummaries, mongo.IndexModel{
+			Keys:    bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "date", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}},
+	}
+	for _, index := range indexes {
+		if err := s.ensureIndex(index.coll, index.model); err != nil {
+			return fmt.Errorf("error creating lifecycle indexes: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// parseRetention reads a duration from the environment, accepting a number
+// of days ("30d") as well as Go durations ("36h").
+func parseRetention(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// rawRetentionCutoff returns the earliest timestamp still held in the raw
+// tier at now, or "" if raw fixes are kept forever.
+func rawRetentionCutoff(now time.Time) string {
+	if !lifecycleEnabled || rawRetention == 0 {
+		return ""
+	}
+	return now.Add(-rawRetention).Format(timestampLayout)
+}
+
+func (s *Server) runLifecycleScheduler(ctx context.Context) {
+	if !lifecycleEnabled {
+		return
+	}
+	for sleep(ctx, lifecycleInterval) {
+		// Pruning and rollups are writes, so pause them outside normal mode
+		if s.serviceMode().Mode != modeNormal || !s.leading() {
+			continue
+		}
+		if _, err := s.runLifecycle(ctx); err != nil {
+			s.logger.Printf("error running data lifecycle: %v", err)
+		}
+	}
+}
+
+// runLifecycle rolls completed UTC days up into daily summaries, recomputes
+// days that have received late fixes, and prunes expired data.
+// Raw fixes are never pruned before they have been rolled up.
+func (s *Server) runLifecycle(ctx context.Context) (LifecycleResult, error) {
+	var result LifecycleResult
+	started := time.Now().UTC()
+
+	var state lifecycleState
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": lifecycleDocumentID}).Decode(&state)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return result, err
+	}
+
+	rawCutoff := rawRetentionCutoff(started)
+
+	// Days already rolled up that have since received late fixes
+	if !state.LastRun.IsZero() && state.RolledUpTo != "" {
+		cursor, err := s.store.Locations.Aggregate(ctx, []bson.M{
+			{"$match": bson.M{
+				"created_at": bson.M{"$gte": state.LastRun},
+				"timestamp":  bson.M{"$lt": state.RolledUpTo, "$gte": rawCutoff},
+			}},
+			{"$group": bson.M{"_id": bson.M{
+				"deployment": "$deployment",
+				"platform":   "$platform",
+				"date":       bson.M{"$substrBytes": bson.A{"$timestamp", 0, 10}},
+			}}},
+		})
+		if err != nil {
+			return result, err
+		}
+		var dirty []struct {
+			ID struct {
+				Deployment string `bson:"deployment"`
+				Platform   string `bson:"platform"`
+				Date       string `bson:"date"`
+			} `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &dirty); err != nil {
+			return result, err
+		}
+		for _, d := range dirty {
+			// Days partly pruned from the raw tier can't be recomputed
+			day, err := time.Parse("2006-01-02", d.ID.Date)
+			if err != nil || day.Format(timestampLayout) < rawCutoff {
+				continue
+			}
+			days, err := s.rollupDays(ctx, bson.M{
+				"deployment": d.ID.Deployment,
+				"platform":   d.ID.Platform,
+				"timestamp": bson.M{
+					"$gte": day.Format(timestampLayout),
+					"$lt":  day.Add(24 * time.Hour).Format(timestampLayout),
+				},
+			})
+			if err != nil {
+				return result, err
+			}
+			result.DailySummaries += days
+			result.RecomputedDays++
+		}
+	}
+
+	// Newly completed days
+	to := started.Truncate(24 * time.Hour).Format(timestampLayout)
+	window := bson.M{"$lt": to}
+	if state.RolledUpTo != "" {
+		window["$gte"] = state.RolledUpTo
+	}
+	days, err := s.rollupDays(ctx, bson.M{"timestamp": window})
+	if err != nil {
+		return result, err
+	}
+	result.DailySummaries += days
+	result.RolledUpTo = to
+
+	state = lifecycleState{RolledUpTo: to, LastRun: started}
+	_, err = s.store.Settings.ReplaceOne(ctx, bson.M{"_id": lifecycleDocumentID}, state, options.Replace().SetUpsert(true))
+	if err != nil {
+		return result, err
+	}
+
+	if rawCutoff != "" {
+		res, err := s.store.Locations.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": min(rawCutoff, to)}})
+		if err != nil {
+			return result, err
+		}
+		result.PrunedRaw = res.DeletedCount
+		if res.DeletedCount > 0 {
+			s.facetCache.invalidate()
+			s.recordChanges(ctx, Change{Type: changePrune, Before: min(rawCutoff, to)})
+		}
+
+		// Telemetry goes with the fixes it was sent with
+		res, err = s.store.Telemetry.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": min(rawCutoff, to)}})
+		if err != nil {
+			return result, err
+		}
+		result.PrunedTelemetry = res.DeletedCount
+	}
+	if minuteRetention > 0 {
+		cutoff := started.Add(-minuteRetention).Format(timestampLayout)
+		res, err := s.store.MinuteRollups.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": cutoff}})
+		if err != nil {
+			return result, err
+		}
+		result.PrunedMinute = res.DeletedCount
+	}
+
+	return result, nil
+}
+
+// rollupDays builds daily summaries from the raw fixes matching filter,
+// which must select whole days, and upserts them.
+func (s *Server) rollupDays(ctx context.Context, filter bson.M) (days int64, err error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"deployment": 1, "platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1, "qc": 1})
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var writes []mongo.WriteModel
+	flush := func(force bool) error {
+		if len(writes) > 0 && (force || len(writes) >= importBatchSize) {
+			if _, err := s.store.DailySummaries.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+				return err
+			}
+			days += int64(len(writes))
+			writes = writes[:0]
+		}
+		return nil
+	}
+
+	var day *DailySummary
+	var prev *api.Location
+	endDay := func() {
+		if day != nil {
+			writes = append(writes, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"deployment": day.Deployment, "platform": day.Platform, "date": day.Date}).
+				SetReplacement(day).
+				SetUpsert(true))
+			day = nil
+		}
+	}
+
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return days, err
+		}
+		// Timestamps are stored fixed-width, so the prefix gives the day
+		if len(location.Timestamp) < 10 {
+			continue
+		}
+		date := location.Timestamp[:10]
+
+		samePlatform := prev != nil && prev.Deployment == location.Deployment && prev.Platform == location.Platform
+		if day == nil || !samePlatform || day.Date != date {
+			endDay()
+			day = &DailySummary{
+				Deployment:     location.Deployment,
+				Platform:       location.Platform,
+				Date:           date,
+				FirstTimestamp: location.Timestamp,
+				Bounds:         pointBounds(location.Latitude, location.Longitude),
+			}
+			samePlatform = false
+		}
+
+		day.Count++
+		day.LastTimestamp = location.Timestamp
+		if samePlatform {
+			day.Distance += haversine(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude)
+		}
+		day.Bounds.extend(location.Latitude, location.Longitude)
+		if location.QC != nil && location.QC.Status == qcFlagged {
+			day.Flagged++
+		}
+
+		current := location
+		prev = &current
+
+		if err := flush(false); err != nil {
+			return days, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return days, err
+	}
+	endDay()
+	return days, flush(true)
+}
+
+func (s *Server) handleGetLifecycle(c *gin.Context) {
+	var state lifecycleState
+	err := s.store.Settings.FindOne(c.Request.Context(), bson.M{"_id": lifecycleDocumentID}).Decode(&state)
+	if err != nil && err != mongo.ErrNoDocuments {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":          lifecycleEnabled,
+		"interval":         lifecycleInterval.String(),
+		"raw_retention":    rawRetention.String(),
+		"minute_retention": minuteRetention.String(),
+		"state":            state,
+	})
+}
+
+func (s *Server) handleRunLifecycle(c *gin.Context) {
+	if !lifecycleEnabled {
+		respondErrorf(c, http.StatusConflict, "data lifecycle is disabled (set LIFECYCLE_ENABLED)")
+		return
+	}
+
+	job := s.startJob("lifecycle", func(progress func(done, total int64)) (interface{}, error) {
+		return s.runLifecycle(context.Background())
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleGetRollups serves the minute, hourly and daily tiers.
+func (s *Server) handleGetRollups(c *gin.Context) {
+	resolution := c.Param("resolution")
+	var coll store.Collection
+	var timeField string
+	switch resolution {
+	case "minute":
+		coll, timeField = s.store.MinuteRollups, "timestamp"
+	case "hourly":
+		coll, timeField = s.store.HourlyRollups, "timestamp"
+	case "daily":
+		coll, timeField = s.store.DailySummaries, "date"
+	default:
+		respondErrorf(c, http.StatusNotFound, "resolution must be minute, hourly or daily")
+		return
+	}
+
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	for param, op := range map[string]string{"start": "$gte", "end": "$lte"} {
+		if v := c.Query(param); v != "" {
+			ts, err := normalizeTimestamp(v, loc)
+			if err != nil {
+				respondErrorf(c, http.StatusBadRequest, "invalid %s: %v", param, err)
+				return
+			}
+			// Daily summaries are keyed by date, the timestamp's prefix
+			if timeField == "date" {
+				ts = ts[:10]
+			}
+			timeRange[op] = ts
+		}
+	}
+	if len(timeRange) > 0 {
+		filter[timeField] = timeRange
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: timeField, Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"_id": 0}).
+		SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := coll.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var docs []bson.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(docs)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	if docs == nil {
+		docs = []bson.M{}
+	}
+
+	c.Header("X-Sort-Order", "platform,"+timeField+",_id")
+	c.JSON(http.StatusOK, docs)
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Result limits unless QUERY_DEFAULT_LIMIT and QUERY_MAX_LIMIT are set
+const (
+	defaultQueryLimit int64 = 10000
+	defaultQueryMax   int64 = 100000
+)
+
+func (s *Server) initLimits() error {
+	// Get result limits from environment variables or use defaults
+	if v := os.Getenv("QUERY_DEFAULT_LIMIT"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid QUERY_DEFAULT_LIMIT %q", v)
+		}
+		s.defaultResultLimit = n
+	}
+	if v := os.Getenv("QUERY_MAX_LIMIT"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid QUERY_MAX_LIMIT %q", v)
+		}
+		s.maxResultLimit = n
+	}
+	if s.defaultResultLimit > s.maxResultLimit {
+		return fmt.Errorf("QUERY_DEFAULT_LIMIT (%d) exceeds QUERY_MAX_LIMIT (%d)", s.defaultResultLimit, s.maxResultLimit)
+	}
+	return nil
+}
+
+// parseLimit validates the limit and offset query parameters. When no limit
+// is given the default limit applies and explicit is false.
+func (s *Server) parseLimit(limitParam, offsetParam string) (limit, offset int64, explicit bool, err error) {
+	limit = s.defaultResultLimit
+	if limitParam != "" {
+		limit, err = strconv.ParseInt(limitParam, 10, 64)
+		if err != nil || limit <= 0 {
+			return 0, 0, false, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > s.maxResultLimit {
+			return 0, 0, false, fmt.Errorf("limit %d exceeds the maximum of %d; narrow the query or paginate with offset", limit, s.maxResultLimit)
+		}
+		explicit = true
+	}
+
+	if offsetParam != "" {
+		offset, err = strconv.ParseInt(offsetParam, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, explicit, nil
+}
+
+func tooManyResultsError(limit int64) error {
+	return withCode(codeTooManyResults, fmt.Errorf("query matches more than %d results; narrow the query or paginate with limit and offset", limit))
+}
+
+// pageOrder is the total order paginated results are returned in: by a
+// field, then by _id between results with the same value, so consecutive
+// pages neither overlap nor leave gaps however many results tie.
+type pageOrder struct {
+	field string
+	desc  bool
+	// The field holds dates rather than timestamp strings
+	date bool
+}
+
+var timestampOrder = pageOrder{field: "timestamp"}
+
+func (o pageOrder) sort() bson.D {
+	dir := 1
+	if o.desc {
+		dir = -1
+	}
+	return bson.D{{Key: o.field, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// String describes the order as the X-Sort-Order header does.
+func (o pageOrder) String() string {
+	if o.desc {
+		return "-" + o.field + ",-_id"
+	}
+	return o.field + ",_id"
+}
+
+// pageCursor marks where a page ended, by its last result's sort value and
+// _id.
+type pageCursor struct {
+	Value interface{}        `json:"v"`
+	ID    primitive.ObjectID `json:"id"`
+}
+
+func (o pageOrder) cursor(value interface{}, id primitive.ObjectID) string {
+	data, _ := json.Marshal(pageCursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseAfter reads the after parameter, the cursor a previous page ended
+// with, and returns the filter for the results following it, or nil if
+// there is none. Cursors resume where the page ended even as results are
+// inserted before it, which offsets can't.
+func (o pageOrder) parseAfter(c *gin.Context, offset int64) (bson.M, error) {
+	return o.afterCursor(c.Query("after"), offset)
+}
+
+// afterCursor is parseAfter for a cursor given other than as the after
+// parameter, such as a GraphQL argument.
+func (o pageOrder) afterCursor(v string, offset int64) (bson.M, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if offset > 0 {
+		return nil, fmt.Errorf("after cannot be combined with offset")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid after cursor")
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, fmt.Errorf("invalid after cursor")
+	}
+	value, ok := cur.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid after cursor")
+	}
+	var key interface{} = value
+	if o.date {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid after cursor")
+		}
+		key = t
+	}
+
+	op := "$gt"
+	if o.desc {
+		op = "$lt"
+	}
+	return bson.M{"$or": []bson.M{
+		{o.field: bson.M{op: key}},
+		{o.field: key, "_id": bson.M{op: cur.ID}},
+	}}, nil
+}
+
+// afterFilter narrows filter to the results following a cursor read by
+// parseAfter, if there is one.
+func afterFilter(filter, after bson.M) bson.M {
+	if after == nil {
+		return filter
+	}
+	return bson.M{"$and": []bson.M{filter, after}}
+}
+
+// setPageHeaders describes the order of a page of n results, and where the
+// next page starts if this one was cut off at the limit.
+func (o pageOrder) setPageHeaders(c *gin.Context, n, limit int64, explicit bool, last func() (interface{}, primitive.ObjectID)) {
+	c.Header("X-Sort-Order", o.String())
+	if explicit && n > 0 && n == limit {
+		c.Header("X-Next-Cursor", o.cursor(last()))
+	}
+}
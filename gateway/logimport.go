@@ -0,0 +1,529 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+// logFix is a position recovered from a vehicle log.
+type logFix struct {
+	Time      time.Time
+	Latitude  float64
+	Longitude float64
+	Source    string
+}
+
+// logParsers maps import formats to their parsers.
+var logParsers = map[string]func(data []byte) ([]logFix, error){
+	"nmea":      parseNMEALog,
+	"glider":    parseGliderLog,
+	"ardupilot": parseArduPilotLog,
+}
+
+const importBatchSize = 1000
+
+type importResult struct {
+	Parsed   int64 `json:"parsed"`
+	Inserted int64 `json:"inserted"`
+	Rejected int64 `json:"rejected"`
+}
+
+// handleImportLog backfills a platform's track from an onboard log file
+// recovered after a mission. The file is parsed up front and stored by a
+// background job.
+func (s *Server) handleImportLog(c *gin.Context) {
+	deployment := c.Query("deployment")
+	platform := c.Query("platform")
+	if deployment == "" || platform == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment and platform are required")
+		return
+	}
+
+	format := c.Query("format")
+	parse, ok := logParsers[format]
+	if !ok {
+		respondErrorf(c, http.StatusBadRequest, "unknown format %q (expected nmea, glider, or ardupilot)", format)
+		return
+	}
+
+	// Accept the log either as a multipart file upload or as the raw body
+	var data []byte
+	var err error
+	if file, ferr := c.FormFile("file"); ferr == nil {
+		f, err := file.Open()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+	} else if data, err = c.GetRawData(); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	fixes, err := parse(data)
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "error parsing %s log: %v", format, err)
+		return
+	}
+	if len(fixes) == 0 {
+		respondErrorf(c, http.StatusBadRequest, "log contains no position fixes")
+		return
+	}
+
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].Time.Before(fixes[j].Time) })
+
+	source := c.Query("source")
+	job := s.startJob("log_import", func(progress func(done, total int64)) (interface{}, error) {
+		return s.importFixes(deployment, platform, source, fixes, progress)
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// importFixes stores parsed fixes as backfilled locations. Each goes through
+// the ingest pipeline as if posted to /api/data, without the clock skew
+// check, so it is derived from the fix stored before it and kept, notified,
+// and recorded like any other. Fixes the pipeline refuses are counted as
+// rejected.
+func (s *Server) importFixes(deployment, platform, source string, fixes []logFix, progress func(done, total int64)) (importResult, error) {
+	ctx := context.Background()
+	result := importResult{Parsed: int64(len(fixes))}
+	receivedAt := time.Now().UTC().Format(timestampLayout)
+
+	for i, fix := range fixes {
+		req := &ingestRequest{
+			location: api.Location{
+				Deployment: deployment,
+				Platform:   platform,
+				Latitude:   fix.Latitude,
+				Longitude:  fix.Longitude,
+				Timestamp:  fix.Time.UTC().Format(timestampLayout),
+				Source:     fix.Source,
+				CRS:        crsWGS84,
+			},
+			tz:        time.UTC,
+			rawFormat: payloadFormatLocation,
+			backfill:  true,
+		}
+		if source != "" {
+			req.location.Source = source
+		}
+		// The fix is kept as the location it was read as, so it can be
+		// reparsed like a posted one
+		raw, err := json.Marshal(req.location)
+		if err != nil {
+			return result, err
+		}
+		req.raw = raw
+		req.location.ReceivedAt = receivedAt
+
+		if status, err := s.importFix(ctx, req); err != nil {
+			if status >= http.StatusInternalServerError {
+				return result, err
+			}
+			result.Rejected++
+		} else {
+			result.Inserted++
+		}
+		if done := int64(i + 1); done%importBatchSize == 0 || done == result.Parsed {
+			progress(done, result.Parsed)
+		}
+	}
+
+	return result, nil
+}
+
+// importFix stores one fix recovered from a log. Errors come with the
+// status ingest would have responded with.
+func (s *Server) importFix(ctx context.Context, req *ingestRequest) (int, error) {
+	if err := normalizeLocation(&req.location, req.tz); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if status, err := s.processIngest(ctx, req, false); err != nil {
+		return status, err
+	}
+	defer req.release()
+	if _, _, err := s.storeIngest(ctx, req); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// NMEA 0183 logs
+
+// parseNMEALog extracts fixes from RMC sentences, and from GGA sentences once
+// an RMC sentence has established the date.
+func parseNMEALog(data []byte) ([]logFix, error) {
+	var fixes []logFix
+	seen := make(map[time.Time]bool)
+	var date time.Time
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Logs often prefix sentences with a logger timestamp
+		start := strings.IndexByte(line, '$')
+		if start < 0 {
+			continue
+		}
+		sentence, ok := verifyNMEAChecksum(line[start:])
+		if !ok {
+			continue
+		}
+
+		fields := strings.Split(sentence, ",")
+		// Sentence type follows the two-character talker ID
+		if len(fields[0]) != 5 {
+			continue
+		}
+
+		var fix logFix
+		switch fields[0][2:] {
+		case "RMC":
+			if len(fields) < 10 || fields[2] != "A" {
+				continue
+			}
+			d, err := time.Parse("020106", fields[9])
+			if err != nil {
+				continue
+			}
+			date = d
+			t, err := nmeaTime(date, fields[1])
+			if err != nil {
+				continue
+			}
+			lat, err1 := nmeaCoordinate(fields[3], fields[4])
+			lon, err2 := nmeaCoordinate(fields[5], fields[6])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			fix = logFix{Time: t, Latitude: lat, Longitude: lon, Source: "nmea"}
+		case "GGA":
+			if len(fields) < 7 || date.IsZero() || fields[6] == "" || fields[6] == "0" {
+				continue
+			}
+			t, err := nmeaTime(date, fields[1])
+			if err != nil {
+				continue
+			}
+			lat, err1 := nmeaCoordinate(fields[2], fields[3])
+			lon, err2 := nmeaCoordinate(fields[4], fields[5])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			fix = logFix{Time: t, Latitude: lat, Longitude: lon, Source: "nmea"}
+		default:
+			continue
+		}
+
+		// RMC and GGA sentences usually report the same epoch
+		if seen[fix.Time] {
+			continue
+		}
+		seen[fix.Time] = true
+		fixes = append(fixes, fix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return fixes, nil
+}
+
+// verifyNMEAChecksum strips the leading $ and trailing checksum from a
+// sentence, reporting whether the checksum (if present) matches.
+func verifyNMEAChecksum(sentence string) (string, bool) {
+	sentence = strings.TrimPrefix(sentence, "$")
+	body, checksum, hasChecksum := strings.Cut(sentence, "*")
+	if !hasChecksum {
+		return body, true
+	}
+
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	want, err := strconv.ParseUint(strings.TrimSpace(checksum), 16, 8)
+	return body, err == nil && byte(want) == sum
+}
+
+func nmeaTime(date time.Time, value string) (time.Time, error) {
+	if len(value) < 6 {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	h, err1 := strconv.Atoi(value[0:2])
+	m, err2 := strconv.Atoi(value[2:4])
+	s, err3 := strconv.ParseFloat(value[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return date.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))), nil
+}
+
+// nmeaCoordinate converts a ddmm.mmmm value and hemisphere to decimal degrees.
+func nmeaCoordinate(value, hemisphere string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	deg := math.Floor(v / 100)
+	result := deg + (v-deg*100)/60
+	if hemisphere == "S" || hemisphere == "W" {
+		result = -result
+	}
+	return result, nil
+}
+
+// Slocum glider logs (.sbd/.tbd/.dbd converted to ASCII with dbd2asc)
+
+// parseGliderLog reads dbd2asc output, preferring GPS fixes and falling back
+// to the dead-reckoned position when no GPS columns are present.
+func parseGliderLog(data []byte) ([]logFix, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	// Header: num_ascii_tags tag lines, then sensor names, units, and byte sizes
+	numTags := -1
+	for line := 0; numTags < 0 || line < numTags; line++ {
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("truncated header")
+		}
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		if strings.TrimSpace(key) == "num_ascii_tags" {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid num_ascii_tags")
+			}
+			numTags = n
+		}
+		if line > 64 && numTags < 0 {
+			return nil, fmt.Errorf("missing num_ascii_tags")
+		}
+	}
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("missing sensor names")
+	}
+	names := strings.Fields(scanner.Text())
+	scanner.Scan() // units
+	scanner.Scan() // byte sizes
+
+	column := func(name string) int {
+		for i, n := range names {
+			if n == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	timeCol := column("m_present_time")
+	if timeCol < 0 {
+		timeCol = column("sci_m_present_time")
+	}
+	latCol, lonCol, source := column("m_gps_lat"), column("m_gps_lon"), "gps"
+	if latCol < 0 || lonCol < 0 {
+		latCol, lonCol, source = column("m_lat"), column("m_lon"), "dead_reckoned"
+	}
+	if timeCol < 0 || latCol < 0 || lonCol < 0 {
+		return nil, fmt.Errorf("log has no time and position columns")
+	}
+
+	var fixes []logFix
+	for scanner.Scan() {
+		values := strings.Fields(scanner.Text())
+		if len(values) != len(names) {
+			continue
+		}
+		t, err1 := strconv.ParseFloat(values[timeCol], 64)
+		lat, err2 := strconv.ParseFloat(values[latCol], 64)
+		lon, err3 := strconv.ParseFloat(values[lonCol], 64)
+		if err1 != nil || err2 != nil || err3 != nil || math.IsNaN(t) || math.IsNaN(lat) || math.IsNaN(lon) {
+			continue
+		}
+		// Gliders report positions as signed ddmm.mmmm; 69696969 marks invalid
+		if math.Abs(lat) > 9000 || math.Abs(lon) > 18000 {
+			continue
+		}
+
+		sec, frac := math.Modf(t)
+		fixes = append(fixes, logFix{
+			Time:      time.Unix(int64(sec), int64(frac*1e9)).UTC(),
+			Latitude:  gliderCoordinate(lat),
+			Longitude: gliderCoordinate(lon),
+			Source:    source,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return fixes, nil
+}
+
+func gliderCoordinate(v float64) float64 {
+	sign := 1.0
+	if v < 0 {
+		sign, v = -1, -v
+	}
+	deg := math.Floor(v / 100)
+	return sign * (deg + (v-deg*100)/60)
+}
+
+// ArduPilot DataFlash logs (.bin)
+
+var dataflashFieldSizes = map[byte]int{
+	'a': 64, 'b': 1, 'B': 1, 'h': 2, 'H': 2, 'i': 4, 'I': 4, 'f': 4, 'd': 8,
+	'n': 4, 'N': 16, 'Z': 64, 'c': 2, 'C': 2, 'e': 4, 'E': 4, 'L': 4, 'M': 1,
+	'q': 8, 'Q': 8, 'g': 2,
+}
+
+type dataflashFormat struct {
+	name    string
+	length  int
+	format  string
+	offsets map[string]int
+	types   map[string]byte
+}
+
+// GPS time starts at 1980-01-06 and has run ahead of UTC by 18 leap seconds
+// since 2017.
+var gpsEpoch = time.Date(1980, 1, 6, 0, 0, 0, 0, time.UTC)
+
+const gpsLeapSeconds = 18
+
+// parseArduPilotLog reads GPS messages from a DataFlash binary log, using the
+// FMT messages in the log to locate their fields.
+func parseArduPilotLog(data []byte) ([]logFix, error) {
+	const head1, head2, fmtType = 0xA3, 0x95, 0x80
+
+	formats := map[byte]*dataflashFormat{
+		fmtType: {name: "FMT", length: 89},
+	}
+
+	var fixes []logFix
+	for pos := 0; pos+3 <= len(data); {
+		if data[pos] != head1 || data[pos+1] != head2 {
+			pos++
+			continue
+		}
+		msgType := data[pos+2]
+		f, ok := formats[msgType]
+		if !ok || pos+f.length > len(data) {
+			pos++
+			continue
+		}
+		msg := data[pos+3 : pos+f.length]
+
+		switch {
+		case msgType == fmtType:
+			def := &dataflashFormat{
+				length: int(msg[1]),
+				name:   strings.TrimRight(string(msg[2:6]), "\x00"),
+				format: strings.TrimRight(string(msg[6:22]), "\x00"),
+			}
+			labels := strings.Split(strings.TrimRight(string(msg[22:86]), "\x00"), ",")
+			if err := def.index(labels); err == nil {
+				formats[msg[0]] = def
+			}
+		case f.name == "GPS":
+			if fix, ok := f.gpsFix(msg); ok {
+				fixes = append(fixes, fix)
+			}
+		}
+		pos += f.length
+	}
+
+	if len(formats) == 1 {
+		return nil, fmt.Errorf("no DataFlash format messages found")
+	}
+	return fixes, nil
+}
+
+func (f *dataflashFormat) index(labels []string) error {
+	if len(labels) != len(f.format) {
+		return fmt.Errorf("format and labels disagree")
+	}
+	f.offsets = make(map[string]int)
+	f.types = make(map[string]byte)
+	offset := 0
+	for i := 0; i < len(f.format); i++ {
+		size, ok := dataflashFieldSizes[f.format[i]]
+		if !ok {
+			return fmt.Errorf("unknown field type %q", f.format[i])
+		}
+		f.offsets[labels[i]] = offset
+		f.types[labels[i]] = f.format[i]
+		offset += size
+	}
+	if offset+3 != f.length {
+		return fmt.Errorf("format length mismatch")
+	}
+	return nil
+}
+
+func (f *dataflashFormat) intField(msg []byte, label string) (int64, bool) {
+	offset, ok := f.offsets[label]
+	if !ok {
+		return 0, false
+	}
+	switch f.types[label] {
+	case 'b':
+		return int64(int8(msg[offset])), true
+	case 'B', 'M':
+		return int64(msg[offset]), true
+	case 'h', 'c':
+		return int64(int16(binary.LittleEndian.Uint16(msg[offset:]))), true
+	case 'H', 'C':
+		return int64(binary.LittleEndian.Uint16(msg[offset:])), true
+	case 'i', 'L', 'e':
+		return int64(int32(binary.LittleEndian.Uint32(msg[offset:]))), true
+	case 'I', 'E':
+		return int64(binary.LittleEndian.Uint32(msg[offset:])), true
+	case 'q':
+		return int64(binary.LittleEndian.Uint64(msg[offset:])), true
+	case 'Q':
+		return int64(binary.LittleEndian.Uint64(msg[offset:])), true
+	}
+	return 0, false
+}
+
+func (f *dataflashFormat) gpsFix(msg []byte) (logFix, bool) {
+	status, ok1 := f.intField(msg, "Status")
+	week, ok2 := f.intField(msg, "GWk")
+	ms, ok3 := f.intField(msg, "GMS")
+	lat, ok4 := f.intField(msg, "Lat")
+	lng, ok5 := f.intField(msg, "Lng")
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || f.types["Lat"] != 'L' || f.types["Lng"] != 'L' {
+		return logFix{}, false
+	}
+	// Status 3 and above is a 3D fix
+	if status < 3 || week == 0 {
+		return logFix{}, false
+	}
+
+	t := gpsEpoch.Add(time.Duration(week)*7*24*time.Hour + time.Duration(ms)*time.Millisecond - gpsLeapSeconds*time.Second)
+	return logFix{Time: t, Latitude: float64(lat) / 1e7, Longitude: float64(lng) / 1e7, Source: "gps"}, true
+}
@@ -0,0 +1,229 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Log entries kept for GET /admin/logs/stream
+const logTailSize = 1000
+
+// Entries sent from the tail when a stream starts, unless lines says
+const defaultLogLines = 100
+
+// Log levels, from least to most severe
+const (
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+var logLevels = map[string]int{logInfo: 0, logWarn: 1, logError: 2}
+
+// LogEntry is a message the gateway logged.
+type LogEntry struct {
+	Seq   int64     `json:"seq"`
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	// The part of the gateway that logged it, such as alerts or reports
+	Module  string `json:"module"`
+	Message string `json:"message"`
+}
+
+// logTail keeps the latest messages written to the gateway's logger and
+// passes new ones to stream subscribers, so operators can follow the log
+// without access to the host.
+type logTail struct {
+	// The logger messages are also written to
+	out *log.Logger
+
+	mu          sync.Mutex
+	entries     []LogEntry
+	next        int
+	seq         int64
+	subscribers map[chan LogEntry]struct{}
+}
+
+// newLogTail returns a logger that writes to out and keeps what it writes
+// in the tail.
+func newLogTail(out *log.Logger) (*log.Logger, *logTail) {
+	t := &logTail{out: out, subscribers: make(map[chan LogEntry]struct{})}
+	return log.New(t, "", 0), t
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	module := logModule()
+	// Formatted as the logger was configured, and attributed to the caller
+	t.out.Output(4, msg)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	entry := LogEntry{Seq: t.seq, Time: time.Now().UTC(), Level: logLevel(module, msg), Module: module, Message: msg}
+	if len(t.entries) < logTailSize {
+		t.entries = append(t.entries, entry)
+	} else {
+		t.entries[t.next] = entry
+		t.next = (t.next + 1) % logTailSize
+	}
+	for ch := range t.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// logModule names the source file that logged the message being written.
+func logModule() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "log.") {
+			return strings.TrimSuffix(filepath.Base(frame.File), ".go")
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// logLevel classifies a message by what it says, since the gateway's
+// messages name the errors they report. Internal request errors are logged
+// by errors.go.
+func logLevel(module, msg string) string {
+	switch {
+	case strings.Contains(msg, " rejected: ") || strings.Contains(msg, "consider"):
+		return logWarn
+	case module == "errors" || strings.Contains(msg, "error") || strings.Contains(msg, "failed"):
+		return logError
+	}
+	return logInfo
+}
+
+// subscribe returns the entries in the tail after seq, oldest first, and a
+// channel receiving the entries logged from then on.
+func (t *logTail) subscribe(seq int64) ([]LogEntry, chan LogEntry) {
+	ch := make(chan LogEntry, 256)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var recent []LogEntry
+	for i := range t.entries {
+		entry := t.entries[(t.next+i)%len(t.entries)]
+		if entry.Seq > seq {
+			recent = append(recent, entry)
+		}
+	}
+	t.subscribers[ch] = struct{}{}
+	return recent, ch
+}
+
+func (t *logTail) unsubscribe(ch chan LogEntry) {
+	t.mu.Lock()
+	delete(t.subscribers, ch)
+	t.mu.Unlock()
+}
+
+// handleStreamLogs sends the gateway's log messages as server-sent events:
+// the latest from the tail, then each as it is logged. Events carry the
+// entry's seq as their ID, so a reconnecting client resumes after the last
+// entry it received.
+func (s *Server) handleStreamLogs(c *gin.Context) {
+	minLevel := logLevels[logInfo]
+	if v := c.Query("level"); v != "" {
+		level, ok := logLevels[v]
+		if !ok {
+			respondErrorf(c, http.StatusBadRequest, "invalid level %q (expected info, warn or error)", v)
+			return
+		}
+		minLevel = level
+	}
+	var modules map[string]bool
+	if v := c.Query("module"); v != "" {
+		modules = make(map[string]bool)
+		for _, module := range strings.Split(v, ",") {
+			modules[strings.TrimSpace(module)] = true
+		}
+	}
+	lines := defaultLogLines
+	if v := c.Query("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > logTailSize {
+			respondErrorf(c, http.StatusBadRequest, "invalid lines %q (expected 0 to %d)", v, logTailSize)
+			return
+		}
+		lines = n
+	}
+	// Set by EventSource when it reconnects
+	after := int64(-1)
+	if v := c.GetHeader("Last-Event-ID"); v != "" {
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid Last-Event-ID %q", v)
+			return
+		}
+		after = seq
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	matches := func(entry LogEntry) bool {
+		return logLevels[entry.Level] >= minLevel && (modules == nil || modules[entry.Module])
+	}
+	recent, ch := s.logTail.subscribe(max(after, 0))
+	defer s.logTail.unsubscribe(ch)
+	var backlog []LogEntry
+	for _, entry := range recent {
+		if matches(entry) {
+			backlog = append(backlog, entry)
+		}
+	}
+	if after < 0 && len(backlog) > lines {
+		backlog = backlog[len(backlog)-lines:]
+	}
+
+	disableWriteTimeout(c)
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	send := func(w io.Writer, entry LogEntry) {
+		entry.Time = entry.Time.In(loc)
+		data, _ := json.Marshal(casedValue(c, entry))
+		fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", entry.Seq, data)
+	}
+	for _, entry := range backlog {
+		send(c.Writer, entry)
+	}
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case entry := <-ch:
+			if matches(entry) {
+				send(w, entry)
+			}
+			return true
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	maxMatchSamples = 10000
+	// Default for how far in time a fix may be from a sample to match it
+	defaultMatchTolerance = time.Minute
+)
+
+// MatchRequest asks for the fixes nearest a list of samples, such as camera
+// frames or bottle fires logged by an instrument without navigation.
+type MatchRequest struct {
+	Deployment string `json:"deployment" binding:"required"`
+	// Limits matches to one platform; required unless every sample has a
+	// position to find the nearest platform by
+	Platform string `json:"platform"`
+	// How far in time a fix may be from a sample, as a duration
+	Tolerance string `json:"tolerance"`
+	// How far in meters a fix may be from a sample's position
+	MaxDistance float64       `json:"max_distance"`
+	Samples     []MatchSample `json:"samples" binding:"required"`
+}
+
+// MatchSample is a time, and optionally a position, to match a fix to.
+type MatchSample struct {
+	ID        string   `json:"id,omitempty"`
+	Timestamp string   `json:"timestamp"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// MatchResult is the fix matched to a sample, if any was within tolerance.
+type MatchResult struct {
+	ID        string        `json:"id,omitempty"`
+	Timestamp string        `json:"timestamp"`
+	Fix       *api.Location `json:"fix"`
+	// Seconds the fix is after (positive) or before the sample
+	Offset *float64 `json:"offset,omitempty"`
+	// Meters between the fix and the sample's position
+	Distance *float64 `json:"distance,omitempty"`
+	// The platform's position at the sample's time, interpolated between
+	// its fixes either side when both are within tolerance
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// platformFixes is one platform's fixes in timestamp order, with their
+// parsed times.
+type platformFixes struct {
+	fixes []api.Location
+	times []time.Time
+}
+
+// nearest returns the index of the fix nearest t, and of the fixes at or
+// before and after it, -1 where there are none.
+func (p *platformFixes) nearest(t time.Time) (nearest, before, after int) {
+	after = sort.Search(len(p.times), func(i int) bool { return p.times[i].After(t) })
+	before = after - 1
+	if after == len(p.times) {
+		after = -1
+	}
+	switch {
+	case before < 0:
+		nearest = after
+	case after < 0:
+		nearest = before
+	case t.Sub(p.times[before]) <= p.times[after].Sub(t):
+		nearest = before
+	default:
+		nearest = after
+	}
+	return nearest, before, after
+}
+
+func (s *Server) handleMatch(c *gin.Context) {
+	var req MatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Samples) > maxMatchSamples {
+		respondErrorf(c, http.StatusBadRequest, "at most %d samples may be matched at once", maxMatchSamples)
+		return
+	}
+	if req.Platform != "" && !canRead(c, req.Deployment, req.Platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	tolerance := defaultMatchTolerance
+	if req.Tolerance != "" {
+		d, err := time.ParseDuration(req.Tolerance)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid tolerance %q", req.Tolerance)
+			return
+		}
+		tolerance = d
+	}
+	if req.MaxDistance < 0 {
+		respondErrorf(c, http.StatusBadRequest, "max_distance must not be negative")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Parse the samples and find the span of time they cover
+	times := make([]time.Time, len(req.Samples))
+	var first, last time.Time
+	for i, sample := range req.Samples {
+		t, err := parseTimestampIn(sample.Timestamp, loc)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "sample %d: %v", i+1, err)
+			return
+		}
+		if (sample.Latitude == nil) != (sample.Longitude == nil) {
+			respondErrorf(c, http.StatusBadRequest, "sample %d: latitude and longitude must be sent together", i+1)
+			return
+		}
+		if req.Platform == "" && sample.Latitude == nil {
+			respondErrorf(c, http.StatusBadRequest, "sample %d: a position is required to match without a platform", i+1)
+			return
+		}
+		times[i] = t
+		if i == 0 || t.Before(first) {
+			first = t
+		}
+		if i == 0 || t.After(last) {
+			last = t
+		}
+	}
+
+	filter := bson.M{"deployment": req.Deployment}
+	if req.Platform != "" {
+		filter["platform"] = req.Platform
+	}
+	if len(req.Samples) > 0 {
+		filter["timestamp"] = bson.M{
+			"$gte": first.Add(-tolerance).UTC().Format(timestampLayout),
+			"$lte": last.Add(tolerance).UTC().Format(timestampLayout),
+		}
+	}
+	ctx := c.Request.Context()
+	// Fetch one extra fix to detect spans exceeding the limit
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetLimit(s.maxResultLimit + 1)
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var locations []api.Location
+	if err := cursor.All(ctx, &locations); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(locations)) > s.maxResultLimit {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, "the samples span more than %d fixes; match them in smaller batches", s.maxResultLimit)
+		return
+	}
+
+	platforms := map[string]*platformFixes{}
+	var names []string
+	for _, location := range locations {
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		p, ok := platforms[location.Platform]
+		if !ok {
+			p = &platformFixes{}
+			platforms[location.Platform] = p
+			names = append(names, location.Platform)
+		}
+		p.fixes = append(p.fixes, location)
+		p.times = append(p.times, t)
+	}
+
+	results := make([]MatchResult, len(req.Samples))
+	for i, sample := range req.Samples {
+		t := times[i]
+		result := MatchResult{ID: sample.ID, Timestamp: t.In(loc).Format(timestampLayout)}
+
+		// Take the fix nearest in time, or with a position, the platform whose
+		// nearest fix in time is nearest in space
+		var best *platformFixes
+		bestIndex, bestBefore, bestAfter := -1, -1, -1
+		bestDistance := 0.0
+		for _, name := range names {
+			p := platforms[name]
+			n, before, after := p.nearest(t)
+			if n < 0 || p.times[n].Sub(t).Abs() > tolerance {
+				continue
+			}
+			distance := 0.0
+			if sample.Latitude != nil {
+				distance = haversine(*sample.Latitude, *sample.Longitude, p.fixes[n].Latitude, p.fixes[n].Longitude)
+				if req.MaxDistance > 0 && distance > req.MaxDistance {
+					continue
+				}
+			}
+			if best == nil || distance < bestDistance {
+				best, bestIndex, bestBefore, bestAfter, bestDistance = p, n, before, after, distance
+			}
+		}
+
+		if best != nil {
+			fix := best.fixes[bestIndex]
+			localizeLocation(&fix, loc)
+			offset := best.times[bestIndex].Sub(t).Seconds()
+			result.Fix, result.Offset = &fix, &offset
+			if sample.Latitude != nil {
+				result.Distance = &bestDistance
+			}
+			lat, lon := best.fixes[bestIndex].Latitude, best.fixes[bestIndex].Longitude
+			if bestBefore >= 0 && bestAfter >= 0 && t.Sub(best.times[bestBefore]) <= tolerance && best.times[bestAfter].Sub(t) <= tolerance {
+				if ilat, ilon, ok := interpolatePosition(best.fixes[bestBefore], best.fixes[bestAfter], t); ok {
+					lat, lon = ilat, ilon
+				}
+			}
+			result.Latitude, result.Longitude = &lat, &lon
+		}
+		results[i] = result
+	}
+	c.JSON(http.StatusOK, results)
+}
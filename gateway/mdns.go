@@ -0,0 +1,355 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// DNS-SD service type the gateway advertises itself as
+const mdnsServiceType = "_datagateway._tcp.local."
+
+// Name browsers query to list the service types on the network
+const mdnsServicesName = "_services._dns-sd._udp.local."
+
+// TTLs RFC 6762 recommends: short for records naming hosts and addresses,
+// which change when a host moves, long for the rest
+const (
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 4500
+)
+
+// Set on the class of records only this host answers for, so caches
+// replace what they held rather than adding to it
+const mdnsCacheFlush = 1 << 15
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsConfig is how the gateway advertises itself on the local network.
+type mdnsConfig struct {
+	// The service instance, shown by browsers, such as "data-gateway on ship-gw"
+	instance string
+	// The host name addresses are advertised under, such as "ship-gw.local."
+	host       string
+	deployment string
+}
+
+// How the gateway advertises itself; nil unless MDNS_ENABLED is set
+var mdnsAdvert *mdnsConfig
+
+func initMDNS() error {
+	mdnsAdvert = nil
+	if os.Getenv("MDNS_ENABLED") != "true" {
+		return nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error reading host name for mDNS: %v", err)
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	cfg := &mdnsConfig{
+		instance:   os.Getenv("MDNS_INSTANCE"),
+		host:       hostname + ".local.",
+		deployment: os.Getenv("MDNS_DEPLOYMENT"),
+	}
+	if cfg.instance == "" {
+		cfg.instance = "data-gateway on " + hostname
+	}
+	if len(cfg.instance) > 63 || strings.Contains(cfg.instance, ".") {
+		return fmt.Errorf("invalid MDNS_INSTANCE %q (expected up to 63 characters, without dots)", cfg.instance)
+	}
+	mdnsAdvert = cfg
+	return nil
+}
+
+// mdnsAdvertiser answers mDNS queries for the gateway's service, and
+// announces it when it starts and stops.
+type mdnsAdvertiser struct {
+	cfg  *mdnsConfig
+	port uint16
+	// TXT record strings
+	txt []string
+	// The address the API is served on, if it isn't every interface's
+	ip net.IP
+
+	instance dnsmessage.Name
+	service  dnsmessage.Name
+	services dnsmessage.Name
+	host     dnsmessage.Name
+
+	mu   sync.Mutex
+	conn *ipv4.PacketConn
+}
+
+// advertiseMDNS advertises the API served at addr until ctx is done, then
+// says goodbye so browsers drop it straight away.
+func (s *Server) advertiseMDNS(ctx context.Context, addr *net.TCPAddr) {
+	cfg := mdnsAdvert
+	a := &mdnsAdvertiser{cfg: cfg, port: uint16(addr.Port), txt: []string{"txtvers=1"}}
+	if !addr.IP.IsUnspecified() {
+		a.ip = addr.IP.To4()
+	}
+	if cfg.deployment != "" {
+		a.txt = append(a.txt, "deployment="+cfg.deployment)
+	}
+	if s.cfg.AdminAddr != "" {
+		if _, port, err := net.SplitHostPort(s.cfg.AdminAddr); err == nil {
+			a.txt = append(a.txt, "admin_port="+port)
+		}
+	}
+	var err error
+	for name, value := range map[*dnsmessage.Name]string{
+		&a.instance: cfg.instance + "." + mdnsServiceType,
+		&a.service:  mdnsServiceType,
+		&a.services: mdnsServicesName,
+		&a.host:     cfg.host,
+	} {
+		if *name, err = dnsmessage.NewName(value); err != nil {
+			s.logger.Printf("error starting mDNS advertisement: invalid name %q: %v", value, err)
+			return
+		}
+	}
+
+	udp, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		s.logger.Printf("error starting mDNS advertisement: %v", err)
+		return
+	}
+	a.conn = ipv4.NewPacketConn(udp)
+	for _, ifi := range mdnsInterfaces() {
+		// Fails for the interface joined by ListenMulticastUDP
+		a.conn.JoinGroup(&ifi, mdnsGroup)
+	}
+	a.conn.SetControlMessage(ipv4.FlagInterface, true)
+	a.conn.SetMulticastTTL(255)
+	s.logger.Printf("Advertising %q as %s on port %d", cfg.instance, mdnsServiceType, a.port)
+
+	go func() {
+		// Announced twice, a second apart, in case the first is lost
+		for i := 0; i < 2; i++ {
+			a.announce(false)
+			if !sleep(ctx, time.Second) {
+				break
+			}
+		}
+		<-ctx.Done()
+		a.announce(true)
+		udp.Close()
+	}()
+	a.serve()
+}
+
+// mdnsInterfaces returns the interfaces the gateway is advertised on.
+func mdnsInterfaces() []net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	return ifaces
+}
+
+// serve answers queries until the connection is closed.
+func (a *mdnsAdvertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		var ifi *net.Interface
+		if cm != nil && cm.IfIndex != 0 {
+			ifi, _ = net.InterfaceByIndex(cm.IfIndex)
+		}
+		udpSrc, _ := src.(*net.UDPAddr)
+		if udpSrc != nil && udpSrc.Port != mdnsGroup.Port {
+			// A one-shot query from a plain DNS resolver, which expects a
+			// unicast reply to its query
+			if msg := a.message(header.ID, questions, ifi, false); msg != nil {
+				a.mu.Lock()
+				a.conn.WriteTo(msg, nil, src)
+				a.mu.Unlock()
+			}
+			continue
+		}
+		if msg := a.message(0, questions, ifi, false); msg != nil {
+			a.send(msg, ifi)
+		}
+	}
+}
+
+// announce sends every record to the network, or with goodbye, tells it
+// they are no longer valid.
+func (a *mdnsAdvertiser) announce(goodbye bool) {
+	for _, ifi := range mdnsInterfaces() {
+		ifi := ifi
+		if msg := a.message(0, nil, &ifi, goodbye); msg != nil {
+			a.send(msg, &ifi)
+		}
+	}
+}
+
+func (a *mdnsAdvertiser) send(msg []byte, ifi *net.Interface) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ifi != nil {
+		a.conn.SetMulticastInterface(ifi)
+	}
+	a.conn.WriteTo(msg, nil, mdnsGroup)
+}
+
+// addresses returns the addresses to advertise on an interface.
+func (a *mdnsAdvertiser) addresses(ifi *net.Interface) []net.IP {
+	var ips []net.IP
+	if ifi == nil {
+		if a.ip != nil {
+			ips = append(ips, a.ip)
+		}
+		return ips
+	}
+	addrs, _ := ifi.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if a.ip == nil || a.ip.Equal(ipnet.IP) {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	return ips
+}
+
+// message builds the answer to questions, or with none, an announcement of
+// every record. It returns nil if none of the questions are about the
+// gateway, or it has no address on the interface.
+func (a *mdnsAdvertiser) message(id uint16, questions []dnsmessage.Question, ifi *net.Interface, goodbye bool) []byte {
+	ips := a.addresses(ifi)
+	if len(ips) == 0 {
+		return nil
+	}
+	ttl := func(t uint32) uint32 {
+		if goodbye {
+			return 0
+		}
+		return t
+	}
+	header := func(name dnsmessage.Name, unique bool, t uint32) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		// Plain DNS resolvers don't expect the cache-flush bit
+		if unique && id == 0 {
+			class |= mdnsCacheFlush
+		}
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl(t)}
+	}
+
+	ptr := dnsmessage.Resource{Header: header(a.service, false, mdnsServiceTTL), Body: &dnsmessage.PTRResource{PTR: a.instance}}
+	srv := dnsmessage.Resource{Header: header(a.instance, true, mdnsHostTTL), Body: &dnsmessage.SRVResource{Target: a.host, Port: a.port}}
+	txt := dnsmessage.Resource{Header: header(a.instance, true, mdnsServiceTTL), Body: &dnsmessage.TXTResource{TXT: a.txt}}
+	services := dnsmessage.Resource{Header: header(a.services, false, mdnsServiceTTL), Body: &dnsmessage.PTRResource{PTR: a.service}}
+	var hostRecords []dnsmessage.Resource
+	for _, ip := range ips {
+		var body dnsmessage.AResource
+		copy(body.A[:], ip)
+		hostRecords = append(hostRecords, dnsmessage.Resource{Header: header(a.host, true, mdnsHostTTL), Body: &body})
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	if len(questions) == 0 {
+		answers = append([]dnsmessage.Resource{ptr, srv, txt}, hostRecords...)
+	}
+	for _, q := range questions {
+		asks := func(name dnsmessage.Name, t dnsmessage.Type) bool {
+			return strings.EqualFold(q.Name.String(), name.String()) && (q.Type == t || q.Type == dnsmessage.TypeALL)
+		}
+		if asks(a.services, dnsmessage.TypePTR) {
+			answers = append(answers, services)
+		}
+		if asks(a.service, dnsmessage.TypePTR) {
+			answers = append(answers, ptr)
+			additionals = append(append(additionals, srv, txt), hostRecords...)
+		}
+		if asks(a.instance, dnsmessage.TypeSRV) {
+			answers = append(answers, srv)
+			additionals = append(additionals, hostRecords...)
+		}
+		if asks(a.instance, dnsmessage.TypeTXT) {
+			answers = append(answers, txt)
+		}
+		if asks(a.host, dnsmessage.TypeA) {
+			answers = append(answers, hostRecords...)
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if id != 0 {
+		// Unicast replies repeat the query's questions
+		b.StartQuestions()
+		for _, q := range questions {
+			b.Question(q)
+		}
+	}
+	sent := make(map[string]bool)
+	add := func(r dnsmessage.Resource) error {
+		key := r.Header.Name.String() + "/" + r.Body.GoString()
+		if sent[key] {
+			return nil
+		}
+		sent[key] = true
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			return b.PTRResource(r.Header, *body)
+		case *dnsmessage.SRVResource:
+			return b.SRVResource(r.Header, *body)
+		case *dnsmessage.TXTResource:
+			return b.TXTResource(r.Header, *body)
+		case *dnsmessage.AResource:
+			return b.AResource(r.Header, *body)
+		}
+		return nil
+	}
+	b.StartAnswers()
+	for _, r := range answers {
+		if add(r) != nil {
+			return nil
+		}
+	}
+	b.StartAdditionals()
+	for _, r := range additionals {
+		if add(r) != nil {
+			return nil
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
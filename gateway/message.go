@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"data-gateway/api"
+)
+
+// Most events one message may carry
+const maxMessageEvents = 100
+
+// ingestMessage is a fix and the events reported with it, such as a
+// platform's status message decoded into its parts.
+type ingestMessage struct {
+	Location json.RawMessage `json:"location" binding:"required"`
+	Events   []api.Event     `json:"events"`
+}
+
+// MessageResult is a stored message: the fix as stored, with its telemetry,
+// and its events.
+type MessageResult struct {
+	Location api.Location `json:"location"`
+	Events   []api.Event  `json:"events"`
+	// Inserted, updated, or duplicate, as for the fix alone
+	Result string `json:"result"`
+	// Whether the records were written in one transaction
+	Transaction bool `json:"transaction"`
+}
+
+// handlePostMessage ingests a fix, its telemetry, and events from one
+// message together. The fix goes through the pipeline POST /api/data uses,
+// and the records are written in a MongoDB transaction where the server
+// supports them, so a failure partway leaves none of them stored.
+func (s *Server) handlePostMessage(c *gin.Context) {
+	req, events, status, err := s.prepareMessage(c)
+	if err != nil {
+		s.countIngest(c, &req.location, requestBodySize(c), status, err)
+		respondError(c, status, err)
+		return
+	}
+	defer req.release()
+
+	ctx := context.Background()
+	resp := MessageResult{Events: []api.Event{}}
+	if req.duplicate != nil {
+		// A resend of a stored message, whose events were stored with it
+		s.countIngest(c, &req.location, requestBodySize(c), http.StatusOK, nil)
+		resp.Location, resp.Result = *req.duplicate, "duplicate"
+		localizeLocation(&resp.Location, req.tz)
+		c.Header("X-Ingest-Result", resp.Result)
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	resp.Transaction, err = s.store.WithTransaction(ctx, func(ctx context.Context) error {
+		location, result, err := s.writeLocation(ctx, req)
+		if err != nil {
+			return err
+		}
+		if result == "duplicate" {
+			return errMessageResent
+		}
+		if len(location.Data) > 0 || req.existing != nil {
+			if err := s.storeTelemetry(ctx, &location); err != nil {
+				return fmt.Errorf("error storing telemetry: %v", err)
+			}
+		}
+		stored := make([]api.Event, len(events))
+		if len(events) > 0 {
+			docs := make([]interface{}, len(events))
+			for i, event := range events {
+				docs[i] = event
+			}
+			res, err := s.store.Events.InsertMany(ctx, docs)
+			if err != nil {
+				return fmt.Errorf("error storing events: %v", err)
+			}
+			for i, event := range events {
+				event.ID = res.InsertedIDs[i].(primitive.ObjectID)
+				stored[i] = event
+			}
+		}
+		resp.Location, resp.Events, resp.Result = location, stored, result
+		return s.enqueueOutbox(ctx, &location, req.publish)
+	})
+	if errors.Is(err, errMessageResent) {
+		err = fmt.Errorf("the fix's uuid was stored by another request meanwhile")
+		s.countIngest(c, &req.location, requestBodySize(c), http.StatusConflict, err)
+		respondError(c, http.StatusConflict, err)
+		return
+	}
+	s.countIngest(c, &req.location, requestBodySize(c), http.StatusInternalServerError, err)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	s.finishIngest(ctx, req, &resp.Location)
+
+	c.Header("X-Ingest-Result", resp.Result)
+	c.Header("X-Ingest-Transaction", strconv.FormatBool(resp.Transaction))
+	localizeLocation(&resp.Location, req.tz)
+	for i := range resp.Events {
+		resp.Events[i].Timestamp = formatTimestamp(resp.Events[i].Timestamp, req.tz)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Another gateway stored a resend of the fix while the message was being
+// written, so its events may have been stored too
+var errMessageResent = errors.New("message resent")
+
+// prepareMessage parses and checks a message, running its fix through the
+// ingest pipeline. Its events belong to the fix's deployment, and default
+// to its platform and timestamp.
+func (s *Server) prepareMessage(c *gin.Context) (*ingestRequest, []api.Event, int, error) {
+	req := &ingestRequest{}
+	location := &req.location
+	var msg ingestMessage
+	if err := c.ShouldBindBodyWith(&msg, binding.JSON); err != nil {
+		return req, nil, http.StatusBadRequest, err
+	}
+	if err := json.Unmarshal(msg.Location, location); err != nil {
+		return req, nil, http.StatusBadRequest, fmt.Errorf("invalid location: %v", err)
+	}
+	location.ReceivedAt = time.Now().UTC().Format(timestampLayout)
+	var err error
+	if location.CommsPath, err = resolveCommsPath(c, location.CommsPath); err != nil {
+		return req, nil, http.StatusBadRequest, err
+	}
+
+	// The signature covers the whole message; the fix alone is kept as its
+	// raw payload, so it can be reparsed like any other
+	body, _ := c.Get(gin.BodyBytesKey)
+	if err := s.verifySignature(location.Platform, body.([]byte), c.GetHeader("X-Signature")); err != nil {
+		return req, nil, http.StatusUnauthorized, err
+	}
+	req.raw, req.rawFormat = msg.Location, payloadFormatLocation
+
+	if req.tz, err = requestTimezone(c); err != nil {
+		return req, nil, http.StatusBadRequest, err
+	}
+	if err := normalizeLocation(location, req.tz); err != nil {
+		return req, nil, http.StatusBadRequest, err
+	}
+
+	if len(msg.Events) > maxMessageEvents {
+		return req, nil, http.StatusBadRequest, fmt.Errorf("a message may carry at most %d events", maxMessageEvents)
+	}
+	now := time.Now()
+	for i := range msg.Events {
+		event := &msg.Events[i]
+		if event.Type == "" {
+			return req, nil, http.StatusBadRequest, fmt.Errorf("event %d has no type", i)
+		}
+		if event.Deployment == "" {
+			event.Deployment = location.Deployment
+		} else if event.Deployment != location.Deployment {
+			return req, nil, http.StatusBadRequest, fmt.Errorf("event %d is for deployment %s, not the fix's %s", i, event.Deployment, location.Deployment)
+		}
+		if event.Platform == "" {
+			event.Platform = location.Platform
+		}
+		if event.Timestamp == "" {
+			event.Timestamp = location.Timestamp
+		} else if event.Timestamp, err = normalizeTimestamp(event.Timestamp, req.tz); err != nil {
+			return req, nil, http.StatusBadRequest, fmt.Errorf("event %d: %v", i, err)
+		}
+		event.ID = primitive.NilObjectID
+		event.CreatedAt = now
+	}
+
+	upsert, err := parseIngestMode(c)
+	if err != nil {
+		return req, nil, http.StatusBadRequest, err
+	}
+	if status, err := s.processIngest(context.Background(), req, upsert); err != nil {
+		return req, nil, status, err
+	}
+	return req, msg.Events, http.StatusOK, nil
+}
@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	modeNormal      = "normal"
+	modeReadOnly    = "read-only"
+	modeMaintenance = "maintenance"
+)
+
+// ServiceMode is the operating mode set by an admin, stored so it survives
+// restarts and is shared by every gateway instance.
+type ServiceMode struct {
+	Mode      string    `json:"mode" bson:"mode"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+const modeDocumentID = "service_mode"
+
+// How often the stored mode is re-read, so changes made through one
+// instance reach the others
+const modeRefreshInterval = 10 * time.Second
+
+// modeState is the mode a server last read or set.
+type modeState struct {
+	mu      sync.RWMutex
+	current ServiceMode
+}
+
+func (s *Server) initMode() error {
+	collectionName := os.Getenv("MONGODB_SETTINGS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "settings"
+	}
+	s.store.Settings = s.store.Collection(collectionName)
+
+	if err := s.loadMode(context.Background()); err != nil {
+		return fmt.Errorf("error loading service mode: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) loadMode(ctx context.Context) error {
+	var mode ServiceMode
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": modeDocumentID}).Decode(&mode)
+	if err == mongo.ErrNoDocuments {
+		mode = ServiceMode{Mode: modeNormal}
+	} else if err != nil {
+		return err
+	}
+
+	s.mode.mu.Lock()
+	s.mode.current = mode
+	s.mode.mu.Unlock()
+	return nil
+}
+
+func (s *Server) watchMode(ctx context.Context) {
+	for sleep(ctx, modeRefreshInterval) {
+		loadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := s.loadMode(loadCtx); err != nil {
+			s.logger.Printf("error refreshing service mode: %v", err)
+		}
+		if err := s.loadFeatures(loadCtx); err != nil {
+			s.logger.Printf("error refreshing feature overrides: %v", err)
+		}
+		cancel()
+	}
+}
+
+func (s *Server) serviceMode() ServiceMode {
+	s.mode.mu.RLock()
+	defer s.mode.mu.RUnlock()
+	return s.mode.current
+}
+
+// Paths that stay available in every mode so the mode can be inspected and
+// switched back
+var modeExemptPaths = map[string]bool{
+	"/healthz":    true,
+	"/admin/mode": true,
+}
+
+// enforceMode rejects writes in read-only mode and everything but health
+// checks in maintenance mode.
+func (s *Server) enforceMode() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := s.serviceMode()
+		if mode.Mode == modeNormal || modeExemptPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		if mode.Mode == modeReadOnly {
+			switch c.Request.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				c.Next()
+				return
+			}
+			// GraphQL queries and ingest validation are reads even when POSTed
+			if c.Request.URL.Path == "/graphql" || c.Request.URL.Path == "/api/data/validate" {
+				c.Next()
+				return
+			}
+		}
+
+		msg := fmt.Sprintf("service is in %s mode", mode.Mode)
+		if mode.Reason != "" {
+			msg += ": " + mode.Reason
+		}
+		c.Header("Retry-After", "60")
+		err := &codedError{code: codeUnavailable, err: errors.New(msg), details: map[string]interface{}{"mode": mode.Mode}}
+		abortError(c, http.StatusServiceUnavailable, err)
+	}
+}
+
+func (s *Server) handleHealthz(c *gin.Context) {
+	mode := s.serviceMode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.store.Ping(ctx); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database unreachable", "mode": mode})
+		return
+	}
+
+	if haEnabled {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "mode": mode, "role": s.haRole()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "mode": mode})
+}
+
+func (s *Server) handleGetMode(c *gin.Context) {
+	c.JSON(http.StatusOK, s.serviceMode())
+}
+
+func (s *Server) handleSetMode(c *gin.Context) {
+	var req struct {
+		Mode   string `json:"mode" binding:"required"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Mode != modeNormal && req.Mode != modeReadOnly && req.Mode != modeMaintenance {
+		respondErrorf(c, http.StatusBadRequest, "mode must be normal, read-only, or maintenance")
+		return
+	}
+
+	mode := ServiceMode{Mode: req.Mode, Reason: req.Reason, UpdatedAt: time.Now().UTC()}
+	_, err := s.store.Settings.ReplaceOne(context.Background(), bson.M{"_id": modeDocumentID}, mode, options.Replace().SetUpsert(true))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.mode.mu.Lock()
+	s.mode.current = mode
+	s.mode.mu.Unlock()
+
+	c.JSON(http.StatusOK, mode)
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route groups network policies apply to
+const (
+	// Fixes, heartbeats, events and environmental records sent in
+	groupIngest = "ingest"
+	// Everything else under /api, with /graphql and /tiles
+	groupAPI = "api"
+	// /admin, and the /api endpoints requiring the admin role
+	groupAdmin = "admin"
+)
+
+var routeGroups = map[string]bool{groupIngest: true, groupAPI: true, groupAdmin: true}
+
+// networkRule limits the addresses a route group accepts requests from.
+// Denied addresses are refused even if allowed; if any are allowed, only
+// those are accepted.
+type networkRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// networkPolicy is the NETWORK_POLICY_CONFIG file.
+type networkPolicy struct {
+	// Proxies whose X-Forwarded-For and X-Real-IP headers are believed;
+	// requests from anywhere else are judged by their peer address
+	TrustedProxies []string                `json:"trusted_proxies"`
+	Groups         map[string]*networkRule `json:"groups"`
+}
+
+var netPolicy *networkPolicy
+
+func initNetworkPolicy() error {
+	configPath := os.Getenv("NETWORK_POLICY_CONFIG")
+	if configPath == "" {
+		netPolicy = nil
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading NETWORK_POLICY_CONFIG: %v", err)
+	}
+	var policy networkPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("error parsing NETWORK_POLICY_CONFIG: %v", err)
+	}
+
+	if _, err := parseCIDRs(policy.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	for group, rule := range policy.Groups {
+		if !routeGroups[group] {
+			return fmt.Errorf("unknown route group %q (expected ingest, api or admin)", group)
+		}
+		if rule == nil {
+			rule = &networkRule{}
+			policy.Groups[group] = rule
+		}
+		if rule.allow, err = parseCIDRs(rule.Allow); err != nil {
+			return fmt.Errorf("group %s: allow: %v", group, err)
+		}
+		if rule.deny, err = parseCIDRs(rule.Deny); err != nil {
+			return fmt.Errorf("group %s: deny: %v", group, err)
+		}
+	}
+	netPolicy = &policy
+	return nil
+}
+
+// parseCIDRs parses CIDR ranges, or single addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the rule accepts requests from ip.
+func (r *networkRule) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(r.allow) == 0 && len(r.deny) == 0
+	}
+	if containsIP(r.deny, ip) {
+		return false
+	}
+	return len(r.allow) == 0 || containsIP(r.allow, ip)
+}
+
+// trustProxies configures which proxies the router takes client addresses
+// from. Without a network policy, gin's default of trusting any is kept.
+func trustProxies(r *gin.Engine) {
+	if netPolicy == nil {
+		return
+	}
+	// Checked by initNetworkPolicy
+	r.SetTrustedProxies(netPolicy.TrustedProxies)
+}
+
+// allowNetwork refuses requests from addresses the network policy doesn't
+// accept for the route group.
+func allowNetwork(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if netPolicy == nil {
+			c.Next()
+			return
+		}
+		rule, ok := netPolicy.Groups[group]
+		if !ok {
+			c.Next()
+			return
+		}
+		addr := c.ClientIP()
+		if !rule.permits(net.ParseIP(addr)) {
+			abortError(c, http.StatusForbidden, fmt.Errorf("%s endpoints are not available from %s", group, addr))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"data-gateway/api"
+)
+
+// channelConfig describes one alert channel in ALERTS_CONFIG. URLs may
+// reference secrets as ${NAME} to keep them out of the file; like other
+// secrets, they can be read from NAME_FILE or Vault and are rotated in place.
+type channelConfig struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+	Template string   `json:"template"`
+}
+
+// notifier delivers alerts to one channel.
+type notifier interface {
+	Type() string
+	Notify(alert api.Alert) error
+}
+
+const defaultAlertTemplate = `[{{.Severity}}] {{if .Deployment}}{{.Deployment}}/{{.Platform}}: {{end}}{{.Message}}`
+const defaultAlertSubject = `[data-gateway] {{.Severity}}: {{.Type}}{{if .Deployment}} on {{.Deployment}}/{{.Platform}}{{end}}`
+
+var notifierClient = &http.Client{Timeout: 10 * time.Second}
+
+func newNotifier(cfg channelConfig) (notifier, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultAlertTemplate
+	}
+	body, err := template.New(cfg.Name).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	switch cfg.Type {
+	case "email":
+		if len(cfg.To) == 0 {
+			return nil, fmt.Errorf("to is required")
+		}
+		if mailer == nil {
+			return nil, fmt.Errorf("email channels require SMTP_HOST")
+		}
+		if cfg.Subject == "" {
+			cfg.Subject = defaultAlertSubject
+		}
+		subject, err := template.New(cfg.Name + "-subject").Parse(cfg.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject: %v", err)
+		}
+		return &emailNotifier{to: cfg.To, subject: subject, body: body}, nil
+	case "slack", "mattermost", "teams", "webhook":
+		url, err := expandSecrets(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return nil, fmt.Errorf("url must be an http(s) webhook URL")
+		}
+		return &webhookNotifier{kind: cfg.Type, url: cfg.URL, body: body}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q (expected email, slack, teams, mattermost, or webhook)", cfg.Type)
+	}
+}
+
+func renderAlert(t *template.Template, alert api.Alert) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, alert); err != nil {
+		return "", fmt.Errorf("error rendering alert template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+type emailNotifier struct {
+	to      []string
+	subject *template.Template
+	body    *template.Template
+}
+
+func (n *emailNotifier) Type() string { return "email" }
+
+func (n *emailNotifier) Notify(alert api.Alert) error {
+	subject, err := renderAlert(n.subject, alert)
+	if err != nil {
+		return err
+	}
+	text, err := renderAlert(n.body, alert)
+	if err != nil {
+		return err
+	}
+	return sendMail(n.to, subject, "<pre>"+html.EscapeString(text)+"</pre>")
+}
+
+// webhookNotifier posts to Slack, Mattermost, and Microsoft Teams incoming
+// webhooks, which differ only in payload shape, and to generic webhooks such
+// as paging services, which are sent the alert itself.
+type webhookNotifier struct {
+	kind string
+	// The configured URL, expanded when posting to pick up rotated secrets
+	url  string
+	body *template.Template
+}
+
+func (n *webhookNotifier) Type() string { return n.kind }
+
+var teamsColors = map[string]string{"info": "2F80ED", "warning": "F2994A", "critical": "EB5757"}
+
+func (n *webhookNotifier) Notify(alert api.Alert) error {
+	text, err := renderAlert(n.body, alert)
+	if err != nil {
+		return err
+	}
+
+	var payload interface{}
+	switch n.kind {
+	case "teams":
+		payload = map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    alert.Type,
+			"themeColor": teamsColors[alert.Severity],
+			"text":       text,
+		}
+	case "webhook":
+		payload = map[string]interface{}{"text": text, "alert": alert}
+	default:
+		payload = map[string]string{"text": text}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	url, err := expandSecrets(n.url)
+	if err != nil {
+		return err
+	}
+	resp, err := notifierClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error posting to %s webhook: %v", n.kind, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s webhook returned %s", n.kind, resp.Status)
+	}
+	return nil
+}
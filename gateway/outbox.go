@@ -0,0 +1,245 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Publications of stored fixes to webhooks go through an outbox: an entry
+// is written with the fix, in the same transaction where MongoDB supports
+// them, and delivered from there until the webhook accepts it. A crash
+// between storing the fix and delivering it only delays delivery, though a
+// fix may be delivered more than once.
+
+const (
+	outboxInterval = time.Second
+	// An entry claimed for delivery is due again after this long, in case
+	// the instance delivering it stopped
+	outboxClaimTimeout = time.Minute
+	// Retries back off exponentially from the first delay to the longest
+	outboxFirstRetry   = 5 * time.Second
+	outboxLongestRetry = time.Hour
+	// Entries delivered at once
+	outboxBatchSize = 100
+)
+
+// outboxEntry is a fix waiting to be published.
+type outboxEntry struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	URL        string             `json:"url" bson:"url"`
+	Deployment string             `json:"deployment" bson:"deployment"`
+	Platform   string             `json:"platform" bson:"platform"`
+	LocationID primitive.ObjectID `json:"location_id" bson:"location_id"`
+	// The fix as stored, as JSON
+	Payload     string    `json:"-" bson:"payload"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	Attempts    int       `json:"attempts" bson:"attempts"`
+	NextAttempt time.Time `json:"next_attempt" bson:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty" bson:"last_error,omitempty"`
+}
+
+func (s *Server) initOutbox() error {
+	collectionName := os.Getenv("MONGODB_OUTBOX_COLLECTION")
+	if collectionName == "" {
+		collectionName = "outbox"
+	}
+	s.store.Outbox = s.store.Collection(collectionName)
+
+	indexModel := mongo.IndexModel{Keys: bson.D{{Key: "next_attempt", Value: 1}}}
+	if err := s.ensureIndex(s.store.Outbox, indexModel); err != nil {
+		return fmt.Errorf("error creating outbox indexes: %v", err)
+	}
+	return nil
+}
+
+type outboxKey struct{}
+
+// withOutbox collects the webhooks hooks publish a fix to into urls, for
+// storing with the fix.
+func withOutbox(ctx context.Context, urls *[]string) context.Context {
+	return context.WithValue(ctx, outboxKey{}, urls)
+}
+
+// publishThroughOutbox queues the fix a hook is running on for url, once it
+// is stored. It returns false if the fix isn't being ingested through the
+// outbox, and the hook must deliver it itself.
+func publishThroughOutbox(ctx context.Context, url string) bool {
+	urls, _ := ctx.Value(outboxKey{}).(*[]string)
+	if urls == nil {
+		return false
+	}
+	*urls = append(*urls, url)
+	return true
+}
+
+// enqueueOutbox writes the entries publishing a stored fix to urls.
+func (s *Server) enqueueOutbox(ctx context.Context, location *api.Location, urls []string) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(location)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	docs := make([]interface{}, len(urls))
+	for i, url := range urls {
+		docs[i] = outboxEntry{
+			URL:         url,
+			Deployment:  location.Deployment,
+			Platform:    location.Platform,
+			LocationID:  location.ID,
+			Payload:     string(payload),
+			CreatedAt:   now,
+			NextAttempt: now,
+		}
+	}
+	if _, err := s.store.Outbox.InsertMany(ctx, docs); err != nil {
+		return fmt.Errorf("error queueing fix for publication: %v", err)
+	}
+	return nil
+}
+
+// runOutbox delivers due outbox entries until ctx is done. Every instance
+// delivers, claiming entries so each is attempted by one at a time.
+func (s *Server) runOutbox(ctx context.Context) {
+	for sleep(ctx, outboxInterval) {
+		for i := 0; i < outboxBatchSize; i++ {
+			entry, err := s.claimOutboxEntry(ctx)
+			if err != nil {
+				s.logger.Printf("error reading outbox: %v", err)
+				break
+			}
+			if entry == nil {
+				break
+			}
+			s.deliverOutboxEntry(ctx, entry)
+		}
+	}
+}
+
+// claimOutboxEntry takes the entry longest due, if any, putting off its next
+// attempt until the claim runs out.
+func (s *Server) claimOutboxEntry(ctx context.Context) (*outboxEntry, error) {
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set": bson.M{"next_attempt": now.Add(outboxClaimTimeout)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt", Value: 1}}).
+		SetReturnDocument(options.After)
+	var entry outboxEntry
+	err := s.store.Outbox.FindOneAndUpdate(ctx, bson.M{"next_attempt": bson.M{"$lte": now}}, update, opts).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// deliverOutboxEntry posts an entry's fix, removing the entry once the
+// webhook accepts it, or scheduling a retry.
+func (s *Server) deliverOutboxEntry(ctx context.Context, entry *outboxEntry) {
+	err := postOutboxEntry(ctx, entry)
+	if err == nil {
+		if _, err := s.store.Outbox.DeleteOne(ctx, bson.M{"_id": entry.ID}); err != nil {
+			s.logger.Printf("error removing delivered outbox entry %s: %v", entry.ID.Hex(), err)
+		}
+		return
+	}
+
+	retry := outboxFirstRetry << min(entry.Attempts-1, 20)
+	retry = min(retry, outboxLongestRetry)
+	s.logger.Printf("error publishing fix %s of %s/%s (attempt %d, retrying in %s): %v",
+		entry.LocationID.Hex(), entry.Deployment, entry.Platform, entry.Attempts, retry, err)
+	update := bson.M{"$set": bson.M{
+		"next_attempt": time.Now().UTC().Add(retry),
+		"last_error":   err.Error(),
+	}}
+	if _, err := s.store.Outbox.UpdateOne(ctx, bson.M{"_id": entry.ID}, update); err != nil {
+		s.logger.Printf("error rescheduling outbox entry %s: %v", entry.ID.Hex(), err)
+	}
+}
+
+// postOutboxEntry posts an entry's fix to its webhook. The entry's ID is
+// sent as X-Delivery-ID, the same on every attempt, so receivers can
+// discard fixes delivered twice.
+func postOutboxEntry(ctx context.Context, entry *outboxEntry) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, entry.URL, bytes.NewReader([]byte(entry.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delivery-ID", entry.ID.Hex())
+	resp, err := notifierClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OutboxStatus summarizes the fixes waiting to be published.
+type OutboxStatus struct {
+	Pending int64 `json:"pending"`
+	// Entries that have failed at least once
+	Retrying int64         `json:"retrying"`
+	Oldest   *time.Time    `json:"oldest,omitempty"`
+	Entries  []outboxEntry `json:"entries"`
+}
+
+// handleGetOutbox reports the outbox's backlog, with the entries that have
+// waited longest.
+func (s *Server) handleGetOutbox(c *gin.Context) {
+	ctx := c.Request.Context()
+	var status OutboxStatus
+	var err error
+	if status.Pending, err = s.store.Outbox.CountDocuments(ctx, bson.M{}); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if status.Retrying, err = s.store.Outbox.CountDocuments(ctx, bson.M{"last_error": bson.M{"$exists": true}}); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	limit, _, _, err := s.parseLimit(c.Query("limit"), "")
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(limit)
+	cursor, err := s.store.Outbox.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	status.Entries = []outboxEntry{}
+	if err := cursor.All(ctx, &status.Entries); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if len(status.Entries) > 0 {
+		status.Oldest = &status.Entries[0].CreatedAt
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// platformConfig records what the gateway expects of a platform. Deployment
+// and platform are glob patterns; the first entry matching a platform wins.
+type platformConfig struct {
+	Deployment       string `json:"deployment,omitempty"`
+	Platform         string `json:"platform"`
+	ExpectedInterval string `json:"expected_interval,omitempty"`
+	StaleAfter       string `json:"stale_after,omitempty"`
+	// Overrides CLOCK_SKEW_TOLERANCE; "0s" disables clock skew checks,
+	// e.g. for platforms that upload stored fixes in bulk
+	ClockSkewTolerance string `json:"clock_skew_tolerance,omitempty"`
+	// Telemetry key holding battery voltage, for endurance estimates
+	BatteryField string `json:"battery_field,omitempty"`
+	// Battery voltage the platform runs out of power at; endurance is only
+	// estimated for platforms that set it
+	EmptyVoltage *float64 `json:"empty_voltage,omitempty"`
+	// Estimated endurance below which a low_endurance alert is raised
+	LowEndurance string `json:"low_endurance,omitempty"`
+
+	expectedInterval   time.Duration
+	staleAfter         time.Duration
+	clockSkewTolerance *time.Duration
+	lowEndurance       time.Duration
+}
+
+// A platform with an expected interval is stale after missing this many
+// reports, unless it sets stale_after itself
+const staleMissedReports = 3
+
+// A fix older than this many expected intervals is late, allowing for jitter
+const lateFactor = 1.5
+
+var platformRegistry []platformConfig
+
+func initPlatforms() error {
+	configPath := os.Getenv("PLATFORMS_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading PLATFORMS_CONFIG: %v", err)
+	}
+	var cfg struct {
+		Platforms []platformConfig `json:"platforms"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing PLATFORMS_CONFIG: %v", err)
+	}
+
+	for i := range cfg.Platforms {
+		p := &cfg.Platforms[i]
+		if p.Platform == "" {
+			return fmt.Errorf("platform %d has no platform pattern", i)
+		}
+		for _, pattern := range []string{p.Deployment, p.Platform} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("platform %d: invalid pattern %q", i, pattern)
+			}
+		}
+		if p.ExpectedInterval != "" {
+			if p.expectedInterval, err = time.ParseDuration(p.ExpectedInterval); err != nil || p.expectedInterval <= 0 {
+				return fmt.Errorf("platform %q: invalid expected_interval %q", p.Platform, p.ExpectedInterval)
+			}
+		}
+		if p.StaleAfter != "" {
+			if p.staleAfter, err = time.ParseDuration(p.StaleAfter); err != nil || p.staleAfter <= 0 {
+				return fmt.Errorf("platform %q: invalid stale_after %q", p.Platform, p.StaleAfter)
+			}
+		}
+		if p.ClockSkewTolerance != "" {
+			d, err := time.ParseDuration(p.ClockSkewTolerance)
+			if err != nil || d < 0 {
+				return fmt.Errorf("platform %q: invalid clock_skew_tolerance %q", p.Platform, p.ClockSkewTolerance)
+			}
+			p.clockSkewTolerance = &d
+		}
+		if p.LowEndurance != "" {
+			if p.EmptyVoltage == nil {
+				return fmt.Errorf("platform %q: low_endurance needs empty_voltage", p.Platform)
+			}
+			if p.lowEndurance, err = time.ParseDuration(p.LowEndurance); err != nil || p.lowEndurance <= 0 {
+				return fmt.Errorf("platform %q: invalid low_endurance %q", p.Platform, p.LowEndurance)
+			}
+		}
+	}
+	platformRegistry = cfg.Platforms
+	return nil
+}
+
+// platformSettings returns the registry entry for a platform, or an empty
+// one if it isn't registered.
+func platformSettings(deployment, platform string) platformConfig {
+	for _, p := range platformRegistry {
+		if ok, _ := path.Match(p.Deployment, deployment); p.Deployment != "" && !ok {
+			continue
+		}
+		if ok, _ := path.Match(p.Platform, platform); ok {
+			return p
+		}
+	}
+	return platformConfig{}
+}
+
+// staleAfterFor returns how long a platform may go without reporting before
+// it is no longer ok: its own stale_after, else a few missed reports at its
+// expected interval, else PLATFORM_STALE_AFTER.
+func (p platformConfig) staleAfterFor() time.Duration {
+	switch {
+	case p.staleAfter > 0:
+		return p.staleAfter
+	case p.expectedInterval > 0:
+		return staleMissedReports * p.expectedInterval
+	}
+	return platformStaleAfter
+}
+
+// clockSkewToleranceFor returns how far a platform's timestamps may be from
+// their receipt time, or zero if they aren't checked.
+func (p platformConfig) clockSkewToleranceFor() time.Duration {
+	if p.clockSkewTolerance != nil {
+		return *p.clockSkewTolerance
+	}
+	return clockSkewTolerance
+}
+
+// longestStaleAfter returns the longest staleness threshold of any platform.
+func longestStaleAfter() time.Duration {
+	longest := platformStaleAfter
+	for _, p := range platformRegistry {
+		if d := p.staleAfterFor(); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	defaultPollWait = 30 * time.Second
+	// Longest a poll may block, kept under the idle timeouts of the proxies
+	// constrained clients sit behind
+	maxPollWait = 2 * time.Minute
+)
+
+// pollCursor marks the last fix a poll returned, by when it was stored,
+// with its ID to order fixes stored in the same millisecond.
+type pollCursor struct {
+	createdAt time.Time
+	id        primitive.ObjectID
+}
+
+func (p pollCursor) String() string {
+	return strconv.FormatInt(p.createdAt.UnixMilli(), 10) + "-" + p.id.Hex()
+}
+
+func parsePollCursor(v string) (pollCursor, error) {
+	ms, hex, ok := strings.Cut(v, "-")
+	if !ok {
+		return pollCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return pollCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return pollCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	return pollCursor{createdAt: time.UnixMilli(n).UTC(), id: id}, nil
+}
+
+// after returns the filter for fixes stored after the cursor.
+func (p pollCursor) after() bson.M {
+	return bson.M{"$or": []bson.M{
+		{"created_at": bson.M{"$gt": p.createdAt}},
+		{"created_at": p.createdAt, "_id": bson.M{"$gt": p.id}},
+	}}
+}
+
+// handlePollLocations returns the fixes stored since a cursor, waiting for
+// some to arrive if there are none yet, for clients that can't hold a
+// stream open. Fixes updated since the cursor are returned again.
+func (s *Server) handlePollLocations(c *gin.Context) {
+	deployment := c.Query("deployment")
+	platform := c.Query("platform")
+
+	var cursor pollCursor
+	since := c.Query("since")
+	if since != "" {
+		var err error
+		if cursor, err = parsePollCursor(since); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	wait := defaultPollWait
+	if v := c.Query("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxPollWait {
+			respondErrorf(c, http.StatusBadRequest, "wait must be a duration of at most %s", maxPollWait)
+			return
+		}
+		wait = d
+	}
+	limit, _, _, err := s.parseLimit(c.Query("limit"), "")
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	filter := bson.M{}
+	if deployment != "" {
+		filter["deployment"] = deployment
+	}
+	if platform != "" {
+		filter["platform"] = platform
+	}
+
+	// Subscribe before looking so a fix stored in between still wakes the poll
+	sub := s.hub.subscribe()
+	defer func() { s.hub.unsubscribe(sub) }()
+	disableWriteTimeout(c)
+
+	// Without a cursor, polling starts after the latest fix already stored
+	ctx := c.Request.Context()
+	if since == "" {
+		var latest api.Location
+		opts := options.FindOne().
+			SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+			SetProjection(bson.M{"_id": 1, "created_at": 1})
+		err := s.store.Locations.FindOne(ctx, scopedFilter(c, filter), opts).Decode(&latest)
+		if err == nil {
+			cursor = pollCursor{createdAt: latest.CreatedAt.UTC(), id: latest.ID}
+		} else if err != mongo.ErrNoDocuments {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		// Fetch one extra fix to tell the client more are waiting
+		opts := options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(limit + 1)
+		query := scopedFilter(c, bson.M{"$and": []bson.M{filter, cursor.after()}})
+		found, err := s.store.Locations.Find(ctx, query, opts)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		locations := []api.Location{}
+		if err := found.All(ctx, &locations); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		more := int64(len(locations)) > limit
+		if more {
+			locations = locations[:limit]
+		}
+		if len(locations) > 0 {
+			last := locations[len(locations)-1]
+			cursor = pollCursor{createdAt: last.CreatedAt.UTC(), id: last.ID}
+			for i := range locations {
+				localizeLocation(&locations[i], loc)
+			}
+			c.JSON(http.StatusOK, gin.H{"locations": locations, "cursor": cursor.String(), "more": more})
+			return
+		}
+
+		// Wait for a fix the client would be sent
+	await:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				c.JSON(http.StatusOK, gin.H{"locations": locations, "cursor": cursor.String(), "more": false})
+				return
+			case <-sub.evicted:
+				// Fixes were stored faster than they were looked at, so look
+				// again with a fresh subscription
+				sub = s.hub.subscribe()
+				break await
+			case event := <-sub.events:
+				location := event.Location
+				if deployment != "" && location.Deployment != deployment {
+					continue
+				}
+				if platform != "" && location.Platform != platform {
+					continue
+				}
+				if canRead(c, location.Deployment, location.Platform) {
+					break await
+				}
+			}
+		}
+	}
+}
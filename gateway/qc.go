@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	qcPass    = "pass"
+	qcFlagged = "flagged"
+)
+
+// QC thresholds unless QC_MAX_SPEED and LATE_DATA_THRESHOLD are set
+const (
+	defaultQCMaxSpeed        = 50.0
+	defaultLateDataThreshold = time.Hour
+)
+
+func (s *Server) initQC() error {
+	// Maximum plausible speed over ground in m/s
+	if v := os.Getenv("QC_MAX_SPEED"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("invalid QC_MAX_SPEED %q", v)
+		}
+		s.qcMaxSpeed = f
+	}
+
+	// Fixes received longer than this after their timestamp are backfill
+	if v := os.Getenv("LATE_DATA_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid LATE_DATA_THRESHOLD %q", v)
+		}
+		s.lateDataThreshold = d
+	}
+	return nil
+}
+
+// previousFix returns the platform's latest fix at or before the timestamp.
+func (s *Server) previousFix(ctx context.Context, location *api.Location) (*api.Location, error) {
+	filter := bson.M{
+		"deployment": location.Deployment,
+		"platform":   location.Platform,
+		"timestamp":  bson.M{"$lte": location.Timestamp},
+	}
+	// A record being replaced is not its own predecessor
+	if !location.ID.IsZero() {
+		filter["_id"] = bson.M{"$ne": location.ID}
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	var prev api.Location
+	err := s.store.Locations.FindOne(ctx, filter, opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &prev, nil
+}
+
+// deriveFields computes speed and course from the platform's previous fix
+// and runs the quality checks.
+func (s *Server) deriveFields(ctx context.Context, location *api.Location) error {
+	prev, err := s.previousFix(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	s.deriveFromPrevious(prev, location)
+	return nil
+}
+
+// headingOrCourse returns the heading a platform reported, or else the
+// course derived from its track, for placing things relative to its bow.
+func headingOrCourse(location *api.Location) *float64 {
+	if location.Heading != nil {
+		return location.Heading
+	}
+	return location.Course
+}
+
+// deriveFromPrevious computes speed and course over ground relative to prev, which may
+// be nil for a platform's first fix, and runs the quality checks.
+func (s *Server) deriveFromPrevious(prev, location *api.Location) {
+	qc := api.QCResult{Status: qcPass, Flags: []string{}}
+	// Speed and course are made good over the ground, always derived, and
+	// course is kept apart from the heading the platform's own sensors report
+	location.Speed, location.Course = nil, nil
+
+	if location.Latitude < -90 || location.Latitude > 90 || location.Longitude < -180 || location.Longitude > 180 {
+		qc.Flags = append(qc.Flags, "position_out_of_range")
+	}
+	if location.Latitude == 0 && location.Longitude == 0 {
+		qc.Flags = append(qc.Flags, "null_island")
+	}
+
+	t, err := parseTimestamp(location.Timestamp)
+	if err == nil && t.After(time.Now().Add(5*time.Minute)) {
+		qc.Flags = append(qc.Flags, "future_timestamp")
+	}
+	if err == nil && time.Since(t) > s.lateDataThreshold {
+		location.Backfilled = true
+	}
+
+	if prev != nil && err == nil {
+		if prevTime, perr := parseTimestamp(prev.Timestamp); perr == nil {
+			dt := t.Sub(prevTime).Seconds()
+			if dt == 0 {
+				qc.Flags = append(qc.Flags, "duplicate_timestamp")
+			} else if dt > 0 {
+				d := haversine(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude)
+				speed := d / dt
+				course := initialBearing(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude)
+				location.Speed = &speed
+				if d > 0 {
+					location.Course = &course
+				}
+				if speed > s.qcMaxSpeed || math.IsInf(speed, 0) {
+					qc.Flags = append(qc.Flags, "speed_exceeds_limit")
+				}
+			}
+		}
+	}
+
+	if len(qc.Flags) > 0 {
+		qc.Status = qcFlagged
+	}
+	location.QC = &qc
+}
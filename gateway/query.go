@@ -0,0 +1,514 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"data-gateway/api"
+)
+
+// Query expressions accepted by the q parameter, e.g.
+//
+//	latitude>40 AND source="ais" AND within(-71,42,-70,43)
+//
+// Grammar:
+//
+//	expr       = andExpr { "OR" andExpr }
+//	andExpr    = unary { "AND" unary }
+//	unary      = [ "NOT" ] primary
+//	primary    = "(" expr ")" | within | comparison
+//	within     = "within" "(" number "," number "," number "," number ")"
+//	comparison = field op value
+//	op         = "=" | "!=" | ">" | ">=" | "<" | "<="
+//	value      = number | quoted string
+
+type fieldType int
+
+const (
+	fieldString fieldType = iota
+	fieldNumber
+)
+
+// queryFields is the allowlist of fields that may be referenced in a query expression.
+var queryFields = map[string]fieldType{
+	"deployment": fieldString,
+	"platform":   fieldString,
+	"source":     fieldString,
+	"timestamp":  fieldString,
+	"crs":        fieldString,
+	"comms_path": fieldString,
+	"uuid":       fieldString,
+	"latitude":   fieldNumber,
+	"longitude":  fieldNumber,
+	"speed":      fieldNumber,
+	"course":     fieldNumber,
+	"heading":    fieldNumber,
+	"pitch":      fieldNumber,
+	"roll":       fieldNumber,
+	"latency":    fieldNumber,
+}
+
+const maxQueryLength = 2048
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		ch := rune(input[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case ch == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case ch == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case ch == '=' || ch == '!' || ch == '<' || ch == '>':
+			start := i
+			i++
+			if i < len(input) && input[i] == '=' {
+				i++
+			}
+			op := input[start:i]
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d", start)
+			}
+			tokens = append(tokens, token{tokOp, op, start})
+		case ch == '"':
+			start := i
+			i++
+			var sb strings.Builder
+			closed := false
+			for i < len(input) {
+				if input[i] == '\\' && i+1 < len(input) {
+					sb.WriteByte(input[i+1])
+					i += 2
+					continue
+				}
+				if input[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(input[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case ch == '-' || ch == '.' || unicode.IsDigit(ch):
+			start := i
+			i++
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.' || input[i] == 'e' || input[i] == 'E' ||
+				((input[i] == '-' || input[i] == '+') && (input[i-1] == 'e' || input[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, input[start:i], start})
+		case unicode.IsLetter(ch) || ch == '_':
+			start := i
+			for i < len(input) && (unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i])) || input[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, input[start:i], start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", ch, i)
+		}
+	}
+	tokens = append(tokens, token{tokEOF, "", len(input)})
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseQuery parses a query expression into a Mongo filter. Only fields in
+// queryFields may be referenced, and values are always bound as literals.
+func parseQuery(input string) (bson.M, error) {
+	if len(input) > maxQueryLength {
+		return nil, fmt.Errorf("query exceeds %d characters", maxQueryLength)
+	}
+
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	filter, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return filter, nil
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *queryParser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		if tok.kind == tokEOF {
+			return tok, fmt.Errorf("expected %s at end of query", what)
+		}
+		return tok, fmt.Errorf("expected %s at position %d, got %q", what, tok.pos, tok.text)
+	}
+	return tok, nil
+}
+
+func (p *queryParser) parseExpr() (bson.M, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []bson.M{left}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, right)
+	}
+	if len(clauses) == 1 {
+		return left, nil
+	}
+	return bson.M{"$or": clauses}, nil
+}
+
+func (p *queryParser) parseAnd() (bson.M, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []bson.M{left}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, right)
+	}
+	if len(clauses) == 1 {
+		return left, nil
+	}
+	return bson.M{"$and": clauses}, nil
+}
+
+func (p *queryParser) parseUnary() (bson.M, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		inner, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": []bson.M{inner}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (bson.M, error) {
+	tok := p.peek()
+	if tok.kind == tokLParen {
+		p.next()
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	if p.isKeyword("within") {
+		return p.parseWithin()
+	}
+
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseWithin() (bson.M, error) {
+	p.next()
+	if _, err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+
+	var bbox [4]float64
+	for i := range bbox {
+		if i > 0 {
+			if _, err := p.expect(tokComma, "','"); err != nil {
+				return nil, err
+			}
+		}
+		tok, err := p.expect(tokNumber, "number")
+		if err != nil {
+			return nil, err
+		}
+		bbox[i], err = strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+	}
+	if _, err := p.expect(tokRParen, "')'"); err != nil {
+		return nil, err
+	}
+
+	filter, err := boxFilter(bbox)
+	if err != nil {
+		return nil, fmt.Errorf("within: %v", err)
+	}
+	return filter, nil
+}
+
+// boxFilter matches fixes within a box given as minimum longitude, minimum
+// latitude, maximum longitude, and maximum latitude.
+func boxFilter(bbox [4]float64) (bson.M, error) {
+	minLon, minLat, maxLon, maxLat := bbox[0], bbox[1], bbox[2], bbox[3]
+	if minLat > maxLat {
+		return nil, fmt.Errorf("minimum latitude is greater than maximum latitude")
+	}
+	if minLat < -90 || maxLat > 90 {
+		return nil, fmt.Errorf("latitudes must be between -90 and 90")
+	}
+	if minLon < -180 || minLon > 180 || maxLon < -180 || maxLon > 180 {
+		return nil, fmt.Errorf("longitudes must be between -180 and 180")
+	}
+	if minLon <= maxLon {
+		return bson.M{
+			"latitude":  bson.M{"$gte": minLat, "$lte": maxLat},
+			"longitude": bson.M{"$gte": minLon, "$lte": maxLon},
+		}, nil
+	}
+	// A box whose western edge is east of its eastern edge crosses the
+	// antimeridian, so covers two ranges of longitude
+	return bson.M{
+		"latitude": bson.M{"$gte": minLat, "$lte": maxLat},
+		"$or": []bson.M{
+			{"longitude": bson.M{"$gte": minLon}},
+			{"longitude": bson.M{"$lte": maxLon}},
+		},
+	}, nil
+}
+
+func (p *queryParser) parseComparison() (bson.M, error) {
+	fieldTok, err := p.expect(tokIdent, "field name")
+	if err != nil {
+		return nil, err
+	}
+	ftype, ok := queryFields[fieldTok.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", fieldTok.text, fieldTok.pos)
+	}
+
+	opTok, err := p.expect(tokOp, "comparison operator")
+	if err != nil {
+		return nil, err
+	}
+
+	valTok := p.next()
+	var value interface{}
+	switch {
+	case ftype == fieldNumber && valTok.kind == tokNumber:
+		n, err := strconv.ParseFloat(valTok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", valTok.text, valTok.pos)
+		}
+		value = n
+	case ftype == fieldString && valTok.kind == tokString && fieldTok.text == "timestamp":
+		// Compare against the normalized UTC form timestamps are stored in
+		ts, err := normalizeTimestamp(valTok.text, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("%v at position %d", err, valTok.pos)
+		}
+		value = ts
+	case ftype == fieldString && valTok.kind == tokString:
+		value = valTok.text
+	case ftype == fieldNumber:
+		return nil, fmt.Errorf("field %q expects a number at position %d", fieldTok.text, valTok.pos)
+	default:
+		return nil, fmt.Errorf("field %q expects a quoted string at position %d", fieldTok.text, valTok.pos)
+	}
+
+	switch opTok.text {
+	case "=", "==":
+		return bson.M{fieldTok.text: value}, nil
+	case "!=":
+		return bson.M{fieldTok.text: bson.M{"$ne": value}}, nil
+	case ">":
+		return bson.M{fieldTok.text: bson.M{"$gt": value}}, nil
+	case ">=":
+		return bson.M{fieldTok.text: bson.M{"$gte": value}}, nil
+	case "<":
+		return bson.M{fieldTok.text: bson.M{"$lt": value}}, nil
+	case "<=":
+		return bson.M{fieldTok.text: bson.M{"$lte": value}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q at position %d", opTok.text, opTok.pos)
+}
+
+// matchQuery evaluates a filter produced by parseQuery against a single
+// location, with MongoDB's semantics for fields the location lacks.
+func matchQuery(filter bson.M, location *api.Location) bool {
+	for key, cond := range filter {
+		var ok bool
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, _ := cond.([]bson.M)
+			matched := 0
+			for _, clause := range clauses {
+				if matchQuery(clause, location) {
+					matched++
+				}
+			}
+			ok = (key == "$and" && matched == len(clauses)) || (key == "$or" && matched > 0) || (key == "$nor" && matched == 0)
+		default:
+			ok = matchField(queryFieldValue(location, key), cond)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchField(value, cond interface{}) bool {
+	ops, isOps := cond.(bson.M)
+	if !isOps {
+		return value != nil && compareValues(value, cond) == 0
+	}
+	for op, operand := range ops {
+		if op == "$ne" {
+			if value != nil && compareValues(value, operand) == 0 {
+				return false
+			}
+			continue
+		}
+		if value == nil {
+			return false
+		}
+		c := compareValues(value, operand)
+		switch {
+		case op == "$gt" && c <= 0, op == "$gte" && c < 0, op == "$lt" && c >= 0, op == "$lte" && c > 0:
+			return false
+		}
+	}
+	return true
+}
+
+// compareValues orders two values of the same query field type.
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case float64:
+		b, _ := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	}
+	return -1
+}
+
+// queryFieldValue returns a location's value for a query field, or nil if
+// the location doesn't have one.
+func queryFieldValue(location *api.Location, field string) interface{} {
+	switch field {
+	case "deployment":
+		return location.Deployment
+	case "platform":
+		return location.Platform
+	case "source":
+		return location.Source
+	case "timestamp":
+		return location.Timestamp
+	case "crs":
+		return location.CRS
+	case "comms_path":
+		return location.CommsPath
+	case "uuid":
+		return location.UUID
+	case "latitude":
+		return location.Latitude
+	case "longitude":
+		return location.Longitude
+	case "speed":
+		if location.Speed != nil {
+			return *location.Speed
+		}
+	case "course":
+		if location.Course != nil {
+			return *location.Course
+		}
+	case "heading":
+		if location.Heading != nil {
+			return *location.Heading
+		}
+	case "pitch":
+		if location.Pitch != nil {
+			return *location.Pitch
+		}
+	case "roll":
+		if location.Roll != nil {
+			return *location.Roll
+		}
+	case "latency":
+		if location.Latency != nil {
+			return *location.Latency
+		}
+	}
+	return nil
+}
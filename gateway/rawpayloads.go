@@ -0,0 +1,437 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Formats payloads are retained in, named by what they are parsed as
+const (
+	// A fix as posted to /api/data, or one line of /api/data/stream
+	payloadFormatLocation = "location"
+	// An acoustic fix as posted to /api/data/usbl
+	payloadFormatUSBL = "usbl"
+)
+
+// Default for how long raw payloads are kept
+const defaultRawPayloadRetention = 90 * 24 * time.Hour
+
+// Most failures listed in the result of a reparse job
+const maxReparseErrors = 100
+
+// payloadFormat parses a retained payload into the fix it describes, reading
+// naive timestamps in tz. Errors come with the status ingest would have
+// responded with.
+type payloadFormat struct {
+	contentType string
+	parse       func(s *Server, ctx context.Context, payload []byte, tz *time.Location) (api.Location, int, error)
+}
+
+var payloadFormats = map[string]payloadFormat{
+	payloadFormatLocation: {"application/json", parseLocationPayload},
+	payloadFormatUSBL:     {"application/json", parseUSBLPayload},
+}
+
+var rawPayloadsEnabled bool
+
+// RawPayload is a submission as it was received, kept so the fix parsed
+// from it can be parsed again once a decoding bug is fixed.
+type RawPayload struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	LocationID primitive.ObjectID `json:"location_id" bson:"location_id"`
+	// The deployment and platform the fix was first stored for
+	Deployment string `json:"deployment" bson:"deployment"`
+	Platform   string `json:"platform" bson:"platform"`
+	Format     string `json:"format" bson:"format"`
+	// The timezone naive timestamps in the payload were read in
+	Timezone string `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	// Base64 in JSON
+	Payload    []byte    `json:"payload" bson:"payload"`
+	ReceivedAt time.Time `json:"received_at" bson:"received_at"`
+}
+
+func (s *Server) initRawPayloads() error {
+	collectionName := os.Getenv("MONGODB_RAW_PAYLOADS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "raw_payloads"
+	}
+	// Kept payloads can be read and deleted with retention off
+	s.store.RawPayloads = s.store.Collection(collectionName)
+
+	if v := os.Getenv("RAW_PAYLOADS_ENABLED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid RAW_PAYLOADS_ENABLED %q", v)
+		}
+		rawPayloadsEnabled = b
+	}
+	if !rawPayloadsEnabled {
+		return nil
+	}
+
+	retention, err := parseRetention("RAW_PAYLOAD_RETENTION", defaultRawPayloadRetention)
+	if err != nil {
+		return err
+	}
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "location_id", Value: 1}, {Key: "received_at", Value: -1}}},
+		{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "received_at", Value: 1}}},
+		{Keys: bson.D{{Key: "received_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds()))},
+	}
+	for _, model := range indexes {
+		if err := s.ensureIndex(s.store.RawPayloads, model); err != nil {
+			return fmt.Errorf("error creating raw payload indexes: %v", err)
+		}
+	}
+	return nil
+}
+
+// storeRawPayload keeps the payload a stored fix was parsed from. A failure
+// is logged rather than returned, as the fix has already been stored.
+func (s *Server) storeRawPayload(ctx context.Context, req *ingestRequest, location *api.Location) {
+	if !rawPayloadsEnabled || req.raw == nil {
+		return
+	}
+	payload := RawPayload{
+		LocationID: location.ID,
+		Deployment: location.Deployment,
+		Platform:   location.Platform,
+		Format:     req.rawFormat,
+		Payload:    req.raw,
+		ReceivedAt: time.Now().UTC(),
+	}
+	if req.tz != nil && req.tz != time.UTC {
+		payload.Timezone = req.tz.String()
+	}
+	if _, err := s.store.RawPayloads.InsertOne(ctx, payload); err != nil {
+		s.logger.Printf("error storing raw payload for location %s: %v", location.ID.Hex(), err)
+	}
+}
+
+func parseLocationPayload(s *Server, ctx context.Context, payload []byte, tz *time.Location) (api.Location, int, error) {
+	var location api.Location
+	if err := json.Unmarshal(payload, &location); err != nil {
+		return location, http.StatusBadRequest, err
+	}
+	if err := normalizeLocation(&location, tz); err != nil {
+		return location, http.StatusBadRequest, err
+	}
+	return location, http.StatusOK, nil
+}
+
+func parseUSBLPayload(s *Server, ctx context.Context, payload []byte, tz *time.Location) (api.Location, int, error) {
+	var fix usblFix
+	if err := json.Unmarshal(payload, &fix); err != nil {
+		return api.Location{}, http.StatusBadRequest, err
+	}
+	if err := binding.Validator.ValidateStruct(&fix); err != nil {
+		return api.Location{}, http.StatusBadRequest, err
+	}
+	return s.usblLocation(ctx, fix, tz)
+}
+
+// reparse parses a fix's raw payload again and runs the result through the
+// ingest pipeline, keeping the stored fix's identity and receipt, and
+// returns how it differs from the stored fix. In place, a fix that differs
+// replaces the stored one, which is kept as a version; in shadow, it is
+// stored in the shadow collection.
+func (s *Server) reparse(ctx context.Context, existing *api.Location, payload *RawPayload, target string) (api.Location, []FieldChange, int, error) {
+	format, ok := payloadFormats[payload.Format]
+	if !ok {
+		return api.Location{}, nil, http.StatusUnprocessableEntity, fmt.Errorf("payloads in format %q can't be parsed", payload.Format)
+	}
+	tz := time.UTC
+	if payload.Timezone != "" {
+		var err error
+		if tz, err = time.LoadLocation(payload.Timezone); err != nil {
+			return api.Location{}, nil, http.StatusUnprocessableEntity, fmt.Errorf("unknown timezone %q", payload.Timezone)
+		}
+	}
+	location, status, err := format.parse(s, ctx, payload.Payload, tz)
+	if err != nil {
+		return location, nil, status, err
+	}
+	// Telemetry is what decoding bugs most often get wrong
+	if err := s.loadTelemetry(ctx, existing); err != nil {
+		return location, nil, http.StatusInternalServerError, err
+	}
+
+	unlock := s.platformLocks.lock(location.Deployment, location.Platform)
+	defer unlock()
+	if status, err := s.reprocessLocation(ctx, existing, &location); err != nil {
+		return location, nil, status, err
+	}
+	changes := diffLocations(existing, &location)
+
+	if target == reparseShadow {
+		if err := s.storeShadowLocation(ctx, &location, changes); err != nil {
+			return location, changes, http.StatusInternalServerError, err
+		}
+		return location, changes, http.StatusOK, nil
+	}
+	if len(changes) == 0 {
+		return location, changes, http.StatusOK, nil
+	}
+	if err := s.storeVersion(ctx, existing, "reparse"); err != nil {
+		return location, changes, http.StatusInternalServerError, err
+	}
+	if err := s.storeReplacement(ctx, existing, &location); err != nil {
+		return location, changes, http.StatusInternalServerError, err
+	}
+	if err := s.storeTelemetry(ctx, &location); err != nil {
+		return location, changes, http.StatusInternalServerError, err
+	}
+	return location, changes, http.StatusOK, nil
+}
+
+// findRawPayloadLocation returns the fix a path's id refers to, if the
+// caller may read it, with its payloads, newest first.
+func (s *Server) findRawPayloadLocation(c *gin.Context) (*api.Location, []RawPayload, bool) {
+	filter, err := locationIDFilter(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return nil, nil, false
+	}
+	ctx := c.Request.Context()
+	var location api.Location
+	err = s.store.Locations.FindOne(ctx, scopedFilter(c, filter)).Decode(&location)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "location not found")
+		return nil, nil, false
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "received_at", Value: -1}})
+	cursor, err := s.store.RawPayloads.Find(ctx, bson.M{"location_id": location.ID}, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+	payloads := []RawPayload{}
+	if err := cursor.All(ctx, &payloads); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+	if len(payloads) == 0 {
+		respondErrorf(c, http.StatusNotFound, "no raw payload is kept for location %s", location.ID.Hex())
+		return nil, nil, false
+	}
+	return &location, payloads, true
+}
+
+// handleGetRawPayload lists the payloads a fix was parsed from, newest
+// first: more than one if it was upserted.
+func (s *Server) handleGetRawPayload(c *gin.Context) {
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	_, payloads, ok := s.findRawPayloadLocation(c)
+	if !ok {
+		return
+	}
+	for i := range payloads {
+		payloads[i].ReceivedAt = payloads[i].ReceivedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, payloads)
+}
+
+// handleDownloadRawPayload responds with the latest payload a fix was
+// parsed from, byte for byte.
+func (s *Server) handleDownloadRawPayload(c *gin.Context) {
+	_, payloads, ok := s.findRawPayloadLocation(c)
+	if !ok {
+		return
+	}
+	payload := payloads[0]
+	contentType := "application/octet-stream"
+	if format, ok := payloadFormats[payload.Format]; ok {
+		contentType = format.contentType
+	}
+	c.Header("X-Payload-Format", payload.Format)
+	c.Data(http.StatusOK, contentType, payload.Payload)
+}
+
+// handleReparseLocation replaces a fix with the one parsed again from its
+// latest raw payload, keeping the fix it replaces as a version.
+func (s *Server) handleReparseLocation(c *gin.Context) {
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	existing, payloads, ok := s.findRawPayloadLocation(c)
+	if !ok {
+		return
+	}
+	location, changes, status, err := s.reparse(context.Background(), existing, &payloads[0], reparseInPlace)
+	if err != nil {
+		respondError(c, status, err)
+		return
+	}
+	if len(changes) == 0 {
+		c.Header("X-Ingest-Result", "unchanged")
+	} else {
+		c.Header("X-Ingest-Result", "updated")
+	}
+	localizeLocation(&location, loc)
+	c.JSON(http.StatusOK, location)
+}
+
+type reparseRequest struct {
+	Deployment string `json:"deployment" binding:"required"`
+	Platform   string `json:"platform"`
+	Format     string `json:"format"`
+	// in_place or shadow
+	Target string `json:"target"`
+	// Reparse fixes whose payloads were received in this range
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type reparseError struct {
+	LocationID string `json:"location_id"`
+	Error      string `json:"error"`
+}
+
+type reparseResult struct {
+	Target string `json:"target"`
+	// Fixes reparsed, changed or not
+	Reparsed  int64 `json:"reparsed"`
+	Changed   int64 `json:"changed"`
+	Unchanged int64 `json:"unchanged"`
+	Failed    int64 `json:"failed"`
+	// Payloads of fixes since deleted
+	Missing int64 `json:"missing"`
+	// How many fixes each field changed in
+	Fields map[string]int64 `json:"fields"`
+	Diffs  []LocationDiff   `json:"diffs,omitempty"`
+	Errors []reparseError   `json:"errors,omitempty"`
+}
+
+// handleReparse parses the fixes whose raw payloads match a filter again, in
+// a background job, for correcting fixes stored by a buggy format adapter.
+// The job reports how the fixes changed, so a reparse can be run into the
+// shadow collection and reviewed before being run in place.
+func (s *Server) handleReparse(c *gin.Context) {
+	var req reparseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	filter := bson.M{"deployment": req.Deployment}
+	if req.Platform != "" {
+		filter["platform"] = req.Platform
+	}
+	if req.Format != "" {
+		if _, ok := payloadFormats[req.Format]; !ok {
+			respondErrorf(c, http.StatusBadRequest, "unknown format %q", req.Format)
+			return
+		}
+		filter["format"] = req.Format
+	}
+	switch req.Target {
+	case "":
+		req.Target = reparseInPlace
+	case reparseInPlace, reparseShadow:
+	default:
+		respondErrorf(c, http.StatusBadRequest, "invalid target %q (expected in_place or shadow)", req.Target)
+		return
+	}
+	receivedAt := bson.M{}
+	for op, v := range map[string]string{"$gte": req.Start, "$lte": req.End} {
+		if v == "" {
+			continue
+		}
+		ts, err := normalizeTimestamp(v, time.UTC)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		t, _ := parseTimestamp(ts)
+		receivedAt[op] = t
+	}
+	if len(receivedAt) > 0 {
+		filter["received_at"] = receivedAt
+	}
+
+	job := s.startJob("reparse", func(progress func(done, total int64)) (interface{}, error) {
+		ctx := context.Background()
+		total, err := s.store.RawPayloads.CountDocuments(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		// Newest first, so each fix is parsed from its latest payload
+		opts := options.Find().SetSort(bson.D{{Key: "received_at", Value: -1}})
+		cursor, err := s.store.RawPayloads.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		result := reparseResult{Target: req.Target, Fields: map[string]int64{}}
+		seen := make(map[primitive.ObjectID]bool)
+		var done int64
+		for cursor.Next(ctx) {
+			done++
+			progress(done, total)
+			var payload RawPayload
+			if err := cursor.Decode(&payload); err != nil {
+				return nil, err
+			}
+			if seen[payload.LocationID] {
+				continue
+			}
+			seen[payload.LocationID] = true
+
+			var existing api.Location
+			err := s.store.Locations.FindOne(ctx, bson.M{"_id": payload.LocationID}).Decode(&existing)
+			if err == mongo.ErrNoDocuments {
+				result.Missing++
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			_, changes, _, err := s.reparse(ctx, &existing, &payload, req.Target)
+			if err != nil {
+				result.Failed++
+				if len(result.Errors) < maxReparseErrors {
+					result.Errors = append(result.Errors, reparseError{LocationID: payload.LocationID.Hex(), Error: err.Error()})
+				}
+				continue
+			}
+			result.Reparsed++
+			if len(changes) == 0 {
+				result.Unchanged++
+				continue
+			}
+			result.Changed++
+			for _, change := range changes {
+				result.Fields[change.Field]++
+			}
+			if len(result.Diffs) < maxReparseDiffs {
+				result.Diffs = append(result.Diffs, LocationDiff{LocationID: payload.LocationID.Hex(), Changes: changes})
+			}
+		}
+		return result, cursor.Err()
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"data-gateway/store"
+)
+
+// How reads for analytical endpoints, such as stats, heatmaps and
+// snapshots, are routed; nil to read from the primary like everything else
+var analyticsReads *options.CollectionOptions
+
+func initAnalyticsReads() error {
+	analyticsReads = nil
+	mode := os.Getenv("ANALYTICS_READ_PREFERENCE")
+	concern := os.Getenv("ANALYTICS_READ_CONCERN")
+	if mode == "" && concern == "" {
+		return nil
+	}
+	if mode == "" {
+		mode = "primary"
+	}
+
+	readMode, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return fmt.Errorf("invalid ANALYTICS_READ_PREFERENCE %q (expected primary, primaryPreferred, secondary, secondaryPreferred or nearest)", mode)
+	}
+	var prefOpts []readpref.Option
+	staleness, err := envDuration("ANALYTICS_MAX_STALENESS", 0)
+	if err != nil {
+		return err
+	}
+	if staleness > 0 {
+		// The server's minimum
+		if staleness < 90*time.Second {
+			return fmt.Errorf("invalid ANALYTICS_MAX_STALENESS %q (expected at least 90s)", os.Getenv("ANALYTICS_MAX_STALENESS"))
+		}
+		prefOpts = append(prefOpts, readpref.WithMaxStaleness(staleness))
+	}
+	if v := os.Getenv("ANALYTICS_READ_TAGS"); v != "" {
+		var tags []string
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" {
+				return fmt.Errorf("invalid ANALYTICS_READ_TAGS entry %q (expected name:value)", pair)
+			}
+			tags = append(tags, name, value)
+		}
+		prefOpts = append(prefOpts, readpref.WithTags(tags...))
+	}
+	pref, err := readpref.New(readMode, prefOpts...)
+	if err != nil {
+		return fmt.Errorf("invalid analytics read preference: %v", err)
+	}
+	opts := options.Collection().SetReadPreference(pref)
+
+	switch concern {
+	case "":
+	case "local", "available", "majority":
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: concern})
+	default:
+		return fmt.Errorf("invalid ANALYTICS_READ_CONCERN %q (expected local, available or majority)", concern)
+	}
+	analyticsReads = opts
+	return nil
+}
+
+// analyticsContext returns a context whose reads are routed as configured
+// for heavy queries, so they can be kept off the primary serving ingest and
+// live positions.
+func analyticsContext(ctx context.Context) context.Context {
+	if analyticsReads == nil {
+		return ctx
+	}
+	return store.WithReadOptions(ctx, analyticsReads)
+}
+
+// analyticalReads routes the reads of a request like analyticsContext.
+func analyticalReads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(analyticsContext(c.Request.Context()))
+		c.Next()
+	}
+}
@@ -0,0 +1,311 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	tileSize        = 256
+	maxRenderSize   = 4096
+	maxRenderZoom   = 17
+	renderPadding   = 24
+	mercatorMaxLat  = 85.05112878
+	renderLineWidth = 2.5
+)
+
+// mercatorPixel converts a position to Web Mercator pixel coordinates at the
+// given zoom level.
+func mercatorPixel(lat, lon float64, zoom int) (float64, float64) {
+	lat = math.Max(-mercatorMaxLat, math.Min(mercatorMaxLat, lat))
+	worldSize := float64(tileSize) * math.Exp2(float64(zoom))
+	x := (lon + 180) / 360 * worldSize
+	sinLat := math.Sin(toRadians(lat))
+	y := (0.5 - math.Log((1+sinLat)/(1-sinLat))/(4*math.Pi)) * worldSize
+	return x, y
+}
+
+// mercatorPosition is the inverse of mercatorPixel.
+func mercatorPosition(x, y float64, zoom int) (float64, float64) {
+	worldSize := float64(tileSize) * math.Exp2(float64(zoom))
+	lon := x/worldSize*360 - 180
+	lat := toDegrees(math.Atan(math.Sinh(math.Pi * (1 - 2*y/worldSize))))
+	return lat, lon
+}
+
+// trackRenderer draws tracks onto an image centred on a Web Mercator view.
+type trackRenderer struct {
+	img              *image.RGBA
+	zoom             int
+	originX, originY float64
+}
+
+// newTrackRenderer picks the highest zoom at which the bounds fit the image.
+func newTrackRenderer(width, height int, bounds ReportBounds) *trackRenderer {
+	// Measured east from the western edge, so bounds across the antimeridian
+	// are viewed across it
+	maxLon := bounds.MinLongitude + bounds.longitudeSpan()
+	zoom := maxRenderZoom
+	for ; zoom > 0; zoom-- {
+		x0, y0 := mercatorPixel(bounds.MaxLatitude, bounds.MinLongitude, zoom)
+		x1, y1 := mercatorPixel(bounds.MinLatitude, maxLon, zoom)
+		if x1-x0 <= float64(width-2*renderPadding) && y1-y0 <= float64(height-2*renderPadding) {
+			break
+		}
+	}
+
+	cx, cy := mercatorPixel((bounds.MinLatitude+bounds.MaxLatitude)/2, (bounds.MinLongitude+maxLon)/2, zoom)
+	return &trackRenderer{
+		img:     image.NewRGBA(image.Rect(0, 0, width, height)),
+		zoom:    zoom,
+		originX: math.Round(cx - float64(width)/2),
+		originY: math.Round(cy - float64(height)/2),
+	}
+}
+
+// project converts a position to image pixels, taking its longitude in
+// whichever copy of the world is closest to the view.
+func (r *trackRenderer) project(lat, lon float64) (float64, float64) {
+	x, y := mercatorPixel(lat, lon, r.zoom)
+	worldSize := float64(tileSize) * math.Exp2(float64(r.zoom))
+	centreX := r.originX + float64(r.img.Bounds().Dx())/2
+	x += worldSize * math.Round((centreX-x)/worldSize)
+	return x - r.originX, y - r.originY
+}
+
+// drawBasemap fills the background with tiles from loadTile, which reads
+// the local tile cache, fetching missing tiles upstream when configured. It
+// reports false if any tile was unavailable.
+func (r *trackRenderer) drawBasemap(loadTile func(z, x, y int) (image.Image, error)) bool {
+	bounds := r.img.Bounds()
+	n := 1 << uint(r.zoom)
+	complete := true
+
+	for ty := int(math.Floor(r.originY / tileSize)); float64(ty*tileSize) < r.originY+float64(bounds.Dy()); ty++ {
+		for tx := int(math.Floor(r.originX / tileSize)); float64(tx*tileSize) < r.originX+float64(bounds.Dx()); tx++ {
+			if ty < 0 || ty >= n {
+				continue
+			}
+			tile, err := loadTile(r.zoom, ((tx%n)+n)%n, ty)
+			if err != nil {
+				complete = false
+				continue
+			}
+			at := image.Pt(tx*tileSize-int(r.originX), ty*tileSize-int(r.originY))
+			draw.Draw(r.img, tile.Bounds().Sub(tile.Bounds().Min).Add(at), tile, tile.Bounds().Min, draw.Src)
+		}
+	}
+	return complete
+}
+
+// loadTile reads a raster tile from TILES_DIR, trying the common extensions.
+func (s *Server) loadTile(z, x, y int) (image.Image, error) {
+	zs, xs := strconv.Itoa(z), strconv.Itoa(x)
+	for _, name := range []string{strconv.Itoa(y) + ".png", strconv.Itoa(y) + ".jpg", strconv.Itoa(y) + ".jpeg", strconv.Itoa(y)} {
+		path := filepath.Join(s.tilesDir, zs, xs, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, err
+	}
+
+	if s.tilesUpstream == "" {
+		return nil, fmt.Errorf("tile %d/%d/%d not cached", z, x, y)
+	}
+	path := filepath.Join(s.tilesDir, zs, xs, strconv.Itoa(y)+".png")
+	if err := s.fetchTile(zs, xs, strconv.Itoa(y)+".png", path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// drawGraticule fills a plain background with latitude/longitude lines at a
+// spacing suited to the view.
+func (r *trackRenderer) drawGraticule() {
+	draw.Draw(r.img, r.img.Bounds(), &image.Uniform{color.RGBA{0xf4, 0xf8, 0xfb, 0xff}}, image.Point{}, draw.Src)
+
+	bounds := r.img.Bounds()
+	north, west := mercatorPosition(r.originX, r.originY, r.zoom)
+	south, east := mercatorPosition(r.originX+float64(bounds.Dx()), r.originY+float64(bounds.Dy()), r.zoom)
+	step := graticuleStep(math.Max(east-west, north-south))
+	lineColor := color.RGBA{0xc8, 0xd2, 0xdc, 0xff}
+
+	for lon := math.Ceil(west/step) * step; lon <= east; lon += step {
+		x, _ := r.project(0, lon)
+		for y := 0; y < bounds.Dy(); y++ {
+			r.img.Set(int(math.Round(x)), y, lineColor)
+		}
+	}
+	for lat := math.Ceil(south/step) * step; lat <= north; lat += step {
+		_, y := r.project(lat, 0)
+		for x := 0; x < bounds.Dx(); x++ {
+			r.img.Set(x, int(math.Round(y)), lineColor)
+		}
+	}
+}
+
+// graticuleStep picks a 1-2-5 spacing giving a handful of lines across span.
+func graticuleStep(span float64) float64 {
+	target := span / 6
+	magnitude := math.Pow(10, math.Floor(math.Log10(target)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if m*magnitude >= target {
+			return m * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// drawTrack strokes a polyline by stamping discs along each segment.
+func (r *trackRenderer) drawTrack(points [][2]float64, c color.RGBA) {
+	for i, pt := range points {
+		x, y := r.project(pt[1], pt[0])
+		if i == 0 {
+			r.disc(x, y, renderLineWidth*1.6, c)
+			continue
+		}
+		px, py := r.project(points[i-1][1], points[i-1][0])
+		steps := int(math.Ceil(math.Hypot(x-px, y-py) * 2))
+		for s := 1; s <= steps; s++ {
+			t := float64(s) / float64(steps)
+			r.disc(px+(x-px)*t, py+(y-py)*t, renderLineWidth/2, c)
+		}
+	}
+	// Mark the latest position
+	if len(points) > 0 {
+		last := points[len(points)-1]
+		x, y := r.project(last[1], last[0])
+		r.disc(x, y, renderLineWidth*2.4, color.RGBA{0xff, 0xff, 0xff, 0xff})
+		r.disc(x, y, renderLineWidth*1.8, c)
+	}
+}
+
+func (r *trackRenderer) disc(cx, cy, radius float64, c color.RGBA) {
+	for y := int(math.Floor(cy - radius)); y <= int(math.Ceil(cy+radius)); y++ {
+		for x := int(math.Floor(cx - radius)); x <= int(math.Ceil(cx+radius)); x++ {
+			if math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) <= radius {
+				r.img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+func trackColor(i int) color.RGBA {
+	c := trackColors[i%len(trackColors)]
+	return color.RGBA{uint8(c[0] * 255), uint8(c[1] * 255), uint8(c[2] * 255), 0xff}
+}
+
+func (s *Server) handleRenderTrack(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+	if q := c.Query("q"); q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid query: %v", err)
+			return
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+
+	width, err := parseRenderSize(c.DefaultQuery("width", "800"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid width: %v", err)
+		return
+	}
+	height, err := parseRenderSize(c.DefaultQuery("height", strconv.Itoa(width*2/3)))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid height: %v", err)
+		return
+	}
+
+	basemap := c.DefaultQuery("basemap", "auto")
+	if basemap != "auto" && basemap != "none" {
+		respondErrorf(c, http.StatusBadRequest, "basemap must be auto or none")
+		return
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"platform": 1, "latitude": 1, "longitude": 1}).
+		SetLimit(s.maxResultLimit)
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var locations []api.Location
+	if err = cursor.All(ctx, &locations); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if len(locations) == 0 {
+		respondErrorf(c, http.StatusNotFound, "no locations found")
+		return
+	}
+
+	// Group into per-platform tracks, thinned to what the image can show
+	var tracks [][][2]float64
+	bounds := pointBounds(locations[0].Latitude, locations[0].Longitude)
+	for i, location := range locations {
+		if i == 0 || location.Platform != locations[i-1].Platform {
+			tracks = append(tracks, nil)
+		}
+		tracks[len(tracks)-1] = append(tracks[len(tracks)-1], [2]float64{location.Longitude, location.Latitude})
+		bounds.extend(location.Latitude, location.Longitude)
+	}
+
+	renderer := newTrackRenderer(width, height, bounds)
+	if basemap == "none" || s.tilesDir == "" || !renderer.drawBasemap(s.loadTile) {
+		renderer.drawGraticule()
+	}
+	for i, track := range tracks {
+		renderer.drawTrack(decimateTrack(track, 4*(width+height)), trackColor(i))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderer.img); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(http.StatusOK, "image/png", buf.Bytes())
+}
+
+func parseRenderSize(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 2*renderPadding+1 || n > maxRenderSize {
+		return 0, fmt.Errorf("must be between %d and %d pixels", 2*renderPadding+1, maxRenderSize)
+	}
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const maxReplaySpeed = 10000
+
+// parseReplaySpeed accepts speeds written as "10x" or "10".
+func parseReplaySpeed(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(value), "x"), 64)
+	if err != nil || speed <= 0 || speed > maxReplaySpeed {
+		return 0, fmt.Errorf("invalid speed %q (expected e.g. 10x, up to %dx)", value, maxReplaySpeed)
+	}
+	return speed, nil
+}
+
+// handleReplay streams a deployment's historical fixes as server-sent events,
+// preserving their relative timing compressed by the requested speed.
+func (s *Server) handleReplay(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	speed, err := parseReplaySpeed(c.Query("speed"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	timeRange := bson.M{}
+	for param, op := range map[string]string{"start": "$gte", "end": "$lte"} {
+		if v := c.Query(param); v != "" {
+			ts, err := normalizeTimestamp(v, loc)
+			if err != nil {
+				respondErrorf(c, http.StatusBadRequest, "invalid %s: %v", param, err)
+				return
+			}
+			timeRange[op] = ts
+		}
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	disableWriteTimeout(c)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	var prevTime time.Time
+	c.Stream(func(w io.Writer) bool {
+		if !cursor.Next(ctx) {
+			if err := cursor.Err(); err != nil {
+				c.SSEvent("error", casedValue(c, newAPIError(c, http.StatusInternalServerError, err)))
+			} else {
+				c.SSEvent("end", gin.H{"status": "complete"})
+			}
+			return false
+		}
+
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			c.SSEvent("error", casedValue(c, newAPIError(c, http.StatusInternalServerError, err)))
+			return false
+		}
+
+		// Wait for the compressed interval since the previous fix
+		if t, err := parseTimestamp(location.Timestamp); err == nil {
+			if !prevTime.IsZero() && t.After(prevTime) {
+				delay := time.Duration(float64(t.Sub(prevTime)) / speed)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return false
+				}
+			}
+			prevTime = t
+		}
+
+		localizeLocation(&location, loc)
+		c.SSEvent("location", casedValue(c, location))
+		return true
+	})
+}
@@ -0,0 +1,298 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trackColors are assigned to platforms in report order.
+var trackColors = [][3]float64{
+	{0.12, 0.47, 0.71}, {1.00, 0.50, 0.05}, {0.17, 0.63, 0.17}, {0.84, 0.15, 0.16},
+	{0.58, 0.40, 0.74}, {0.55, 0.34, 0.29}, {0.89, 0.47, 0.76}, {0.50, 0.50, 0.50},
+}
+
+func trackColorHex(i int) string {
+	c := trackColors[i%len(trackColors)]
+	return fmt.Sprintf("#%02x%02x%02x", int(c[0]*255), int(c[1]*255), int(c[2]*255))
+}
+
+// projectTracks fits every platform's track into a width x height box using
+// an equirectangular projection scaled for the report's mid latitude. Points
+// are returned with y increasing downwards.
+func projectTracks(report *Report, width, height, margin float64) [][][2]float64 {
+	b := report.Bounds
+	midLat := toRadians((b.MinLatitude + b.MaxLatitude) / 2)
+	spanX := b.longitudeSpan() * math.Cos(midLat)
+	spanY := b.MaxLatitude - b.MinLatitude
+
+	scale := 1.0
+	if spanX > 0 || spanY > 0 {
+		scale = math.Min((width-2*margin)/math.Max(spanX, 1e-9), (height-2*margin)/math.Max(spanY, 1e-9))
+	}
+	// Center the track in the box
+	offsetX := (width - spanX*scale) / 2
+	offsetY := (height - spanY*scale) / 2
+
+	tracks := make([][][2]float64, len(report.Platforms))
+	for i, p := range report.Platforms {
+		for _, pt := range p.Track {
+			x := offsetX + degreesEast(b.MinLongitude, pt[0])*math.Cos(midLat)*scale
+			y := offsetY + (b.MaxLatitude-pt[1])*scale
+			tracks[i] = append(tracks[i], [2]float64{x, y})
+		}
+	}
+	return tracks
+}
+
+func reportFilename(report *Report, ext string) string {
+	end, _ := parseTimestamp(report.End)
+	return fmt.Sprintf("%s-%s-%s.%s", report.Deployment, report.Kind, end.Format("20060102"), ext)
+}
+
+func reportTitle(report *Report) string {
+	if report.Kind == reportMission {
+		return fmt.Sprintf("Mission report: %s", report.Deployment)
+	}
+	return fmt.Sprintf("Daily report: %s", report.Deployment)
+}
+
+type reportPlatformView struct {
+	ReportPlatform
+	Color    string
+	Km       string
+	GapTotal string
+	Flags    string
+}
+
+type reportView struct {
+	*Report
+	Title     string
+	Km        string
+	Platforms []reportPlatformView
+	Paths     []reportPath
+	Gaps      []Gap
+}
+
+type reportPath struct {
+	Color  string
+	Points string
+}
+
+func buildReportView(report *Report) reportView {
+	view := reportView{
+		Report: report,
+		Title:  reportTitle(report),
+		Km:     fmt.Sprintf("%.1f", report.Distance/1000),
+	}
+	for i, p := range report.Platforms {
+		var gapSeconds float64
+		for _, g := range p.Gaps {
+			gapSeconds += g.Seconds
+			view.Gaps = append(view.Gaps, g)
+		}
+		view.Platforms = append(view.Platforms, reportPlatformView{
+			ReportPlatform: p,
+			Color:          trackColorHex(i),
+			Km:             fmt.Sprintf("%.1f", p.Distance/1000),
+			GapTotal:       (time.Duration(gapSeconds) * time.Second).String(),
+			Flags:          formatFlagCounts(p.QCFlags),
+		})
+	}
+	for i, track := range projectTracks(report, 800, 500, 20) {
+		points := make([]string, len(track))
+		for j, pt := range track {
+			points[j] = fmt.Sprintf("%.1f,%.1f", pt[0], pt[1])
+		}
+		view.Paths = append(view.Paths, reportPath{Color: trackColorHex(i), Points: strings.Join(points, " ")})
+	}
+	return view
+}
+
+// formatFlagCounts renders QC flag counts as "flag: n, ..." in flag order.
+func formatFlagCounts(flags map[string]int64) string {
+	if len(flags) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s: %d", name, flags[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.swatch { display: inline-block; width: 12px; height: 12px; margin-right: 4px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Start}} to {{.End}} &middot; {{.Count}} fixes &middot; {{.Km}} km travelled</p>
+
+<svg width="800" height="500" viewBox="0 0 800 500" style="border: 1px solid #ccc; background: #f4f8fb">
+{{range .Paths}}<polyline fill="none" stroke="{{.Color}}" stroke-width="2" points="{{.Points}}"/>
+{{end}}</svg>
+<p>Latitude {{printf "%.4f" .Bounds.MinLatitude}} to {{printf "%.4f" .Bounds.MaxLatitude}}, longitude {{printf "%.4f" .Bounds.MinLongitude}} to {{printf "%.4f" .Bounds.MaxLongitude}}</p>
+
+<h2>Platforms</h2>
+<table>
+<tr><th>Platform</th><th>Fixes</th><th>Distance (km)</th><th>First fix</th><th>Last fix</th><th>Gaps</th><th>Time in gaps</th><th>QC flags</th></tr>
+{{range .Platforms}}<tr><td><span class="swatch" style="background: {{.Color}}"></span>{{.Platform}}</td><td>{{.Count}}</td><td>{{.Km}}</td><td>{{.FirstTimestamp}}</td><td>{{.LastTimestamp}}</td><td>{{len .Gaps}}</td><td>{{.GapTotal}}</td><td>{{.Flags}}</td></tr>
+{{end}}</table>
+
+<h2>Gaps longer than {{.GapThreshold}}</h2>
+{{if .Gaps}}<table>
+<tr><th>Platform</th><th>From</th><th>To</th><th>Duration</th></tr>
+{{range .Gaps}}<tr><td>{{.Platform}}</td><td>{{.Start}}</td><td>{{.End}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<p><small>Generated {{.GeneratedAt.UTC.Format "2006-01-02 15:04:05"}} UTC</small></p>
+</body>
+</html>
+`))
+
+func writeReportHTML(w io.Writer, report *Report) error {
+	return reportTemplate.Execute(w, buildReportView(report))
+}
+
+func renderReportHTML(report *Report) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeReportHTML(&buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderReportPDF lays the report out on a single A4 page: a text summary
+// followed by the track map.
+func renderReportPDF(report *Report) []byte {
+	const pageWidth, pageHeight, margin = 595.0, 842.0, 50.0
+	const mapHeight = 320.0
+
+	var content bytes.Buffer
+	y := pageHeight - margin
+	// Text stops before running into the map
+	full := func() bool { return y < margin+mapHeight+20 }
+	text := func(size float64, s string) {
+		if full() {
+			return
+		}
+		fmt.Fprintf(&content, "BT /F1 %.0f Tf %.1f %.1f Td (%s) Tj ET\n", size, margin, y, pdfEscape(s))
+		y -= size * 1.5
+	}
+
+	text(18, reportTitle(report))
+	text(10, fmt.Sprintf("%s to %s", report.Start, report.End))
+	text(10, fmt.Sprintf("%d fixes, %.1f km travelled", report.Count, report.Distance/1000))
+	y -= 8
+	for i, p := range report.Platforms {
+		if full() {
+			break
+		}
+		c := trackColors[i%len(trackColors)]
+		fmt.Fprintf(&content, "%.2f %.2f %.2f rg %.1f %.1f 8 8 re f 0 g\n", c[0], c[1], c[2], margin, y-1)
+		fmt.Fprintf(&content, "BT /F1 11 Tf %.1f %.1f Td (%s) Tj ET\n", margin+12, y, pdfEscape(p.Platform))
+		y -= 15
+		text(9, fmt.Sprintf("%d fixes, %.1f km, %s to %s", p.Count, p.Distance/1000, p.FirstTimestamp, p.LastTimestamp))
+		text(9, fmt.Sprintf("%d gaps longer than %s; QC flags: %s", len(p.Gaps), report.GapThreshold, formatFlagCounts(p.QCFlags)))
+		for j, g := range p.Gaps {
+			if j == 5 {
+				text(9, fmt.Sprintf("    ... and %d more", len(p.Gaps)-5))
+				break
+			}
+			text(9, fmt.Sprintf("    %s to %s (%s)", g.Start, g.End, g.Duration))
+		}
+		y -= 6
+	}
+
+	// Map frame and tracks; PDF y increases upwards
+	mapWidth := pageWidth - 2*margin
+	fmt.Fprintf(&content, "0.5 G 0.5 w %.1f %.1f %.1f %.1f re S\n", margin, margin, mapWidth, mapHeight)
+	for i, track := range projectTracks(report, mapWidth, mapHeight, 10) {
+		if len(track) == 0 {
+			continue
+		}
+		c := trackColors[i%len(trackColors)]
+		fmt.Fprintf(&content, "%.2f %.2f %.2f RG 1 w\n", c[0], c[1], c[2])
+		for j, pt := range track {
+			op := "l"
+			if j == 0 {
+				op = "m"
+			}
+			fmt.Fprintf(&content, "%.2f %.2f %s\n", margin+pt[0], margin+mapHeight-pt[1], op)
+		}
+		content.WriteString("S\n")
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>", pageWidth, pageHeight),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+// pdfEscape makes s safe inside a PDF string literal. Characters outside
+// printable ASCII are replaced since the page uses a standard font.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// emailReport sends the HTML report with the PDF attached.
+func emailReport(report *Report, to []string) error {
+	html, err := renderReportHTML(report)
+	if err != nil {
+		return err
+	}
+	return sendMail(to, reportTitle(report), string(html), mailAttachment{
+		Filename:    reportFilename(report, "pdf"),
+		ContentType: "application/pdf",
+		Data:        renderReportPDF(report),
+	})
+}
@@ -0,0 +1,583 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	reportDaily   = "daily"
+	reportMission = "mission"
+)
+
+// maxTrackPoints caps the positions kept per platform for the report map.
+const maxTrackPoints = 1000
+
+// Reports are listed newest first
+var reportOrder = pageOrder{field: "generated_at", desc: true, date: true}
+
+// ReportPlatform summarizes one platform's activity over a report period.
+type ReportPlatform struct {
+	Platform       string           `json:"platform" bson:"platform"`
+	Count          int64            `json:"count" bson:"count"`
+	FirstTimestamp string           `json:"first_timestamp" bson:"first_timestamp"`
+	LastTimestamp  string           `json:"last_timestamp" bson:"last_timestamp"`
+	Distance       float64          `json:"distance" bson:"distance"`
+	Gaps           []Gap            `json:"gaps" bson:"gaps"`
+	QCFlags        map[string]int64 `json:"qc_flags" bson:"qc_flags"`
+	Track          [][2]float64     `json:"-" bson:"track"`
+}
+
+// ReportBounds is the area covered by a report's tracks. Its longitudes
+// run east from MinLongitude to MaxLongitude, so an area crossing the
+// antimeridian has a MinLongitude greater than its MaxLongitude.
+type ReportBounds struct {
+	MinLatitude  float64 `json:"min_latitude" bson:"min_latitude"`
+	MinLongitude float64 `json:"min_longitude" bson:"min_longitude"`
+	MaxLatitude  float64 `json:"max_latitude" bson:"max_latitude"`
+	MaxLongitude float64 `json:"max_longitude" bson:"max_longitude"`
+}
+
+// pointBounds returns the bounds of a single position.
+func pointBounds(lat, lon float64) ReportBounds {
+	return ReportBounds{lat, lon, lat, lon}
+}
+
+// degreesEast returns how far east of one longitude another is, in [0, 360).
+func degreesEast(from, to float64) float64 {
+	return math.Mod(math.Mod(to-from, 360)+360, 360)
+}
+
+// longitudeSpan returns the degrees of longitude the bounds cover.
+func (b ReportBounds) longitudeSpan() float64 {
+	return degreesEast(b.MinLongitude, b.MaxLongitude)
+}
+
+// containsLongitudes reports whether the other bounds' longitudes lie within these.
+func (b ReportBounds) containsLongitudes(o ReportBounds) bool {
+	return degreesEast(b.MinLongitude, o.MinLongitude)+o.longitudeSpan() <= b.longitudeSpan()
+}
+
+// extend grows the bounds to include a position, reaching east or west for
+// it, whichever is shorter, so tracks across the antimeridian are bounded
+// by the few degrees either side of it rather than most of the globe.
+func (b *ReportBounds) extend(lat, lon float64) {
+	b.union(pointBounds(lat, lon))
+}
+
+// union grows the bounds to include other bounds, by the smallest span of
+// longitude covering both.
+func (b *ReportBounds) union(o ReportBounds) {
+	b.MinLatitude = min(b.MinLatitude, o.MinLatitude)
+	b.MaxLatitude = max(b.MaxLatitude, o.MaxLatitude)
+
+	best := ReportBounds{MinLongitude: -180, MaxLongitude: 180}
+	bestSpan := 360.0
+	for _, c := range []ReportBounds{
+		{MinLongitude: b.MinLongitude, MaxLongitude: b.MaxLongitude},
+		{MinLongitude: o.MinLongitude, MaxLongitude: o.MaxLongitude},
+		{MinLongitude: b.MinLongitude, MaxLongitude: o.MaxLongitude},
+		{MinLongitude: o.MinLongitude, MaxLongitude: b.MaxLongitude},
+	} {
+		if c.containsLongitudes(*b) && c.containsLongitudes(o) && c.longitudeSpan() < bestSpan {
+			best, bestSpan = c, c.longitudeSpan()
+		}
+	}
+	b.MinLongitude, b.MaxLongitude = best.MinLongitude, best.MaxLongitude
+}
+
+// Report is a stored summary of a deployment over a day or a whole mission.
+type Report struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Deployment   string             `json:"deployment" bson:"deployment"`
+	Kind         string             `json:"kind" bson:"kind"`
+	Start        string             `json:"start" bson:"start"`
+	End          string             `json:"end" bson:"end"`
+	Count        int64              `json:"count" bson:"count"`
+	Distance     float64            `json:"distance" bson:"distance"`
+	GapThreshold string             `json:"gap_threshold" bson:"gap_threshold"`
+	Bounds       ReportBounds       `json:"bounds" bson:"bounds"`
+	Platforms    []ReportPlatform   `json:"platforms" bson:"platforms"`
+	Schedule     string             `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	GeneratedAt  time.Time          `json:"generated_at" bson:"generated_at"`
+}
+
+type reportSchedule struct {
+	kind string
+	expr string
+	cron *cronSchedule
+}
+
+var reportSchedules []reportSchedule
+var reportDeployments []string
+var reportEmailTo []string
+var reportGapThreshold = 10 * time.Minute
+var reportMissionIdle = 24 * time.Hour
+
+var errEmptyReport = errors.New("no fixes in report period")
+
+func (s *Server) initReports() error {
+	collectionName := os.Getenv("MONGODB_REPORTS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "reports"
+	}
+	s.store.Reports = s.store.Collection(collectionName)
+
+	// Schedules are kind=cron pairs, e.g. "daily=0 6 * * *;mission=0 * * * *"
+	if v := os.Getenv("REPORT_SCHEDULES"); v != "" {
+		for _, entry := range strings.Split(v, ";") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			kind, expr, ok := strings.Cut(entry, "=")
+			kind = strings.TrimSpace(kind)
+			if !ok || (kind != reportDaily && kind != reportMission) {
+				return fmt.Errorf("invalid REPORT_SCHEDULES entry %q (expected daily=<cron> or mission=<cron>)", entry)
+			}
+			cron, err := parseCron(expr)
+			if err != nil {
+				return fmt.Errorf("invalid REPORT_SCHEDULES entry %q: %v", entry, err)
+			}
+			reportSchedules = append(reportSchedules, reportSchedule{kind: kind, expr: strings.TrimSpace(expr), cron: cron})
+		}
+	}
+
+	if v := os.Getenv("REPORT_DEPLOYMENTS"); v != "" {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				reportDeployments = append(reportDeployments, d)
+			}
+		}
+	}
+	if v := os.Getenv("REPORT_EMAIL_TO"); v != "" {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				reportEmailTo = append(reportEmailTo, addr)
+			}
+		}
+		if mailer == nil {
+			return fmt.Errorf("REPORT_EMAIL_TO requires SMTP_HOST")
+		}
+	}
+
+	if v := os.Getenv("REPORT_GAP_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid REPORT_GAP_THRESHOLD %q", v)
+		}
+		reportGapThreshold = d
+	}
+	// A deployment is treated as finished once it has been quiet this long
+	if v := os.Getenv("REPORT_MISSION_IDLE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid REPORT_MISSION_IDLE %q", v)
+		}
+		reportMissionIdle = d
+	}
+
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "kind", Value: 1}, {Key: "end", Value: -1}},
+	}
+	if err := s.ensureIndex(s.store.Reports, indexModel); err != nil {
+		return fmt.Errorf("error creating report indexes: %v", err)
+	}
+
+	return nil
+}
+
+// generateReport summarizes a deployment's fixes. Daily reports cover the 24
+// hours before end; mission reports cover every fix in the deployment.
+func (s *Server) generateReport(ctx context.Context, deployment, kind string, end time.Time) (*Report, error) {
+	filter := bson.M{"deployment": deployment}
+	report := &Report{
+		Deployment:   deployment,
+		Kind:         kind,
+		GapThreshold: reportGapThreshold.String(),
+		Platforms:    []ReportPlatform{},
+		GeneratedAt:  time.Now(),
+	}
+	if kind == reportDaily {
+		report.Start = end.Add(-24 * time.Hour).UTC().Format(timestampLayout)
+		report.End = end.UTC().Format(timestampLayout)
+		filter["timestamp"] = bson.M{"$gte": report.Start, "$lt": report.End}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1, "qc": 1})
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var current *ReportPlatform
+	var prev *api.Location
+	first := true
+	var prevTime time.Time
+	finish := func() {
+		if current != nil {
+			current.Track = decimateTrack(current.Track, maxTrackPoints)
+			report.Count += current.Count
+			report.Distance += current.Distance
+			report.Platforms = append(report.Platforms, *current)
+		}
+	}
+
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.Platform != location.Platform {
+			finish()
+			current = &ReportPlatform{Platform: location.Platform, Gaps: []Gap{}, QCFlags: map[string]int64{}, FirstTimestamp: location.Timestamp}
+			prev = nil
+		}
+
+		current.Count++
+		current.LastTimestamp = location.Timestamp
+		current.Track = append(current.Track, [2]float64{location.Longitude, location.Latitude})
+		if location.QC != nil {
+			for _, flag := range location.QC.Flags {
+				current.QCFlags[flag]++
+			}
+		}
+
+		if first {
+			report.Bounds = pointBounds(location.Latitude, location.Longitude)
+			first = false
+		}
+		report.Bounds.extend(location.Latitude, location.Longitude)
+
+		t, err := parseTimestamp(location.Timestamp)
+		if prev != nil {
+			current.Distance += haversine(prev.Latitude, prev.Longitude, location.Latitude, location.Longitude)
+			if d := t.Sub(prevTime); err == nil && d > reportGapThreshold {
+				current.Gaps = append(current.Gaps, Gap{
+					Deployment: deployment,
+					Platform:   location.Platform,
+					Start:      prev.Timestamp,
+					End:        location.Timestamp,
+					Duration:   d.String(),
+					Seconds:    d.Seconds(),
+				})
+			}
+		}
+		if err == nil {
+			loc := location
+			prev = &loc
+			prevTime = t
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+
+	if report.Count == 0 {
+		return nil, errEmptyReport
+	}
+
+	if kind == reportMission {
+		report.Start = report.Platforms[0].FirstTimestamp
+		report.End = report.Platforms[0].LastTimestamp
+		for _, p := range report.Platforms[1:] {
+			report.Start = min(report.Start, p.FirstTimestamp)
+			report.End = max(report.End, p.LastTimestamp)
+		}
+	}
+
+	return report, nil
+}
+
+// decimateTrack keeps at most n evenly spaced points, always including the
+// last.
+func decimateTrack(track [][2]float64, n int) [][2]float64 {
+	if len(track) <= n {
+		return track
+	}
+	out := make([][2]float64, 0, n)
+	step := float64(len(track)-1) / float64(n-1)
+	for i := 0; i < n; i++ {
+		out = append(out, track[int(float64(i)*step+0.5)])
+	}
+	return out
+}
+
+func (s *Server) storeReport(ctx context.Context, report *Report) error {
+	res, err := s.store.Reports.InsertOne(ctx, report)
+	if err != nil {
+		return err
+	}
+	report.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// runReportScheduler generates scheduled reports, checking the schedules at
+// the start of every minute (UTC).
+func (s *Server) runReportScheduler(ctx context.Context) {
+	if len(reportSchedules) == 0 {
+		return
+	}
+	for {
+		next := time.Now().UTC().Truncate(time.Minute).Add(time.Minute)
+		if !sleep(ctx, time.Until(next)) {
+			return
+		}
+		// Scheduled reports are writes, so pause them outside normal mode
+		if s.serviceMode().Mode != modeNormal || !s.leading() {
+			continue
+		}
+		for _, sched := range reportSchedules {
+			if sched.cron.Matches(next) {
+				s.runScheduledReports(sched, next)
+			}
+		}
+	}
+}
+
+func (s *Server) runScheduledReports(sched reportSchedule, at time.Time) {
+	if !s.featureEnabled(featureReports) {
+		return
+	}
+	ctx := analyticsContext(context.Background())
+
+	deployments := reportDeployments
+	if len(deployments) == 0 {
+		var err error
+		if deployments, err = s.deployments(ctx, nil); err != nil {
+			s.logger.Printf("error listing deployments for %s reports: %v", sched.kind, err)
+			return
+		}
+	}
+
+	for _, deployment := range deployments {
+		if sched.kind == reportMission {
+			done, err := s.missionReported(ctx, deployment, at)
+			if err != nil {
+				s.logger.Printf("error checking mission report for %s: %v", deployment, err)
+				continue
+			}
+			if done {
+				continue
+			}
+		}
+
+		report, err := s.generateReport(ctx, deployment, sched.kind, at)
+		if err == errEmptyReport {
+			continue
+		} else if err != nil {
+			s.logger.Printf("error generating %s report for %s: %v", sched.kind, deployment, err)
+			continue
+		}
+		report.Schedule = sched.expr
+		if err := s.storeReport(ctx, report); err != nil {
+			s.logger.Printf("error storing %s report for %s: %v", sched.kind, deployment, err)
+			continue
+		}
+		if len(reportEmailTo) > 0 {
+			if err := emailReport(report, reportEmailTo); err != nil {
+				s.logger.Printf("error emailing %s report for %s: %v", sched.kind, deployment, err)
+			}
+		}
+	}
+}
+
+// missionReported reports whether a deployment is still active, or has
+// already had a mission report covering its latest fix.
+func (s *Server) missionReported(ctx context.Context, deployment string, at time.Time) (bool, error) {
+	var last api.Location
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetProjection(bson.M{"timestamp": 1})
+	err := s.store.Locations.FindOne(ctx, bson.M{"deployment": deployment}, opts).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	t, err := parseTimestamp(last.Timestamp)
+	if err != nil || at.Sub(t) < reportMissionIdle {
+		return true, nil
+	}
+
+	count, err := s.store.Reports.CountDocuments(ctx, bson.M{
+		"deployment": deployment,
+		"kind":       reportMission,
+		"end":        bson.M{"$gte": last.Timestamp},
+	})
+	return count > 0, err
+}
+
+// canReadReport reports whether the caller may read every platform a report
+// covers.
+func canReadReport(c *gin.Context, report *Report) bool {
+	for _, p := range report.Platforms {
+		if !canRead(c, report.Deployment, p.Platform) {
+			return false
+		}
+	}
+	return canRead(c, report.Deployment, "")
+}
+
+func (s *Server) handleGetReports(c *gin.Context) {
+	filter := bson.M{}
+	if deployment := c.Query("deployment"); deployment != "" {
+		filter["deployment"] = deployment
+	}
+	if kind := c.Query("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+
+	limit, offset, _, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().
+		SetSort(reportOrder.sort()).
+		SetProjection(bson.M{"platforms.track": 0}).
+		SetLimit(limit).
+		SetSkip(offset)
+	cursor, err := s.store.Reports.Find(ctx, filter, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var results []Report
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	visible := []Report{}
+	for i := range results {
+		if canReadReport(c, &results[i]) {
+			visible = append(visible, results[i])
+		}
+	}
+
+	c.Header("X-Sort-Order", reportOrder.String())
+	c.JSON(http.StatusOK, visible)
+}
+
+func (s *Server) handleGetReport(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid report id")
+		return
+	}
+
+	var report Report
+	err = s.store.Reports.FindOne(c.Request.Context(), bson.M{"_id": id}).Decode(&report)
+	if err == mongo.ErrNoDocuments || (err == nil && !canReadReport(c, &report)) {
+		respondErrorf(c, http.StatusNotFound, "report not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "html":
+		var body responseBody
+		defer body.Close()
+		if err := writeReportHTML(&body, &report); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		body.send(c, http.StatusOK, "text/html; charset=utf-8")
+	case "pdf":
+		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", reportFilename(&report, "pdf")))
+		c.Data(http.StatusOK, "application/pdf", renderReportPDF(&report))
+	default:
+		respondErrorf(c, http.StatusBadRequest, "format must be json, html, or pdf")
+	}
+}
+
+type reportRequest struct {
+	Deployment string `json:"deployment" binding:"required"`
+	Kind       string `json:"kind"`
+	End        string `json:"end"`
+	Email      bool   `json:"email"`
+}
+
+func (s *Server) handleCreateReport(c *gin.Context) {
+	var req reportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = reportDaily
+	}
+	if req.Kind != reportDaily && req.Kind != reportMission {
+		respondErrorf(c, http.StatusBadRequest, "kind must be daily or mission")
+		return
+	}
+	if req.Email && len(reportEmailTo) == 0 {
+		respondErrorf(c, http.StatusBadRequest, "report email is not configured (set REPORT_EMAIL_TO)")
+		return
+	}
+
+	end := time.Now()
+	if req.End != "" {
+		loc, err := requestTimezone(c)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if end, err = parseTimestampIn(req.End, loc); err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid end: %v", err)
+			return
+		}
+	}
+
+	ctx := analyticsContext(context.Background())
+	report, err := s.generateReport(ctx, req.Deployment, req.Kind, end)
+	if err == errEmptyReport {
+		respondError(c, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !canReadReport(c, report) {
+		respondErrorf(c, http.StatusForbidden, "access to deployment denied")
+		return
+	}
+
+	if err := s.storeReport(ctx, report); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if req.Email {
+		if err := emailReport(report, reportEmailTo); err != nil {
+			respondErrorf(c, http.StatusBadGateway, "report %s stored but not emailed: %v", report.ID.Hex(), err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusCreated, report)
+}
@@ -0,0 +1,315 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// Where reparsed fixes are stored
+const (
+	// Replacing the stored fixes they differ from, which are kept as versions
+	reparseInPlace = "in_place"
+	// In the shadow collection, leaving the stored fixes as they are
+	reparseShadow = "shadow"
+)
+
+// Reparsed fixes are listed in the order of the fixes they replace, whose
+// _id they share
+var reparsedOrder = pageOrder{field: "location.timestamp"}
+
+// Most fixes whose changes are listed in the result of a reparse job
+const maxReparseDiffs = 100
+
+// Fields that always differ between a stored fix and its replacement, or
+// never do
+var undiffedFields = map[string]bool{"id": true, "uuid": true, "created_at": true}
+
+// FieldChange is a field of a fix that reprocessing changed.
+type FieldChange struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// LocationDiff lists the fields reprocessing changed in a fix.
+type LocationDiff struct {
+	LocationID string        `json:"location_id"`
+	Changes    []FieldChange `json:"changes"`
+}
+
+// LocationVersion is a fix as it was stored before being replaced by
+// reprocessing, numbered from 1 for its first replacement.
+type LocationVersion struct {
+	ID         primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	LocationID primitive.ObjectID `json:"location_id" bson:"location_id"`
+	Version    int64              `json:"version" bson:"version"`
+	// Why the fix was replaced
+	Reason     string                 `json:"reason" bson:"reason"`
+	Location   api.Location           `json:"location" bson:"location"`
+	Data       map[string]interface{} `json:"-" bson:"data,omitempty"`
+	ReplacedAt time.Time              `json:"replaced_at" bson:"replaced_at"`
+}
+
+// ReparsedLocation is a fix as reparsed into the shadow collection, with
+// how it differs from the stored fix.
+type ReparsedLocation struct {
+	LocationID primitive.ObjectID     `json:"location_id" bson:"_id"`
+	Deployment string                 `json:"-" bson:"deployment"`
+	Platform   string                 `json:"-" bson:"platform"`
+	Changed    bool                   `json:"changed" bson:"changed"`
+	Changes    []FieldChange          `json:"changes" bson:"changes"`
+	Location   api.Location           `json:"location" bson:"location"`
+	Data       map[string]interface{} `json:"-" bson:"data,omitempty"`
+	ReparsedAt time.Time              `json:"reparsed_at" bson:"reparsed_at"`
+}
+
+func (s *Server) initReprocessing() error {
+	versionsName := os.Getenv("MONGODB_LOCATION_VERSIONS_COLLECTION")
+	if versionsName == "" {
+		versionsName = s.store.Locations.Name() + "_versions"
+	}
+	shadowName := os.Getenv("MONGODB_REPARSE_SHADOW_COLLECTION")
+	if shadowName == "" {
+		shadowName = s.store.Locations.Name() + "_reparsed"
+	}
+	s.store.LocationVersions = s.store.Collection(versionsName)
+	s.store.ReparsedLocations = s.store.Collection(shadowName)
+
+	indexes := []struct {
+		coll  store.Collection
+		model mongo.IndexModel
+	}{
+		{s.store.LocationVersions, mongo.IndexModel{
+			Keys:    bson.D{{Key: "location_id", Value: 1}, {Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}},
+		{s.store.ReparsedLocations, mongo.IndexModel{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}}}},
+	}
+	for _, index := range indexes {
+		if err := s.ensureIndex(index.coll, index.model); err != nil {
+			return fmt.Errorf("error creating reprocessing indexes: %v", err)
+		}
+	}
+	return nil
+}
+
+// loadTelemetry reads a stored fix's data back from its telemetry.
+func (s *Server) loadTelemetry(ctx context.Context, location *api.Location) error {
+	var telemetry api.Telemetry
+	err := s.store.Telemetry.FindOne(ctx, bson.M{"location_id": location.ID}).Decode(&telemetry)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	location.Data = telemetry.Data
+	return nil
+}
+
+// diffLocations lists the fields that differ between two versions of a fix,
+// as they would be returned to clients.
+func diffLocations(before, after *api.Location) []FieldChange {
+	a, b := clientFields(before), clientFields(after)
+	fields := make([]string, 0, len(a)+len(b))
+	for field := range a {
+		fields = append(fields, field)
+	}
+	for field := range b {
+		if _, ok := a[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if undiffedFields[field] || reflect.DeepEqual(a[field], b[field]) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: field, Before: a[field], After: b[field]})
+	}
+	return changes
+}
+
+// clientFields returns a fix as clients see it, field by field.
+func clientFields(location *api.Location) map[string]interface{} {
+	fields := map[string]interface{}{}
+	data, err := json.Marshal(location)
+	if err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// plainValue converts a value decoded from BSON without a type back into
+// the maps and slices it was stored from.
+func plainValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = plainValue(e.Value)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for i := range v {
+			a[i] = plainValue(v[i])
+		}
+		return a
+	}
+	return v
+}
+
+// storeVersion keeps a stored fix, with its data, before it is replaced.
+func (s *Server) storeVersion(ctx context.Context, location *api.Location, reason string) error {
+	n, err := s.store.LocationVersions.CountDocuments(ctx, bson.M{"location_id": location.ID})
+	if err != nil {
+		return err
+	}
+	_, err = s.store.LocationVersions.InsertOne(ctx, LocationVersion{
+		LocationID: location.ID,
+		Version:    n + 1,
+		Reason:     reason,
+		Location:   *location,
+		Data:       location.Data,
+		ReplacedAt: time.Now().UTC(),
+	})
+	return err
+}
+
+// storeShadowLocation stores a reparsed fix in the shadow collection,
+// replacing any from an earlier reparse.
+func (s *Server) storeShadowLocation(ctx context.Context, location *api.Location, changes []FieldChange) error {
+	shadow := ReparsedLocation{
+		LocationID: location.ID,
+		Deployment: location.Deployment,
+		Platform:   location.Platform,
+		Changed:    len(changes) > 0,
+		Changes:    changes,
+		Location:   *location,
+		Data:       location.Data,
+		ReparsedAt: time.Now().UTC(),
+	}
+	_, err := s.store.ReparsedLocations.ReplaceOne(ctx, bson.M{"_id": location.ID}, shadow, options.Replace().SetUpsert(true))
+	return err
+}
+
+// handleGetLocationVersions lists the versions a fix replaced, newest first.
+func (s *Server) handleGetLocationVersions(c *gin.Context) {
+	filter, err := locationIDFilter(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	ctx := c.Request.Context()
+	var location api.Location
+	err = s.store.Locations.FindOne(ctx, scopedFilter(c, filter)).Decode(&location)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "location not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: -1}})
+	cursor, err := s.store.LocationVersions.Find(ctx, bson.M{"location_id": location.ID}, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	versions := []LocationVersion{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range versions {
+		versions[i].Location.Data = versions[i].Data
+		localizeLocation(&versions[i].Location, loc)
+		versions[i].ReplacedAt = versions[i].ReplacedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// handleGetReparsed lists a deployment's fixes reparsed into the shadow
+// collection, for reviewing a reparse before running it in place.
+func (s *Server) handleGetReparsed(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+	if c.Query("changed") == "true" {
+		filter["changed"] = true
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(reparsedOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.ReparsedLocations.Find(ctx, filter, opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []ReparsedLocation{}
+	if err := cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	c.Header("X-Sort-Order", reparsedOrder.String())
+
+	for i := range results {
+		for j := range results[i].Changes {
+			change := &results[i].Changes[j]
+			change.Before, change.After = plainValue(change.Before), plainValue(change.After)
+		}
+		results[i].Location.Data = results[i].Data
+		localizeLocation(&results[i].Location, loc)
+		results[i].ReparsedAt = results[i].ReparsedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,533 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+	"data-gateway/store"
+)
+
+// PositionRollup summarizes a platform's fixes over one minute or one hour.
+// First and last fixes are kept so consecutive rollups can be joined into
+// exact distances and speeds.
+type PositionRollup struct {
+	Deployment   string       `json:"deployment" bson:"deployment"`
+	Platform     string       `json:"platform" bson:"platform"`
+	Timestamp    string       `json:"timestamp" bson:"timestamp"`
+	Count        int64        `json:"count" bson:"count"`
+	Latitude     float64      `json:"latitude" bson:"latitude"`
+	Longitude    float64      `json:"longitude" bson:"longitude"`
+	Bounds       ReportBounds `json:"bounds" bson:"bounds"`
+	Distance     float64      `json:"distance" bson:"distance"`
+	Duration     float64      `json:"duration" bson:"duration"`
+	AverageSpeed float64      `json:"average_speed" bson:"average_speed"`
+	MaxSpeed     float64      `json:"max_speed" bson:"max_speed"`
+	First        RollupFix    `json:"first" bson:"first"`
+	Last         RollupFix    `json:"last" bson:"last"`
+}
+
+// RollupFix is the position and time of a fix at the edge of a rollup.
+type RollupFix struct {
+	Timestamp string  `json:"timestamp" bson:"timestamp"`
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+}
+
+// add accumulates a fix, which must not be earlier than those already added.
+// The centroid is a running sum until finish.
+func (r *PositionRollup) add(location *api.Location) {
+	fix := RollupFix{Timestamp: location.Timestamp, Latitude: location.Latitude, Longitude: location.Longitude}
+	if r.Count == 0 {
+		r.First = fix
+		r.Bounds = pointBounds(fix.Latitude, fix.Longitude)
+	} else {
+		r.join(r.Last, fix)
+		r.Bounds.extend(fix.Latitude, fix.Longitude)
+	}
+	r.Count++
+	r.Latitude += fix.Latitude
+	r.Longitude += fix.Longitude
+	r.Last = fix
+}
+
+// merge accumulates a finished rollup that follows those already merged.
+func (r *PositionRollup) merge(o PositionRollup) {
+	if o.Count == 0 {
+		return
+	}
+	if r.Count == 0 {
+		r.First = o.First
+		r.Bounds = o.Bounds
+	} else {
+		r.join(r.Last, o.First)
+		r.Bounds.union(o.Bounds)
+	}
+	r.Count += o.Count
+	r.Latitude += o.Latitude * float64(o.Count)
+	r.Longitude += o.Longitude * float64(o.Count)
+	r.Distance += o.Distance
+	r.Duration += o.Duration
+	r.MaxSpeed = max(r.MaxSpeed, o.MaxSpeed)
+	r.Last = o.Last
+}
+
+// join adds the segment between two consecutive fixes.
+func (r *PositionRollup) join(from, to RollupFix) {
+	d := haversine(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	r.Distance += d
+
+	t0, err0 := parseTimestamp(from.Timestamp)
+	t1, err1 := parseTimestamp(to.Timestamp)
+	if err0 == nil && err1 == nil {
+		if dt := t1.Sub(t0).Seconds(); dt > 0 {
+			r.Duration += dt
+			r.MaxSpeed = max(r.MaxSpeed, d/dt)
+		}
+	}
+}
+
+func (r *PositionRollup) finish() {
+	if r.Count > 0 {
+		r.Latitude /= float64(r.Count)
+		r.Longitude /= float64(r.Count)
+	}
+	if r.Duration > 0 {
+		r.AverageSpeed = r.Distance / r.Duration
+	}
+}
+
+// rollupBucket identifies the hour of a platform's fixes that a rollup run
+// recomputes.
+type rollupBucket struct {
+	Deployment string `bson:"deployment"`
+	Platform   string `bson:"platform"`
+	Hour       string `bson:"hour"`
+}
+
+func (b rollupBucket) filter() (bson.M, error) {
+	start, err := time.Parse("2006-01-02T15", b.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{
+		"deployment": b.Deployment,
+		"platform":   b.Platform,
+		"timestamp": bson.M{
+			"$gte": start.Format(timestampLayout),
+			"$lt":  start.Add(time.Hour).Format(timestampLayout),
+		},
+	}, nil
+}
+
+// rollupState records when rollups were last brought up to date, in the
+// settings collection.
+type rollupState struct {
+	LastRun time.Time `json:"last_run" bson:"last_run"`
+}
+
+// RollupResult reports what one rollup run did.
+type RollupResult struct {
+	Rebuilt bool  `json:"rebuilt"`
+	Hours   int64 `json:"hours"`
+	Rollups int64 `json:"rollups"`
+}
+
+const rollupsDocumentID = "rollups"
+
+// Fixes stamped shortly before a run started may be written after it read
+// them, so each run looks back this far past the previous one
+const rollupOverlap = time.Minute
+
+var rollupsEnabled bool
+var rollupInterval = time.Minute
+var rollupQueryThreshold = 24 * time.Hour
+
+// dirtyRollup records an hour changed by an edit or delete, which leaves no
+// trace in created_at, for the next rollup run to recompute. Marks are kept
+// in MongoDB, so edits made through any instance reach the one running
+// rollups.
+type dirtyRollup struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Bucket   rollupBucket       `bson:",inline"`
+	MarkedAt time.Time          `bson:"marked_at"`
+}
+
+func (s *Server) initRollups() error {
+	minuteName := os.Getenv("MONGODB_MINUTE_COLLECTION")
+	if minuteName == "" {
+		minuteName = s.store.Locations.Name() + "_1m"
+	}
+	hourlyName := os.Getenv("MONGODB_HOURLY_COLLECTION")
+	if hourlyName == "" {
+		hourlyName = s.store.Locations.Name() + "_1h"
+	}
+	dirtyName := os.Getenv("MONGODB_DIRTY_ROLLUPS_COLLECTION")
+	if dirtyName == "" {
+		dirtyName = s.store.Locations.Name() + "_rollups_dirty"
+	}
+	s.store.MinuteRollups = s.store.Collection(minuteName)
+	s.store.HourlyRollups = s.store.Collection(hourlyName)
+	s.store.DirtyRollups = s.store.Collection(dirtyName)
+
+	if v := os.Getenv("ROLLUPS_ENABLED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid ROLLUPS_ENABLED %q", v)
+		}
+		rollupsEnabled = b
+	}
+	if !rollupsEnabled {
+		return nil
+	}
+
+	var err error
+	if rollupInterval, err = parseRetention("ROLLUP_INTERVAL", rollupInterval); err != nil {
+		return err
+	}
+	if rollupQueryThreshold, err = parseRetention("ROLLUP_QUERY_THRESHOLD", rollupQueryThreshold); err != nil {
+		return err
+	}
+
+	// Runs find new fixes by created_at
+	if err := s.ensureIndex(s.store.Locations, mongo.IndexModel{Keys: bson.D{{Key: "created_at", Value: 1}}}); err != nil {
+		return fmt.Errorf("error creating rollup indexes: %v", err)
+	}
+	for _, coll := range []store.Collection{s.store.MinuteRollups, s.store.HourlyRollups} {
+		models := []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+		}
+		for _, model := range models {
+			if err := s.ensureIndex(coll, model); err != nil {
+				return fmt.Errorf("error creating rollup indexes: %v", err)
+			}
+		}
+	}
+	dirtyIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "hour", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if err := s.ensureIndex(s.store.DirtyRollups, dirtyIndex); err != nil {
+		return fmt.Errorf("error creating rollup indexes: %v", err)
+	}
+
+	return nil
+}
+
+// markRollupsDirty queues the hour holding timestamp for recomputation on
+// the next rollup run. Marking an hour again moves its mark forward, so a run
+// already recomputing it does it again.
+func (s *Server) markRollupsDirty(ctx context.Context, deployment, platform, timestamp string) error {
+	if !rollupsEnabled || len(timestamp) < 13 {
+		return nil
+	}
+	b := rollupBucket{Deployment: deployment, Platform: platform, Hour: timestamp[:13]}
+	filter := bson.M{"deployment": b.Deployment, "platform": b.Platform, "hour": b.Hour}
+	update := bson.M{"$set": bson.M{"marked_at": time.Now().UTC()}}
+	_, err := s.store.DirtyRollups.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// dirtyRollups lists the hours marked for recomputation.
+func (s *Server) dirtyRollups(ctx context.Context) ([]dirtyRollup, error) {
+	cursor, err := s.store.DirtyRollups.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var marks []dirtyRollup
+	if err := cursor.All(ctx, &marks); err != nil {
+		return nil, err
+	}
+	return marks, nil
+}
+
+// clearDirtyRollup removes a mark once its hour has been recomputed, unless
+// the hour has been marked again since.
+func (s *Server) clearDirtyRollup(ctx context.Context, mark dirtyRollup) error {
+	_, err := s.store.DirtyRollups.DeleteOne(ctx, bson.M{"_id": mark.ID, "marked_at": mark.MarkedAt})
+	return err
+}
+
+// rollupBucketsMatching lists the hours holding raw fixes that match filter.
+func (s *Server) rollupBucketsMatching(ctx context.Context, filter bson.M) ([]rollupBucket, error) {
+	cursor, err := s.store.Locations.Aggregate(ctx, []bson.M{
+		{"$match": filter},
+		{"$group": bson.M{"_id": bson.M{
+			"deployment": "$deployment",
+			"platform":   "$platform",
+			"hour":       bson.M{"$substrBytes": bson.A{"$timestamp", 0, 13}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID rollupBucket `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	buckets := make([]rollupBucket, len(groups))
+	for i, g := range groups {
+		buckets[i] = g.ID
+	}
+	return buckets, nil
+}
+
+func (s *Server) runRollupScheduler(ctx context.Context) {
+	if !rollupsEnabled {
+		return
+	}
+	for sleep(ctx, rollupInterval) {
+		if s.serviceMode().Mode != modeNormal || !s.leading() {
+			continue
+		}
+		if _, err := s.runRollups(ctx); err != nil {
+			s.logger.Printf("error updating rollups: %v", err)
+		}
+	}
+}
+
+// runRollups brings the minute and hour rollups up to date by recomputing
+// every hour that has received fixes, or been edited, since the last run.
+// The first run builds rollups for all existing data.
+func (s *Server) runRollups(ctx context.Context) (RollupResult, error) {
+	s.rollupMu.Lock()
+	defer s.rollupMu.Unlock()
+
+	var result RollupResult
+	started := time.Now().UTC()
+
+	var state rollupState
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": rollupsDocumentID}).Decode(&state)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return result, err
+	}
+
+	if state.LastRun.IsZero() {
+		n, err := s.rebuildRollups(ctx, bson.M{})
+		if err != nil {
+			return result, err
+		}
+		// The rebuild read everything marked before it started
+		if _, err := s.store.DirtyRollups.DeleteMany(ctx, bson.M{"marked_at": bson.M{"$lt": started}}); err != nil {
+			return result, err
+		}
+		result.Rebuilt = true
+		result.Rollups = n
+	} else {
+		// Marks are cleared as their hours are recomputed, so a failed run
+		// leaves the rest for the next
+		marks, err := s.dirtyRollups(ctx)
+		if err != nil {
+			return result, err
+		}
+		changed, err := s.rollupBucketsMatching(ctx, bson.M{"created_at": bson.M{"$gte": state.LastRun.Add(-rollupOverlap)}})
+		if err != nil {
+			return result, err
+		}
+		buckets := make(map[rollupBucket]bool)
+		for _, b := range changed {
+			buckets[b] = true
+		}
+
+		// Hours partly pruned from the raw tier can't be recomputed
+		cutoff := rawRetentionCutoff(started)
+		for _, mark := range marks {
+			if mark.Bucket.Hour+":00:00.000Z" >= cutoff {
+				n, err := s.refreshBucket(ctx, mark.Bucket)
+				if err != nil {
+					return result, err
+				}
+				result.Hours++
+				result.Rollups += n
+			}
+			delete(buckets, mark.Bucket)
+			if err := s.clearDirtyRollup(ctx, mark); err != nil {
+				return result, err
+			}
+		}
+		for b := range buckets {
+			if b.Hour+":00:00.000Z" < cutoff {
+				continue
+			}
+			n, err := s.refreshBucket(ctx, b)
+			if err != nil {
+				return result, err
+			}
+			result.Hours++
+			result.Rollups += n
+		}
+	}
+
+	state = rollupState{LastRun: started}
+	_, err = s.store.Settings.ReplaceOne(ctx, bson.M{"_id": rollupsDocumentID}, state, options.Replace().SetUpsert(true))
+	return result, err
+}
+
+// refreshBucket replaces the rollups for one hour of a platform's fixes.
+func (s *Server) refreshBucket(ctx context.Context, b rollupBucket) (int64, error) {
+	filter, err := b.filter()
+	if err != nil {
+		return 0, err
+	}
+	for _, coll := range []store.Collection{s.store.MinuteRollups, s.store.HourlyRollups} {
+		if _, err := coll.DeleteMany(ctx, filter); err != nil {
+			return 0, err
+		}
+	}
+	return s.rebuildRollups(ctx, filter)
+}
+
+// rebuildRollups builds minute and hour rollups from the raw fixes matching
+// filter, which must select whole hours, and upserts them.
+func (s *Server) rebuildRollups(ctx context.Context, filter bson.M) (int64, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"deployment": 1, "platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1})
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var written int64
+	writes := map[store.Collection][]mongo.WriteModel{}
+	flush := func(force bool) error {
+		for coll, models := range writes {
+			if len(models) == 0 || (!force && len(models) < importBatchSize) {
+				continue
+			}
+			if _, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+				return err
+			}
+			written += int64(len(models))
+			writes[coll] = models[:0]
+		}
+		return nil
+	}
+	end := func(coll store.Collection, r *PositionRollup) {
+		if r == nil {
+			return
+		}
+		r.finish()
+		writes[coll] = append(writes[coll], mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"deployment": r.Deployment, "platform": r.Platform, "timestamp": r.Timestamp}).
+			SetReplacement(r).
+			SetUpsert(true))
+	}
+
+	var minute, hour *PositionRollup
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return written, err
+		}
+		// Timestamps are stored fixed-width, so prefixes give the minute and hour
+		if len(location.Timestamp) < 16 {
+			continue
+		}
+		minuteStart := location.Timestamp[:16] + ":00.000Z"
+		hourStart := location.Timestamp[:13] + ":00:00.000Z"
+
+		if minute == nil || minute.Deployment != location.Deployment || minute.Platform != location.Platform || minute.Timestamp != minuteStart {
+			end(s.store.MinuteRollups, minute)
+			minute = &PositionRollup{Deployment: location.Deployment, Platform: location.Platform, Timestamp: minuteStart}
+		}
+		if hour == nil || hour.Deployment != location.Deployment || hour.Platform != location.Platform || hour.Timestamp != hourStart {
+			end(s.store.HourlyRollups, hour)
+			hour = &PositionRollup{Deployment: location.Deployment, Platform: location.Platform, Timestamp: hourStart}
+		}
+		minute.add(&location)
+		hour.add(&location)
+
+		if err := flush(false); err != nil {
+			return written, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return written, err
+	}
+	end(s.store.MinuteRollups, minute)
+	end(s.store.HourlyRollups, hour)
+	return written, flush(true)
+}
+
+// useRollups reports whether a query from start to end, either of which may
+// be empty, spans long enough to be answered from rollups.
+func useRollups(start, end string) bool {
+	if !rollupsEnabled {
+		return false
+	}
+	if start == "" {
+		return true
+	}
+	from, err := parseTimestamp(start)
+	if err != nil {
+		return false
+	}
+	to := time.Now()
+	if end != "" {
+		if to, err = parseTimestamp(end); err != nil {
+			return false
+		}
+	}
+	return to.Sub(from) >= rollupQueryThreshold
+}
+
+// handleRebuildRollups recomputes rollups from the raw tier, for one
+// deployment or everything, as a background job.
+func (s *Server) handleRebuildRollups(c *gin.Context) {
+	if !rollupsEnabled {
+		respondErrorf(c, http.StatusConflict, "rollups are disabled (set ROLLUPS_ENABLED)")
+		return
+	}
+
+	filter := bson.M{}
+	if deployment := c.Query("deployment"); deployment != "" {
+		filter["deployment"] = deployment
+	}
+
+	job := s.startJob("rollup_rebuild", func(progress func(done, total int64)) (interface{}, error) {
+		ctx := context.Background()
+		s.rollupMu.Lock()
+		defer s.rollupMu.Unlock()
+
+		// Rollups for pruned raw data can't be rebuilt, so keep them
+		rebuild := bson.M{}
+		for k, v := range filter {
+			rebuild[k] = v
+		}
+		if cutoff := rawRetentionCutoff(time.Now().UTC()); cutoff != "" {
+			t, _ := parseTimestamp(cutoff)
+			rebuild["timestamp"] = bson.M{"$gte": t.Truncate(time.Hour).Add(time.Hour).Format(timestampLayout)}
+		}
+
+		for _, coll := range []store.Collection{s.store.MinuteRollups, s.store.HourlyRollups} {
+			if _, err := coll.DeleteMany(ctx, rebuild); err != nil {
+				return nil, err
+			}
+		}
+		n, err := s.rebuildRollups(ctx, rebuild)
+		if err != nil {
+			return nil, err
+		}
+		return RollupResult{Rebuilt: true, Rollups: n}, nil
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
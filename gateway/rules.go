@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"data-gateway/api"
+)
+
+const (
+	ruleReject = "reject"
+	ruleFlag   = "flag"
+)
+
+// validationRule rejects or flags fixes matching a condition written in the
+// query language used by the q parameter, e.g. "speed > 4.1". Platform and
+// deployment are glob patterns limiting which fixes the rule applies to.
+type validationRule struct {
+	Name       string `json:"name"`
+	Deployment string `json:"deployment,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	When       string `json:"when"`
+	Action     string `json:"action"`
+	Message    string `json:"message,omitempty"`
+
+	filter bson.M
+}
+
+// ruleViolation is returned when a fix is rejected by a rule.
+type ruleViolation struct {
+	rule *validationRule
+}
+
+func (v ruleViolation) Error() string {
+	msg := fmt.Sprintf("rejected by rule %s", v.rule.Name)
+	if v.rule.Message != "" {
+		msg += ": " + v.rule.Message
+	}
+	return msg
+}
+
+// ruleState holds the rules a server checks fixes against, as last loaded.
+type ruleState struct {
+	mu    sync.RWMutex
+	rules []*validationRule
+}
+
+func (s *Server) initRules() error {
+	rules, err := loadRules()
+	if err != nil {
+		return err
+	}
+	s.rules.mu.Lock()
+	s.rules.rules = rules
+	s.rules.mu.Unlock()
+	return nil
+}
+
+// loadRules reads and compiles the rules file named by RULES_CONFIG.
+func loadRules() ([]*validationRule, error) {
+	configPath := os.Getenv("RULES_CONFIG")
+	if configPath == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RULES_CONFIG: %v", err)
+	}
+	var cfg struct {
+		Rules []*validationRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing RULES_CONFIG: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Action != ruleReject && rule.Action != ruleFlag {
+			return nil, fmt.Errorf("rule %q: action must be reject or flag", rule.Name)
+		}
+		for _, pattern := range []string{rule.Deployment, rule.Platform} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: invalid pattern %q", rule.Name, pattern)
+			}
+		}
+		if rule.filter, err = parseQuery(rule.When); err != nil {
+			return nil, fmt.Errorf("rule %q: invalid condition: %v", rule.Name, err)
+		}
+	}
+	return cfg.Rules, nil
+}
+
+// applyRules checks a fix, after its speed and course are derived, against
+// the rules for its deployment and platform. Flagging rules add their name to
+// the QC flags; the first rejecting rule to match is returned as an error.
+func (s *Server) applyRules(location *api.Location) error {
+	s.rules.mu.RLock()
+	rules := s.rules.rules
+	s.rules.mu.RUnlock()
+
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Deployment, location.Deployment); rule.Deployment != "" && !ok {
+			continue
+		}
+		if ok, _ := path.Match(rule.Platform, location.Platform); rule.Platform != "" && !ok {
+			continue
+		}
+		if !matchQuery(rule.filter, location) {
+			continue
+		}
+
+		if rule.Action == ruleReject {
+			return ruleViolation{rule}
+		}
+		if location.QC == nil {
+			location.QC = &api.QCResult{Status: qcPass, Flags: []string{}}
+		}
+		location.QC.Flags = append(location.QC.Flags, rule.Name)
+		location.QC.Status = qcFlagged
+	}
+	return nil
+}
+
+func (s *Server) handleGetRules(c *gin.Context) {
+	s.rules.mu.RLock()
+	rules := s.rules.rules
+	s.rules.mu.RUnlock()
+
+	if rules == nil {
+		rules = []*validationRule{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// handleReloadRules re-reads RULES_CONFIG so rule changes take effect without
+// a restart. Invalid files are rejected and the current rules kept.
+func (s *Server) handleReloadRules(c *gin.Context) {
+	rules, err := loadRules()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	s.rules.mu.Lock()
+	s.rules.rules = rules
+	s.rules.mu.Unlock()
+
+	if rules == nil {
+		rules = []*validationRule{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
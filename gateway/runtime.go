@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// When the gateway process started
+var processStart = time.Now()
+
+// mongoPool counts the connections in the MongoDB driver's pool.
+type mongoPool struct {
+	created, closed         int64
+	checkedOut, checkedIn   int64
+	checkoutFailed, cleared int64
+}
+
+// poolMonitor tallies pool events into s.pool.
+func (s *Server) poolMonitor() *event.PoolMonitor {
+	p := &s.pool
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				atomic.AddInt64(&p.created, 1)
+			case event.ConnectionClosed:
+				atomic.AddInt64(&p.closed, 1)
+			case event.GetSucceeded:
+				atomic.AddInt64(&p.checkedOut, 1)
+			case event.ConnectionReturned:
+				atomic.AddInt64(&p.checkedIn, 1)
+			case event.GetFailed:
+				atomic.AddInt64(&p.checkoutFailed, 1)
+			case event.PoolCleared:
+				atomic.AddInt64(&p.cleared, 1)
+			}
+		},
+	}
+}
+
+// RuntimeStats summarizes the gateway process, for diagnosing memory growth
+// and leaks without a profiler.
+type RuntimeStats struct {
+	GoVersion  string      `json:"go_version"`
+	Uptime     string      `json:"uptime"`
+	StartedAt  time.Time   `json:"started_at"`
+	CPUs       int         `json:"cpus"`
+	GOMAXPROCS int         `json:"gomaxprocs"`
+	Goroutines int         `json:"goroutines"`
+	Memory     MemoryStats `json:"memory"`
+	GC         GCStats     `json:"gc"`
+	Mongo      *MongoStats `json:"mongo,omitempty"`
+	Streams    int         `json:"stream_subscribers"`
+	// Stream subscribers disconnected for falling behind, since startup
+	StreamEvictions int64 `json:"stream_evictions"`
+	// Response bodies being assembled, in bytes
+	Responses ResponseMemoryStats `json:"responses"`
+}
+
+// ResponseMemoryStats describes the memory large responses are assembled in.
+type ResponseMemoryStats struct {
+	Budget int64 `json:"memory_budget"`
+	InUse  int64 `json:"memory_in_use"`
+	// Responses written to temporary files since the gateway started, for
+	// going over the budget
+	Spilled int64 `json:"spilled"`
+}
+
+// MemoryStats are the Go runtime's memory figures, in bytes.
+type MemoryStats struct {
+	// Obtained from the operating system, for the heap, stacks, and runtime
+	Sys uint64 `json:"sys"`
+	// Allocated heap objects, live or not yet collected
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapIdle    uint64 `json:"heap_idle"`
+	HeapObjects uint64 `json:"heap_objects"`
+	// Returned to the operating system
+	HeapReleased uint64 `json:"heap_released"`
+	StackInuse   uint64 `json:"stack_inuse"`
+	// Allocated since the process started
+	TotalAlloc uint64 `json:"total_alloc"`
+}
+
+// GCStats describes the garbage collector's work.
+type GCStats struct {
+	Cycles uint32     `json:"cycles"`
+	LastGC *time.Time `json:"last_gc,omitempty"`
+	// Heap size the next cycle starts at
+	NextGC     uint64  `json:"next_gc"`
+	PauseTotal string  `json:"pause_total"`
+	LastPause  string  `json:"last_pause"`
+	CPUPercent float64 `json:"cpu_percent"`
+}
+
+// MongoStats describes the MongoDB driver's connection pool.
+type MongoStats struct {
+	// Connections open, and lent out to operations
+	Open  int64 `json:"open"`
+	InUse int64 `json:"in_use"`
+	// Connections made and closed since the gateway started
+	Created int64 `json:"created"`
+	Closed  int64 `json:"closed"`
+	// Operations that couldn't get a connection, such as when the pool is
+	// exhausted or the server unreachable
+	CheckoutFailures int64 `json:"checkout_failures"`
+	// Times the pool was cleared after a network error
+	Cleared int64 `json:"cleared"`
+}
+
+// handleGetRuntime reports goroutines, memory, garbage collection, and
+// MongoDB connections.
+func (s *Server) handleGetRuntime(c *gin.Context) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := RuntimeStats{
+		GoVersion:  runtime.Version(),
+		Uptime:     time.Since(processStart).Round(time.Second).String(),
+		StartedAt:  processStart.UTC(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			Sys:          m.Sys,
+			HeapAlloc:    m.HeapAlloc,
+			HeapInuse:    m.HeapInuse,
+			HeapIdle:     m.HeapIdle,
+			HeapObjects:  m.HeapObjects,
+			HeapReleased: m.HeapReleased,
+			StackInuse:   m.StackInuse,
+			TotalAlloc:   m.TotalAlloc,
+		},
+		GC: GCStats{
+			Cycles:     m.NumGC,
+			NextGC:     m.NextGC,
+			PauseTotal: time.Duration(m.PauseTotalNs).String(),
+			LastPause:  time.Duration(m.PauseNs[(m.NumGC+255)%256]).String(),
+			CPUPercent: m.GCCPUFraction * 100,
+		},
+		Streams:         s.hub.subscriberCount(),
+		StreamEvictions: s.hub.evictionCount(),
+		Responses: ResponseMemoryStats{
+			Budget:  responseMemoryBudget,
+			InUse:   atomic.LoadInt64(&responseMemoryUsed),
+			Spilled: atomic.LoadInt64(&responsesSpilled),
+		},
+	}
+	if m.NumGC > 0 {
+		last := time.Unix(0, int64(m.LastGC)).UTC()
+		stats.GC.LastGC = &last
+	}
+	if s.store.Client() != nil {
+		p := &s.pool
+		created, closed := atomic.LoadInt64(&p.created), atomic.LoadInt64(&p.closed)
+		out, in := atomic.LoadInt64(&p.checkedOut), atomic.LoadInt64(&p.checkedIn)
+		stats.Mongo = &MongoStats{
+			Open:             created - closed,
+			InUse:            out - in,
+			Created:          created,
+			Closed:           closed,
+			CheckoutFailures: atomic.LoadInt64(&p.checkoutFailed),
+			Cleared:          atomic.LoadInt64(&p.cleared),
+		}
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// adminListenerOnly answers as if the endpoint didn't exist unless the
+// request came in on the separate admin listener, so profiles can't be
+// taken over the public one even by admins.
+func adminListenerOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if surface, _ := c.Request.Context().Value(surfaceKey{}).(string); surface != surfaceAdmin {
+			abortError(c, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// handlePprof serves the runtime profiles of net/http/pprof, which expects
+// them under /debug/pprof/.
+func handlePprof(c *gin.Context) {
+	// CPU profiles and traces run for as long as the caller asks
+	disableWriteTimeout(c)
+	switch name := strings.TrimPrefix(c.Param("profile"), "/"); name {
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// handleExpvar serves the variables published with expvar, including the
+// runtime's memstats.
+var handleExpvar = gin.WrapH(expvar.Handler())
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// parseSample parses the sample parameter of GET /api/locations: the number
+// of fixes to spread over everything a query matches, or 0 for all of them.
+func (s *Server) parseSample(c *gin.Context) (int64, error) {
+	v := c.Query("sample")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("sample must be a positive integer")
+	}
+	if n > s.maxResultLimit {
+		return 0, fmt.Errorf("sample %d exceeds the maximum of %d", n, s.maxResultLimit)
+	}
+	for _, param := range []string{"limit", "offset", "after"} {
+		if c.Query(param) != "" {
+			return 0, fmt.Errorf("sample cannot be combined with %s", param)
+		}
+	}
+	return n, nil
+}
+
+// sampleCursor decodes n evenly spaced documents of the total a cursor
+// returns, always including the first and last, in the order they come. The
+// documents skipped are read but not decoded.
+func sampleCursor[T any](ctx context.Context, cursor *mongo.Cursor, total, n int64) ([]T, error) {
+	if n > total {
+		n = total
+	}
+	// Index of the kth document kept, rounded to the nearest
+	pick := func(k int64) int64 {
+		if n == 1 {
+			return 0
+		}
+		return (2*k*(total-1) + n - 1) / (2 * (n - 1))
+	}
+	docs := make([]T, 0, n)
+	var i int64
+	for k := int64(0); k < n && cursor.Next(ctx); i++ {
+		if i != pick(k) {
+			continue
+		}
+		var doc T
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+		k++
+	}
+	return docs, cursor.Err()
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of settings read from Vault, written as vault:<path>#<field>
+const vaultPrefix = "vault:"
+
+const defaultSecretsRefreshInterval = time.Minute
+
+// secret is a setting that may be rotated while the gateway runs: read from
+// a file named by NAME_FILE, from Vault when NAME is a vault: reference, or
+// from NAME itself.
+type secret struct {
+	name string
+	// Called with the new value when it changes; an error keeps the old one
+	onRotate func(value string) error
+
+	mu    sync.RWMutex
+	value string
+}
+
+func (sec *secret) get() string {
+	sec.mu.RLock()
+	defer sec.mu.RUnlock()
+	return sec.value
+}
+
+var (
+	secretsMu sync.Mutex
+	// Secrets loaded since the gateway was configured, by name
+	secrets               = map[string]*secret{}
+	secretsRefresh        = defaultSecretsRefreshInterval
+	secretsVaultClient    = &http.Client{Timeout: 10 * time.Second}
+	secretsVaultNamespace string
+)
+
+func initSecrets() error {
+	interval, err := envDuration("SECRETS_REFRESH_INTERVAL", defaultSecretsRefreshInterval)
+	if err != nil {
+		return err
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = map[string]*secret{}
+	secretsRefresh = interval
+	secretsVaultNamespace = os.Getenv("VAULT_NAMESPACE")
+	return nil
+}
+
+// loadSecret reads the named secret and keeps it up to date, calling
+// onRotate, if given, when it changes. An unset secret reads as empty.
+func loadSecret(name string, onRotate func(value string) error) (*secret, error) {
+	value, err := readSecret(name)
+	if err != nil {
+		return nil, err
+	}
+	sec := &secret{name: name, onRotate: onRotate, value: value}
+	secretsMu.Lock()
+	secrets[name] = sec
+	secretsMu.Unlock()
+	return sec, nil
+}
+
+// readSecret reads the current value of the named secret.
+func readSecret(name string) (string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		if os.Getenv(name) != "" {
+			return "", fmt.Errorf("set %s or %s_FILE, not both", name, name)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	value := os.Getenv(name)
+	if ref, ok := strings.CutPrefix(value, vaultPrefix); ok {
+		value, err := readVault(ref)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s from Vault: %v", name, err)
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+// readVault reads a field of a Vault secret, from either version of the KV
+// secrets engine.
+func readVault(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("expected vault:<path>#<field>, got %q", vaultPrefix+ref)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	// Read each time, so tokens renewed by an agent are picked up
+	token, err := readSecret("VAULT_TOKEN")
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if secretsVaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", secretsVaultNamespace)
+	}
+	resp, err := secretsVaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error parsing response for %s: %v", path, err)
+	}
+	data := body.Data
+	// KV version 2 nests the secret's fields with its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("%s has no string field %q", path, field)
+	}
+	return value, nil
+}
+
+// expandSecrets replaces ${NAME} references in a value with the secrets
+// they name, loading any not loaded yet.
+func expandSecrets(value string) (string, error) {
+	var err error
+	expanded := os.Expand(value, func(name string) string {
+		secretsMu.Lock()
+		sec, ok := secrets[name]
+		secretsMu.Unlock()
+		if !ok {
+			var loadErr error
+			if sec, loadErr = loadSecret(name, nil); loadErr != nil {
+				err = loadErr
+				return ""
+			}
+		}
+		return sec.get()
+	})
+	return expanded, err
+}
+
+// watchSecrets reads the loaded secrets again every
+// SECRETS_REFRESH_INTERVAL, so they can be rotated without a restart.
+func (s *Server) watchSecrets(ctx context.Context) {
+	if secretsRefresh == 0 {
+		return
+	}
+	for sleep(ctx, secretsRefresh) {
+		s.refreshSecrets()
+	}
+}
+
+func (s *Server) refreshSecrets() {
+	secretsMu.Lock()
+	loaded := make([]*secret, 0, len(secrets))
+	for _, sec := range secrets {
+		loaded = append(loaded, sec)
+	}
+	secretsMu.Unlock()
+
+	for _, sec := range loaded {
+		value, err := readSecret(sec.name)
+		if err != nil {
+			s.logger.Printf("error refreshing secret %s: %v", sec.name, err)
+			continue
+		}
+		if value == sec.get() {
+			continue
+		}
+		if sec.onRotate != nil {
+			if err := sec.onRotate(value); err != nil {
+				s.logger.Printf("error rotating secret %s, keeping the old value: %v", sec.name, err)
+				continue
+			}
+		}
+		sec.mu.Lock()
+		sec.value = value
+		sec.mu.Unlock()
+		s.logger.Printf("secret %s rotated", sec.name)
+	}
+}
@@ -0,0 +1,405 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"golang.org/x/net/netutil"
+
+	"data-gateway/store"
+)
+
+// Config is how the gateway serves its API. ConfigFromEnv reads it from
+// the environment; programs embedding the gateway may build their own.
+type Config struct {
+	Addr string
+	// AdminAddr, if set, is where the /admin endpoints are served instead
+	// of on Addr, so they can be kept to a different interface or port
+	AdminAddr string
+
+	MaxBodyBytes      int64
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxConnections    int
+
+	// Logger receives the gateway's own log messages; the standard logger
+	// if nil
+	Logger *log.Logger
+
+	// Store holds the gateway's records, such as store.NewMemory() in
+	// tests; if nil, the gateway connects to MongoDB at MONGODB_URI
+	Store *store.Store
+}
+
+// Server holds the gateway's dependencies: its database handles, alert
+// channels, and live stream subscribers. Handlers and background jobs are
+// its methods, so several servers can run side by side, such as in tests.
+// Everything a server changes while it runs is kept on it, such as the
+// service mode, feature overrides, validation rules, platform secrets, field
+// keys, and jobs, along with settings such as QC thresholds, result limits,
+// the admin key, and the tile source. Settings that are read once at startup
+// and never change, such as the platform registry and deployment origins,
+// are still shared by every server in a process.
+type Server struct {
+	cfg      Config
+	store    *store.Store
+	notifier alertNotifier
+	hub      *streamHub
+	logger   *log.Logger
+	logTail  *logTail
+	leader   leaderState
+
+	// Names this server in stream events shared with other instances
+	streamOrigin string
+	// Stream events waiting to be shared, nil unless STREAM_FANOUT=mongo
+	streamShared chan streamEvent
+
+	exports exportRunner
+	jobs    jobRegistry
+	// Serializes rollup runs and rebuilds
+	rollupMu sync.Mutex
+
+	// Runtime settings: the service mode and feature overrides, re-read from
+	// the settings collection, and the validation rules and signing
+	// secrets, which can be reloaded
+	mode       modeState
+	features   featureState
+	rules      ruleState
+	signatures signatureState
+	// Keys sensitive credential fields are encrypted with
+	fieldKeys fieldKeyring
+
+	// Indexes created at startup, for the doctor's index check
+	requiredIndexes []requiredIndex
+	platformLocks   platformLocks
+	facetCache      facetCache
+	advisor         indexAdvisor
+	ingestStats     ingestStats
+	bench           benchRunner
+	pool            mongoPool
+
+	// Durability the MongoDB client writes with, for the doctor
+	writeConcern *writeconcern.WriteConcern
+	retryWrites  *bool
+
+	// The bootstrap admin key; authentication is enabled by setting one
+	adminKey    *secret
+	authEnabled bool
+	// Records a query returns unless it asks for a limit, and at most
+	defaultResultLimit int64
+	maxResultLimit     int64
+	// Fastest plausible speed over ground in m/s, and how long after its
+	// timestamp a fix may be received before it is backfill
+	qcMaxSpeed        float64
+	lateDataThreshold time.Duration
+	// Where basemap tiles are cached, if they are served, and the server
+	// missing ones are fetched from
+	tilesDir      string
+	tilesUpstream string
+}
+
+// New returns a gateway with the given configuration, not yet connected to
+// its store.
+func New(cfg Config) *Server {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger, tail := newLogTail(logger)
+	return &Server{
+		cfg:      cfg,
+		store:    cfg.Store,
+		notifier: alertNotifier{channels: make(map[string]notifier)},
+		hub:      newStreamHub(),
+		logger:   logger,
+		logTail:  tail,
+		mode:     modeState{current: ServiceMode{Mode: modeNormal}},
+
+		defaultResultLimit: defaultQueryLimit,
+		maxResultLimit:     defaultQueryMax,
+		qcMaxSpeed:         defaultQCMaxSpeed,
+		lateDataThreshold:  defaultLateDataThreshold,
+	}
+}
+
+// Run sets the gateway up and serves the API until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	if s.cfg.Store == nil {
+		defer func() {
+			if s.store != nil {
+				s.store.Close(context.Background())
+			}
+		}()
+	}
+	if err := s.Setup(ctx); err != nil {
+		return err
+	}
+	return s.serve(ctx, s.Handler())
+}
+
+// Setup reads the gateway's settings from the environment, connects to
+// MongoDB unless a store was configured, and starts the background jobs,
+// which stop when ctx is done. Programs serving the API themselves call it
+// before Handler.
+func (s *Server) Setup(ctx context.Context) error {
+	for _, step := range s.configSteps() {
+		if err := step.init(); err != nil {
+			return err
+		}
+	}
+	if err := s.initDB(); err != nil {
+		return err
+	}
+	for _, step := range s.databaseSteps() {
+		if err := step.init(); err != nil {
+			return err
+		}
+	}
+
+	go s.watchMode(ctx)
+	go s.runLeaderElection(ctx)
+	go s.watchSecrets(ctx)
+	go s.runReportScheduler(ctx)
+	go s.runRollupScheduler(ctx)
+	go s.watchPlatformStatus(ctx)
+	go s.runEscalations(ctx)
+	go s.runLifecycleScheduler(ctx)
+	go s.runStreamFanout(ctx)
+	go s.runOutbox(ctx)
+	s.startExports(ctx)
+	return nil
+}
+
+// Handler returns the gateway's API. Setup must have been called.
+func (s *Server) Handler() http.Handler {
+	return s.router()
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+func envInt(name string, def int64) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// ConfigFromEnv reads the API_* and HTTP_* settings.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{}
+
+	host := os.Getenv("API_HOST")
+	port := os.Getenv("API_PORT")
+	if port == "" {
+		port = "8080"
+	}
+	cfg.Addr = net.JoinHostPort(host, port)
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		adminHost, ok := os.LookupEnv("ADMIN_HOST")
+		if !ok {
+			adminHost = host
+		}
+		cfg.AdminAddr = net.JoinHostPort(adminHost, adminPort)
+		if cfg.AdminAddr == cfg.Addr {
+			return cfg, fmt.Errorf("ADMIN_PORT must differ from API_PORT on the same host")
+		}
+	}
+
+	var err error
+	if cfg.MaxBodyBytes, err = envInt("HTTP_MAX_BODY_BYTES", 10<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadTimeout, err = envDuration("HTTP_READ_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadHeaderTimeout, err = envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.WriteTimeout, err = envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.IdleTimeout, err = envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return cfg, err
+	}
+	maxConnections, err := envInt("HTTP_MAX_CONNECTIONS", 1000)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxConnections = int(maxConnections)
+
+	return cfg, nil
+}
+
+// streamingBodyPaths are read a record at a time for as long as the client
+// sends, so limit the size of each record rather than the body.
+var streamingBodyPaths = map[string]bool{
+	"/api/data/stream": true,
+}
+
+// limitBody rejects request bodies larger than maxBytes.
+func limitBody(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxBytes <= 0 || streamingBodyPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > maxBytes {
+			abortError(c, http.StatusRequestEntityTooLarge, withCode(codeBodyTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBytes)))
+			return
+		}
+		// Bodies without a declared length are cut off once they exceed the limit
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// disableWriteTimeout lifts the server write timeout for long-lived streaming
+// responses.
+func disableWriteTimeout(c *gin.Context) {
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+}
+
+// disableReadTimeout lifts the server read timeout for long-lived streaming
+// request bodies.
+func disableReadTimeout(c *gin.Context) {
+	http.NewResponseController(c.Writer).SetReadDeadline(time.Time{})
+}
+
+// How long open requests are given to finish when the gateway stops
+const shutdownTimeout = 10 * time.Second
+
+// The parts of the API a listener serves when AdminAddr separates them
+const (
+	surfacePublic = "public"
+	surfaceAdmin  = "admin"
+)
+
+type surfaceKey struct{}
+
+// adminPath reports whether a request path is part of the admin surface.
+func adminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// separateSurfaces answers requests for the admin endpoints on the public
+// listener, and for the rest of the API on the admin listener, as if they
+// didn't exist. Health checks are served on both. Handlers served other
+// than by serve, such as in tests, serve everything.
+func separateSurfaces() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		surface, ok := c.Request.Context().Value(surfaceKey{}).(string)
+		path := c.Request.URL.Path
+		if !ok || path == "/healthz" || adminPath(path) == (surface == surfaceAdmin) {
+			c.Next()
+			return
+		}
+		abortError(c, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// serve runs the HTTP servers with the configured timeouts and connection
+// limit until ctx is done: one on Addr, and one for the admin endpoints on
+// AdminAddr if set.
+func (s *Server) serve(ctx context.Context, handler http.Handler) error {
+	cfg := s.cfg
+	listeners := []struct{ addr, surface string }{{cfg.Addr, surfacePublic}}
+	if cfg.AdminAddr != "" {
+		listeners = append(listeners, struct{ addr, surface string }{cfg.AdminAddr, surfaceAdmin})
+	}
+
+	var servers []*http.Server
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		listener, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			for _, srv := range servers {
+				srv.Close()
+			}
+			return fmt.Errorf("error listening on %s: %v", l.addr, err)
+		}
+		if cfg.MaxConnections > 0 {
+			listener = netutil.LimitListener(listener, cfg.MaxConnections)
+		}
+
+		surface := l.surface
+		srv := &http.Server{
+			Addr:              l.addr,
+			Handler:           handler,
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		if cfg.AdminAddr != "" {
+			srv.BaseContext = func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), surfaceKey{}, surface)
+			}
+		}
+		servers = append(servers, srv)
+
+		if surface == surfaceAdmin {
+			s.logger.Printf("Serving admin endpoints on %s", l.addr)
+		} else {
+			s.logger.Printf("Listening on %s", l.addr)
+			if mdnsAdvert != nil {
+				go s.advertiseMDNS(ctx, listener.Addr().(*net.TCPAddr))
+			}
+		}
+		go func() { errc <- srv.Serve(listener) }()
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+type smoothOptions struct {
+	method  string  // "", "moving_average", or "kalman"
+	window  int     // moving average window in fixes
+	q       float64 // Kalman process noise, m²/s³
+	r       float64 // Kalman measurement noise standard deviation, m
+	replace bool    // replace raw positions instead of adding smoothed ones
+}
+
+func parseSmoothOptions(c *gin.Context) (smoothOptions, error) {
+	opts := smoothOptions{method: c.Query("smooth"), window: 5, q: 0.5, r: 10}
+
+	switch opts.method {
+	case "", "moving_average", "kalman":
+	default:
+		return opts, fmt.Errorf("unknown smooth %q (expected moving_average or kalman)", opts.method)
+	}
+
+	if v := c.Query("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1001 {
+			return opts, fmt.Errorf("window must be between 1 and 1001")
+		}
+		opts.window = n
+	}
+	if v := c.Query("processNoise"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return opts, fmt.Errorf("processNoise must be a positive number")
+		}
+		opts.q = f
+	}
+	if v := c.Query("measurementNoise"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return opts, fmt.Errorf("measurementNoise must be a positive number")
+		}
+		opts.r = f
+	}
+
+	switch c.DefaultQuery("smoothOutput", "alongside") {
+	case "alongside":
+	case "replace":
+		opts.replace = true
+	default:
+		return opts, fmt.Errorf("smoothOutput must be alongside or replace")
+	}
+
+	return opts, nil
+}
+
+// smoothLocations smooths each platform's track independently. Locations are
+// expected in timestamp order.
+func smoothLocations(locations []api.Location, opts smoothOptions) {
+	if opts.method == "" {
+		return
+	}
+
+	tracks := make(map[string][]int)
+	var order []string
+	for i, location := range locations {
+		key := location.Deployment + "\x00" + location.Platform
+		if _, ok := tracks[key]; !ok {
+			order = append(order, key)
+		}
+		tracks[key] = append(tracks[key], i)
+	}
+
+	for _, key := range order {
+		indexes := tracks[key]
+		track := make([]api.Location, len(indexes))
+		for j, i := range indexes {
+			track[j] = locations[i]
+		}
+
+		var smoothed []api.SmoothedPosition
+		if opts.method == "kalman" {
+			smoothed = kalmanSmooth(track, opts.q, opts.r)
+		} else {
+			smoothed = movingAverage(track, opts.window)
+		}
+
+		for j, i := range indexes {
+			if opts.replace {
+				locations[i].Latitude = smoothed[j].Latitude
+				locations[i].Longitude = smoothed[j].Longitude
+			} else {
+				position := smoothed[j]
+				locations[i].Smoothed = &position
+			}
+		}
+	}
+}
+
+// trackToLocal projects a track onto a tangent plane at its first fix.
+func trackToLocal(track []api.Location) (origin, []api.LocalCoordinate) {
+	o := origin{Latitude: track[0].Latitude, Longitude: track[0].Longitude}
+	points := make([]api.LocalCoordinate, len(track))
+	for i, location := range track {
+		points[i] = toLocal(o, location.Latitude, location.Longitude)
+	}
+	return o, points
+}
+
+// movingAverage averages each fix with its neighbours in a centered window.
+func movingAverage(track []api.Location, window int) []api.SmoothedPosition {
+	o, points := trackToLocal(track)
+	half := window / 2
+
+	result := make([]api.SmoothedPosition, len(track))
+	for i := range track {
+		lo, hi := i-half, i+half
+		if lo < 0 {
+			lo = 0
+		}
+		if hi >= len(track) {
+			hi = len(track) - 1
+		}
+
+		var sum api.LocalCoordinate
+		for j := lo; j <= hi; j++ {
+			sum.X += points[j].X
+			sum.Y += points[j].Y
+			sum.Z += points[j].Z
+		}
+		n := float64(hi - lo + 1)
+		lat, lon := fromLocal(o, api.LocalCoordinate{X: sum.X / n, Y: sum.Y / n, Z: sum.Z / n})
+		result[i] = api.SmoothedPosition{Latitude: lat, Longitude: lon}
+	}
+	return result
+}
+
+// kalmanSmooth runs a constant-velocity Kalman filter followed by a
+// Rauch-Tung-Striebel backward pass, independently on the east and north
+// axes of a tangent plane.
+func kalmanSmooth(track []api.Location, q, r float64) []api.SmoothedPosition {
+	o, points := trackToLocal(track)
+
+	// Time steps between fixes; unparseable or repeated timestamps get a
+	// nominal one-second step
+	dts := make([]float64, len(track))
+	for i := 1; i < len(track); i++ {
+		dts[i] = 1
+		t0, err0 := parseTimestamp(track[i-1].Timestamp)
+		t1, err1 := parseTimestamp(track[i].Timestamp)
+		if err0 == nil && err1 == nil {
+			if dt := t1.Sub(t0).Seconds(); dt > 0 {
+				dts[i] = dt
+			}
+		}
+	}
+
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for i, p := range points {
+		xs[i], ys[i] = p.X, p.Y
+	}
+	xs = kalmanAxis(xs, dts, q, r*r)
+	ys = kalmanAxis(ys, dts, q, r*r)
+
+	result := make([]api.SmoothedPosition, len(track))
+	for i := range track {
+		lat, lon := fromLocal(o, api.LocalCoordinate{X: xs[i], Y: ys[i], Z: points[i].Z})
+		result[i] = api.SmoothedPosition{Latitude: lat, Longitude: lon}
+	}
+	return result
+}
+
+type vec2 [2]float64
+type mat2 [2][2]float64
+
+func (a mat2) mul(b mat2) mat2 {
+	return mat2{
+		{a[0][0]*b[0][0] + a[0][1]*b[1][0], a[0][0]*b[0][1] + a[0][1]*b[1][1]},
+		{a[1][0]*b[0][0] + a[1][1]*b[1][0], a[1][0]*b[0][1] + a[1][1]*b[1][1]},
+	}
+}
+
+func (a mat2) mulVec(v vec2) vec2 {
+	return vec2{a[0][0]*v[0] + a[0][1]*v[1], a[1][0]*v[0] + a[1][1]*v[1]}
+}
+
+func (a mat2) transpose() mat2 {
+	return mat2{{a[0][0], a[1][0]}, {a[0][1], a[1][1]}}
+}
+
+func (a mat2) add(b mat2) mat2 {
+	return mat2{{a[0][0] + b[0][0], a[0][1] + b[0][1]}, {a[1][0] + b[1][0], a[1][1] + b[1][1]}}
+}
+
+func (a mat2) sub(b mat2) mat2 {
+	return mat2{{a[0][0] - b[0][0], a[0][1] - b[0][1]}, {a[1][0] - b[1][0], a[1][1] - b[1][1]}}
+}
+
+func (a mat2) inverse() mat2 {
+	det := a[0][0]*a[1][1] - a[0][1]*a[1][0]
+	return mat2{{a[1][1] / det, -a[0][1] / det}, {-a[1][0] / det, a[0][0] / det}}
+}
+
+// kalmanAxis smooths one axis of positions with a [position, velocity] state.
+func kalmanAxis(z, dts []float64, q, r float64) []float64 {
+	n := len(z)
+	if n == 0 {
+		return z
+	}
+
+	xPred := make([]vec2, n)
+	pPred := make([]mat2, n)
+	xFilt := make([]vec2, n)
+	pFilt := make([]mat2, n)
+	transitions := make([]mat2, n)
+
+	// Start at the first measurement with an uninformative velocity
+	x := vec2{z[0], 0}
+	p := mat2{{r, 0}, {0, 100}}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dt := dts[i]
+			f := mat2{{1, dt}, {0, 1}}
+			noise := mat2{
+				{q * dt * dt * dt / 3, q * dt * dt / 2},
+				{q * dt * dt / 2, q * dt},
+			}
+			transitions[i] = f
+			x = f.mulVec(x)
+			p = f.mul(p).mul(f.transpose()).add(noise)
+		}
+		xPred[i], pPred[i] = x, p
+
+		// Measurement update; only position is observed
+		s := p[0][0] + r
+		k := vec2{p[0][0] / s, p[1][0] / s}
+		innovation := z[i] - x[0]
+		x = vec2{x[0] + k[0]*innovation, x[1] + k[1]*innovation}
+		p = mat2{
+			{(1 - k[0]) * p[0][0], (1 - k[0]) * p[0][1]},
+			{p[1][0] - k[1]*p[0][0], p[1][1] - k[1]*p[0][1]},
+		}
+		xFilt[i], pFilt[i] = x, p
+	}
+
+	// Rauch-Tung-Striebel backward pass
+	xSmooth := make([]vec2, n)
+	pSmooth := make([]mat2, n)
+	xSmooth[n-1], pSmooth[n-1] = xFilt[n-1], pFilt[n-1]
+	for i := n - 2; i >= 0; i-- {
+		f := transitions[i+1]
+		gain := pFilt[i].mul(f.transpose()).mul(pPred[i+1].inverse())
+		diff := vec2{xSmooth[i+1][0] - xPred[i+1][0], xSmooth[i+1][1] - xPred[i+1][1]}
+		correction := gain.mulVec(diff)
+		xSmooth[i] = vec2{xFilt[i][0] + correction[0], xFilt[i][1] + correction[1]}
+		pSmooth[i] = pFilt[i].add(gain.mul(pSmooth[i+1].sub(pPred[i+1])).mul(gain.transpose()))
+	}
+
+	result := make([]float64, n)
+	for i := range xSmooth {
+		result[i] = xSmooth[i][0]
+	}
+	return result
+}
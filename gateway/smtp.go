@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+type smtpConfig struct {
+	host     string
+	port     string
+	username string
+	password *secret
+	from     string
+}
+
+var mailer *smtpConfig
+
+// mailAttachment is a file attached to an outgoing email.
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+func initSMTP() error {
+	// Outgoing mail is disabled unless a relay is configured
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+
+	password, err := loadSecret("SMTP_PASSWORD", nil)
+	if err != nil {
+		return err
+	}
+	cfg := &smtpConfig{
+		host:     host,
+		port:     os.Getenv("SMTP_PORT"),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: password,
+		from:     os.Getenv("SMTP_FROM"),
+	}
+	if cfg.port == "" {
+		cfg.port = "587"
+	}
+	if cfg.from == "" {
+		return fmt.Errorf("SMTP_FROM is required when SMTP_HOST is set")
+	}
+
+	mailer = cfg
+	return nil
+}
+
+// sendMail sends an HTML email with optional attachments through the
+// configured relay. The relay's STARTTLS is used when it offers it.
+func sendMail(to []string, subject, html string, attachments ...mailAttachment) error {
+	if mailer == nil {
+		return fmt.Errorf("email is not configured (set SMTP_HOST)")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	headers := []string{
+		"From: " + mailer.from,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + writer.Boundary(),
+	}
+	msg := bytes.NewBufferString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	writeBase64(part, []byte(html))
+
+	for _, a := range attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		})
+		if err != nil {
+			return err
+		}
+		writeBase64(part, a.Data)
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	msg.Write(body.Bytes())
+
+	var auth smtp.Auth
+	if mailer.username != "" {
+		auth = smtp.PlainAuth("", mailer.username, mailer.password.get(), mailer.host)
+	}
+	if err := smtp.SendMail(net.JoinHostPort(mailer.host, mailer.port), auth, mailer.from, to, msg.Bytes()); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	return nil
+}
+
+// writeBase64 writes data base64-encoded in 76-character lines.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
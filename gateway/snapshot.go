@@ -0,0 +1,206 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+type PlatformSnapshot struct {
+	Platform     string         `json:"platform"`
+	Latitude     float64        `json:"latitude"`
+	Longitude    float64        `json:"longitude"`
+	Timestamp    string         `json:"timestamp"`
+	Interpolated bool           `json:"interpolated"`
+	Before       *api.Location  `json:"before,omitempty"`
+	After        *api.Location  `json:"after,omitempty"`
+	History      []api.Location `json:"history"`
+}
+
+type Snapshot struct {
+	Deployment string             `json:"deployment"`
+	At         string             `json:"at"`
+	Platforms  []PlatformSnapshot `json:"platforms"`
+}
+
+// findAdjacent returns the last fix at or before ts and the first fix after
+// it. Backfilled fixes are skipped when live is set.
+func (s *Server) findAdjacent(ctx context.Context, deployment, platform, ts string, live bool) (*api.Location, *api.Location, error) {
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	if live {
+		filter["backfilled"] = bson.M{"$ne": true}
+	}
+
+	var before, after *api.Location
+
+	filter["timestamp"] = bson.M{"$lte": ts}
+	var location api.Location
+	err := s.store.Locations.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})).Decode(&location)
+	if err == nil {
+		before = &location
+	} else if err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	filter["timestamp"] = bson.M{"$gt": ts}
+	var next api.Location
+	err = s.store.Locations.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: 1}})).Decode(&next)
+	if err == nil {
+		after = &next
+	} else if err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	return before, after, nil
+}
+
+// interpolatePosition linearly interpolates between two fixes at time t,
+// taking the short way around the antimeridian.
+func interpolatePosition(before, after api.Location, t time.Time) (float64, float64, bool) {
+	t0, err0 := parseTimestamp(before.Timestamp)
+	t1, err1 := parseTimestamp(after.Timestamp)
+	if err0 != nil || err1 != nil || !t1.After(t0) {
+		return 0, 0, false
+	}
+
+	frac := float64(t.Sub(t0)) / float64(t1.Sub(t0))
+	dLon := after.Longitude - before.Longitude
+	if dLon > 180 {
+		dLon -= 360
+	} else if dLon < -180 {
+		dLon += 360
+	}
+
+	lat := before.Latitude + frac*(after.Latitude-before.Latitude)
+	lon := before.Longitude + frac*dLon
+	if lon > 180 {
+		lon -= 360
+	} else if lon < -180 {
+		lon += 360
+	}
+	return lat, lon, true
+}
+
+func (s *Server) handleGetSnapshot(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Without an explicit time the snapshot is the live fleet picture
+	at := time.Now().UTC()
+	live := true
+	if v := c.Query("at"); v != "" {
+		live = false
+		if at, err = parseTimestampIn(v, loc); err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid at: %v", err)
+			return
+		}
+	}
+	atTimestamp := at.UTC().Format(timestampLayout)
+
+	mode := c.DefaultQuery("mode", "interpolate")
+	if mode != "interpolate" && mode != "nearest" {
+		respondErrorf(c, http.StatusBadRequest, "invalid mode %q (expected interpolate or nearest)", mode)
+		return
+	}
+
+	history := 10 * time.Minute
+	if v := c.Query("history"); v != "" {
+		if history, err = time.ParseDuration(v); err != nil || history < 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid history %q", v)
+			return
+		}
+	}
+	historyStart := at.Add(-history).UTC().Format(timestampLayout)
+
+	ctx := c.Request.Context()
+	platforms, err := s.platforms(ctx, deployment, requestCredential(c))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	snapshot := Snapshot{Deployment: deployment, At: formatTimestamp(atTimestamp, loc), Platforms: []PlatformSnapshot{}}
+	for _, platform := range platforms {
+		before, after, err := s.findAdjacent(ctx, deployment, platform, atTimestamp, live)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		// Platforms that had not reported yet at the requested time are left out
+		if before == nil {
+			continue
+		}
+
+		ps := PlatformSnapshot{
+			Platform:  platform,
+			Latitude:  before.Latitude,
+			Longitude: before.Longitude,
+			Timestamp: before.Timestamp,
+			Before:    before,
+			After:     after,
+			History:   []api.Location{},
+		}
+
+		if after != nil {
+			if mode == "interpolate" {
+				if lat, lon, ok := interpolatePosition(*before, *after, at); ok {
+					ps.Latitude, ps.Longitude = lat, lon
+					ps.Timestamp = atTimestamp
+					ps.Interpolated = true
+				}
+			} else if t0, err := parseTimestamp(before.Timestamp); err == nil {
+				if t1, err := parseTimestamp(after.Timestamp); err == nil && t1.Sub(at) < at.Sub(t0) {
+					ps.Latitude, ps.Longitude = after.Latitude, after.Longitude
+					ps.Timestamp = after.Timestamp
+				}
+			}
+		}
+
+		// Recent track leading up to the requested time
+		if history > 0 {
+			filter := bson.M{
+				"deployment": deployment,
+				"platform":   platform,
+				"timestamp":  bson.M{"$gte": historyStart, "$lte": atTimestamp},
+			}
+			opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}).SetLimit(s.defaultResultLimit)
+			cursor, err := s.store.Locations.Find(ctx, filter, opts)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if err = cursor.All(ctx, &ps.History); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		ps.Timestamp = formatTimestamp(ps.Timestamp, loc)
+		localizeLocation(ps.Before, loc)
+		if ps.After != nil {
+			localizeLocation(ps.After, loc)
+		}
+		for i := range ps.History {
+			localizeLocation(&ps.History[i], loc)
+		}
+		snapshot.Platforms = append(snapshot.Platforms, ps)
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
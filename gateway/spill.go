@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultResponseMemoryBudget = 256 << 20
+
+// Bytes of response bodies being assembled that may be held in memory at
+// once, over all requests. Bodies that would go over it are written to a
+// temporary file instead, so one huge export can't exhaust memory.
+var responseMemoryBudget int64 = defaultResponseMemoryBudget
+
+// Response memory in use, and bodies spilled to disk since startup
+var responseMemoryUsed, responsesSpilled int64
+
+func initResponseMemory() error {
+	n, err := envInt("RESPONSE_MEMORY_BUDGET", defaultResponseMemoryBudget)
+	if err != nil {
+		return err
+	}
+	responseMemoryBudget = n
+	return nil
+}
+
+func reserveResponseMemory(n int64) bool {
+	if atomic.AddInt64(&responseMemoryUsed, n) > responseMemoryBudget {
+		atomic.AddInt64(&responseMemoryUsed, -n)
+		return false
+	}
+	return true
+}
+
+// responseBody assembles a response in memory while the budget allows, and
+// in a temporary file once it doesn't. It must be closed.
+type responseBody struct {
+	buf      bytes.Buffer
+	reserved int64
+	file     *os.File
+	size     int64
+}
+
+func (b *responseBody) Write(p []byte) (int, error) {
+	if b.file == nil {
+		if reserveResponseMemory(int64(len(p))) {
+			b.reserved += int64(len(p))
+			b.size += int64(len(p))
+			return b.buf.Write(p)
+		}
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves what has been written so far to a temporary file.
+func (b *responseBody) spill() error {
+	f, err := os.CreateTemp("", "data-gateway-response-*")
+	if err != nil {
+		return fmt.Errorf("error spilling response to disk: %v", err)
+	}
+	if _, err := f.Write(b.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("error spilling response to disk: %v", err)
+	}
+	b.file = f
+	b.release()
+	atomic.AddInt64(&responsesSpilled, 1)
+	return nil
+}
+
+func (b *responseBody) release() {
+	atomic.AddInt64(&responseMemoryUsed, -b.reserved)
+	b.reserved = 0
+	b.buf = bytes.Buffer{}
+}
+
+// Close frees the memory or file holding the body.
+func (b *responseBody) Close() error {
+	b.release()
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// send responds with the body assembled.
+func (b *responseBody) send(c *gin.Context, status int, contentType string) {
+	var r io.Reader = &b.buf
+	if b.file != nil {
+		if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		r = b.file
+	}
+	c.DataFromReader(status, b.size, contentType, r, nil)
+}
+
+// encodeList writes a JSON object with fields and, last, items as the array
+// named list, marshaling an element at a time so the document is never held
+// in memory whole.
+func encodeList[T any](w io.Writer, fields gin.H, list string, items []T) error {
+	head, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	head = head[:len(head)-1]
+	if len(fields) > 0 {
+		head = append(head, ',')
+	}
+	name, _ := json.Marshal(list)
+	head = append(append(head, name...), ":["...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	for i, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+type PlatformStats struct {
+	Deployment     string  `json:"deployment"`
+	Platform       string  `json:"platform"`
+	Count          int64   `json:"count"`
+	FirstTimestamp string  `json:"first_timestamp"`
+	LastTimestamp  string  `json:"last_timestamp"`
+	Distance       float64 `json:"distance"`
+	AverageSpeed   float64 `json:"average_speed"`
+	MaxSpeed       float64 `json:"max_speed"`
+}
+
+type StatsResponse struct {
+	Units     UnitSystem      `json:"units"`
+	Source    string          `json:"source"`
+	Platforms []PlatformStats `json:"platforms"`
+}
+
+// Sources a stats or heatmap response was computed from
+const (
+	sourceRaw     = "raw"
+	sourceRollups = "rollups"
+)
+
+// computePlatformStats walks a platform's fixes in timestamp order and
+// accumulates distance travelled and speed over ground, in SI units.
+func (s *Server) computePlatformStats(ctx context.Context, deployment, platform string, timeRange bson.M) (PlatformStats, error) {
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"timestamp": 1, "latitude": 1, "longitude": 1})
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return PlatformStats{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var total PositionRollup
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return PlatformStats{}, err
+		}
+		total.add(&location)
+	}
+	if err := cursor.Err(); err != nil {
+		return PlatformStats{}, err
+	}
+
+	return rollupStats(deployment, platform, total), nil
+}
+
+// computeRollupStats gives the same figures as computePlatformStats from the
+// hourly rollups, joining consecutive hours by their edge fixes.
+func (s *Server) computeRollupStats(ctx context.Context, deployment, platform string, timeRange bson.M) (PlatformStats, error) {
+	filter := bson.M{"deployment": deployment, "platform": platform}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := s.store.HourlyRollups.Find(ctx, filter, opts)
+	if err != nil {
+		return PlatformStats{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var total PositionRollup
+	for cursor.Next(ctx) {
+		var hour PositionRollup
+		if err := cursor.Decode(&hour); err != nil {
+			return PlatformStats{}, err
+		}
+		total.merge(hour)
+	}
+	if err := cursor.Err(); err != nil {
+		return PlatformStats{}, err
+	}
+
+	return rollupStats(deployment, platform, total), nil
+}
+
+func rollupStats(deployment, platform string, total PositionRollup) PlatformStats {
+	total.finish()
+	return PlatformStats{
+		Deployment:     deployment,
+		Platform:       platform,
+		Count:          total.Count,
+		FirstTimestamp: total.First.Timestamp,
+		LastTimestamp:  total.Last.Timestamp,
+		Distance:       total.Distance,
+		AverageSpeed:   total.AverageSpeed,
+		MaxSpeed:       total.MaxSpeed,
+	}
+}
+
+func (s *Server) handleGetStats(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	units, err := parseUnits(c.Query("units"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, status, err := s.deploymentStats(c.Request.Context(), requestCredential(c), deployment, c.Query("platform"), start, end, units)
+	if err != nil {
+		respondError(c, status, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// deploymentStats computes the stats of a deployment's platforms, or of one
+// of them, that cred may read, between stored timestamps start and end,
+// either of which may be empty. It returns the status to respond with on
+// error.
+func (s *Server) deploymentStats(ctx context.Context, cred *Credential, deployment, platform, start, end string, units UnitSystem) (StatsResponse, int, error) {
+	// Long ranges are answered from hourly rollups, which cover whole hours
+	source, coll, compute := sourceRaw, s.store.Locations, s.computePlatformStats
+	if useRollups(start, end) {
+		source, coll, compute = sourceRollups, s.store.HourlyRollups, s.computeRollupStats
+		if start != "" {
+			start = start[:13] + ":00:00.000Z"
+		}
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+
+	var platforms []string
+	if platform != "" {
+		if !grantAllows(cred, deployment, platform) {
+			return StatsResponse{}, http.StatusForbidden, fmt.Errorf("access to platform denied")
+		}
+		platforms = []string{platform}
+	} else {
+		values, err := coll.Distinct(ctx, "platform", restrictFilter(grantFilter(cred), bson.M{"deployment": deployment}))
+		if err != nil {
+			return StatsResponse{}, http.StatusInternalServerError, err
+		}
+		for _, v := range values {
+			if platform, ok := v.(string); ok {
+				platforms = append(platforms, platform)
+			}
+		}
+	}
+
+	resp := StatsResponse{Units: units, Source: source, Platforms: []PlatformStats{}}
+	for _, platform := range platforms {
+		stats, err := compute(ctx, deployment, platform, timeRange)
+		if err != nil {
+			return StatsResponse{}, http.StatusInternalServerError, err
+		}
+		stats.Distance = units.Distance(stats.Distance)
+		stats.AverageSpeed = units.Speed(stats.AverageSpeed)
+		stats.MaxSpeed = units.Speed(stats.MaxSpeed)
+		resp.Platforms = append(resp.Platforms, stats)
+	}
+	return resp, http.StatusOK, nil
+}
+
+// parseTimeRange reads the start and end query parameters as stored
+// timestamps; either may be empty.
+func parseTimeRange(c *gin.Context) (start, end string, err error) {
+	loc, err := requestTimezone(c)
+	if err != nil {
+		return "", "", err
+	}
+	if v := c.Query("start"); v != "" {
+		if start, err = normalizeTimestamp(v, loc); err != nil {
+			return "", "", fmt.Errorf("invalid start: %v", err)
+		}
+	}
+	if v := c.Query("end"); v != "" {
+		if end, err = normalizeTimestamp(v, loc); err != nil {
+			return "", "", fmt.Errorf("invalid end: %v", err)
+		}
+	}
+	return start, end, nil
+}
@@ -0,0 +1,17 @@
+package gateway
+
+import "fmt"
+
+// openCollections opens the collection for each type of record and creates
+// its indexes.
+func (s *Server) openCollections() error {
+	s.store.Open()
+	for _, c := range s.store.Collections() {
+		for _, model := range c.Indexes {
+			if err := s.ensureIndex(*c.Handle, model); err != nil {
+				return fmt.Errorf("error creating %s indexes: %v", c.DataType, err)
+			}
+		}
+	}
+	return nil
+}
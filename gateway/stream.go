@@ -0,0 +1,388 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	eventLocation = "location"
+	eventBackfill = "backfill"
+	// Sent on resuming when fixes older than the resume window were missed
+	eventGap = "gap"
+	// Sent every heartbeat interval, so clients can tell a quiet stream from
+	// a dead one
+	eventPing = "ping"
+	// Sent before the gateway closes a stream, with the reason
+	eventClose = "close"
+)
+
+const (
+	defaultStreamResumeWindow = 10 * time.Minute
+	defaultStreamBuffer       = 256
+	defaultStreamHeartbeat    = 15 * time.Second
+	defaultStreamWriteTimeout = 30 * time.Second
+)
+
+var (
+	// How far back a reconnecting stream client is sent the fixes it
+	// missed; zero turns resuming off
+	streamResumeWindow = defaultStreamResumeWindow
+	// Events waiting to be sent to a subscriber before it is evicted
+	streamBuffer = defaultStreamBuffer
+	// Zero sends no pings
+	streamHeartbeat = defaultStreamHeartbeat
+	// Longest a write to a stream client may block before the stream is
+	// closed; zero waits for as long as it takes
+	streamWriteTimeout = defaultStreamWriteTimeout
+)
+
+func initStream() error {
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{"STREAM_RESUME_WINDOW", &streamResumeWindow, defaultStreamResumeWindow},
+		{"STREAM_HEARTBEAT_INTERVAL", &streamHeartbeat, defaultStreamHeartbeat},
+		{"STREAM_WRITE_TIMEOUT", &streamWriteTimeout, defaultStreamWriteTimeout},
+	} {
+		d, err := envDuration(setting.name, setting.def)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid %s %q", setting.name, os.Getenv(setting.name))
+		}
+		*setting.value = d
+	}
+	n, err := envInt("STREAM_BUFFER", defaultStreamBuffer)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("invalid STREAM_BUFFER %q (expected at least 1)", os.Getenv("STREAM_BUFFER"))
+	}
+	streamBuffer = int(n)
+	return nil
+}
+
+type streamEvent struct {
+	Type     string
+	Location api.Location
+}
+
+// streamSubscriber receives stream events until it unsubscribes, or is
+// evicted for falling behind.
+type streamSubscriber struct {
+	events chan streamEvent
+	// Closed on eviction
+	evicted chan struct{}
+}
+
+// streamHub fans ingested locations out to live stream subscribers.
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	// Subscribers evicted since startup
+	evictions int64
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: make(map[*streamSubscriber]struct{})}
+}
+
+func (h *streamHub) subscribe() *streamSubscriber {
+	sub := &streamSubscriber{
+		events:  make(chan streamEvent, streamBuffer),
+		evicted: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *streamHub) unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+func (h *streamHub) evictionCount() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.evictions
+}
+
+func (h *streamHub) subscriberCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// publish delivers an event to every subscriber. A subscriber whose buffer
+// is full is evicted rather than blocking ingest, or silently missing
+// events.
+func (h *streamHub) publish(event streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.evicted)
+			h.evictions++
+		}
+	}
+}
+
+// handleStream sends newly ingested locations as server-sent events. Late
+// fixes are sent as backfill events so live views can keep them off the
+// current position. Each event's ID is a resume token: a client
+// reconnecting with it, as Last-Event-ID or resume, is first sent the fixes
+// stored since, within the resume window. Clients too slow to keep up are
+// sent a close event and disconnected, to resume once they catch up.
+func (s *Server) handleStream(c *gin.Context) {
+	filter, err := streamFilter(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	// Set by EventSource when it reconnects
+	token := c.GetHeader("Last-Event-ID")
+	if v := c.Query("resume"); v != "" {
+		token = v
+	}
+	var resume *pollCursor
+	if token != "" && streamResumeWindow > 0 {
+		cursor, err := parsePollCursor(token)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid resume token %q", token)
+			return
+		}
+		resume = &cursor
+	}
+
+	// Subscribe before catching up so fixes stored meanwhile aren't missed
+	sub := s.hub.subscribe()
+	defer s.hub.unsubscribe(sub)
+
+	// A write that blocks past the deadline fails and cancels the request,
+	// so a stalled client can't hold the stream open indefinitely
+	disableWriteTimeout(c)
+	rc := http.NewResponseController(c.Writer)
+	writeDeadline := func() {
+		if streamWriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		}
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	send := func(w io.Writer, eventType string, location api.Location) {
+		id := pollCursor{createdAt: location.CreatedAt.UTC(), id: location.ID}
+		localizeLocation(&location, loc)
+		data, _ := json.Marshal(casedValue(c, location))
+		writeDeadline()
+		fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, eventType, data)
+	}
+	signal := func(w io.Writer, eventType string, value gin.H) {
+		data, _ := json.Marshal(casedValue(c, value))
+		writeDeadline()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	}
+
+	// Fixes sent while catching up, which may be published live as well
+	var replayed map[primitive.ObjectID]time.Time
+	if resume != nil {
+		replayed, err = s.replayStream(c, filter, *resume, send, signal)
+		if err != nil {
+			// The stream has started, so the client can only be told by
+			// closing it
+			s.logger.Printf("error resuming stream: %v", err)
+			return
+		}
+	}
+	writeDeadline()
+	c.Writer.Flush()
+
+	var heartbeat <-chan time.Time
+	if streamHeartbeat > 0 {
+		ticker := time.NewTicker(streamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-sub.evicted:
+			// Whatever is still buffered would be out of date by now; the
+			// client resumes from the last event it got
+			signal(w, eventClose, gin.H{
+				"reason":  "slow_consumer",
+				"message": fmt.Sprintf("more than %d events were waiting to be sent", streamBuffer),
+			})
+			return false
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-sub.evicted:
+			return true
+		case now := <-heartbeat:
+			signal(w, eventPing, gin.H{"time": now.UTC().Format(timestampLayout)})
+			return true
+		case event := <-sub.events:
+			location := event.Location
+			if !matchQuery(filter, &location) || !canRead(c, location.Deployment, location.Platform) {
+				return true
+			}
+			// MongoDB keeps times to the millisecond
+			if createdAt, ok := replayed[location.ID]; ok && createdAt.Equal(location.CreatedAt.Truncate(time.Millisecond)) {
+				return true
+			}
+			send(w, event.Type, location)
+			return true
+		}
+	})
+}
+
+// streamFilter builds the filter a stream's fixes must match from its
+// parameters. It only uses what query expressions do, so it can be run
+// against stored fixes when resuming and evaluated on each live fix.
+func streamFilter(c *gin.Context) (bson.M, error) {
+	var clauses []bson.M
+	if deployment := c.Query("deployment"); deployment != "" {
+		clauses = append(clauses, bson.M{"deployment": deployment})
+	}
+	platforms := listParam(c.Query("platforms"))
+	if platform := c.Query("platform"); platform != "" {
+		platforms = append(platforms, platform)
+	}
+	if len(platforms) > 0 {
+		clauses = append(clauses, anyOf("platform", platforms))
+	}
+	if sources := listParam(c.Query("sources")); len(sources) > 0 {
+		clauses = append(clauses, anyOf("source", sources))
+	}
+	if v := c.Query("bbox"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("bbox must be min_lon,min_lat,max_lon,max_lat")
+		}
+		var bbox [4]float64
+		for i, part := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bbox must be min_lon,min_lat,max_lon,max_lat")
+			}
+			bbox[i] = f
+		}
+		box, err := boxFilter(bbox)
+		if err != nil {
+			return nil, fmt.Errorf("bbox: %v", err)
+		}
+		clauses = append(clauses, box)
+	}
+	if v := c.Query("min_speed"); v != "" {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil || speed < 0 {
+			return nil, fmt.Errorf("min_speed must be a non-negative number of m/s")
+		}
+		clauses = append(clauses, bson.M{"speed": bson.M{"$gte": speed}})
+	}
+	if q := c.Query("q"); q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %v", err)
+		}
+		clauses = append(clauses, queryFilter)
+	}
+	if len(clauses) == 0 {
+		return bson.M{}, nil
+	}
+	return bson.M{"$and": clauses}, nil
+}
+
+// listParam splits a comma-separated parameter, dropping empty items.
+func listParam(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// anyOf matches records whose field has one of the values.
+func anyOf(field string, values []string) bson.M {
+	if len(values) == 1 {
+		return bson.M{field: values[0]}
+	}
+	clauses := make([]bson.M, len(values))
+	for i, v := range values {
+		clauses[i] = bson.M{field: v}
+	}
+	return bson.M{"$or": clauses}
+}
+
+// replayStream sends the fixes stored after the resume token, oldest first,
+// going back no further than the resume window. If the token is older than
+// that, a gap event says when the fixes sent start.
+func (s *Server) replayStream(c *gin.Context, filter bson.M, since pollCursor, send func(io.Writer, string, api.Location), signal func(io.Writer, string, gin.H)) (map[primitive.ObjectID]time.Time, error) {
+	ctx := c.Request.Context()
+	windowStart := time.Now().Add(-streamResumeWindow).UTC().Truncate(time.Millisecond)
+	if since.createdAt.Before(windowStart) {
+		signal(c.Writer, eventGap, gin.H{"since": windowStart.Format(timestampLayout)})
+		since = pollCursor{createdAt: windowStart}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	query := scopedFilter(c, bson.M{"$and": []bson.M{filter, since.after()}})
+	cursor, err := s.store.Locations.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	replayed := make(map[primitive.ObjectID]time.Time)
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			return nil, err
+		}
+		eventType := eventLocation
+		if location.Backfilled {
+			eventType = eventBackfill
+		}
+		send(c.Writer, eventType, location)
+		replayed[location.ID] = location.CreatedAt.Truncate(time.Millisecond)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return replayed, nil
+}
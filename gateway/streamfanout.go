@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// How live stream events reach subscribers
+const (
+	// Only subscribers of the instance that ingested the fix
+	fanoutLocal = "local"
+	// Subscribers of every instance sharing the database
+	fanoutMongo = "mongo"
+)
+
+const (
+	streamSequenceID = "stream_sequence"
+	// Events shared through MongoDB are only needed until every instance
+	// has read them
+	streamEventRetention = 10 * time.Minute
+	// An event numbered but not yet visible after this long is taken to
+	// have failed, and readers move past it
+	streamEventGapTimeout = 2 * time.Second
+	defaultFanoutInterval = 500 * time.Millisecond
+	// Events written or read at once
+	streamEventBatchSize = 1000
+)
+
+var streamFanout = fanoutLocal
+var streamFanoutInterval = defaultFanoutInterval
+
+// sharedStreamEvent is a stream event shared with the other instances.
+type sharedStreamEvent struct {
+	Seq int64 `bson:"seq"`
+	// The instance that published it, which has already delivered it
+	Origin   string       `bson:"origin"`
+	Type     string       `bson:"type"`
+	Location api.Location `bson:"location"`
+	Time     time.Time    `bson:"time"`
+}
+
+func initStreamFanout() error {
+	switch v := os.Getenv("STREAM_FANOUT"); v {
+	case "", fanoutLocal:
+		streamFanout = fanoutLocal
+	case fanoutMongo:
+		streamFanout = fanoutMongo
+	default:
+		return fmt.Errorf("invalid STREAM_FANOUT %q (expected local or mongo)", v)
+	}
+	interval, err := envDuration("STREAM_FANOUT_INTERVAL", defaultFanoutInterval)
+	if err != nil {
+		return err
+	}
+	if interval == 0 {
+		return fmt.Errorf("invalid STREAM_FANOUT_INTERVAL %q", os.Getenv("STREAM_FANOUT_INTERVAL"))
+	}
+	streamFanoutInterval = interval
+	return nil
+}
+
+func (s *Server) initStreamEvents() error {
+	if streamFanout != fanoutMongo {
+		return nil
+	}
+	collectionName := os.Getenv("MONGODB_STREAM_EVENTS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "stream_events"
+	}
+	s.store.StreamEvents = s.store.Collection(collectionName)
+
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "time", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(streamEventRetention.Seconds()))},
+	}
+	for _, model := range indexes {
+		if err := s.ensureIndex(s.store.StreamEvents, model); err != nil {
+			return fmt.Errorf("error creating stream event indexes: %v", err)
+		}
+	}
+	s.streamOrigin = primitive.NewObjectID().Hex()
+	s.streamShared = make(chan streamEvent, 1024)
+	return nil
+}
+
+// publishStream delivers an event to this instance's stream subscribers,
+// and with STREAM_FANOUT=mongo, queues it for the other instances.
+func (s *Server) publishStream(event streamEvent) {
+	s.hub.publish(event)
+	if s.streamShared == nil {
+		return
+	}
+	select {
+	case s.streamShared <- event:
+	default:
+		s.logger.Printf("error sharing stream event for %s/%s: queue full", event.Location.Deployment, event.Location.Platform)
+	}
+}
+
+// runStreamFanout shares this instance's stream events and delivers the
+// other instances' until ctx is done.
+func (s *Server) runStreamFanout(ctx context.Context) {
+	if s.streamShared == nil {
+		return
+	}
+	go s.shareStreamEvents(ctx)
+	s.followStreamEvents(ctx)
+}
+
+// shareStreamEvents writes queued events to the database, numbering each
+// batch with one update so ingest isn't held up.
+func (s *Server) shareStreamEvents(ctx context.Context) {
+	for {
+		var batch []streamEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.streamShared:
+			batch = append(batch, event)
+		}
+	drain:
+		for len(batch) < streamEventBatchSize {
+			select {
+			case event := <-s.streamShared:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+
+		var counter struct {
+			Seq int64 `bson:"seq"`
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		update := bson.M{"$inc": bson.M{"seq": int64(len(batch))}}
+		if err := s.store.Settings.FindOneAndUpdate(ctx, bson.M{"_id": streamSequenceID}, update, opts).Decode(&counter); err != nil {
+			s.logger.Printf("error numbering %d stream events: %v", len(batch), err)
+			continue
+		}
+		now := time.Now().UTC()
+		docs := make([]interface{}, len(batch))
+		for i, event := range batch {
+			docs[i] = sharedStreamEvent{
+				Seq:      counter.Seq - int64(len(batch)-1-i),
+				Origin:   s.streamOrigin,
+				Type:     event.Type,
+				Location: event.Location,
+				Time:     now,
+			}
+		}
+		if _, err := s.store.StreamEvents.InsertMany(ctx, docs); err != nil {
+			s.logger.Printf("error sharing %d stream events: %v", len(batch), err)
+		}
+	}
+}
+
+// followStreamEvents polls for events shared by the other instances and
+// delivers them to this instance's subscribers, in order. It starts from
+// the latest event, as subscribers only want what is ingested from now on.
+func (s *Server) followStreamEvents(ctx context.Context) {
+	var last int64
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.store.Settings.FindOne(ctx, bson.M{"_id": streamSequenceID}).Decode(&counter)
+	if err != nil && err != mongo.ErrNoDocuments {
+		s.logger.Printf("error reading stream event sequence: %v", err)
+	}
+	last = counter.Seq
+
+	// When the event after last was first found missing
+	var gapSince time.Time
+	for sleep(ctx, streamFanoutInterval) {
+		opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(streamEventBatchSize)
+		cursor, err := s.store.StreamEvents.Find(ctx, bson.M{"seq": bson.M{"$gt": last}}, opts)
+		if err != nil {
+			s.logger.Printf("error reading shared stream events: %v", err)
+			continue
+		}
+		var events []sharedStreamEvent
+		err = cursor.All(ctx, &events)
+		if err != nil {
+			s.logger.Printf("error reading shared stream events: %v", err)
+			continue
+		}
+
+		for _, event := range events {
+			if event.Seq != last+1 {
+				// Wait for an event still being written, unless it failed
+				if gapSince.IsZero() {
+					gapSince = time.Now()
+				}
+				if time.Since(gapSince) < streamEventGapTimeout {
+					break
+				}
+			}
+			gapSince = time.Time{}
+			last = event.Seq
+			if event.Origin != s.streamOrigin {
+				s.hub.publish(streamEvent{Type: event.Type, Location: event.Location})
+			}
+		}
+	}
+}
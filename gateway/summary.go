@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type PlatformSummary struct {
+	Platform       string `json:"platform"`
+	Count          int64  `json:"count"`
+	StorageBytes   int64  `json:"storage_bytes"`
+	FirstTimestamp string `json:"first_timestamp"`
+	LastTimestamp  string `json:"last_timestamp"`
+	Gaps           []Gap  `json:"gaps"`
+}
+
+type IngestBucket struct {
+	Hour  string `json:"hour"`
+	Count int64  `json:"count"`
+}
+
+type DeploymentSummary struct {
+	Deployment   string            `json:"deployment"`
+	Count        int64             `json:"count"`
+	StorageBytes int64             `json:"storage_bytes"`
+	GapThreshold string            `json:"gap_threshold"`
+	Platforms    []PlatformSummary `json:"platforms"`
+	IngestRate   []IngestBucket    `json:"ingest_rate"`
+}
+
+func (s *Server) handleGetDeploymentSummary(c *gin.Context) {
+	deployment := c.Param("deployment")
+
+	minGap := 10 * time.Minute
+	if v := c.Query("minGap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid minGap %q", v)
+			return
+		}
+		minGap = d
+	}
+
+	ctx := c.Request.Context()
+	summary := DeploymentSummary{
+		Deployment:   deployment,
+		GapThreshold: minGap.String(),
+		Platforms:    []PlatformSummary{},
+		IngestRate:   []IngestBucket{},
+	}
+
+	// Document counts and storage footprint per platform
+	cursor, err := s.store.Locations.Aggregate(ctx, []bson.M{
+		{"$match": scopedFilter(c, bson.M{"deployment": deployment})},
+		{"$group": bson.M{
+			"_id":             "$platform",
+			"count":           bson.M{"$sum": 1},
+			"storage_bytes":   bson.M{"$sum": bson.M{"$bsonSize": "$$ROOT"}},
+			"first_timestamp": bson.M{"$min": "$timestamp"},
+			"last_timestamp":  bson.M{"$max": "$timestamp"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var platformResults []struct {
+		Platform       string `bson:"_id"`
+		Count          int64  `bson:"count"`
+		StorageBytes   int64  `bson:"storage_bytes"`
+		FirstTimestamp string `bson:"first_timestamp"`
+		LastTimestamp  string `bson:"last_timestamp"`
+	}
+	if err = cursor.All(ctx, &platformResults); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(platformResults) == 0 {
+		respondErrorf(c, http.StatusNotFound, "deployment not found")
+		return
+	}
+
+	for _, result := range platformResults {
+		gaps, err := s.findGaps(ctx, deployment, result.Platform, minGap, false, nil, 0)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		summary.Count += result.Count
+		summary.StorageBytes += result.StorageBytes
+		summary.Platforms = append(summary.Platforms, PlatformSummary{
+			Platform:       result.Platform,
+			Count:          result.Count,
+			StorageBytes:   result.StorageBytes,
+			FirstTimestamp: result.FirstTimestamp,
+			LastTimestamp:  result.LastTimestamp,
+			Gaps:           gaps,
+		})
+	}
+
+	// Ingest rate in hourly buckets of receipt time
+	cursor, err = s.store.Locations.Aggregate(ctx, []bson.M{
+		{"$match": scopedFilter(c, bson.M{"deployment": deployment})},
+		{"$group": bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"format": "%Y-%m-%dT%H:00:00Z", "date": "$created_at"}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var bucketResults []struct {
+		Hour  string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err = cursor.All(ctx, &bucketResults); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	for _, result := range bucketResults {
+		summary.IngestRate = append(summary.IngestRate, IngestBucket{Hour: result.Hour, Count: result.Count})
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
@@ -0,0 +1,370 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Longest a recurring suppression may last each time its schedule fires
+const maxSuppressionDuration = 7 * 24 * time.Hour
+
+// Alerts for conditions that last until they are resolved. Those held back
+// by a suppression are sent when it ends if they are still open; others
+// are only kept in the alert history.
+var ongoingAlerts = map[string]bool{
+	alertPlatformNoFix:  true,
+	alertPlatformSilent: true,
+	alertLowEndurance:   true,
+}
+
+// Suppression holds back a deployment's alerts, or a platform's, either over
+// one window, such as a planned recovery when a platform will go silent, or
+// for a duration every time a cron schedule fires, as quiet hours.
+type Suppression struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Deployment string             `json:"deployment" bson:"deployment"`
+	// Every platform of the deployment if empty
+	Platform string `json:"platform,omitempty" bson:"platform,omitempty"`
+	// Every type of alert if empty
+	Types []string `json:"types,omitempty" bson:"types,omitempty"`
+	// A one-off window
+	Start string `json:"start,omitempty" bson:"start,omitempty"`
+	End   string `json:"end,omitempty" bson:"end,omitempty"`
+	// A recurring window, opening when the schedule fires in Timezone
+	Schedule string `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	Timezone string `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	// How long each recurring window lasts, or with neither start nor end,
+	// how long a window opening now lasts
+	Duration  string    `json:"duration,omitempty" bson:"duration,omitempty"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	// Whether alerts are being held back now
+	Active bool `json:"active" bson:"-"`
+}
+
+func (s *Server) initSuppressions() error {
+	collectionName := os.Getenv("MONGODB_SUPPRESSIONS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "suppressions"
+	}
+	s.store.Suppressions = s.store.Collection(collectionName)
+
+	indexModel := mongo.IndexModel{Keys: bson.D{{Key: "deployment", Value: 1}}}
+	if err := s.ensureIndex(s.store.Suppressions, indexModel); err != nil {
+		return fmt.Errorf("error creating suppression indexes: %v", err)
+	}
+	return nil
+}
+
+// until returns when the suppression's window holding t ends, or false if
+// t is outside its windows.
+func (sup *Suppression) until(t time.Time) (time.Time, bool) {
+	if sup.Schedule == "" {
+		start, _ := parseTimestamp(sup.Start)
+		end, _ := parseTimestamp(sup.End)
+		return end, !t.Before(start) && t.Before(end)
+	}
+	cron, err := parseCron(sup.Schedule)
+	if err != nil {
+		return time.Time{}, false
+	}
+	loc, err := time.LoadLocation(sup.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	d, _ := time.ParseDuration(sup.Duration)
+	// The latest time the schedule fired within the duration before t
+	t = t.In(loc)
+	for m := t.Truncate(time.Minute); t.Sub(m) < d; m = m.Add(-time.Minute) {
+		if cron.Matches(m) {
+			return m.Add(d).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (sup *Suppression) matches(alert api.Alert) bool {
+	if sup.Deployment != alert.Deployment || (sup.Platform != "" && sup.Platform != alert.Platform) {
+		return false
+	}
+	if len(sup.Types) == 0 {
+		return true
+	}
+	for _, t := range sup.Types {
+		if t == alert.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSuppression returns the suppression holding an alert back and when
+// it ends, the latest of them if several are, or nil.
+func (s *Server) activeSuppression(ctx context.Context, alert api.Alert) (*Suppression, time.Time, error) {
+	cursor, err := s.store.Suppressions.Find(ctx, bson.M{"deployment": alert.Deployment})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var suppressions []Suppression
+	if err := cursor.All(ctx, &suppressions); err != nil {
+		return nil, time.Time{}, err
+	}
+	var found *Suppression
+	var latest time.Time
+	for i := range suppressions {
+		sup := &suppressions[i]
+		if !sup.matches(alert) {
+			continue
+		}
+		if end, ok := sup.until(alert.Time); ok && end.After(latest) {
+			found, latest = sup, end
+		}
+	}
+	return found, latest, nil
+}
+
+// releaseSuppressedAlerts sends the alerts held back by suppressions that
+// have since ended, if their conditions haven't cleared meanwhile.
+func (s *Server) releaseSuppressedAlerts(ctx context.Context, now time.Time) error {
+	filter := bson.M{
+		"state":            alertOpen,
+		"notified_at":      bson.M{"$exists": false},
+		"suppressed_until": bson.M{"$lte": now},
+	}
+	cursor, err := s.store.Alerts.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var alerts []api.Alert
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return err
+	}
+
+	for _, alert := range alerts {
+		// Escalation starts over from now
+		alert.NotifiedAt = &now
+		targets := s.alertTargets(&alert)
+		result, err := s.store.Alerts.UpdateOne(ctx,
+			bson.M{"_id": alert.ID, "state": alertOpen, "notified_at": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"notified_at": now, "escalations": alert.Escalations}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			s.notify(alert, targets)
+		}
+	}
+	return nil
+}
+
+type suppressionRequest struct {
+	Deployment string   `json:"deployment" binding:"required"`
+	Platform   string   `json:"platform"`
+	Types      []string `json:"types"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	Schedule   string   `json:"schedule"`
+	Timezone   string   `json:"timezone"`
+	Duration   string   `json:"duration"`
+	Reason     string   `json:"reason"`
+}
+
+// handleCreateSuppression adds a suppression: a window from start to end, a
+// snooze for a duration from now, or quiet hours recurring on a schedule.
+func (s *Server) handleCreateSuppression(c *gin.Context) {
+	var req suppressionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if !canRead(c, req.Deployment, req.Platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+
+	now := time.Now().UTC()
+	sup := Suppression{
+		Deployment: req.Deployment,
+		Platform:   req.Platform,
+		Types:      req.Types,
+		Reason:     req.Reason,
+		CreatedAt:  now,
+	}
+	if cred := requestCredential(c); cred != nil {
+		sup.CreatedBy = cred.Name
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid duration %q", req.Duration)
+			return
+		}
+		sup.Duration = d.String()
+	}
+
+	switch {
+	case req.Schedule != "":
+		if req.Start != "" || req.End != "" {
+			respondErrorf(c, http.StatusBadRequest, "schedule cannot be combined with start or end")
+			return
+		}
+		if _, err := parseCron(req.Schedule); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if d == 0 || d > maxSuppressionDuration {
+			respondErrorf(c, http.StatusBadRequest, "a schedule needs a duration of up to %s", maxSuppressionDuration)
+			return
+		}
+		sup.Schedule, sup.Timezone = req.Schedule, req.Timezone
+		if sup.Timezone == "" {
+			sup.Timezone = "UTC"
+		}
+		if _, err := time.LoadLocation(sup.Timezone); err != nil {
+			respondErrorf(c, http.StatusBadRequest, "unknown timezone %q", sup.Timezone)
+			return
+		}
+	case req.End != "":
+		if d != 0 {
+			respondErrorf(c, http.StatusBadRequest, "duration cannot be combined with end")
+			return
+		}
+		sup.Start = now.Format(timestampLayout)
+		if req.Start != "" {
+			start, err := normalizeTimestamp(req.Start, time.UTC)
+			if err != nil {
+				respondErrorf(c, http.StatusBadRequest, "invalid start: %v", err)
+				return
+			}
+			sup.Start = start
+		}
+		end, err := normalizeTimestamp(req.End, time.UTC)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid end: %v", err)
+			return
+		}
+		if end <= sup.Start {
+			respondErrorf(c, http.StatusBadRequest, "end must be after start")
+			return
+		}
+		sup.End = end
+	case d != 0:
+		if req.Start != "" {
+			respondErrorf(c, http.StatusBadRequest, "start needs an end, not a duration")
+			return
+		}
+		sup.Start, sup.End = now.Format(timestampLayout), now.Add(d).Format(timestampLayout)
+	default:
+		respondErrorf(c, http.StatusBadRequest, "one of end, duration, or schedule is required")
+		return
+	}
+
+	result, err := s.store.Suppressions.InsertOne(c.Request.Context(), sup)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	sup.ID = result.InsertedID.(primitive.ObjectID)
+	_, sup.Active = sup.until(now)
+	c.JSON(http.StatusCreated, sup)
+}
+
+// handleGetSuppressions lists a deployment's suppressions, newest first,
+// leaving out windows that have ended unless all is set.
+func (s *Server) handleGetSuppressions(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+	now := time.Now().UTC()
+	if c.Query("all") != "true" {
+		filter["$or"] = bson.A{
+			bson.M{"schedule": bson.M{"$exists": true}},
+			bson.M{"end": bson.M{"$gt": now.Format(timestampLayout)}},
+		}
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(s.maxResultLimit)
+	cursor, err := s.store.Suppressions.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	suppressions := []Suppression{}
+	if err := cursor.All(ctx, &suppressions); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range suppressions {
+		sup := &suppressions[i]
+		_, sup.Active = sup.until(now)
+		if sup.Start != "" {
+			sup.Start, sup.End = formatTimestamp(sup.Start, loc), formatTimestamp(sup.End, loc)
+		}
+		sup.CreatedAt = sup.CreatedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, suppressions)
+}
+
+// handleDeleteSuppression removes a suppression, ending it early. Alerts it
+// is holding back are sent at the next check.
+func (s *Server) handleDeleteSuppression(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid suppression id")
+		return
+	}
+	ctx := c.Request.Context()
+	var sup Suppression
+	err = s.store.Suppressions.FindOne(ctx, bson.M{"_id": id}).Decode(&sup)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "suppression not found")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !canRead(c, sup.Deployment, sup.Platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+
+	if _, err := s.store.Suppressions.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = s.store.Alerts.UpdateMany(ctx,
+		bson.M{"suppressed_by": id.Hex(), "notified_at": bson.M{"$exists": false}, "suppressed_until": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"suppressed_until": time.Now().UTC()}},
+	)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,532 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	// Cross-track distance in meters within which a line counts as run,
+	// unless a plan sets its own
+	defaultSurveyTolerance = 25
+	// Fraction of a line that must be run for it to count as complete
+	surveyLineComplete = 0.95
+	// Track directions further than this from a line's, in degrees, are
+	// crossing it rather than running it
+	surveyMaxHeadingOffset = 45
+	maxSurveyLines         = 10000
+	defaultSurveyPace      = 6 * time.Hour
+)
+
+// SurveyPlan is the lines planned for a deployment's survey, given as lines
+// or as a polygon to cover with parallel lines.
+type SurveyPlan struct {
+	Deployment string `json:"deployment" bson:"_id"`
+	// Cross-track tolerance in meters
+	Tolerance float64 `json:"tolerance" bson:"tolerance"`
+	// Platforms whose fixes count towards coverage; all if empty
+	Platforms []string     `json:"platforms,omitempty" bson:"platforms,omitempty"`
+	Lines     []SurveyLine `json:"lines" bson:"lines"`
+	// A polygon of [longitude, latitude] vertices is covered with lines
+	// LineSpacing meters apart, heading LineHeading degrees true
+	Polygon     [][2]float64 `json:"polygon,omitempty" bson:"polygon,omitempty"`
+	LineSpacing float64      `json:"line_spacing,omitempty" bson:"line_spacing,omitempty"`
+	LineHeading *float64     `json:"line_heading,omitempty" bson:"line_heading,omitempty"`
+	// The lines covering the polygon, generated rather than stored
+	PolygonLines []SurveyLine `json:"polygon_lines,omitempty" bson:"-"`
+	UpdatedAt    time.Time    `json:"updated_at" bson:"updated_at"`
+}
+
+// allLines returns the plan's lines followed by those covering its polygon.
+func (p *SurveyPlan) allLines() []SurveyLine {
+	return append(append([]SurveyLine{}, p.Lines...), p.PolygonLines...)
+}
+
+// generateLines covers the plan's polygon with lines.
+func (p *SurveyPlan) generateLines() {
+	p.PolygonLines = nil
+	if len(p.Polygon) < 3 || !(p.LineSpacing > 0) || p.LineHeading == nil {
+		return
+	}
+	p.PolygonLines = polygonLines(p.Polygon, p.LineSpacing, *p.LineHeading, maxSurveyLines+1)
+	for i := range p.PolygonLines {
+		p.PolygonLines[i].Name = fmt.Sprintf("polygon-%d", i+1)
+	}
+}
+
+// SurveyLine is a planned line of [longitude, latitude] positions.
+type SurveyLine struct {
+	Name        string       `json:"name" bson:"name"`
+	Coordinates [][2]float64 `json:"coordinates" bson:"coordinates"`
+}
+
+func (s *Server) initSurveyPlans() error {
+	collectionName := os.Getenv("MONGODB_SURVEY_PLANS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "survey_plans"
+	}
+	s.store.SurveyPlans = s.store.Collection(collectionName)
+	return nil
+}
+
+// validateSurveyPlan checks a plan and fills in its defaults.
+func validateSurveyPlan(plan *SurveyPlan) error {
+	if plan.Tolerance == 0 {
+		plan.Tolerance = defaultSurveyTolerance
+	}
+	if !(plan.Tolerance > 0) {
+		return fmt.Errorf("tolerance must be positive")
+	}
+
+	validPosition := func(p [2]float64) bool {
+		return p[0] >= -180 && p[0] <= 180 && p[1] >= -90 && p[1] <= 90
+	}
+	names := make(map[string]bool)
+	for i := range plan.Lines {
+		line := &plan.Lines[i]
+		if line.Name == "" {
+			line.Name = fmt.Sprintf("L%d", i+1)
+		}
+		if names[line.Name] {
+			return fmt.Errorf("duplicate line name %q", line.Name)
+		}
+		names[line.Name] = true
+		if len(line.Coordinates) < 2 {
+			return fmt.Errorf("line %q needs at least two positions", line.Name)
+		}
+		for _, p := range line.Coordinates {
+			if !validPosition(p) {
+				return fmt.Errorf("line %q has invalid position %v", line.Name, p)
+			}
+		}
+	}
+
+	if len(plan.Polygon) > 0 {
+		if len(plan.Polygon) < 3 {
+			return fmt.Errorf("polygon needs at least three vertices")
+		}
+		for _, p := range plan.Polygon {
+			if !validPosition(p) {
+				return fmt.Errorf("polygon has invalid vertex %v", p)
+			}
+		}
+		if !(plan.LineSpacing > 0) || plan.LineHeading == nil {
+			return fmt.Errorf("a polygon requires line_spacing and line_heading")
+		}
+	}
+	plan.generateLines()
+	for _, line := range plan.PolygonLines {
+		if names[line.Name] {
+			return fmt.Errorf("duplicate line name %q", line.Name)
+		}
+	}
+
+	n := len(plan.Lines) + len(plan.PolygonLines)
+	if n == 0 {
+		return fmt.Errorf("plan has no lines")
+	}
+	if n > maxSurveyLines {
+		return fmt.Errorf("plan has more than %d lines", maxSurveyLines)
+	}
+	return nil
+}
+
+// polygonLines covers a polygon with parallel lines spacing meters apart,
+// the first half a spacing in from its edge, running along heading. Lines
+// are planned on a plane tangent at the polygon's first vertex.
+func polygonLines(polygon [][2]float64, spacing, heading float64, maxLines int) []SurveyLine {
+	o := origin{Latitude: polygon[0][1], Longitude: polygon[0][0]}
+	theta := toRadians(heading)
+	// Along and across the lines, as east/north unit vectors
+	along := [2]float64{math.Sin(theta), math.Cos(theta)}
+	across := [2]float64{math.Cos(theta), -math.Sin(theta)}
+
+	type vertex struct{ u, v float64 }
+	vertices := make([]vertex, len(polygon))
+	minU, maxU := math.Inf(1), math.Inf(-1)
+	for i, p := range polygon {
+		local := toLocal(o, p[1], p[0])
+		vertices[i] = vertex{local.X*across[0] + local.Y*across[1], local.X*along[0] + local.Y*along[1]}
+		minU, maxU = math.Min(minU, vertices[i].u), math.Max(maxU, vertices[i].u)
+	}
+	toPosition := func(u, v float64) [2]float64 {
+		lat, lon := fromLocal(o, api.LocalCoordinate{X: u*across[0] + v*along[0], Y: u*across[1] + v*along[1]})
+		return [2]float64{lon, lat}
+	}
+
+	var lines []SurveyLine
+	for u := minU + spacing/2; u < maxU && len(lines) < maxLines; u += spacing {
+		// Where the line crosses the polygon's edges, paired into the
+		// stretches inside it
+		var crossings []float64
+		for i, a := range vertices {
+			b := vertices[(i+1)%len(vertices)]
+			if (a.u <= u) != (b.u <= u) {
+				crossings = append(crossings, a.v+(u-a.u)/(b.u-a.u)*(b.v-a.v))
+			}
+		}
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			lines = append(lines, SurveyLine{Coordinates: [][2]float64{toPosition(u, crossings[i]), toPosition(u, crossings[i+1])}})
+		}
+	}
+	return lines
+}
+
+func (s *Server) handlePutSurveyPlan(c *gin.Context) {
+	var plan SurveyPlan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	plan.Deployment = c.Param("deployment")
+	if err := validateSurveyPlan(&plan); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	plan.UpdatedAt = time.Now().UTC()
+
+	_, err := s.store.SurveyPlans.ReplaceOne(c.Request.Context(), bson.M{"_id": plan.Deployment}, plan, options.Replace().SetUpsert(true))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *Server) surveyPlan(ctx context.Context, deployment string) (*SurveyPlan, error) {
+	var plan SurveyPlan
+	if err := s.store.SurveyPlans.FindOne(ctx, bson.M{"_id": deployment}).Decode(&plan); err != nil {
+		return nil, err
+	}
+	plan.generateLines()
+	return &plan, nil
+}
+
+func (s *Server) handleGetSurveyPlan(c *gin.Context) {
+	deployment := c.Param("deployment")
+	if !canRead(c, deployment, "") {
+		respondErrorf(c, http.StatusForbidden, "access to deployment denied")
+		return
+	}
+	plan, err := s.surveyPlan(c.Request.Context(), deployment)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "no survey plan for deployment")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *Server) handleDeleteSurveyPlan(c *gin.Context) {
+	res, err := s.store.SurveyPlans.DeleteOne(c.Request.Context(), bson.M{"_id": c.Param("deployment")})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if res.DeletedCount == 0 {
+		respondErrorf(c, http.StatusNotFound, "no survey plan for deployment")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// LineCoverage is how much of a planned line has been run.
+type LineCoverage struct {
+	Name     string  `json:"name"`
+	Length   float64 `json:"length"`
+	Covered  float64 `json:"covered"`
+	Percent  float64 `json:"percent"`
+	Complete bool    `json:"complete"`
+}
+
+// SurveyCoverage is a deployment's progress through its survey plan.
+type SurveyCoverage struct {
+	Deployment        string   `json:"deployment"`
+	Tolerance         float64  `json:"tolerance"`
+	PlannedDistance   float64  `json:"planned_distance"`
+	CoveredDistance   float64  `json:"covered_distance"`
+	RemainingDistance float64  `json:"remaining_distance"`
+	Percent           float64  `json:"percent"`
+	LinesComplete     int      `json:"lines_complete"`
+	RemainingLines    []string `json:"remaining_lines"`
+	PaceWindow        string   `json:"pace_window"`
+	// Meters of line covered per hour over the pace window
+	Pace float64 `json:"pace"`
+	// When the remaining lines will be run at the current pace
+	ETA   string         `json:"eta,omitempty"`
+	Lines []LineCoverage `json:"lines"`
+}
+
+// planSegment is a straight part of a planned line on the tangent plane.
+type planSegment struct {
+	line       int
+	x, y       float64 // start
+	dx, dy     float64 // unit direction
+	length     float64
+	lineOffset float64 // distance along the line to the start
+}
+
+// coverageInterval is a stretch of a line run by the fix at time t.
+type coverageInterval struct {
+	from, to float64
+	t        time.Time
+}
+
+// surveyCoverage accumulates the stretches of a plan's lines run by
+// tracks. Lines and tracks are compared on a plane tangent at the plan's
+// first position, accurate over the extent of a survey.
+type surveyCoverage struct {
+	plan      *SurveyPlan
+	origin    origin
+	segments  []planSegment
+	lengths   []float64
+	intervals [][]coverageInterval
+}
+
+func newSurveyCoverage(plan *SurveyPlan, lines []SurveyLine) *surveyCoverage {
+	first := lines[0].Coordinates[0]
+	sc := &surveyCoverage{
+		plan:      plan,
+		origin:    origin{Latitude: first[1], Longitude: first[0]},
+		lengths:   make([]float64, len(lines)),
+		intervals: make([][]coverageInterval, len(lines)),
+	}
+	for i, line := range lines {
+		for j := 1; j < len(line.Coordinates); j++ {
+			a := sc.project(line.Coordinates[j-1][1], line.Coordinates[j-1][0])
+			b := sc.project(line.Coordinates[j][1], line.Coordinates[j][0])
+			length := math.Hypot(b[0]-a[0], b[1]-a[1])
+			if length == 0 {
+				continue
+			}
+			sc.segments = append(sc.segments, planSegment{
+				line: i, x: a[0], y: a[1],
+				dx: (b[0] - a[0]) / length, dy: (b[1] - a[1]) / length,
+				length: length, lineOffset: sc.lengths[i],
+			})
+			sc.lengths[i] += length
+		}
+	}
+	return sc
+}
+
+func (sc *surveyCoverage) project(lat, lon float64) [2]float64 {
+	local := toLocal(sc.origin, lat, lon)
+	return [2]float64{local.X, local.Y}
+}
+
+// addLeg records the stretches of lines run between two consecutive fixes:
+// the parts of the leg within the tolerance of a line, heading along it
+// either way.
+func (sc *surveyCoverage) addLeg(p0, p1 [2]float64, t time.Time) {
+	legX, legY := p1[0]-p0[0], p1[1]-p0[1]
+	legLength := math.Hypot(legX, legY)
+	if legLength == 0 {
+		return
+	}
+	minAlignment := math.Cos(toRadians(surveyMaxHeadingOffset))
+	tol := sc.plan.Tolerance
+	for _, seg := range sc.segments {
+		if math.Abs(legX*seg.dx+legY*seg.dy)/legLength < minAlignment {
+			continue
+		}
+		// Signed cross-track and along-track distances of the leg's ends
+		cross0 := (p0[0]-seg.x)*seg.dy - (p0[1]-seg.y)*seg.dx
+		cross1 := (p1[0]-seg.x)*seg.dy - (p1[1]-seg.y)*seg.dx
+		along0 := (p0[0]-seg.x)*seg.dx + (p0[1]-seg.y)*seg.dy
+		along1 := (p1[0]-seg.x)*seg.dx + (p1[1]-seg.y)*seg.dy
+
+		// The fraction of the leg within the tolerance
+		s0, s1 := 0.0, 1.0
+		if cross1 != cross0 {
+			a, b := (-tol-cross0)/(cross1-cross0), (tol-cross0)/(cross1-cross0)
+			s0, s1 = math.Max(s0, math.Min(a, b)), math.Min(s1, math.Max(a, b))
+		} else if math.Abs(cross0) > tol {
+			continue
+		}
+		if s0 >= s1 {
+			continue
+		}
+		from := along0 + s0*(along1-along0)
+		to := along0 + s1*(along1-along0)
+		if from > to {
+			from, to = to, from
+		}
+		from, to = math.Max(from, 0), math.Min(to, seg.length)
+		if from < to {
+			sc.intervals[seg.line] = append(sc.intervals[seg.line], coverageInterval{seg.lineOffset + from, seg.lineOffset + to, t})
+		}
+	}
+}
+
+// covered returns how much of each line was run by fixes before the time,
+// or by every fix if it is zero.
+func (sc *surveyCoverage) covered(before time.Time) []float64 {
+	covered := make([]float64, len(sc.intervals))
+	for i, intervals := range sc.intervals {
+		var run []coverageInterval
+		for _, iv := range intervals {
+			if before.IsZero() || iv.t.Before(before) {
+				run = append(run, iv)
+			}
+		}
+		sort.Slice(run, func(a, b int) bool { return run[a].from < run[b].from })
+		end := math.Inf(-1)
+		for _, iv := range run {
+			if iv.from > end {
+				covered[i] += iv.to - iv.from
+				end = iv.to
+			} else if iv.to > end {
+				covered[i] += iv.to - end
+				end = iv.to
+			}
+		}
+	}
+	return covered
+}
+
+func (s *Server) handleGetCoverage(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	if !canRead(c, deployment, "") {
+		respondErrorf(c, http.StatusForbidden, "access to deployment denied")
+		return
+	}
+
+	paceWindow := defaultSurveyPace
+	if v := c.Query("paceWindow"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid paceWindow %q", v)
+			return
+		}
+		paceWindow = d
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	plan, err := s.surveyPlan(ctx, deployment)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "no survey plan for deployment")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	filter := bson.M{"deployment": deployment}
+	if len(plan.Platforms) > 0 {
+		filter["platform"] = bson.M{"$in": plan.Platforms}
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1})
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	lines := plan.allLines()
+	sc := newSurveyCoverage(plan, lines)
+	// Fixes further apart than a track segment gap aren't joined
+	var prev *api.Location
+	var prevPos [2]float64
+	var prevTime time.Time
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		pos := sc.project(location.Latitude, location.Longitude)
+		if prev != nil && prev.Platform == location.Platform && t.Sub(prevTime) <= defaultSegmentGap {
+			sc.addLeg(prevPos, pos, t)
+		}
+		prev, prevPos, prevTime = &location, pos, t
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	covered := sc.covered(time.Time{})
+	coveredBefore := sc.covered(now.Add(-paceWindow))
+	resp := SurveyCoverage{
+		Deployment:     deployment,
+		Tolerance:      plan.Tolerance,
+		RemainingLines: []string{},
+		PaceWindow:     paceWindow.String(),
+		Lines:          make([]LineCoverage, len(lines)),
+	}
+	progress := 0.0
+	for i, line := range lines {
+		lc := LineCoverage{Name: line.Name, Length: sc.lengths[i], Covered: covered[i]}
+		if lc.Length > 0 {
+			lc.Percent = 100 * lc.Covered / lc.Length
+		}
+		lc.Complete = lc.Covered >= surveyLineComplete*lc.Length
+		if lc.Complete {
+			resp.LinesComplete++
+		} else {
+			resp.RemainingLines = append(resp.RemainingLines, line.Name)
+		}
+		resp.Lines[i] = lc
+		resp.PlannedDistance += lc.Length
+		resp.CoveredDistance += lc.Covered
+		progress += covered[i] - coveredBefore[i]
+	}
+	resp.RemainingDistance = resp.PlannedDistance - resp.CoveredDistance
+	if resp.PlannedDistance > 0 {
+		resp.Percent = 100 * resp.CoveredDistance / resp.PlannedDistance
+	}
+	resp.Pace = progress / paceWindow.Hours()
+	if resp.Pace > 0 && len(resp.RemainingLines) > 0 {
+		eta := now.Add(time.Duration(resp.RemainingDistance / resp.Pace * float64(time.Hour)))
+		resp.ETA = eta.In(loc).Format(timestampLayout)
+	}
+	c.JSON(http.StatusOK, resp)
+}
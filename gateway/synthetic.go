@@ -0,0 +1,358 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+// Movement models synthetic platforms follow
+var syntheticModels = map[string]func(r *rand.Rand) syntheticMover{
+	"transit": newTransitMover,
+	"survey":  newSurveyMover,
+	"drift":   newDriftMover,
+	"glider":  newGliderMover,
+}
+
+var syntheticModelNames = []string{"transit", "survey", "drift", "glider"}
+
+const (
+	defaultSyntheticPlatforms = 3
+	maxSyntheticPlatforms     = 100
+	defaultSyntheticDuration  = 24 * time.Hour
+	defaultSyntheticInterval  = time.Minute
+	defaultSyntheticNoise     = 5
+	defaultSyntheticDropout   = 0.02
+	defaultSyntheticGaps      = 1
+	defaultSyntheticGapLength = 30 * time.Minute
+	// Most fixes one request may generate, over all its platforms
+	maxSyntheticFixes = 2000000
+)
+
+// Deployments synthetic data may be written to, as a glob pattern, so a
+// typo can't fill a real deployment with made-up fixes
+var syntheticDeployments = "test-*"
+
+func initSynthetic() error {
+	if v := os.Getenv("TESTDATA_DEPLOYMENTS"); v != "" {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid TESTDATA_DEPLOYMENTS pattern %q", v)
+		}
+		syntheticDeployments = v
+	}
+	return nil
+}
+
+// syntheticMover moves a platform over the local plane around the origin,
+// returning its position in meters after each step of dt.
+type syntheticMover interface {
+	step(dt time.Duration) (x, y float64)
+	// Whether the platform can report its position, such as a glider at
+	// the surface
+	reporting(elapsed time.Duration) bool
+}
+
+// transitMover steams at a steady speed on a slowly wandering heading, like
+// a ship on passage.
+type transitMover struct {
+	r             *rand.Rand
+	x, y, heading float64
+	speed         float64
+}
+
+func newTransitMover(r *rand.Rand) syntheticMover {
+	return &transitMover{r: r, heading: r.Float64() * 2 * math.Pi, speed: 4 + 2*r.Float64()}
+}
+
+func (m *transitMover) step(dt time.Duration) (float64, float64) {
+	// About two degrees a minute
+	m.heading += m.r.NormFloat64() * toRadians(2) * math.Sqrt(dt.Minutes())
+	d := m.speed * dt.Seconds()
+	m.x += d * math.Sin(m.heading)
+	m.y += d * math.Cos(m.heading)
+	return m.x, m.y
+}
+
+func (m *transitMover) reporting(time.Duration) bool { return true }
+
+// surveyMover runs back and forth along parallel lines, like a vessel or
+// AUV surveying an area.
+type surveyMover struct {
+	x, y     float64
+	speed    float64
+	length   float64
+	spacing  float64
+	dir      float64
+	turning  float64
+	lineDone float64
+}
+
+func newSurveyMover(r *rand.Rand) syntheticMover {
+	return &surveyMover{speed: 2 + r.Float64(), length: 1000 + 2000*r.Float64(), spacing: 100 + 200*r.Float64(), dir: 1}
+}
+
+func (m *surveyMover) step(dt time.Duration) (float64, float64) {
+	d := m.speed * dt.Seconds()
+	for d > 0 {
+		if m.turning > 0 {
+			// Crossing over to the next line
+			moved := math.Min(d, m.turning)
+			m.x += moved
+			m.turning -= moved
+			d -= moved
+			continue
+		}
+		moved := math.Min(d, m.length-m.lineDone)
+		m.y += m.dir * moved
+		m.lineDone += moved
+		d -= moved
+		if m.lineDone >= m.length {
+			m.dir, m.lineDone, m.turning = -m.dir, 0, m.spacing
+		}
+	}
+	return m.x, m.y
+}
+
+func (m *surveyMover) reporting(time.Duration) bool { return true }
+
+// driftMover is carried by a current that veers slowly, like a drifting
+// buoy.
+type driftMover struct {
+	r                  *rand.Rand
+	x, y               float64
+	current, direction float64
+}
+
+func newDriftMover(r *rand.Rand) syntheticMover {
+	return &driftMover{r: r, current: 0.1 + 0.4*r.Float64(), direction: r.Float64() * 2 * math.Pi}
+}
+
+func (m *driftMover) step(dt time.Duration) (float64, float64) {
+	m.direction += m.r.NormFloat64() * toRadians(5) * math.Sqrt(dt.Hours())
+	m.current = math.Max(0.02, m.current+m.r.NormFloat64()*0.02*math.Sqrt(dt.Hours()))
+	d := m.current * dt.Seconds()
+	m.x += d*math.Sin(m.direction) + m.r.NormFloat64()*0.05*dt.Seconds()
+	m.y += d*math.Cos(m.direction) + m.r.NormFloat64()*0.05*dt.Seconds()
+	return m.x, m.y
+}
+
+func (m *driftMover) reporting(time.Duration) bool { return true }
+
+// gliderMover flies slowly, like a ship on passage but at a fraction of the
+// speed, and only reports its position while at the surface between dives.
+type gliderMover struct {
+	transitMover
+	dive    time.Duration
+	surface time.Duration
+	offset  time.Duration
+}
+
+func newGliderMover(r *rand.Rand) syntheticMover {
+	m := &gliderMover{dive: 3 * time.Hour, surface: 15 * time.Minute}
+	m.r, m.heading, m.speed = r, r.Float64()*2*math.Pi, 0.25+0.1*r.Float64()
+	m.offset = time.Duration(r.Int63n(int64(m.dive)))
+	return m
+}
+
+func (m *gliderMover) reporting(elapsed time.Duration) bool {
+	return (elapsed+m.offset)%(m.dive+m.surface) >= m.dive
+}
+
+type syntheticRequest struct {
+	Deployment  string   `json:"deployment" binding:"required"`
+	Platforms   int      `json:"platforms"`
+	Models      []string `json:"models"`
+	Start       string   `json:"start"`
+	Duration    string   `json:"duration"`
+	Interval    string   `json:"interval"`
+	Origin      *origin  `json:"origin"`
+	Noise       *float64 `json:"noise"`
+	Dropout     *float64 `json:"dropout"`
+	Gaps        *int     `json:"gaps"`
+	GapDuration string   `json:"gap_duration"`
+	Seed        *int64   `json:"seed"`
+}
+
+type syntheticResult struct {
+	Deployment string   `json:"deployment"`
+	Seed       int64    `json:"seed"`
+	Platforms  []string `json:"platforms"`
+	Inserted   int64    `json:"inserted"`
+	Rejected   int64    `json:"rejected"`
+}
+
+// syntheticPlatform is one platform to generate, with its fixes.
+type syntheticPlatform struct {
+	name  string
+	fixes []logFix
+}
+
+// handleGenerateTestData fills a test deployment with synthetic platforms,
+// for load testing dashboards and downstream consumers. The fixes are
+// generated up front and stored by a background job, the way a log import
+// stores them.
+func (s *Server) handleGenerateTestData(c *gin.Context) {
+	var req syntheticRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if ok, _ := path.Match(syntheticDeployments, req.Deployment); !ok {
+		respondErrorf(c, http.StatusBadRequest, "test data can only be written to deployments matching %q", syntheticDeployments)
+		return
+	}
+
+	platforms := defaultSyntheticPlatforms
+	if req.Platforms != 0 {
+		platforms = req.Platforms
+	}
+	if platforms < 1 || platforms > maxSyntheticPlatforms {
+		respondErrorf(c, http.StatusBadRequest, "platforms must be between 1 and %d", maxSyntheticPlatforms)
+		return
+	}
+	models := req.Models
+	if len(models) == 0 {
+		models = syntheticModelNames
+	}
+	for _, model := range models {
+		if _, ok := syntheticModels[model]; !ok {
+			respondErrorf(c, http.StatusBadRequest, "unknown model %q (expected transit, survey, drift, or glider)", model)
+			return
+		}
+	}
+	duration, interval, gapLength := defaultSyntheticDuration, defaultSyntheticInterval, defaultSyntheticGapLength
+	for _, p := range []struct {
+		name, value string
+		d           *time.Duration
+	}{
+		{"duration", req.Duration, &duration},
+		{"interval", req.Interval, &interval},
+		{"gap_duration", req.GapDuration, &gapLength},
+	} {
+		if p.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(p.value)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid %s %q", p.name, p.value)
+			return
+		}
+		*p.d = d
+	}
+	if interval < time.Second {
+		respondErrorf(c, http.StatusBadRequest, "interval must be at least 1s")
+		return
+	}
+	if n := int64(platforms) * int64(duration/interval); n > maxSyntheticFixes {
+		respondErrorf(c, http.StatusBadRequest, "%d platforms over %s at %s would generate %d fixes, more than the maximum of %d", platforms, duration, interval, n, maxSyntheticFixes)
+		return
+	}
+	start := time.Now().UTC().Truncate(time.Second).Add(-duration)
+	if req.Start != "" {
+		t, err := parseTimestamp(req.Start)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid start: %v", err)
+			return
+		}
+		start = t.UTC()
+	}
+
+	// Null Island unless an origin is given or configured
+	o := deploymentOrigins[req.Deployment]
+	if req.Origin != nil {
+		o = *req.Origin
+	}
+	if o.Latitude < -80 || o.Latitude > 80 || o.Longitude < -180 || o.Longitude > 180 {
+		respondErrorf(c, http.StatusBadRequest, "origin must be within 80 degrees of the equator")
+		return
+	}
+	noise, dropout, gaps := float64(defaultSyntheticNoise), defaultSyntheticDropout, defaultSyntheticGaps
+	if req.Noise != nil {
+		noise = *req.Noise
+	}
+	if req.Dropout != nil {
+		dropout = *req.Dropout
+	}
+	if req.Gaps != nil {
+		gaps = *req.Gaps
+	}
+	if noise < 0 || dropout < 0 || dropout >= 1 || gaps < 0 {
+		respondErrorf(c, http.StatusBadRequest, "noise and gaps must not be negative, and dropout must be from 0 to less than 1")
+		return
+	}
+	seed := time.Now().UnixNano()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	generated := make([]syntheticPlatform, platforms)
+	var total int64
+	for i := range generated {
+		model := models[i%len(models)]
+		mover := syntheticModels[model](r)
+		// Platforms start spread over a few kilometers of the origin
+		x0, y0 := r.NormFloat64()*2000, r.NormFloat64()*2000
+		var outages [][2]time.Duration
+		for g := 0; g < gaps; g++ {
+			at := time.Duration(r.Int63n(int64(duration)))
+			outages = append(outages, [2]time.Duration{at, at + gapLength})
+		}
+
+		p := syntheticPlatform{name: fmt.Sprintf("%s-%02d", model, i+1)}
+		for elapsed := time.Duration(0); elapsed <= duration; elapsed += interval {
+			x, y := 0.0, 0.0
+			if elapsed > 0 {
+				x, y = mover.step(interval)
+			}
+			if !mover.reporting(elapsed) || r.Float64() < dropout || inOutage(outages, elapsed) {
+				continue
+			}
+			lat, lon := fromLocal(o, api.LocalCoordinate{X: x0 + x + r.NormFloat64()*noise, Y: y0 + y + r.NormFloat64()*noise})
+			p.fixes = append(p.fixes, logFix{Time: start.Add(elapsed), Latitude: lat, Longitude: normalizeLongitude(lon), Source: "synthetic"})
+		}
+		total += int64(len(p.fixes))
+		generated[i] = p
+	}
+
+	deployment := req.Deployment
+	job := s.startJob("testdata", func(progress func(done, total int64)) (interface{}, error) {
+		result := syntheticResult{Deployment: deployment, Seed: seed, Platforms: []string{}}
+		for _, p := range generated {
+			result.Platforms = append(result.Platforms, p.name)
+			if len(p.fixes) == 0 {
+				continue
+			}
+			done := result.Inserted + result.Rejected
+			imported, err := s.importFixes(deployment, p.name, "", p.fixes, func(n, _ int64) {
+				progress(done+n, total)
+			})
+			result.Inserted += imported.Inserted
+			result.Rejected += imported.Rejected
+			if err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// inOutage reports whether elapsed falls in one of the outages.
+func inOutage(outages [][2]time.Duration, elapsed time.Duration) bool {
+	for _, outage := range outages {
+		if elapsed >= outage[0] && elapsed < outage[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// storeTelemetry stores the data sent with a stored fix, replacing any
+// stored with an earlier version of the fix, or removing it if the new
+// version has none.
+func (s *Server) storeTelemetry(ctx context.Context, location *api.Location) error {
+	if len(location.Data) == 0 {
+		_, err := s.store.Telemetry.DeleteOne(ctx, bson.M{"location_id": location.ID})
+		return err
+	}
+	record := api.Telemetry{
+		Deployment: location.Deployment,
+		Platform:   location.Platform,
+		Timestamp:  location.Timestamp,
+		LocationID: location.ID,
+		Data:       location.Data,
+		CreatedAt:  location.CreatedAt,
+	}
+	_, err := s.store.Telemetry.ReplaceOne(ctx, bson.M{"location_id": location.ID}, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *Server) handleGetTelemetry(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	limit, offset, explicitLimit, err := s.parseLimit(c.Query("limit"), c.Query("offset"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	after, err := timestampOrder.parseAfter(c, offset)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	opts := options.Find().SetSort(timestampOrder.sort()).SetSkip(offset)
+	if explicitLimit {
+		opts.SetLimit(limit)
+	} else {
+		opts.SetLimit(limit + 1)
+	}
+
+	ctx := c.Request.Context()
+	cursor, err := s.store.Telemetry.Find(ctx, scopedFilter(c, afterFilter(filter, after)), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	results := []api.Telemetry{}
+	if err = cursor.All(ctx, &results); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(results)) > limit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(limit))
+		return
+	}
+	timestampOrder.setPageHeaders(c, int64(len(results)), limit, explicitLimit, func() (interface{}, primitive.ObjectID) {
+		last := results[len(results)-1]
+		return last.Timestamp, last.ID
+	})
+
+	for i := range results {
+		results[i].Timestamp = formatTimestamp(results[i].Timestamp, loc)
+		results[i].CreatedAt = results[i].CreatedAt.In(loc)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// Telemetry records copy these fields from their fix
+var telemetryFixFields = []string{"deployment", "platform", "timestamp"}
+
+// syncTelemetry applies the renames and timestamp shift of a bulk update
+// pipeline to the telemetry of the given fixes.
+func (s *Server) syncTelemetry(ctx context.Context, ids []primitive.ObjectID, pipeline bson.A) error {
+	set := bson.M{}
+	for _, stage := range pipeline {
+		for _, field := range telemetryFixFields {
+			if v, ok := stage.(bson.M)["$set"].(bson.M)[field]; ok {
+				set[field] = v
+			}
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+
+	for start := 0; start < len(ids); start += importBatchSize {
+		batch := ids[start:min(start+importBatchSize, len(ids))]
+		if _, err := s.store.Telemetry.UpdateMany(ctx, bson.M{"location_id": bson.M{"$in": batch}}, bson.A{bson.M{"$set": set}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// locationIDs returns the IDs of the fixes matching filter.
+func (s *Server) locationIDs(ctx context.Context, filter bson.M) ([]primitive.ObjectID, error) {
+	cursor, err := s.store.Locations.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids, nil
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var tileIndexPattern = regexp.MustCompile(`^[0-9]+$`)
+var tileNamePattern = regexp.MustCompile(`^[0-9]+(\.(png|jpg|jpeg|webp|pbf|mvt))?$`)
+
+func (s *Server) initTiles() error {
+	// Tiles are only served when a local tile directory is configured
+	s.tilesDir = os.Getenv("TILES_DIR")
+	if s.tilesDir == "" {
+		return nil
+	}
+
+	// Optional upstream tile server used to fill the cache, e.g.
+	// https://tile.openstreetmap.org/{z}/{x}/{y}.png
+	s.tilesUpstream = os.Getenv("TILES_UPSTREAM_URL")
+	return nil
+}
+
+func (s *Server) handleGetTile(c *gin.Context) {
+	z := c.Param("z")
+	x := c.Param("x")
+	y := c.Param("y")
+
+	// Only accept numeric path segments so requests can't escape the tile directory
+	if !tileIndexPattern.MatchString(z) || !tileIndexPattern.MatchString(x) || !tileNamePattern.MatchString(y) {
+		respondErrorf(c, http.StatusBadRequest, "invalid tile coordinates")
+		return
+	}
+
+	path := filepath.Join(s.tilesDir, z, x, y)
+	if _, err := os.Stat(path); err == nil {
+		c.Header("Cache-Control", "public, max-age=86400")
+		c.File(path)
+		return
+	}
+
+	if s.tilesUpstream == "" {
+		respondErrorf(c, http.StatusNotFound, "tile not found")
+		return
+	}
+
+	if err := s.fetchTile(z, x, y, path); err != nil {
+		respondError(c, http.StatusBadGateway, err)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.File(path)
+}
+
+// fetchTile downloads a tile from the upstream server into the local cache.
+func (s *Server) fetchTile(z, x, y, path string) error {
+	yNum := strings.SplitN(y, ".", 2)[0]
+	url := strings.NewReplacer("{z}", z, "{x}", x, "{y}", yNum).Replace(s.tilesUpstream)
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("error fetching upstream tile: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream tile server returned %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating tile directory: %v", err)
+	}
+
+	// Write to a temporary file first so a failed download never leaves a partial tile
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tile-*")
+	if err != nil {
+		return fmt.Errorf("error creating tile file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing tile: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing tile: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error saving tile: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const defaultTimeseriesBucket = time.Hour
+
+// TimeseriesPoint is a metric over one bucket of time.
+type TimeseriesPoint struct {
+	// Start of the bucket
+	Time string `json:"time"`
+	// Fixes in the bucket, or with metric=speed, the average speed over
+	// ground between them
+	Value float64 `json:"value"`
+	// Fastest speed between consecutive fixes, with metric=speed
+	Max *float64 `json:"max,omitempty"`
+}
+
+// TimeseriesSeries is one platform's time series.
+type TimeseriesSeries struct {
+	Deployment string            `json:"deployment"`
+	Platform   string            `json:"platform"`
+	Points     []TimeseriesPoint `json:"points"`
+}
+
+type TimeseriesResponse struct {
+	Metric string             `json:"metric"`
+	Bucket string             `json:"bucket"`
+	Units  *UnitSystem        `json:"units,omitempty"`
+	Source string             `json:"source"`
+	Series []TimeseriesSeries `json:"series"`
+}
+
+// handleGetTimeseries buckets each platform's fixes over time, counting them
+// or averaging their speed, for plotting fix rates and speeds. Buckets of
+// whole minutes or hours over long ranges are summed from rollups.
+func (s *Server) handleGetTimeseries(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		if !canRead(c, deployment, platform) {
+			respondErrorf(c, http.StatusForbidden, "access to platform denied")
+			return
+		}
+		filter["platform"] = platform
+	}
+
+	metric := c.DefaultQuery("metric", "count")
+	if metric != "count" && metric != "speed" {
+		respondErrorf(c, http.StatusBadRequest, "metric must be count or speed")
+		return
+	}
+	bucket := defaultTimeseriesBucket
+	if v := c.Query("bucket"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second || d%time.Second != 0 || d > 7*24*time.Hour {
+			respondErrorf(c, http.StatusBadRequest, "bucket must be a whole number of seconds up to 168h")
+			return
+		}
+		bucket = d
+	}
+	units, err := parseUnits(c.Query("units"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if start != "" {
+		// Whole buckets, so the first isn't cut short
+		t, _ := parseTimestamp(start)
+		start = t.Truncate(bucket).Format(timestampLayout)
+	}
+
+	source, coll := sourceRaw, s.store.Locations
+	if useRollups(start, end) && bucket%time.Minute == 0 {
+		// Fall back to hours where the minute tier has been pruned
+		minutesPruned := minuteRetention > 0 && (start == "" || start < time.Now().UTC().Add(-minuteRetention).Format(timestampLayout))
+		switch {
+		case bucket%time.Hour == 0:
+			source, coll = sourceRollups, s.store.HourlyRollups
+		case !minutesPruned:
+			source, coll = sourceRollups, s.store.MinuteRollups
+		}
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}})
+	if source == sourceRaw {
+		opts.SetProjection(bson.M{"deployment": 1, "platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1})
+	}
+	cursor, err := coll.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	resp := TimeseriesResponse{Metric: metric, Bucket: bucket.String(), Source: source, Series: []TimeseriesSeries{}}
+	if metric == "speed" {
+		resp.Units = &units
+	}
+	var series *TimeseriesSeries
+	var current PositionRollup
+	var currentTime time.Time
+	points := 0
+	flush := func() {
+		if current.Count == 0 {
+			return
+		}
+		current.finish()
+		point := TimeseriesPoint{Time: currentTime.In(loc).Format(timestampLayout), Value: float64(current.Count)}
+		if metric == "speed" {
+			// A speed needs two fixes
+			if current.Duration == 0 {
+				current = PositionRollup{}
+				return
+			}
+			point.Value = units.Speed(current.AverageSpeed)
+			fastest := units.Speed(current.MaxSpeed)
+			point.Max = &fastest
+		}
+		series.Points = append(series.Points, point)
+		points++
+		current = PositionRollup{}
+	}
+	for cursor.Next(ctx) {
+		var rollup PositionRollup
+		if source == sourceRaw {
+			var location api.Location
+			if err := cursor.Decode(&location); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			rollup.Deployment, rollup.Platform, rollup.Timestamp = location.Deployment, location.Platform, location.Timestamp
+			rollup.add(&location)
+			rollup.finish()
+		} else if err := cursor.Decode(&rollup); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		t, err := parseTimestamp(rollup.Timestamp)
+		if err != nil {
+			continue
+		}
+		t = t.Truncate(bucket)
+
+		if series == nil || rollup.Platform != series.Platform {
+			flush()
+			resp.Series = append(resp.Series, TimeseriesSeries{Deployment: rollup.Deployment, Platform: rollup.Platform, Points: []TimeseriesPoint{}})
+			series = &resp.Series[len(resp.Series)-1]
+		} else if !t.Equal(currentTime) {
+			flush()
+			if metric == "count" {
+				// Empty buckets count as none, so plots drop to zero across gaps
+				for gap := currentTime.Add(bucket); gap.Before(t) && points <= int(s.maxResultLimit); gap = gap.Add(bucket) {
+					series.Points = append(series.Points, TimeseriesPoint{Time: gap.In(loc).Format(timestampLayout)})
+					points++
+				}
+			}
+		}
+		if int64(points) > s.maxResultLimit {
+			respondErrorf(c, http.StatusRequestEntityTooLarge, "time series have more than %d points; use a larger bucket or narrow the query", s.maxResultLimit)
+			return
+		}
+		currentTime = t
+		current.merge(rollup)
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	flush()
+
+	c.JSON(http.StatusOK, resp)
+}
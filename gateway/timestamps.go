@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+	// Embed the timezone database since the runtime image doesn't ship one
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/api"
+)
+
+// timestampLayout is the fixed-width UTC format timestamps are stored in, so
+// that string ordering in Mongo matches chronological ordering.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// timestampLayouts are the ISO 8601 variants accepted in location timestamps.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+// zonelessTimestampLayouts are accepted variants that carry no zone offset.
+var zonelessTimestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseTimestamp parses an ISO 8601 timestamp. Timestamps without a zone
+// offset are taken to be UTC.
+func parseTimestamp(value string) (time.Time, error) {
+	return parseTimestampIn(value, time.UTC)
+}
+
+// parseTimestampIn parses an ISO 8601 timestamp, interpreting timestamps
+// without a zone offset in loc.
+func parseTimestampIn(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range zonelessTimestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// normalizeTimestamp converts an ISO 8601 timestamp to the UTC storage format.
+func normalizeTimestamp(value string, loc *time.Location) (string, error) {
+	t, err := parseTimestampIn(value, loc)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(timestampLayout), nil
+}
+
+// requestTimezone returns the timezone requested with the tz query parameter
+// or the X-Timezone header, defaulting to UTC.
+func requestTimezone(c *gin.Context) (*time.Location, error) {
+	name := c.Query("tz")
+	if name == "" {
+		name = c.GetHeader("X-Timezone")
+	}
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// formatTimestamp renders a stored timestamp in loc. Values that cannot be
+// parsed are returned unchanged.
+func formatTimestamp(value string, loc *time.Location) string {
+	if loc == time.UTC {
+		return value
+	}
+	t, err := parseTimestamp(value)
+	if err != nil {
+		return value
+	}
+	return t.In(loc).Format(timestampLayout)
+}
+
+func localizeLocation(location *api.Location, loc *time.Location) {
+	location.Timestamp = formatTimestamp(location.Timestamp, loc)
+	if location.ReceivedAt != "" {
+		location.ReceivedAt = formatTimestamp(location.ReceivedAt, loc)
+	}
+	if location.ReportedTimestamp != "" {
+		location.ReportedTimestamp = formatTimestamp(location.ReportedTimestamp, loc)
+	}
+	location.CreatedAt = location.CreatedAt.In(loc)
+}
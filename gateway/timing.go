@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Requests carrying this header get a Server-Timing breakdown in the
+// response, if the caller is an admin
+const timingHeader = "X-Debug-Timing"
+
+type timingsKey struct{}
+
+// requestTimings accumulates where a request spent its time.
+type requestTimings struct {
+	start time.Time
+
+	mu      sync.Mutex
+	db      time.Duration
+	queries int
+	docs    int64
+}
+
+func requestTimingsFrom(ctx context.Context) *requestTimings {
+	t, _ := ctx.Value(timingsKey{}).(*requestTimings)
+	return t
+}
+
+func (t *requestTimings) recordQuery(d time.Duration, docs int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.db += d
+	t.queries++
+	t.docs += docs
+}
+
+// timingMonitor attributes MongoDB command time to the request whose context
+// issued the command.
+var timingMonitor = &event.CommandMonitor{
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		if t := requestTimingsFrom(ctx); t != nil {
+			t.recordQuery(e.Duration, countReplyDocs(e.Reply))
+		}
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		if t := requestTimingsFrom(ctx); t != nil {
+			t.recordQuery(e.Duration, 0)
+		}
+	},
+}
+
+// countReplyDocs counts the documents a command returned: cursor batches for
+// find, aggregate and getMore, or values for distinct.
+func countReplyDocs(reply bson.Raw) int64 {
+	for _, path := range [][]string{{"cursor", "firstBatch"}, {"cursor", "nextBatch"}, {"values"}} {
+		if v, err := reply.LookupErr(path...); err == nil {
+			if arr, ok := v.ArrayOK(); ok {
+				values, _ := arr.Values()
+				return int64(len(values))
+			}
+		}
+	}
+	return 0
+}
+
+// serverTiming collects timings for requests that ask for them.
+func (s *Server) serverTiming() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(timingHeader) == "" {
+			c.Next()
+			return
+		}
+
+		t := &requestTimings{start: time.Now()}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), timingsKey{}, t))
+		c.Writer = &timingWriter{ResponseWriter: c.Writer, c: c, timings: t, adminOnly: s.authEnabled}
+		c.Next()
+	}
+}
+
+// timingWriter adds the Server-Timing header just before the response
+// headers go out. Handlers set the status before encoding the body, so the
+// time between the two is serialization.
+type timingWriter struct {
+	gin.ResponseWriter
+	c        *gin.Context
+	timings  *requestTimings
+	statusAt time.Time
+	sent     bool
+	// Whether only admins may see timings, as when authentication is on
+	adminOnly bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if w.statusAt.IsZero() {
+		w.statusAt = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) WriteHeaderNow() {
+	w.addHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *timingWriter) Write(data []byte) (int, error) {
+	w.addHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timingWriter) WriteString(s string) (int, error) {
+	w.addHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *timingWriter) addHeader() {
+	if w.sent || w.ResponseWriter.Written() {
+		return
+	}
+	w.sent = true
+
+	// Timings reveal query behaviour, so only admins may see them
+	if cred := requestCredential(w.c); w.adminOnly && (cred == nil || cred.Role != roleAdmin) {
+		return
+	}
+
+	now := time.Now()
+	total := now.Sub(w.timings.start)
+	var encode time.Duration
+	if !w.statusAt.IsZero() {
+		encode = now.Sub(w.statusAt)
+	}
+
+	w.timings.mu.Lock()
+	db, queries, docs := w.timings.db, w.timings.queries, w.timings.docs
+	w.timings.mu.Unlock()
+
+	app := total - db - encode
+	if app < 0 {
+		app = 0
+	}
+
+	metrics := []string{
+		fmt.Sprintf(`db;dur=%.2f;desc="%d queries"`, ms(db), queries),
+		fmt.Sprintf(`app;dur=%.2f`, ms(app)),
+		fmt.Sprintf(`encode;dur=%.2f`, ms(encode)),
+		fmt.Sprintf(`total;dur=%.2f`, ms(total)),
+		fmt.Sprintf(`docs;desc="%d"`, docs),
+	}
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Layback models for towed platforms
+const (
+	// Directly astern of the tow vessel along its current heading
+	towAstern = "astern"
+	// Along the tow vessel's own track, so the towed body follows the
+	// vessel through turns
+	towTrack = "track"
+)
+
+// towConfig positions a platform without its own fixes relative to the
+// vessel towing it. Layback is measured behind the vessel and offset to
+// starboard of its track, both in meters.
+type towConfig struct {
+	Deployment string  `json:"deployment"`
+	Platform   string  `json:"platform"`
+	TowedBy    string  `json:"towed_by"`
+	Model      string  `json:"model"`
+	Layback    float64 `json:"layback"`
+	Offset     float64 `json:"offset"`
+}
+
+const sourceLayback = "layback"
+
+// Longest stretch of the vessel's track walked back for the track model
+const maxTowTrackFixes = 1000
+
+var tows []towConfig
+
+func initTows() error {
+	configPath := os.Getenv("TOW_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading TOW_CONFIG: %v", err)
+	}
+	var cfg struct {
+		Tows []towConfig `json:"tows"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing TOW_CONFIG: %v", err)
+	}
+
+	for i, tow := range cfg.Tows {
+		if tow.Platform == "" || tow.TowedBy == "" {
+			return fmt.Errorf("tow %d: platform and towed_by are required", i)
+		}
+		if tow.Platform == tow.TowedBy {
+			return fmt.Errorf("tow %d: platform %q can't tow itself", i, tow.Platform)
+		}
+		if _, err := path.Match(tow.Deployment, ""); err != nil {
+			return fmt.Errorf("tow %d: invalid deployment pattern %q", i, tow.Deployment)
+		}
+		switch tow.Model {
+		case "":
+			cfg.Tows[i].Model = towTrack
+		case towAstern, towTrack:
+		default:
+			return fmt.Errorf("tow %d: model must be astern or track", i)
+		}
+		if tow.Layback < 0 {
+			return fmt.Errorf("tow %d: layback must not be negative", i)
+		}
+	}
+	tows = cfg.Tows
+	return nil
+}
+
+// storeTowedFixes positions the platforms towed by the vessel that reported
+// a fix, and stores their fixes at the same time as the vessel's. Failures
+// are logged rather than failing the vessel's ingest.
+func (s *Server) storeTowedFixes(ctx context.Context, vessel *api.Location) {
+	for _, tow := range tows {
+		if tow.TowedBy != vessel.Platform {
+			continue
+		}
+		if ok, _ := path.Match(tow.Deployment, vessel.Deployment); tow.Deployment != "" && !ok {
+			continue
+		}
+
+		towed, err := s.towPosition(ctx, tow, vessel)
+		if err != nil {
+			s.logger.Printf("error positioning towed platform %s: %v", tow.Platform, err)
+			continue
+		}
+		if towed == nil {
+			continue
+		}
+		unlock := s.platformLocks.lock(towed.Deployment, towed.Platform)
+		if err := s.storeTowedFix(ctx, towed); err != nil {
+			s.logger.Printf("error storing fix for towed platform %s: %v", tow.Platform, err)
+		}
+		unlock()
+	}
+}
+
+// towPosition computes the towed platform's position when the vessel is at
+// the given fix, or nil if the vessel's heading or track isn't known yet.
+func (s *Server) towPosition(ctx context.Context, tow towConfig, vessel *api.Location) (*api.Location, error) {
+	var lat, lon, course float64
+	switch tow.Model {
+	case towAstern:
+		heading := headingOrCourse(vessel)
+		if heading == nil {
+			return nil, nil
+		}
+		course = *heading
+		lat, lon = destinationPoint(vessel.Latitude, vessel.Longitude, course+180, tow.Layback)
+	case towTrack:
+		var ok bool
+		var err error
+		lat, lon, course, ok, err = s.walkBackTrack(ctx, vessel, tow.Layback)
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+	if tow.Offset != 0 {
+		lat, lon = destinationPoint(lat, lon, course+90, tow.Offset)
+	}
+
+	towed := &api.Location{
+		Deployment: vessel.Deployment,
+		Platform:   tow.Platform,
+		Latitude:   lat,
+		Longitude:  lon,
+		Timestamp:  vessel.Timestamp,
+		Source:     sourceLayback,
+		CRS:        crsWGS84,
+		ReceivedAt: vessel.ReceivedAt,
+		Latency:    vessel.Latency,
+		CommsPath:  vessel.CommsPath,
+	}
+	towed.SetDerived("towed_by", vessel.Platform)
+	towed.SetDerived("layback_model", tow.Model)
+	return towed, nil
+}
+
+// walkBackTrack finds the point distance meters back along the vessel's
+// track from its current fix, and the vessel's course there. ok is false if
+// the recorded track is shorter than distance.
+func (s *Server) walkBackTrack(ctx context.Context, vessel *api.Location, distance float64) (lat, lon, course float64, ok bool, err error) {
+	filter := bson.M{
+		"deployment": vessel.Deployment,
+		"platform":   vessel.Platform,
+		"timestamp":  bson.M{"$lt": vessel.Timestamp},
+		"backfilled": bson.M{"$ne": true},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetProjection(bson.M{"latitude": 1, "longitude": 1}).
+		SetLimit(maxTowTrackFixes)
+	cursor, err := s.store.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	defer cursor.Close(ctx)
+
+	remaining := distance
+	next := vessel
+	for cursor.Next(ctx) {
+		var prev api.Location
+		if err := cursor.Decode(&prev); err != nil {
+			return 0, 0, 0, false, err
+		}
+		segment := haversine(prev.Latitude, prev.Longitude, next.Latitude, next.Longitude)
+		if segment == 0 {
+			continue
+		}
+		course = initialBearing(prev.Latitude, prev.Longitude, next.Latitude, next.Longitude)
+		if segment >= remaining {
+			// Step back from the later fix towards the earlier one
+			back := initialBearing(next.Latitude, next.Longitude, prev.Latitude, prev.Longitude)
+			lat, lon = destinationPoint(next.Latitude, next.Longitude, back, remaining)
+			return lat, lon, course, true, nil
+		}
+		remaining -= segment
+		p := prev
+		next = &p
+	}
+	return 0, 0, 0, false, cursor.Err()
+}
+
+// storeTowedFix derives the towed fix's speed and heading and stores it,
+// replacing any earlier fix computed for the same time.
+func (s *Server) storeTowedFix(ctx context.Context, towed *api.Location) error {
+	filter := bson.M{"deployment": towed.Deployment, "platform": towed.Platform, "timestamp": towed.Timestamp}
+	var existing api.Location
+	err := s.store.Locations.FindOne(ctx, filter).Decode(&existing)
+	if err == nil {
+		towed.ID = existing.ID
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if err := s.deriveFields(ctx, towed); err != nil {
+		return err
+	}
+	towed.CreatedAt = time.Now()
+
+	if towed.ID.IsZero() {
+		res, err := s.store.Locations.InsertOne(ctx, towed)
+		if err != nil {
+			return err
+		}
+		towed.ID = res.InsertedID.(primitive.ObjectID)
+		s.facetCache.added(towed.Deployment, towed.Platform)
+		s.recordChanges(ctx, locationChange(changeInsert, towed))
+	} else if _, err := s.store.Locations.ReplaceOne(ctx, bson.M{"_id": towed.ID}, towed); err != nil {
+		return err
+	} else {
+		s.recordChanges(ctx, locationChange(changeUpdate, towed))
+	}
+
+	event := streamEvent{Type: eventLocation, Location: *towed}
+	if towed.Backfilled {
+		event.Type = eventBackfill
+	}
+	s.publishStream(event)
+	return nil
+}
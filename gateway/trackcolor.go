@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// trackVariable is a value of each fix that colorized tracks are colored
+// by: a field of the fix, a value derived from it, or its telemetry.
+type trackVariable struct {
+	name string
+	// Field the fix's value is read from, for the projection
+	field string
+	// Key of the fix's telemetry data, for data.<key>
+	telemetry string
+	// Whether the value is an angle in degrees, averaged around the circle
+	angle bool
+	value func(location api.Location, data map[string]interface{}) (float64, bool)
+}
+
+// parseTrackVariable parses the colorBy parameter of GET /api/tracks.
+func parseTrackVariable(name string) (*trackVariable, error) {
+	pointer := func(f func(api.Location) *float64) func(api.Location, map[string]interface{}) (float64, bool) {
+		return func(location api.Location, _ map[string]interface{}) (float64, bool) {
+			if v := f(location); v != nil {
+				return *v, true
+			}
+			return 0, false
+		}
+	}
+	switch name {
+	case "speed":
+		return &trackVariable{name: name, field: name, value: pointer(func(l api.Location) *float64 { return l.Speed })}, nil
+	case "course":
+		return &trackVariable{name: name, field: name, angle: true, value: pointer(func(l api.Location) *float64 { return l.Course })}, nil
+	case "heading":
+		return &trackVariable{name: name, field: name, angle: true, value: pointer(func(l api.Location) *float64 { return l.Heading })}, nil
+	case "pitch":
+		return &trackVariable{name: name, field: name, value: pointer(func(l api.Location) *float64 { return l.Pitch })}, nil
+	case "roll":
+		return &trackVariable{name: name, field: name, value: pointer(func(l api.Location) *float64 { return l.Roll })}, nil
+	case "latency":
+		return &trackVariable{name: name, field: name, value: pointer(func(l api.Location) *float64 { return l.Latency })}, nil
+	}
+	if key, ok := strings.CutPrefix(name, "derived."); ok && key != "" {
+		return &trackVariable{name: name, field: "derived", value: func(location api.Location, _ map[string]interface{}) (float64, bool) {
+			return numericValue(location.Derived[key])
+		}}, nil
+	}
+	if key, ok := strings.CutPrefix(name, "data."); ok && key != "" {
+		return &trackVariable{name: name, telemetry: key, value: func(_ api.Location, data map[string]interface{}) (float64, bool) {
+			return numericValue(data[key])
+		}}, nil
+	}
+	return nil, fmt.Errorf("invalid colorBy %q (expected speed, course, heading, pitch, roll, latency, derived.<name> or data.<name>)", name)
+}
+
+// numericValue returns a stored value as a number, if it is one.
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, !math.IsNaN(n)
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Fixes whose telemetry is looked up at once
+const trackTelemetryBatch = 1000
+
+// trackTelemetry returns the telemetry data of fixes, by fix ID.
+func (s *Server) trackTelemetry(ctx context.Context, locations []api.Location) (map[primitive.ObjectID]map[string]interface{}, error) {
+	data := make(map[primitive.ObjectID]map[string]interface{})
+	opts := options.Find().SetProjection(bson.M{"location_id": 1, "data": 1})
+	for start := 0; start < len(locations); start += trackTelemetryBatch {
+		batch := locations[start:min(start+trackTelemetryBatch, len(locations))]
+		ids := make(bson.A, len(batch))
+		for i, location := range batch {
+			ids[i] = location.ID
+		}
+		cursor, err := s.store.Telemetry.Find(ctx, bson.M{"location_id": bson.M{"$in": ids}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var records []api.Telemetry
+		if err := cursor.All(ctx, &records); err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			data[record.LocationID] = record.Data
+		}
+	}
+	return data, nil
+}
+
+// colorizedFeatureCollection converts fixes sorted by platform and timestamp
+// to GeoJSON with a LineString feature, or a MultiLineString where it
+// crosses the antimeridian, from each fix to the next within a segment. Each
+// carries the variable's mean over its two fixes as its value, so map
+// clients can color tracks by it directly. It returns the collection's
+// members other than the features, the features, and the number of
+// positions in them.
+func colorizedFeatureCollection(locations []api.Location, telemetry map[primitive.ObjectID]map[string]interface{}, variable *trackVariable, segmentGap time.Duration, densify float64, loc *time.Location) (gin.H, []gin.H, int) {
+	features := []gin.H{}
+	positions := 0
+	low, high := math.Inf(1), math.Inf(-1)
+	var prev *api.Location
+	var prevTime time.Time
+	for i := range locations {
+		location := &locations[i]
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		if prev != nil && prev.Platform == location.Platform && t.Sub(prevTime) <= segmentGap {
+			line := [][2]float64{{prev.Longitude, prev.Latitude}, {location.Longitude, location.Latitude}}
+			if densify > 0 {
+				line = densifyLine(line, densify)
+			}
+			positions += len(line)
+
+			var value interface{}
+			a, okA := variable.value(*prev, telemetry[prev.ID])
+			b, okB := variable.value(*location, telemetry[location.ID])
+			switch {
+			case okA && okB && variable.angle:
+				// So the mean of 350° and 10° is 0°, not 180°
+				mean := math.Atan2(math.Sin(toRadians(a))+math.Sin(toRadians(b)), math.Cos(toRadians(a))+math.Cos(toRadians(b)))
+				value = math.Mod(toDegrees(mean)+360, 360)
+			case okA && okB:
+				value = (a + b) / 2
+			case okA:
+				value = a
+			case okB:
+				value = b
+			}
+			if v, ok := value.(float64); ok {
+				low, high = math.Min(low, v), math.Max(high, v)
+			}
+
+			geometry := gin.H{"type": "LineString", "coordinates": line}
+			if parts := splitAntimeridian(line); len(parts) > 1 {
+				geometry = gin.H{"type": "MultiLineString", "coordinates": parts}
+			}
+			features = append(features, gin.H{
+				"type":     "Feature",
+				"geometry": geometry,
+				"properties": gin.H{
+					"deployment": location.Deployment,
+					"platform":   location.Platform,
+					"start":      formatTimestamp(prev.Timestamp, loc),
+					"end":        formatTimestamp(location.Timestamp, loc),
+					"value":      value,
+				},
+			})
+		}
+		prev, prevTime = location, t
+	}
+
+	collection := gin.H{"type": "FeatureCollection", "color_by": variable.name}
+	if low <= high {
+		collection["range"] = [2]float64{low, high}
+	}
+	return collection, features, positions
+}
@@ -0,0 +1,330 @@
+package gateway
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+// Default gap between consecutive fixes at which a track is split, so map
+// clients don't draw a straight line across an interval the platform wasn't
+// reporting
+const defaultSegmentGap = 10 * time.Minute
+
+// Track is a platform's fixes as a line split into segments wherever
+// consecutive fixes are further apart than the segment gap.
+type Track struct {
+	Deployment string         `json:"deployment"`
+	Platform   string         `json:"platform"`
+	Segments   []TrackSegment `json:"segments"`
+	// Coordinates holds each segment's positions as [longitude, latitude]
+	// pairs, in the layout of a GeoJSON MultiLineString
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// TrackSegment describes one unbroken part of a track.
+type TrackSegment struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Count int    `json:"count"`
+}
+
+// splitTracks groups fixes sorted by platform and timestamp into one track
+// per platform. Fixes with unparseable timestamps are skipped.
+func splitTracks(locations []api.Location, segmentGap time.Duration) []Track {
+	tracks := []Track{}
+	var track *Track
+	var prevTime time.Time
+	for _, location := range locations {
+		t, err := parseTimestamp(location.Timestamp)
+		if err != nil {
+			continue
+		}
+		if track == nil || location.Platform != track.Platform {
+			tracks = append(tracks, Track{Deployment: location.Deployment, Platform: location.Platform})
+			track = &tracks[len(tracks)-1]
+		}
+		n := len(track.Segments)
+		if n == 0 || t.Sub(prevTime) > segmentGap {
+			track.Segments = append(track.Segments, TrackSegment{Start: location.Timestamp})
+			track.Coordinates = append(track.Coordinates, nil)
+			n++
+		}
+		track.Segments[n-1].End = location.Timestamp
+		track.Segments[n-1].Count++
+		track.Coordinates[n-1] = append(track.Coordinates[n-1], [2]float64{location.Longitude, location.Latitude})
+		prevTime = t
+	}
+	return tracks
+}
+
+// Smallest spacing tracks may be densified to, in kilometres, bounding how
+// many points a long transit becomes
+const minDensifySpacing = 1
+
+// densifyTracks adds points along the great circle to each segment of the tracks
+// so none is longer than spacing meters, and returns how many positions the
+// tracks then hold.
+func densifyTracks(tracks []Track, spacing float64) int {
+	n := 0
+	for i := range tracks {
+		for j, line := range tracks[i].Coordinates {
+			tracks[i].Coordinates[j] = densifyLine(line, spacing)
+			n += len(tracks[i].Coordinates[j])
+		}
+	}
+	return n
+}
+
+// exportLines returns a track's lines for GeoJSON and KML: each segment,
+// split where it crosses the antimeridian. A line needs two positions, so a
+// segment of a single fix is given its position twice.
+func exportLines(track Track) [][][2]float64 {
+	var lines [][][2]float64
+	for _, line := range track.Coordinates {
+		if len(line) == 1 {
+			line = [][2]float64{line[0], line[0]}
+		}
+		lines = append(lines, splitAntimeridian(line)...)
+	}
+	return lines
+}
+
+// trackFeatures converts tracks to GeoJSON features, one MultiLineString
+// per platform.
+func trackFeatures(tracks []Track) []gin.H {
+	features := make([]gin.H, 0, len(tracks))
+	for _, track := range tracks {
+		features = append(features, gin.H{
+			"type":     "Feature",
+			"geometry": gin.H{"type": "MultiLineString", "coordinates": exportLines(track)},
+			"properties": gin.H{
+				"deployment": track.Deployment,
+				"platform":   track.Platform,
+				"segments":   track.Segments,
+			},
+		})
+	}
+	return features
+}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string          `xml:"name"`
+	Description string          `xml:"description"`
+	Lines       []kmlLineString `xml:"MultiGeometry>LineString"`
+}
+
+type kmlLineString struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// writeTrackKML writes tracks to w as a KML document, one placemark per
+// platform holding its lines.
+func writeTrackKML(w io.Writer, deployment string, tracks []Track) error {
+	doc := kmlDocument{Name: deployment}
+	for _, track := range tracks {
+		placemark := kmlPlacemark{Name: track.Platform}
+		if n := len(track.Segments); n > 0 {
+			placemark.Description = fmt.Sprintf("%s to %s", track.Segments[0].Start, track.Segments[n-1].End)
+		}
+		for _, line := range exportLines(track) {
+			positions := make([]string, len(line))
+			for i, p := range line {
+				positions[i] = strconv.FormatFloat(p[0], 'f', -1, 64) + "," + strconv.FormatFloat(p[1], 'f', -1, 64)
+			}
+			placemark.Lines = append(placemark.Lines, kmlLineString{strings.Join(positions, " ")})
+		}
+		doc.Placemarks = append(doc.Placemarks, placemark)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func (s *Server) handleGetTracks(c *gin.Context) {
+	deployment := c.Query("deployment")
+	if deployment == "" {
+		respondErrorf(c, http.StatusBadRequest, "deployment is required")
+		return
+	}
+
+	segmentGap := defaultSegmentGap
+	if v := c.Query("segmentGap"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondErrorf(c, http.StatusBadRequest, "invalid segmentGap %q", v)
+			return
+		}
+		segmentGap = d
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "geojson" && format != "kml" {
+		respondErrorf(c, http.StatusBadRequest, "format must be json, geojson, or kml")
+		return
+	}
+
+	var densify float64
+	if v := c.Query("densify"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f >= minDensifySpacing) {
+			respondErrorf(c, http.StatusBadRequest, "densify must be a spacing in kilometres of at least %d", minDensifySpacing)
+			return
+		}
+		densify = f * 1000
+	}
+
+	var colorBy *trackVariable
+	if v := c.Query("colorBy"); v != "" {
+		if format != "geojson" {
+			respondErrorf(c, http.StatusBadRequest, "colorBy requires format=geojson")
+			return
+		}
+		var err error
+		if colorBy, err = parseTrackVariable(v); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	filter := bson.M{"deployment": deployment}
+	if platform := c.Query("platform"); platform != "" {
+		filter["platform"] = platform
+	}
+	start, end, err := parseTimeRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeRange := bson.M{}
+	if start != "" {
+		timeRange["$gte"] = start
+	}
+	if end != "" {
+		timeRange["$lte"] = end
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	if q := c.Query("q"); q != "" {
+		queryFilter, err := parseQuery(q)
+		if err != nil {
+			respondErrorf(c, http.StatusBadRequest, "invalid query: %v", err)
+			return
+		}
+		filter = bson.M{"$and": []bson.M{filter, queryFilter}}
+	}
+
+	ctx := c.Request.Context()
+	projection := bson.M{"deployment": 1, "platform": 1, "timestamp": 1, "latitude": 1, "longitude": 1}
+	if colorBy != nil && colorBy.field != "" {
+		projection[colorBy.field] = 1
+	}
+	// Fetch one extra fix to detect tracks exceeding the limit
+	opts := options.Find().
+		SetSort(bson.D{{Key: "platform", Value: 1}, {Key: "timestamp", Value: 1}}).
+		SetProjection(projection).
+		SetLimit(s.maxResultLimit + 1)
+	cursor, err := s.store.Locations.Find(ctx, scopedFilter(c, filter), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var locations []api.Location
+	if err = cursor.All(ctx, &locations); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(len(locations)) > s.maxResultLimit {
+		respondError(c, http.StatusRequestEntityTooLarge, tooManyResultsError(s.maxResultLimit))
+		return
+	}
+
+	if colorBy != nil {
+		var telemetry map[primitive.ObjectID]map[string]interface{}
+		if colorBy.telemetry != "" {
+			if telemetry, err = s.trackTelemetry(ctx, locations); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		collection, features, positions := colorizedFeatureCollection(locations, telemetry, colorBy, segmentGap, densify, loc)
+		if int64(positions) > s.maxResultLimit {
+			respondErrorf(c, http.StatusRequestEntityTooLarge, "densified tracks have more than %d positions; use a larger spacing or narrow the query", s.maxResultLimit)
+			return
+		}
+		// The fixes are no longer needed while the body is assembled
+		locations = nil
+		var body responseBody
+		defer body.Close()
+		if err := encodeList(&body, collection, "features", features); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		body.send(c, http.StatusOK, "application/geo+json")
+		return
+	}
+
+	tracks := splitTracks(locations, segmentGap)
+	if densify > 0 && int64(densifyTracks(tracks, densify)) > s.maxResultLimit {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, "densified tracks have more than %d positions; use a larger spacing or narrow the query", s.maxResultLimit)
+		return
+	}
+	for i := range tracks {
+		for j := range tracks[i].Segments {
+			segment := &tracks[i].Segments[j]
+			segment.Start = formatTimestamp(segment.Start, loc)
+			segment.End = formatTimestamp(segment.End, loc)
+		}
+	}
+
+	// Assembled within the response memory budget, as the formatted tracks
+	// are several times the size of the fixes
+	locations = nil
+	var body responseBody
+	defer body.Close()
+	contentType := "application/json; charset=utf-8"
+	switch format {
+	case "geojson":
+		contentType = "application/geo+json"
+		err = encodeList(&body, gin.H{"type": "FeatureCollection"}, "features", trackFeatures(tracks))
+	case "kml":
+		contentType = "application/vnd.google-earth.kml+xml"
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", deployment+".kml"))
+		err = writeTrackKML(&body, deployment, tracks)
+	default:
+		err = encodeList(&body, gin.H{"segment_gap": segmentGap.String()}, "tracks", tracks)
+	}
+	if err != nil {
+		c.Writer.Header().Del("Content-Disposition")
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	body.send(c, http.StatusOK, contentType)
+}
@@ -0,0 +1,40 @@
+package gateway
+
+import "fmt"
+
+// UnitSystem converts derived values from SI units for presentation.
+type UnitSystem struct {
+	Name          string  `json:"system"`
+	SpeedUnit     string  `json:"speed"`
+	DistanceUnit  string  `json:"distance"`
+	speedFactor   float64 // multiplier from m/s
+	distanceScale float64 // multiplier from meters
+}
+
+var unitSystems = map[string]UnitSystem{
+	"metric":   {Name: "metric", SpeedUnit: "m/s", DistanceUnit: "km", speedFactor: 1, distanceScale: 0.001},
+	"nautical": {Name: "nautical", SpeedUnit: "kn", DistanceUnit: "nmi", speedFactor: 3600.0 / 1852.0, distanceScale: 1 / 1852.0},
+	"imperial": {Name: "imperial", SpeedUnit: "mph", DistanceUnit: "mi", speedFactor: 3600.0 / 1609.344, distanceScale: 1 / 1609.344},
+}
+
+// parseUnits returns the requested unit system, defaulting to metric.
+func parseUnits(name string) (UnitSystem, error) {
+	if name == "" {
+		name = "metric"
+	}
+	units, ok := unitSystems[name]
+	if !ok {
+		return UnitSystem{}, fmt.Errorf("unknown units %q (expected metric, nautical, or imperial)", name)
+	}
+	return units, nil
+}
+
+// Speed converts a speed in meters per second.
+func (u UnitSystem) Speed(metersPerSecond float64) float64 {
+	return metersPerSecond * u.speedFactor
+}
+
+// Distance converts a distance in meters.
+func (u UnitSystem) Distance(meters float64) float64 {
+	return meters * u.distanceScale
+}
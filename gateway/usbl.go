@@ -0,0 +1,285 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"data-gateway/api"
+)
+
+// usblShip describes where a ship's USBL transducer sits relative to the
+// GPS antenna its fixes are reported for, in meters.
+type usblShip struct {
+	Platform  string  `json:"platform"`
+	Forward   float64 `json:"forward"`
+	Starboard float64 `json:"starboard"`
+	Depth     float64 `json:"depth"`
+}
+
+// usblBeacon maps a transponder ID to the platform carrying it.
+type usblBeacon struct {
+	Deployment string `json:"deployment"`
+	Beacon     string `json:"beacon"`
+	Platform   string `json:"platform"`
+}
+
+// usblFix is an acoustic fix as reported by the ship's USBL system.
+type usblFix struct {
+	Deployment       string   `json:"deployment" binding:"required"`
+	Ship             string   `json:"ship" binding:"required"`
+	Beacon           string   `json:"beacon" binding:"required"`
+	Timestamp        string   `json:"timestamp" binding:"required"`
+	Range            float64  `json:"range"`
+	Bearing          float64  `json:"bearing"`
+	BearingReference string   `json:"bearing_reference"`
+	Depth            float64  `json:"depth"`
+	ShipHeading      *float64 `json:"ship_heading"`
+	CommsPath        string   `json:"comms_path"`
+	UUID             string   `json:"uuid"`
+}
+
+const (
+	bearingRelative = "relative"
+	bearingTrue     = "true"
+)
+
+const sourceUSBL = "usbl"
+
+// Longest time between a USBL fix and the ship fix it is resolved against
+// when the ship has no fix after it
+const usblMaxShipAge = 30 * time.Second
+
+var usblShips = make(map[string]usblShip)
+var usblBeacons []usblBeacon
+
+func initUSBL() error {
+	configPath := os.Getenv("USBL_CONFIG")
+	if configPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading USBL_CONFIG: %v", err)
+	}
+	var cfg struct {
+		Ships   []usblShip   `json:"ships"`
+		Beacons []usblBeacon `json:"beacons"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing USBL_CONFIG: %v", err)
+	}
+
+	for i, ship := range cfg.Ships {
+		if ship.Platform == "" {
+			return fmt.Errorf("USBL ship %d has no platform", i)
+		}
+		usblShips[ship.Platform] = ship
+	}
+	for i, beacon := range cfg.Beacons {
+		if beacon.Beacon == "" || beacon.Platform == "" {
+			return fmt.Errorf("USBL beacon %d: beacon and platform are required", i)
+		}
+		if _, err := path.Match(beacon.Deployment, ""); err != nil {
+			return fmt.Errorf("USBL beacon %d: invalid deployment pattern %q", i, beacon.Deployment)
+		}
+	}
+	usblBeacons = cfg.Beacons
+	return nil
+}
+
+// beaconPlatform returns the platform carrying a beacon in a deployment.
+func beaconPlatform(deployment, beacon string) (string, bool) {
+	for _, b := range usblBeacons {
+		if b.Beacon != beacon {
+			continue
+		}
+		if ok, _ := path.Match(b.Deployment, deployment); b.Deployment == "" || ok {
+			return b.Platform, true
+		}
+	}
+	return "", false
+}
+
+// shipPose returns the ship's antenna position and heading at time ts,
+// interpolated between its fixes either side. A heading given with the USBL
+// fix takes precedence over the ship's reported heading, and that over the
+// course derived from its track.
+func (s *Server) shipPose(ctx context.Context, deployment, ship, ts string, heading *float64) (lat, lon, hdg float64, err error) {
+	before, after, err := s.findAdjacent(ctx, deployment, ship, ts, false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if before == nil {
+		return 0, 0, 0, fmt.Errorf("no position for ship %q at %s", ship, ts)
+	}
+
+	t, _ := parseTimestamp(ts)
+	lat, lon = before.Latitude, before.Longitude
+	if after != nil {
+		var ok bool
+		if lat, lon, ok = interpolatePosition(*before, *after, t); !ok {
+			lat, lon = before.Latitude, before.Longitude
+		}
+	} else if t0, err := parseTimestamp(before.Timestamp); err != nil || t.Sub(t0) > usblMaxShipAge {
+		return 0, 0, 0, fmt.Errorf("no position for ship %q within %s of %s", ship, usblMaxShipAge, ts)
+	}
+
+	switch {
+	case heading != nil:
+		hdg = *heading
+	case after != nil && headingOrCourse(after) != nil:
+		hdg = *headingOrCourse(after)
+	case headingOrCourse(before) != nil:
+		hdg = *headingOrCourse(before)
+	default:
+		return 0, 0, 0, fmt.Errorf("no heading for ship %q at %s; send ship_heading", ship, ts)
+	}
+	return lat, lon, hdg, nil
+}
+
+// resolveUSBL converts a range, bearing, and depth measured from the ship's
+// transducer into the beacon's geographic position.
+func resolveUSBL(fix usblFix, shipLat, shipLon, heading float64) (lat, lon float64) {
+	ship := usblShips[fix.Ship]
+
+	// Move from the GPS antenna to the transducer in the ship's frame
+	lat, lon = shipLat, shipLon
+	if ship.Forward != 0 {
+		lat, lon = destinationPoint(lat, lon, heading, ship.Forward)
+	}
+	if ship.Starboard != 0 {
+		lat, lon = destinationPoint(lat, lon, heading+90, ship.Starboard)
+	}
+
+	// The range is slant range, so take the horizontal component
+	dz := fix.Depth - ship.Depth
+	horizontal := 0.0
+	if fix.Range > math.Abs(dz) {
+		horizontal = math.Sqrt(fix.Range*fix.Range - dz*dz)
+	}
+
+	bearing := fix.Bearing
+	if fix.BearingReference != bearingTrue {
+		bearing += heading
+	}
+	return destinationPoint(lat, lon, math.Mod(bearing+360, 360), horizontal)
+}
+
+// usblLocation resolves a USBL fix to the fix of the platform carrying the
+// beacon, reading naive timestamps in tz. Errors come with the status to
+// respond with.
+func (s *Server) usblLocation(ctx context.Context, fix usblFix, tz *time.Location) (api.Location, int, error) {
+	if fix.Range < 0 {
+		return api.Location{}, http.StatusBadRequest, fmt.Errorf("range must not be negative")
+	}
+	if fix.BearingReference == "" {
+		fix.BearingReference = bearingRelative
+	}
+	if fix.BearingReference != bearingRelative && fix.BearingReference != bearingTrue {
+		return api.Location{}, http.StatusBadRequest, fmt.Errorf("bearing_reference must be relative or true")
+	}
+	platform, ok := beaconPlatform(fix.Deployment, fix.Beacon)
+	if !ok {
+		return api.Location{}, http.StatusUnprocessableEntity, fmt.Errorf("beacon %q is not mapped to a platform in USBL_CONFIG", fix.Beacon)
+	}
+	ts, err := normalizeTimestamp(fix.Timestamp, tz)
+	if err != nil {
+		return api.Location{}, http.StatusBadRequest, err
+	}
+
+	shipLat, shipLon, heading, err := s.shipPose(ctx, fix.Deployment, fix.Ship, ts, fix.ShipHeading)
+	if err != nil {
+		return api.Location{}, http.StatusUnprocessableEntity, err
+	}
+	lat, lon := resolveUSBL(fix, shipLat, shipLon, heading)
+
+	location := api.Location{
+		Deployment: fix.Deployment,
+		Platform:   platform,
+		Latitude:   lat,
+		Longitude:  lon,
+		Timestamp:  ts,
+		Source:     sourceUSBL,
+		CRS:        crsWGS84,
+		UUID:       fix.UUID,
+	}
+	location.SetDerived("depth", fix.Depth)
+	location.SetDerived("usbl", map[string]interface{}{
+		"ship":              fix.Ship,
+		"beacon":            fix.Beacon,
+		"range":             fix.Range,
+		"bearing":           fix.Bearing,
+		"bearing_reference": fix.BearingReference,
+		"ship_heading":      heading,
+	})
+	return location, http.StatusOK, nil
+}
+
+// handlePostUSBL ingests an acoustic fix of a beacon relative to the ship,
+// resolved to a geographic position using the ship's stored fixes, and
+// stores it for the platform carrying the beacon.
+func (s *Server) handlePostUSBL(c *gin.Context) {
+	var fix usblFix
+	if err := c.ShouldBindBodyWith(&fix, binding.JSON); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// USBL fixes are relayed by the ship, so they are signed with its secret
+	body, _ := c.Get(gin.BodyBytesKey)
+	if err := s.verifySignature(fix.Ship, body.([]byte), c.GetHeader("X-Signature")); err != nil {
+		respondError(c, http.StatusUnauthorized, err)
+		return
+	}
+
+	commsPath, err := resolveCommsPath(c, fix.CommsPath)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	req := &ingestRequest{raw: body.([]byte), rawFormat: payloadFormatUSBL}
+	if req.tz, err = requestTimezone(c); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	upsert, err := parseIngestMode(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := context.Background()
+	location, status, err := s.usblLocation(ctx, fix, req.tz)
+	if err != nil {
+		respondError(c, status, err)
+		return
+	}
+	req.location = location
+	req.location.ReceivedAt = time.Now().UTC().Format(timestampLayout)
+	req.location.CommsPath = commsPath
+
+	if status, err := s.processIngest(ctx, req, upsert); err != nil {
+		respondError(c, status, err)
+		return
+	}
+	defer req.release()
+	location, result, err := s.storeIngest(ctx, req)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("X-Ingest-Result", result)
+
+	localizeLocation(&location, req.tz)
+	c.JSON(http.StatusOK, location)
+}
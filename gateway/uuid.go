@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"data-gateway/api"
+)
+
+// How fixes get a UUID, set by LOCATION_ID_STRATEGY
+const (
+	// Fixes keep a UUID if sent one
+	idStrategyObjectID = "objectid"
+	// Fixes sent without a UUID are given one
+	idStrategyUUID = "uuid"
+	// Fixes must be sent with a UUID
+	idStrategyClient = "client"
+)
+
+var idStrategy = idStrategyObjectID
+
+func initIDStrategy() error {
+	if v := os.Getenv("LOCATION_ID_STRATEGY"); v != "" {
+		if v != idStrategyObjectID && v != idStrategyUUID && v != idStrategyClient {
+			return fmt.Errorf("invalid LOCATION_ID_STRATEGY %q (expected objectid, uuid, or client)", v)
+		}
+		idStrategy = v
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// normalizeUUID checks a UUID is in the canonical 8-4-4-4-12 form of hex
+// digits and lowercases it, so the same UUID always matches.
+func normalizeUUID(v string) (string, error) {
+	uuid := strings.ToLower(v)
+	if len(uuid) != 36 || uuid[8] != '-' || uuid[13] != '-' || uuid[18] != '-' || uuid[23] != '-' {
+		return "", fmt.Errorf("invalid uuid %q", v)
+	}
+	if _, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", "")); err != nil {
+		return "", fmt.Errorf("invalid uuid %q", v)
+	}
+	return uuid, nil
+}
+
+// checkUUID normalizes the UUID a fix was submitted with, and requires one
+// if clients are to supply them.
+func checkUUID(location *api.Location) error {
+	if location.UUID == "" {
+		if idStrategy == idStrategyClient {
+			return fmt.Errorf("uuid is required")
+		}
+		return nil
+	}
+	uuid, err := normalizeUUID(location.UUID)
+	if err != nil {
+		return err
+	}
+	location.UUID = uuid
+	return nil
+}
+
+// locationIDFilter matches the fix a path's id refers to, by its ObjectID
+// or UUID.
+func locationIDFilter(id string) (bson.M, error) {
+	if uuid, err := normalizeUUID(id); err == nil {
+		return bson.M{"uuid": uuid}, nil
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location id")
+	}
+	return bson.M{"_id": oid}, nil
+}
+
+// findByUUID returns the stored fix with a UUID, or nil if there is none.
+func (s *Server) findByUUID(ctx context.Context, uuid string) (*api.Location, error) {
+	var location api.Location
+	err := s.store.Locations.FindOne(ctx, bson.M{"uuid": uuid}).Decode(&location)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
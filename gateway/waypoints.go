@@ -0,0 +1,314 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"data-gateway/api"
+)
+
+const (
+	// How close in meters a platform must come to a waypoint to reach it,
+	// unless its plan sets its own
+	defaultArrivalRadius = 100
+	// Speed over this window of recent fixes estimates arrival times
+	waypointSpeedWindow = 30 * time.Minute
+	maxWaypoints        = 10000
+)
+
+// WaypointPlan is the route a platform is to follow, as waypoints to be
+// reached in order.
+type WaypointPlan struct {
+	Deployment string     `json:"deployment" bson:"deployment"`
+	Platform   string     `json:"platform" bson:"platform"`
+	Waypoints  []Waypoint `json:"waypoints" bson:"waypoints"`
+	// Radius in meters within which a waypoint counts as reached
+	ArrivalRadius float64 `json:"arrival_radius" bson:"arrival_radius"`
+	// Fixes from this time count towards reaching waypoints; when the plan
+	// was uploaded if unset
+	Start     string    `json:"start" bson:"start"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// Waypoint is a position on a platform's planned route.
+type Waypoint struct {
+	Name      string  `json:"name,omitempty" bson:"name,omitempty"`
+	Latitude  float64 `json:"latitude" bson:"latitude"`
+	Longitude float64 `json:"longitude" bson:"longitude"`
+}
+
+func (s *Server) initWaypoints() error {
+	collectionName := os.Getenv("MONGODB_WAYPOINTS_COLLECTION")
+	if collectionName == "" {
+		collectionName = "waypoints"
+	}
+	s.store.Waypoints = s.store.Collection(collectionName)
+
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "deployment", Value: 1}, {Key: "platform", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if err := s.ensureIndex(s.store.Waypoints, indexModel); err != nil {
+		return fmt.Errorf("error creating waypoint indexes: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) handleGetWaypointPlans(c *gin.Context) {
+	deployment := c.Param("deployment")
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "platform", Value: 1}})
+	cursor, err := s.store.Waypoints.Find(ctx, scopedFilter(c, bson.M{"deployment": deployment}), opts)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	plans := []WaypointPlan{}
+	if err := cursor.All(ctx, &plans); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+func (s *Server) handleGetWaypointPlan(c *gin.Context) {
+	deployment, platform := c.Param("deployment"), c.Param("platform")
+	if !canRead(c, deployment, platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	var plan WaypointPlan
+	err := s.store.Waypoints.FindOne(c.Request.Context(), bson.M{"deployment": deployment, "platform": platform}).Decode(&plan)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "no waypoints for platform")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *Server) handlePutWaypointPlan(c *gin.Context) {
+	var plan WaypointPlan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	plan.Deployment, plan.Platform = c.Param("deployment"), c.Param("platform")
+	plan.UpdatedAt = time.Now().UTC()
+
+	if len(plan.Waypoints) == 0 || len(plan.Waypoints) > maxWaypoints {
+		respondErrorf(c, http.StatusBadRequest, "a plan needs between 1 and %d waypoints", maxWaypoints)
+		return
+	}
+	for i, wp := range plan.Waypoints {
+		if !(wp.Latitude >= -90 && wp.Latitude <= 90 && wp.Longitude >= -180 && wp.Longitude <= 180) {
+			respondErrorf(c, http.StatusBadRequest, "waypoint %d has an invalid position", i+1)
+			return
+		}
+	}
+	if plan.ArrivalRadius == 0 {
+		plan.ArrivalRadius = defaultArrivalRadius
+	}
+	if !(plan.ArrivalRadius > 0) {
+		respondErrorf(c, http.StatusBadRequest, "arrival_radius must be positive")
+		return
+	}
+	if plan.Start == "" {
+		plan.Start = plan.UpdatedAt.Format(timestampLayout)
+	}
+	start, err := normalizeTimestamp(plan.Start, time.UTC)
+	if err != nil {
+		respondErrorf(c, http.StatusBadRequest, "invalid start: %v", err)
+		return
+	}
+	plan.Start = start
+
+	filter := bson.M{"deployment": plan.Deployment, "platform": plan.Platform}
+	if _, err := s.store.Waypoints.ReplaceOne(c.Request.Context(), filter, plan, options.Replace().SetUpsert(true)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+func (s *Server) handleDeleteWaypointPlan(c *gin.Context) {
+	filter := bson.M{"deployment": c.Param("deployment"), "platform": c.Param("platform")}
+	res, err := s.store.Waypoints.DeleteOne(c.Request.Context(), filter)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if res.DeletedCount == 0 {
+		respondErrorf(c, http.StatusNotFound, "no waypoints for platform")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// WaypointTarget is a waypoint relative to a platform's latest position.
+type WaypointTarget struct {
+	Index    int      `json:"index"`
+	Waypoint Waypoint `json:"waypoint"`
+	Distance float64  `json:"distance"`
+	Bearing  float64  `json:"bearing"`
+	// When the platform will reach it at its recent speed
+	ETA string `json:"eta,omitempty"`
+}
+
+// WaypointProgress is how far a platform has got along its planned route.
+type WaypointProgress struct {
+	Deployment string        `json:"deployment"`
+	Platform   string        `json:"platform"`
+	Position   *api.Location `json:"position"`
+	Reached    int           `json:"reached"`
+	Complete   bool          `json:"complete"`
+	// The waypoint the platform is heading to; omitted once all are reached
+	Next    *WaypointTarget `json:"next,omitempty"`
+	Nearest WaypointTarget  `json:"nearest"`
+	// Distance from the leg between the last waypoint reached and the next,
+	// positive to the right of it
+	CrossTrack *float64 `json:"cross_track,omitempty"`
+	// Average speed over ground over recent fixes, in m/s
+	Speed *float64 `json:"speed,omitempty"`
+}
+
+func (s *Server) handleGetWaypointProgress(c *gin.Context) {
+	deployment, platform := c.Param("deployment"), c.Param("platform")
+	if !canRead(c, deployment, platform) {
+		respondErrorf(c, http.StatusForbidden, "access to platform denied")
+		return
+	}
+	loc, err := requestTimezone(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	var plan WaypointPlan
+	err = s.store.Waypoints.FindOne(ctx, bson.M{"deployment": deployment, "platform": platform}).Decode(&plan)
+	if err == mongo.ErrNoDocuments {
+		respondErrorf(c, http.StatusNotFound, "no waypoints for platform")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Follow the platform's track since the plan started, reaching each
+	// waypoint in turn
+	filter := bson.M{"deployment": deployment, "platform": platform, "timestamp": bson.M{"$gte": plan.Start}}
+	cursor, err := s.store.Locations.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	reached := 0
+	var latest *api.Location
+	var recent []api.Location
+	for cursor.Next(ctx) {
+		var location api.Location
+		if err := cursor.Decode(&location); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		for reached < len(plan.Waypoints) {
+			wp := plan.Waypoints[reached]
+			if haversine(location.Latitude, location.Longitude, wp.Latitude, wp.Longitude) > plan.ArrivalRadius {
+				break
+			}
+			reached++
+		}
+		latest = &location
+		recent = append(recent, location)
+		if t, err := parseTimestamp(location.Timestamp); err == nil {
+			for len(recent) > 1 {
+				first, err := parseTimestamp(recent[0].Timestamp)
+				if err == nil && t.Sub(first) <= waypointSpeedWindow {
+					break
+				}
+				recent = recent[1:]
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if latest == nil {
+		respondErrorf(c, http.StatusNotFound, "no locations since the plan started")
+		return
+	}
+
+	progress := WaypointProgress{
+		Deployment: deployment,
+		Platform:   platform,
+		Position:   latest,
+		Reached:    reached,
+		Complete:   reached == len(plan.Waypoints),
+		Speed:      averageSpeed(recent),
+	}
+	target := func(i int) WaypointTarget {
+		wp := plan.Waypoints[i]
+		return WaypointTarget{
+			Index:    i,
+			Waypoint: wp,
+			Distance: haversine(latest.Latitude, latest.Longitude, wp.Latitude, wp.Longitude),
+			Bearing:  initialBearing(latest.Latitude, latest.Longitude, wp.Latitude, wp.Longitude),
+		}
+	}
+
+	progress.Nearest = target(0)
+	for i := 1; i < len(plan.Waypoints); i++ {
+		if t := target(i); t.Distance < progress.Nearest.Distance {
+			progress.Nearest = t
+		}
+	}
+
+	if !progress.Complete {
+		next := target(reached)
+		if t, err := parseTimestamp(latest.Timestamp); err == nil && progress.Speed != nil && *progress.Speed > 0 {
+			eta := t.Add(time.Duration(next.Distance / *progress.Speed * float64(time.Second)))
+			next.ETA = eta.In(loc).Format(timestampLayout)
+		}
+		progress.Next = &next
+		if reached > 0 {
+			from, to := plan.Waypoints[reached-1], plan.Waypoints[reached]
+			xt := crossTrackDistance(latest.Latitude, latest.Longitude, from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+			progress.CrossTrack = &xt
+		}
+	}
+
+	localizeLocation(progress.Position, loc)
+	c.JSON(http.StatusOK, progress)
+}
+
+// averageSpeed returns the distance over time along a run of fixes in m/s,
+// or nil if they span no time.
+func averageSpeed(fixes []api.Location) *float64 {
+	if len(fixes) < 2 {
+		return nil
+	}
+	t0, err0 := parseTimestamp(fixes[0].Timestamp)
+	t1, err1 := parseTimestamp(fixes[len(fixes)-1].Timestamp)
+	if err0 != nil || err1 != nil || !t1.After(t0) {
+		return nil
+	}
+	distance := 0.0
+	for i := 1; i < len(fixes); i++ {
+		distance += haversine(fixes[i-1].Latitude, fixes[i-1].Longitude, fixes[i].Latitude, fixes[i].Longitude)
+	}
+	speed := distance / t1.Sub(t0).Seconds()
+	return &speed
+}
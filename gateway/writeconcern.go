@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Durability settings for the MongoDB client. Those left unset keep the
+// value given in MONGODB_URI, if any, or the server's default.
+var (
+	// "majority" or a number of members
+	writeConcernW interface{}
+	writeJournal  *bool
+	writeTimeout  *time.Duration
+	retryWrites   *bool
+)
+
+func initWriteConcern() error {
+	writeConcernW, writeJournal, writeTimeout, retryWrites = nil, nil, nil, nil
+	if v := os.Getenv("MONGODB_WRITE_CONCERN"); v != "" {
+		if v == "majority" {
+			writeConcernW = v
+		} else if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			writeConcernW = n
+		} else {
+			return fmt.Errorf("invalid MONGODB_WRITE_CONCERN %q (expected majority or a number of members)", v)
+		}
+	}
+	for _, setting := range []struct {
+		name  string
+		value **bool
+	}{
+		{"MONGODB_JOURNAL", &writeJournal},
+		{"MONGODB_RETRY_WRITES", &retryWrites},
+	} {
+		if v := os.Getenv(setting.name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q (expected true or false)", setting.name, v)
+			}
+			*setting.value = &b
+		}
+	}
+	if os.Getenv("MONGODB_WRITE_TIMEOUT") != "" {
+		d, err := envDuration("MONGODB_WRITE_TIMEOUT", 0)
+		if err != nil {
+			return err
+		}
+		writeTimeout = &d
+	}
+	if writeConcernW == 0 && writeJournal != nil && *writeJournal {
+		return fmt.Errorf("MONGODB_JOURNAL=true needs acknowledged writes, not MONGODB_WRITE_CONCERN=0")
+	}
+	return nil
+}
+
+// applyWriteConcern sets the configured durability settings on opts, over
+// those from the URI.
+func applyWriteConcern(opts *options.ClientOptions) {
+	if writeConcernW != nil || writeJournal != nil || writeTimeout != nil {
+		wc := &writeconcern.WriteConcern{}
+		if opts.WriteConcern != nil {
+			*wc = *opts.WriteConcern
+		}
+		if writeConcernW != nil {
+			wc.W = writeConcernW
+		}
+		if writeJournal != nil {
+			wc.Journal = writeJournal
+		}
+		if writeTimeout != nil {
+			wc.WTimeout = *writeTimeout
+		}
+		opts.SetWriteConcern(wc)
+	}
+	if retryWrites != nil {
+		opts.SetRetryWrites(*retryWrites)
+	}
+}
+
+// checkWriteConcern reports the durability writes are acknowledged with,
+// warning of settings that can lose acknowledged fixes.
+func (s *Server) checkWriteConcern(ctx context.Context, report *DoctorReport) {
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	s.store.DB().RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+
+	wc := s.writeConcern
+	if wc == nil {
+		wc = &writeconcern.WriteConcern{}
+	}
+	w := "server default"
+	if wc.W != nil {
+		w = fmt.Sprint(wc.W)
+	}
+	journal := "server default"
+	if wc.Journal != nil {
+		journal = strconv.FormatBool(*wc.Journal)
+	}
+	retry := s.retryWrites == nil || *s.retryWrites
+	detail := gin.H{"w": w, "journal": journal, "retry_writes": retry, "replica_set": hello.SetName}
+	if wc.WTimeout > 0 {
+		detail["wtimeout_ms"] = wc.WTimeout.Milliseconds()
+	}
+
+	f := Finding{Check: "write concern", Status: findingOK, Detail: detail,
+		Message: fmt.Sprintf("writes are acknowledged with w=%s, journal=%s", w, journal)}
+	switch {
+	case wc.W == 0:
+		f.Status = findingWarning
+		f.Message = "writes are unacknowledged (MONGODB_WRITE_CONCERN=0), so failed inserts go unnoticed"
+	case wc.Journal != nil && !*wc.Journal:
+		f.Status = findingWarning
+		f.Message = "writes are acknowledged before they are journaled (MONGODB_JOURNAL=false), so fixes can be lost if MongoDB crashes"
+	case hello.SetName != "" && wc.W != nil && wc.W != "majority":
+		f.Status = findingWarning
+		f.Message = fmt.Sprintf("writes to replica set %s are acknowledged by %v member(s) rather than a majority, so fixes can be rolled back if the primary fails over", hello.SetName, wc.W)
+	}
+	report.add(f)
+}
@@ -0,0 +1,59 @@
+// Package gatewaytest runs a gateway over HTTP with an in-memory store, for
+// integration tests of clients and custom hooks without a real MongoDB.
+//
+// The gateway reads its settings from the environment as usual, so tests
+// configure it with t.Setenv before calling NewServer:
+//
+//	func TestTideHook(t *testing.T) {
+//		t.Setenv("HOOKS_CONFIG", "testdata/hooks.json")
+//		srv := gatewaytest.NewServer(t)
+//		resp, err := http.Post(srv.URL+"/api/data", "application/json", body)
+//		...
+//	}
+package gatewaytest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"data-gateway/gateway"
+	"data-gateway/store"
+)
+
+// Server is a gateway serving its API from an httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	Gateway *gateway.Server
+	// Store holds what the gateway has stored, for tests to inspect or seed
+	Store *store.Store
+}
+
+// NewServer starts a gateway with an empty in-memory store. It is stopped
+// when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	cfg, err := gateway.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("gatewaytest: %v", err)
+	}
+	cfg.Store = store.NewMemory()
+	g := gateway.New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := g.Setup(ctx); err != nil {
+		cancel()
+		t.Fatalf("gatewaytest: %v", err)
+	}
+	srv := httptest.NewServer(g.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+	return &Server{Server: srv, Gateway: g, Store: cfg.Store}
+}
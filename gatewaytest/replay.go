@@ -0,0 +1,292 @@
+package gatewaytest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var update = flag.Bool("gatewaytest.update", false, "rewrite golden files with what the gateway stored")
+
+// Fixture is a recorded exchange with the gateway, such as the ingest
+// payloads a platform sent during a cruise, replayed by Replay. Fixtures
+// are JSON files; what the gateway should store from them is kept beside
+// each in a golden file with the extension .golden.
+type Fixture struct {
+	// Env is set before the gateway starts
+	Env map[string]string `json:"env"`
+	// Requests are sent in order
+	Requests []FixtureRequest `json:"requests"`
+	// Ignore lists fields, as dotted paths, left out of stored records
+	// because they differ between runs. Record IDs and the times a record
+	// was received and created are always left out, wherever they appear.
+	Ignore []string `json:"ignore"`
+}
+
+// FixtureRequest is one request in a fixture.
+type FixtureRequest struct {
+	// POST if unset
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header"`
+	// Body is sent as JSON. BodyFile, relative to the fixture, is sent as
+	// is instead, for formats such as vehicle logs.
+	Body     json.RawMessage `json:"body"`
+	BodyFile string          `json:"body_file"`
+	// The status the gateway should respond with; any 2xx status if unset
+	Status int `json:"status"`
+}
+
+// Fields that differ on every run, left out at any depth, such as from the
+// fix embedded in an alert
+var volatileFields = []string{"_id", "location_id", "received_at", "created_at", "latency"}
+
+// How long a background job started by a request, such as a log import, is
+// given to finish
+const jobTimeout = 30 * time.Second
+
+// Replay sends a fixture's requests to a new gateway and compares the
+// records it stored with the fixture's golden file: for each type of
+// record that was stored, the records in the order they were inserted.
+// Requests that start a background job wait for it to finish. Run the test
+// with -gatewaytest.update to write the golden file instead, then review
+// the changes.
+func Replay(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture Fixture
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fixture); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+
+	for name, value := range fixture.Env {
+		t.Setenv(name, value)
+	}
+	srv := NewServer(t)
+
+	for i, req := range fixture.Requests {
+		if err := srv.send(filepath.Dir(path), req); err != nil {
+			t.Fatalf("%s: request %d (%s %s): %v", path, i+1, req.method(), req.Path, err)
+		}
+	}
+
+	got, err := srv.stored(fixture.Ignore)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+
+	goldenPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".golden"
+	if *update {
+		out, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(goldenPath, append(out, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("%v; run with -gatewaytest.update to create it", err)
+	}
+	var want map[string][]interface{}
+	if err := json.Unmarshal(golden, &want); err != nil {
+		t.Fatalf("%s: %v", goldenPath, err)
+	}
+	compareStored(t, goldenPath, want, got)
+}
+
+func (r FixtureRequest) method() string {
+	if r.Method == "" {
+		return http.MethodPost
+	}
+	return r.Method
+}
+
+// send sends a fixture request, checks the response status, and waits for
+// any job it started.
+func (srv *Server) send(dir string, r FixtureRequest) error {
+	var body io.Reader
+	contentType := ""
+	switch {
+	case r.BodyFile != "":
+		data, err := os.ReadFile(filepath.Join(dir, r.BodyFile))
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/octet-stream"
+	case len(r.Body) > 0:
+		body = bytes.NewReader(r.Body)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequest(r.method(), srv.URL+r.Path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range r.Header {
+		req.Header.Set(name, value)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if (r.Status == 0 && resp.StatusCode/100 != 2) || (r.Status != 0 && resp.StatusCode != r.Status) {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		var job struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(respBody, &job) == nil && job.ID != "" && job.Type != "" {
+			return srv.waitForJob(job.ID)
+		}
+	}
+	return nil
+}
+
+// waitForJob polls a background job until it finishes.
+func (srv *Server) waitForJob(id string) error {
+	deadline := time.Now().Add(jobTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := srv.Client().Get(srv.URL + "/api/jobs/" + id)
+		if err != nil {
+			return err
+		}
+		var job struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		switch job.Status {
+		case "succeeded":
+			return nil
+		case "failed":
+			return fmt.Errorf("job %s failed: %s", id, job.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("job %s still running after %s", id, jobTimeout)
+}
+
+// stored returns the records in each collection that holds any, as JSON
+// values without the ignored fields.
+func (srv *Server) stored(ignore []string) (map[string][]interface{}, error) {
+	ctx := context.Background()
+	out := make(map[string][]interface{})
+	for _, c := range srv.Store.Collections() {
+		cursor, err := (*c.Handle).Find(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			data, err := bson.MarshalExtJSON(doc, false, false)
+			if err != nil {
+				return nil, err
+			}
+			var record map[string]interface{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return nil, err
+			}
+			removeVolatile(record)
+			for _, field := range ignore {
+				removeField(record, field)
+			}
+			out[c.DataType] = append(out[c.DataType], record)
+		}
+	}
+	return out, nil
+}
+
+func removeVolatile(record map[string]interface{}) {
+	for _, field := range volatileFields {
+		delete(record, field)
+	}
+	for _, v := range record {
+		if nested, ok := v.(map[string]interface{}); ok {
+			removeVolatile(nested)
+		}
+	}
+}
+
+func removeField(record map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := record[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		record = next
+	}
+	delete(record, parts[len(parts)-1])
+}
+
+// compareStored reports each record that differs from the golden file.
+func compareStored(t *testing.T, goldenPath string, want, got map[string][]interface{}) {
+	t.Helper()
+	types := make(map[string]bool)
+	for name := range want {
+		types[name] = true
+	}
+	for name := range got {
+		types[name] = true
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w, g := want[name], got[name]
+		if len(w) != len(g) {
+			t.Errorf("%s: stored %d %s, want %d", goldenPath, len(g), name, len(w))
+		}
+		for i := 0; i < len(w) && i < len(g); i++ {
+			if !reflect.DeepEqual(w[i], g[i]) {
+				wantJSON, _ := json.Marshal(w[i])
+				gotJSON, _ := json.Marshal(g[i])
+				t.Errorf("%s: %s[%d] differs\n got: %s\nwant: %s", goldenPath, name, i, gotJSON, wantJSON)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection is the subset of *mongo.Collection the gateway uses, with the
+// same signatures, plus index management.
+type Collection interface {
+	Name() string
+
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	FindOneAndDelete(ctx context.Context, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) ([]interface{}, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+
+	// CreateIndex creates an index if it doesn't already exist.
+	CreateIndex(ctx context.Context, model mongo.IndexModel) error
+	// IndexKeys returns the keys of the collection's indexes.
+	IndexKeys(ctx context.Context) ([]bson.D, error)
+}
+
+type readOptionsKey struct{}
+
+// WithReadOptions returns a context whose MongoDB reads use opts, such as a
+// read preference sending them to secondaries. Writes are unaffected, and
+// the in-memory store ignores it.
+func WithReadOptions(ctx context.Context, opts *options.CollectionOptions) context.Context {
+	return context.WithValue(ctx, readOptionsKey{}, opts)
+}
+
+// mongoCollection is a Collection in MongoDB, reached through the store's
+// current client so operations follow a Reconnect.
+type mongoCollection struct {
+	conn *mongoConn
+	name string
+}
+
+func (c mongoCollection) coll(ctx context.Context) *mongo.Collection {
+	_, db := c.conn.get()
+	if opts, ok := ctx.Value(readOptionsKey{}).(*options.CollectionOptions); ok {
+		return db.Collection(c.name, opts)
+	}
+	return db.Collection(c.name)
+}
+
+func (c mongoCollection) Name() string {
+	return c.name
+}
+
+func (c mongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	return c.coll(ctx).Find(ctx, filter, opts...)
+}
+
+func (c mongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return c.coll(ctx).FindOne(ctx, filter, opts...)
+}
+
+func (c mongoCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	return c.coll(ctx).FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+func (c mongoCollection) FindOneAndDelete(ctx context.Context, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	return c.coll(ctx).FindOneAndDelete(ctx, filter, opts...)
+}
+
+func (c mongoCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return c.coll(ctx).Aggregate(ctx, pipeline, opts...)
+}
+
+func (c mongoCollection) Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) ([]interface{}, error) {
+	return c.coll(ctx).Distinct(ctx, fieldName, filter, opts...)
+}
+
+func (c mongoCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return c.coll(ctx).CountDocuments(ctx, filter, opts...)
+}
+
+func (c mongoCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return c.coll(ctx).InsertOne(ctx, document, opts...)
+}
+
+func (c mongoCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return c.coll(ctx).InsertMany(ctx, documents, opts...)
+}
+
+func (c mongoCollection) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	return c.coll(ctx).ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (c mongoCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.coll(ctx).UpdateOne(ctx, filter, update, opts...)
+}
+
+func (c mongoCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.coll(ctx).UpdateMany(ctx, filter, update, opts...)
+}
+
+func (c mongoCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.coll(ctx).DeleteOne(ctx, filter, opts...)
+}
+
+func (c mongoCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.coll(ctx).DeleteMany(ctx, filter, opts...)
+}
+
+func (c mongoCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	return c.coll(ctx).BulkWrite(ctx, models, opts...)
+}
+
+func (c mongoCollection) CreateIndex(ctx context.Context, model mongo.IndexModel) error {
+	_, err := c.coll(ctx).Indexes().CreateOne(ctx, model)
+	return err
+}
+
+func (c mongoCollection) IndexKeys(ctx context.Context) ([]bson.D, error) {
+	cursor, err := c.coll(ctx).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []struct {
+		Key bson.D `bson:"key"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, err
+	}
+	keys := make([]bson.D, len(indexes))
+	for i, index := range indexes {
+		keys[i] = index.Key
+	}
+	return keys, nil
+}
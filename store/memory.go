@@ -0,0 +1,592 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrUnsupported is returned by in-memory collections for queries, updates,
+// and aggregation stages they can't evaluate, rather than a wrong answer.
+var ErrUnsupported = errors.New("not supported by the in-memory store")
+
+func unsupported(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, fmt.Sprintf(format, args...))
+}
+
+// NewMemory returns a store that keeps its records in memory, for tests
+// that don't need a real MongoDB. Its collections understand the queries,
+// updates, and aggregation stages the gateway uses.
+func NewMemory() *Store {
+	var mu sync.Mutex
+	collections := make(map[string]*memoryCollection)
+	return &Store{
+		open: func(name string) Collection {
+			mu.Lock()
+			defer mu.Unlock()
+			if collections[name] == nil {
+				collections[name] = &memoryCollection{name: name}
+			}
+			return collections[name]
+		},
+	}
+}
+
+// memoryCollection is a Collection held in memory. Documents are kept in
+// insertion order in their normalized form: bson.M for documents, bson.A for
+// arrays, and the types the driver decodes BSON values to.
+type memoryCollection struct {
+	name    string
+	mu      sync.Mutex
+	docs    []bson.M
+	indexes []mongo.IndexModel
+}
+
+func (c *memoryCollection) Name() string {
+	return c.name
+}
+
+// find returns copies of the documents matching filter, sorted, skipped,
+// and limited. The caller must hold c.mu.
+func (c *memoryCollection) find(filter interface{}, sort interface{}, skip, limit *int64) ([]bson.M, []int, error) {
+	f, err := document(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	var matched []bson.M
+	var positions []int
+	for i, doc := range c.docs {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			matched = append(matched, doc)
+			positions = append(positions, i)
+		}
+	}
+
+	if sort != nil {
+		spec, err := ordered(sort)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := sortDocs(matched, positions, spec); err != nil {
+			return nil, nil, err
+		}
+	}
+	if skip != nil && *skip > 0 {
+		n := min(int(*skip), len(matched))
+		matched, positions = matched[n:], positions[n:]
+	}
+	if limit != nil && *limit != 0 {
+		n := int(*limit)
+		if n < 0 {
+			n = -n
+		}
+		if n < len(matched) {
+			matched, positions = matched[:n], positions[:n]
+		}
+	}
+	return matched, positions, nil
+}
+
+func cursor(docs []bson.M, projection interface{}) (*mongo.Cursor, error) {
+	out := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		projected, err := project(doc, projection)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = projected
+	}
+	return mongo.NewCursorFromDocuments(out, nil, nil)
+}
+
+func singleResult(doc bson.M, projection interface{}, err error) *mongo.SingleResult {
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	if doc == nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	projected, err := project(doc, projection)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return mongo.NewSingleResultFromDocument(projected, nil, nil)
+}
+
+func (c *memoryCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	o := options.MergeFindOptions(opts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, _, err := c.find(filter, o.Sort, o.Skip, o.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs, o.Projection)
+}
+
+func (c *memoryCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	o := options.MergeFindOneOptions(opts...)
+	one := int64(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, _, err := c.find(filter, o.Sort, o.Skip, &one)
+	if err != nil || len(docs) == 0 {
+		return singleResult(nil, nil, err)
+	}
+	return singleResult(docs[0], o.Projection, nil)
+}
+
+func (c *memoryCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	one := int64(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, positions, err := c.find(filter, o.Sort, nil, &one)
+	if err != nil {
+		return singleResult(nil, nil, err)
+	}
+
+	if len(docs) == 0 {
+		if o.Upsert == nil || !*o.Upsert {
+			return singleResult(nil, nil, nil)
+		}
+		doc, err := c.upsert(filter, update)
+		if err != nil || o.ReturnDocument == nil || *o.ReturnDocument == options.Before {
+			return singleResult(nil, nil, err)
+		}
+		return singleResult(doc, o.Projection, nil)
+	}
+
+	before := docs[0]
+	after, err := updated(before, update, false)
+	if err != nil {
+		return singleResult(nil, nil, err)
+	}
+	if err := c.replaceAt(positions[0], after); err != nil {
+		return singleResult(nil, nil, err)
+	}
+	if o.ReturnDocument != nil && *o.ReturnDocument == options.After {
+		return singleResult(after, o.Projection, nil)
+	}
+	return singleResult(before, o.Projection, nil)
+}
+
+func (c *memoryCollection) FindOneAndDelete(ctx context.Context, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndDeleteOptions(opts...)
+	one := int64(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, positions, err := c.find(filter, o.Sort, nil, &one)
+	if err != nil || len(docs) == 0 {
+		return singleResult(nil, nil, err)
+	}
+	c.deleteAt(positions)
+	return singleResult(docs[0], o.Projection, nil)
+}
+
+func (c *memoryCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	stages, err := array(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	docs := make([]bson.M, len(c.docs))
+	copy(docs, c.docs)
+	c.mu.Unlock()
+
+	docs, err = aggregate(docs, stages)
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs, nil)
+}
+
+func (c *memoryCollection) Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, _, err := c.find(filter, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	add := func(v interface{}) {
+		for _, seen := range values {
+			if compare(seen, v) == 0 {
+				return
+			}
+		}
+		values = append(values, v)
+	}
+	for _, doc := range docs {
+		v, ok := lookup(doc, fieldName)
+		if !ok {
+			continue
+		}
+		if a, isArray := v.(bson.A); isArray {
+			for _, e := range a {
+				add(e)
+			}
+		} else {
+			add(v)
+		}
+	}
+	return values, nil
+}
+
+func (c *memoryCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	o := options.MergeCountOptions(opts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs, _, err := c.find(filter, nil, o.Skip, o.Limit)
+	return int64(len(docs)), err
+}
+
+// insert adds a document, giving it an _id if it has none. The caller must
+// hold c.mu.
+func (c *memoryCollection) insert(doc bson.M) (interface{}, error) {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	if err := c.checkUnique(doc, -1); err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+	return doc["_id"], nil
+}
+
+// replaceAt replaces the document at position i. The caller must hold c.mu.
+func (c *memoryCollection) replaceAt(i int, doc bson.M) error {
+	if err := c.checkUnique(doc, i); err != nil {
+		return err
+	}
+	c.docs[i] = doc
+	return nil
+}
+
+// deleteAt removes the documents at the given positions. The caller must
+// hold c.mu.
+func (c *memoryCollection) deleteAt(positions []int) {
+	remove := make(map[int]bool, len(positions))
+	for _, i := range positions {
+		remove[i] = true
+	}
+	kept := c.docs[:0]
+	for i, doc := range c.docs {
+		if !remove[i] {
+			kept = append(kept, doc)
+		}
+	}
+	c.docs = kept
+}
+
+// checkUnique rejects a document that would duplicate the _id or a unique
+// index key of another document, ignoring the one at position self.
+func (c *memoryCollection) checkUnique(doc bson.M, self int) error {
+	keys := []bson.D{{{Key: "_id", Value: 1}}}
+	for _, index := range c.indexes {
+		if index.Options != nil && index.Options.Unique != nil && *index.Options.Unique {
+			spec, _ := ordered(index.Keys)
+			// Sparse indexes leave out documents missing an indexed field
+			if index.Options.Sparse != nil && *index.Options.Sparse && !hasFields(doc, spec) {
+				continue
+			}
+			keys = append(keys, spec)
+		}
+	}
+	for i, other := range c.docs {
+		if i == self {
+			continue
+		}
+		for _, key := range keys {
+			same := true
+			for _, e := range key {
+				a, _ := lookup(doc, e.Key)
+				b, _ := lookup(other, e.Key)
+				same = same && compare(a, b) == 0
+			}
+			if same {
+				return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+					Code:    11000,
+					Message: fmt.Sprintf("E11000 duplicate key error collection: %s", c.name),
+				}}}
+			}
+		}
+	}
+	return nil
+}
+
+// hasFields reports whether doc has every field of an index key.
+func hasFields(doc bson.M, key bson.D) bool {
+	for _, e := range key {
+		if _, ok := lookup(doc, e.Key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// upsert inserts the document an update creates when nothing matches its
+// filter. The caller must hold c.mu.
+func (c *memoryCollection) upsert(filter, update interface{}) (bson.M, error) {
+	f, err := document(filter)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := updated(equalityFields(f), update, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.insert(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *memoryCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := normalizedDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.insert(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+func (c *memoryCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := &mongo.InsertManyResult{}
+	for _, document := range documents {
+		doc, err := normalizedDocument(document)
+		if err != nil {
+			return result, err
+		}
+		id, err := c.insert(doc)
+		if err != nil {
+			return result, err
+		}
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+	return result, nil
+}
+
+func (c *memoryCollection) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeReplaceOptions(opts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replaceOne(filter, replacement, o.Upsert != nil && *o.Upsert)
+}
+
+// replaceOne is ReplaceOne for a caller holding c.mu.
+func (c *memoryCollection) replaceOne(filter, replacement interface{}, upsert bool) (*mongo.UpdateResult, error) {
+	doc, err := normalizedDocument(replacement)
+	if err != nil {
+		return nil, err
+	}
+	one := int64(1)
+	matched, positions, err := c.find(filter, nil, nil, &one)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matched) == 0 {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		if _, ok := doc["_id"]; !ok {
+			f, err := document(filter)
+			if err != nil {
+				return nil, err
+			}
+			if id, ok := equalityFields(f)["_id"]; ok {
+				doc["_id"] = id
+			}
+		}
+		id, err := c.insert(doc)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil
+	}
+
+	doc["_id"] = matched[0]["_id"]
+	if err := c.replaceAt(positions[0], doc); err != nil {
+		return nil, err
+	}
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (c *memoryCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeUpdateOptions(opts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.update(filter, update, o.Upsert != nil && *o.Upsert, false)
+}
+
+func (c *memoryCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeUpdateOptions(opts...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.update(filter, update, o.Upsert != nil && *o.Upsert, true)
+}
+
+// update applies an update to the first or all matching documents. The
+// caller must hold c.mu.
+func (c *memoryCollection) update(filter, update interface{}, upsert, many bool) (*mongo.UpdateResult, error) {
+	var limit *int64
+	if !many {
+		one := int64(1)
+		limit = &one
+	}
+	matched, positions, err := c.find(filter, nil, nil, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matched) == 0 {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		doc, err := c.upsert(filter, update)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: doc["_id"]}, nil
+	}
+
+	result := &mongo.UpdateResult{MatchedCount: int64(len(matched))}
+	for i, doc := range matched {
+		after, err := updated(doc, update, false)
+		if err != nil {
+			return result, err
+		}
+		if compare(doc, after) != 0 {
+			result.ModifiedCount++
+		}
+		if err := c.replaceAt(positions[i], after); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (c *memoryCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(filter, false)
+}
+
+func (c *memoryCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(filter, true)
+}
+
+// delete removes the first or all matching documents. The caller must hold
+// c.mu.
+func (c *memoryCollection) delete(filter interface{}, many bool) (*mongo.DeleteResult, error) {
+	var limit *int64
+	if !many {
+		one := int64(1)
+		limit = &one
+	}
+	_, positions, err := c.find(filter, nil, nil, limit)
+	if err != nil {
+		return nil, err
+	}
+	c.deleteAt(positions)
+	return &mongo.DeleteResult{DeletedCount: int64(len(positions))}, nil
+}
+
+func (c *memoryCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+	for i, model := range models {
+		var res *mongo.UpdateResult
+		var err error
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			var doc bson.M
+			if doc, err = normalizedDocument(m.Document); err == nil {
+				_, err = c.insert(doc)
+				result.InsertedCount++
+			}
+		case *mongo.ReplaceOneModel:
+			res, err = c.replaceOne(m.Filter, m.Replacement, m.Upsert != nil && *m.Upsert)
+		case *mongo.UpdateOneModel:
+			res, err = c.update(m.Filter, m.Update, m.Upsert != nil && *m.Upsert, false)
+		case *mongo.UpdateManyModel:
+			res, err = c.update(m.Filter, m.Update, m.Upsert != nil && *m.Upsert, true)
+		case *mongo.DeleteOneModel:
+			var del *mongo.DeleteResult
+			if del, err = c.delete(m.Filter, false); err == nil {
+				result.DeletedCount += del.DeletedCount
+			}
+		case *mongo.DeleteManyModel:
+			var del *mongo.DeleteResult
+			if del, err = c.delete(m.Filter, true); err == nil {
+				result.DeletedCount += del.DeletedCount
+			}
+		default:
+			err = unsupported("write model %T", model)
+		}
+		if err != nil {
+			return result, err
+		}
+		if res != nil {
+			result.MatchedCount += res.MatchedCount
+			result.ModifiedCount += res.ModifiedCount
+			result.UpsertedCount += res.UpsertedCount
+			if res.UpsertedID != nil {
+				result.UpsertedIDs[int64(i)] = res.UpsertedID
+			}
+		}
+	}
+	return result, nil
+}
+
+func (c *memoryCollection) CreateIndex(ctx context.Context, model mongo.IndexModel) error {
+	keys, err := ordered(model.Keys)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, index := range c.indexes {
+		existing, _ := ordered(index.Keys)
+		if compare(toValue(existing), toValue(keys)) == 0 {
+			return nil
+		}
+	}
+	c.indexes = append(c.indexes, model)
+	return nil
+}
+
+func (c *memoryCollection) IndexKeys(ctx context.Context) ([]bson.D, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := []bson.D{{{Key: "_id", Value: int32(1)}}}
+	for _, index := range c.indexes {
+		spec, err := ordered(index.Keys)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, spec)
+	}
+	return keys, nil
+}
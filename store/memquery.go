@@ -0,0 +1,1244 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Query evaluation for in-memory collections. Values are normalized by a
+// BSON round trip, so filters, updates, and documents compare the way they
+// would in MongoDB: times become primitive.DateTime, slices bson.A.
+
+// ordered normalizes a document, keeping field order and nested documents
+// as bson.D.
+func ordered(v interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	err = bson.Unmarshal(data, &d)
+	return d, err
+}
+
+// array normalizes an array such as a pipeline, keeping documents as bson.D.
+func array(v interface{}) (bson.A, error) {
+	d, err := ordered(bson.M{"v": v})
+	if err != nil {
+		return nil, err
+	}
+	a, ok := d[0].Value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("expected an array, got %T", v)
+	}
+	return a, nil
+}
+
+// toValue converts nested bson.D to bson.M.
+func toValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := make(bson.M, len(v))
+		for _, e := range v {
+			m[e.Key] = toValue(e.Value)
+		}
+		return m
+	case bson.M:
+		m := make(bson.M, len(v))
+		for k, e := range v {
+			m[k] = toValue(e)
+		}
+		return m
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = toValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+// document normalizes a filter or other document, treating nil as empty.
+func document(v interface{}) (bson.M, error) {
+	d, err := ordered(v)
+	if err != nil {
+		return nil, err
+	}
+	return toValue(d).(bson.M), nil
+}
+
+// normalizedDocument normalizes a document to be stored.
+func normalizedDocument(v interface{}) (bson.M, error) {
+	if v == nil {
+		return nil, fmt.Errorf("document is nil")
+	}
+	return document(v)
+}
+
+// lookup returns the value at a dotted path, and whether it exists. Paths
+// through arrays collect the value from each element.
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case bson.M:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case bson.A:
+			if i, err := strconv.Atoi(part); err == nil {
+				if i < 0 || i >= len(v) {
+					return nil, false
+				}
+				cur = v[i]
+				continue
+			}
+			var values bson.A
+			for _, e := range v {
+				if m, ok := e.(bson.M); ok {
+					if x, ok := lookup(m, part); ok {
+						values = append(values, x)
+					}
+				}
+			}
+			if len(values) == 0 {
+				return nil, false
+			}
+			cur = values
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setPath sets the value at a dotted path, creating documents on the way.
+func setPath(doc bson.M, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(bson.M)
+		if !ok {
+			if _, exists := doc[part]; exists {
+				return fmt.Errorf("cannot create field in %q of %q", part, path)
+			}
+			next = bson.M{}
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+	return nil
+}
+
+// unsetPath removes the value at a dotted path.
+func unsetPath(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(bson.M)
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+// isOperators reports whether a filter condition is a document of query
+// operators rather than a value to compare with.
+func isOperators(cond interface{}) bool {
+	m, ok := cond.(bson.M)
+	if !ok || len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matches evaluates a query filter against a document.
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, isArray := cond.(bson.A)
+			if !isArray || len(clauses) == 0 {
+				return false, fmt.Errorf("%s must be a nonempty array", key)
+			}
+			n := 0
+			for _, clause := range clauses {
+				m, isDoc := clause.(bson.M)
+				if !isDoc {
+					return false, fmt.Errorf("%s entries must be documents", key)
+				}
+				matched, err := matches(doc, m)
+				if err != nil {
+					return false, err
+				}
+				if matched {
+					n++
+				}
+			}
+			ok = (key == "$and" && n == len(clauses)) || (key == "$or" && n > 0) || (key == "$nor" && n == 0)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, unsupported("query operator %s", key)
+			}
+			value, found := lookup(doc, key)
+			ok, err = matchCondition(value, found, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchCondition evaluates one field's condition: a value to equal, or a
+// document of operators.
+func matchCondition(value interface{}, found bool, cond interface{}) (bool, error) {
+	if !isOperators(cond) {
+		return equalsOrContains(value, found, cond), nil
+	}
+	ops := cond.(bson.M)
+	for op, operand := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = equalsOrContains(value, found, operand)
+		case "$ne":
+			ok = !equalsOrContains(value, found, operand)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = anyValue(value, found, func(v interface{}) bool {
+				if typeOrder(v) != typeOrder(operand) {
+					return false
+				}
+				c := compare(v, operand)
+				return (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0)
+			})
+		case "$in", "$nin":
+			list, isArray := operand.(bson.A)
+			if !isArray {
+				return false, fmt.Errorf("%s needs an array", op)
+			}
+			in := false
+			for _, candidate := range list {
+				in = in || equalsOrContains(value, found, candidate)
+			}
+			ok = in == (op == "$in")
+		case "$exists":
+			ok = found == truthy(operand)
+		case "$not":
+			matched, err := matchCondition(value, found, operand)
+			if err != nil {
+				return false, err
+			}
+			ok = !matched
+		case "$regex":
+			pattern, ok2 := operand.(string)
+			if r, isRegex := operand.(primitive.Regex); isRegex {
+				pattern, ok2 = r.Pattern, true
+				if r.Options != "" {
+					pattern = "(?" + r.Options + ")" + pattern
+				}
+			}
+			if !ok2 {
+				return false, fmt.Errorf("$regex needs a string")
+			}
+			if opts, _ := ops["$options"].(string); opts != "" {
+				pattern = "(?" + opts + ")" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, err
+			}
+			ok = anyValue(value, found, func(v interface{}) bool {
+				s, isString := v.(string)
+				return isString && re.MatchString(s)
+			})
+		case "$options":
+			ok = true
+		default:
+			return false, unsupported("query operator %s", op)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// anyValue applies a test to a value, or to each element of an array value.
+func anyValue(value interface{}, found bool, test func(interface{}) bool) bool {
+	if !found {
+		return false
+	}
+	if a, ok := value.(bson.A); ok {
+		for _, e := range a {
+			if test(e) {
+				return true
+			}
+		}
+	}
+	return test(value)
+}
+
+// equalsOrContains is MongoDB's equality match: the value equals the
+// operand, or is an array with an element equal to it. A missing field
+// equals null.
+func equalsOrContains(value interface{}, found bool, operand interface{}) bool {
+	if !found {
+		return operand == nil
+	}
+	return anyValue(value, found, func(v interface{}) bool { return compare(v, operand) == 0 })
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int32, int64, float64:
+		f, _ := number(v)
+		return f != 0
+	}
+	return true
+}
+
+// equalityFields returns the fields a filter fixes to a value, which an
+// upsert copies into the document it inserts.
+func equalityFields(filter bson.M) bson.M {
+	doc := bson.M{}
+	for k, v := range filter {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if isOperators(v) {
+			if eq, ok := v.(bson.M)["$eq"]; ok {
+				setPath(doc, k, eq)
+			}
+			continue
+		}
+		setPath(doc, k, v)
+	}
+	return doc
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// typeOrder is MongoDB's order of BSON types in comparisons and sorts.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.M:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	}
+	return 12
+}
+
+// compare orders two normalized values.
+func compare(a, b interface{}) int {
+	if oa, ob := typeOrder(a), typeOrder(b); oa != ob {
+		return cmp(oa, ob)
+	}
+	switch a := a.(type) {
+	case int32, int64, float64:
+		x, _ := number(a)
+		y, _ := number(b)
+		return cmp(x, y)
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.M:
+		bm := b.(bson.M)
+		keys := make(map[string]bool)
+		for k := range a {
+			keys[k] = true
+		}
+		for k := range bm {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			x, okA := a[k]
+			y, okB := bm[k]
+			if okA != okB {
+				if okA {
+					return 1
+				}
+				return -1
+			}
+			if c := compare(x, y); c != 0 {
+				return c
+			}
+		}
+		return 0
+	case bson.A:
+		ba := b.(bson.A)
+		for i := 0; i < len(a) && i < len(ba); i++ {
+			if c := compare(a[i], ba[i]); c != 0 {
+				return c
+			}
+		}
+		return cmp(len(a), len(ba))
+	case primitive.ObjectID:
+		bid := b.(primitive.ObjectID)
+		return bytes.Compare(a[:], bid[:])
+	case bool:
+		bb := b.(bool)
+		switch {
+		case a == bb:
+			return 0
+		case bb:
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return cmp(a, b.(primitive.DateTime))
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func cmp[T int | float64 | primitive.DateTime](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortDocs sorts documents, and their positions alongside, by a sort spec.
+func sortDocs(docs []bson.M, positions []int, spec bson.D) error {
+	for _, e := range spec {
+		if _, ok := number(e.Value); !ok {
+			return unsupported("sort by %v", e.Value)
+		}
+	}
+	idx := make([]int, len(docs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		for _, e := range spec {
+			a, _ := lookup(docs[idx[i]], e.Key)
+			b, _ := lookup(docs[idx[j]], e.Key)
+			c := compare(a, b)
+			if dir, _ := number(e.Value); dir < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	sortedDocs := make([]bson.M, len(docs))
+	var sortedPositions []int
+	if positions != nil {
+		sortedPositions = make([]int, len(positions))
+	}
+	for i, k := range idx {
+		sortedDocs[i] = docs[k]
+		if positions != nil {
+			sortedPositions[i] = positions[k]
+		}
+	}
+	copy(docs, sortedDocs)
+	copy(positions, sortedPositions)
+	return nil
+}
+
+// project applies an inclusion or exclusion projection to a copy of doc.
+func project(doc bson.M, projection interface{}) (bson.M, error) {
+	out := toValue(doc).(bson.M)
+	if projection == nil {
+		return out, nil
+	}
+	spec, err := document(projection)
+	if err != nil || len(spec) == 0 {
+		return out, err
+	}
+
+	// A projection includes fields unless it only excludes them; _id alone
+	// can be excluded from an inclusion, or included by itself
+	include := false
+	for k, v := range spec {
+		if _, isNumber := number(v); !isNumber {
+			if _, isBool := v.(bool); !isBool {
+				return nil, unsupported("projection of %s", k)
+			}
+		}
+		if (k != "_id" || len(spec) == 1) && truthy(v) {
+			include = true
+		}
+	}
+
+	if !include {
+		for k := range spec {
+			unsetPath(out, k)
+		}
+		return out, nil
+	}
+	projected := bson.M{}
+	if id, ok := out["_id"]; ok && (spec["_id"] == nil || truthy(spec["_id"])) {
+		projected["_id"] = id
+	}
+	for k, v := range spec {
+		if k == "_id" || !truthy(v) {
+			continue
+		}
+		if value, ok := lookup(out, k); ok {
+			setPath(projected, k, value)
+		}
+	}
+	return projected, nil
+}
+
+// updated returns a copy of doc with an update applied: a document of
+// update operators, or a pipeline of $set and $unset stages. $setOnInsert
+// applies only when inserting.
+func updated(doc bson.M, update interface{}, inserting bool) (bson.M, error) {
+	out := toValue(doc).(bson.M)
+
+	if stages, err := array(update); err == nil {
+		for _, stage := range stages {
+			if err := applyStage(out, toValue(stage)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	u, err := document(update)
+	if err != nil {
+		return nil, err
+	}
+	if len(u) == 0 || !isOperators(u) {
+		return nil, fmt.Errorf("update document requires atomic operators")
+	}
+	for op, fields := range u {
+		m, ok := fields.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a document", op)
+		}
+		for path, v := range m {
+			switch op {
+			case "$set":
+				err = setPath(out, path, v)
+			case "$setOnInsert":
+				if inserting {
+					err = setPath(out, path, v)
+				}
+			case "$unset":
+				unsetPath(out, path)
+			case "$inc":
+				current, _ := lookup(out, path)
+				var sum interface{}
+				if sum, err = arithmetic("$add", bson.A{orZero(current), v}); err == nil {
+					err = setPath(out, path, sum)
+				}
+			case "$min", "$max":
+				current, found := lookup(out, path)
+				c := compare(v, current)
+				if !found || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+					err = setPath(out, path, v)
+				}
+			case "$push":
+				current, _ := lookup(out, path)
+				a, _ := current.(bson.A)
+				err = setPath(out, path, append(append(bson.A{}, a...), v))
+			default:
+				return nil, unsupported("update operator %s", op)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+func orZero(v interface{}) interface{} {
+	if v == nil {
+		return int32(0)
+	}
+	return v
+}
+
+// applyStage applies a $set, $addFields, or $unset stage to doc in place.
+// Expressions see the document as it was before the stage.
+func applyStage(doc bson.M, stage interface{}) error {
+	m, ok := stage.(bson.M)
+	if !ok || len(m) != 1 {
+		return fmt.Errorf("invalid pipeline stage %v", stage)
+	}
+	for name, spec := range m {
+		switch name {
+		case "$set", "$addFields":
+			fields, ok := spec.(bson.M)
+			if !ok {
+				return fmt.Errorf("%s needs a document", name)
+			}
+			before := toValue(doc).(bson.M)
+			for path, expr := range fields {
+				v, err := eval(before, expr)
+				if err != nil {
+					return err
+				}
+				if v == removed || v == missing {
+					unsetPath(doc, path)
+					continue
+				}
+				if err := setPath(doc, path, v); err != nil {
+					return err
+				}
+			}
+		case "$unset":
+			switch fields := spec.(type) {
+			case string:
+				unsetPath(doc, fields)
+			case bson.A:
+				for _, f := range fields {
+					path, ok := f.(string)
+					if !ok {
+						return fmt.Errorf("$unset needs field names")
+					}
+					unsetPath(doc, path)
+				}
+			default:
+				return fmt.Errorf("$unset needs field names")
+			}
+		default:
+			return unsupported("update pipeline stage %s", name)
+		}
+	}
+	return nil
+}
+
+// Results of expressions that name no value
+type sentinel string
+
+const (
+	missing sentinel = "missing"
+	removed sentinel = "$$REMOVE"
+)
+
+// value turns a missing or removed result into null.
+func value(v interface{}) interface{} {
+	if _, ok := v.(sentinel); ok {
+		return nil
+	}
+	return v
+}
+
+// eval evaluates an aggregation expression against a document.
+func eval(doc bson.M, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		switch {
+		case e == "$$ROOT" || e == "$$CURRENT":
+			return toValue(doc), nil
+		case e == "$$REMOVE":
+			return removed, nil
+		case strings.HasPrefix(e, "$$"):
+			return nil, unsupported("variable %s", e)
+		case strings.HasPrefix(e, "$"):
+			v, ok := lookup(doc, e[1:])
+			if !ok {
+				return missing, nil
+			}
+			return v, nil
+		}
+		return e, nil
+	case bson.A:
+		out := make(bson.A, len(e))
+		for i, x := range e {
+			v, err := eval(doc, x)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value(v)
+		}
+		return out, nil
+	case bson.M:
+		if len(e) == 1 {
+			for op, args := range e {
+				if strings.HasPrefix(op, "$") {
+					return evalOperator(doc, op, args)
+				}
+			}
+		}
+		out := bson.M{}
+		for k, x := range e {
+			v, err := eval(doc, x)
+			if err != nil {
+				return nil, err
+			}
+			if _, isSentinel := v.(sentinel); !isSentinel {
+				out[k] = v
+			}
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+// evalArgs evaluates an operator's arguments, which may be given as an
+// array or, for one argument, bare.
+func evalArgs(doc bson.M, args interface{}) (bson.A, error) {
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+	out := make(bson.A, len(list))
+	for i, x := range list {
+		v, err := eval(doc, x)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func evalOperator(doc bson.M, op string, args interface{}) (interface{}, error) {
+	switch op {
+	case "$literal":
+		return args, nil
+	case "$cond":
+		var cond, then, otherwise interface{}
+		switch a := args.(type) {
+		case bson.A:
+			if len(a) != 3 {
+				return nil, fmt.Errorf("$cond needs 3 arguments")
+			}
+			cond, then, otherwise = a[0], a[1], a[2]
+		case bson.M:
+			cond, then, otherwise = a["if"], a["then"], a["else"]
+		default:
+			return nil, fmt.Errorf("invalid $cond")
+		}
+		c, err := eval(doc, cond)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(value(c)) {
+			return eval(doc, then)
+		}
+		return eval(doc, otherwise)
+	case "$dateToString":
+		return dateToString(doc, args)
+	case "$dateFromString":
+		return dateFromString(doc, args)
+	}
+
+	a, err := evalArgs(doc, args)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "$type":
+		return typeName(a[0]), nil
+	case "$ifNull":
+		for _, v := range a {
+			if value(v) != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		if len(a) != 2 {
+			return nil, fmt.Errorf("%s needs 2 arguments", op)
+		}
+		c := compare(value(a[0]), value(a[1]))
+		switch op {
+		case "$eq":
+			return c == 0, nil
+		case "$ne":
+			return c != 0, nil
+		case "$gt":
+			return c > 0, nil
+		case "$gte":
+			return c >= 0, nil
+		case "$lt":
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	case "$add", "$subtract", "$multiply", "$divide":
+		for i := range a {
+			a[i] = value(a[i])
+		}
+		return arithmetic(op, a)
+	case "$floor":
+		v := value(a[0])
+		if v == nil {
+			return nil, nil
+		}
+		if f, ok := v.(float64); ok {
+			return math.Floor(f), nil
+		}
+		if _, ok := number(v); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("$floor needs a number")
+	case "$substrBytes":
+		if len(a) != 3 {
+			return nil, fmt.Errorf("$substrBytes needs 3 arguments")
+		}
+		s, _ := value(a[0]).(string)
+		start, ok1 := number(a[1])
+		n, ok2 := number(a[2])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("$substrBytes needs numeric bounds")
+		}
+		from := min(int(start), len(s))
+		to := len(s)
+		if n >= 0 {
+			to = min(from+int(n), len(s))
+		}
+		return s[from:to], nil
+	case "$bsonSize":
+		m, ok := value(a[0]).(bson.M)
+		if !ok {
+			return nil, nil
+		}
+		data, err := bson.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return int32(len(data)), nil
+	}
+	return nil, unsupported("expression operator %s", op)
+}
+
+// arithmetic adds, subtracts, multiplies, or divides numbers, keeping
+// integers integral except when dividing. Dates may have milliseconds added
+// or subtracted. Null operands give null.
+func arithmetic(op string, args bson.A) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s needs arguments", op)
+	}
+	var date *primitive.DateTime
+	integral := op != "$divide"
+	var result float64
+	for i, arg := range args {
+		if arg == nil {
+			return nil, nil
+		}
+		if d, ok := arg.(primitive.DateTime); ok && (op == "$add" || (op == "$subtract" && i == 0)) && date == nil {
+			date = &d
+			arg = int64(d)
+		}
+		f, ok := number(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s needs numbers, got %T", op, arg)
+		}
+		if _, isFloat := arg.(float64); isFloat {
+			integral = false
+		}
+		if i == 0 {
+			result = f
+			continue
+		}
+		switch op {
+		case "$add":
+			result += f
+		case "$subtract":
+			result -= f
+		case "$multiply":
+			result *= f
+		case "$divide":
+			if f == 0 {
+				return nil, fmt.Errorf("can't $divide by zero")
+			}
+			result /= f
+		}
+	}
+	if date != nil {
+		return primitive.DateTime(int64(math.Round(result))), nil
+	}
+	if integral {
+		return int64(result), nil
+	}
+	return result, nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case sentinel:
+		return "missing"
+	case nil:
+		return "null"
+	case float64:
+		return "double"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case primitive.DateTime:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case bson.M:
+		return "object"
+	case bson.A:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// dateFormats maps $dateToString format specifiers to Go layouts.
+var dateFormats = map[byte]string{
+	'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05", 'L': "000",
+}
+
+func dateToString(doc bson.M, args interface{}) (interface{}, error) {
+	spec, ok := args.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$dateToString needs a document")
+	}
+	format, _ := spec["format"].(string)
+	if format == "" {
+		format = "%Y-%m-%dT%H:%M:%S.%LZ"
+	}
+	v, err := eval(doc, spec["date"])
+	if err != nil {
+		return nil, err
+	}
+	d, ok := value(v).(primitive.DateTime)
+	if !ok {
+		return nil, nil
+	}
+	t := d.Time().UTC()
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		layout, ok := dateFormats[format[i]]
+		if !ok {
+			return nil, unsupported("$dateToString format %%%c", format[i])
+		}
+		if format[i] == 'L' {
+			b.WriteString(fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond)))
+		} else {
+			b.WriteString(t.Format(layout))
+		}
+	}
+	return b.String(), nil
+}
+
+func dateFromString(doc bson.M, args interface{}) (interface{}, error) {
+	spec, ok := args.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$dateFromString needs a document")
+	}
+	for k := range spec {
+		if k != "dateString" {
+			return nil, unsupported("$dateFromString option %s", k)
+		}
+	}
+	v, err := eval(doc, spec["dateString"])
+	if err != nil {
+		return nil, err
+	}
+	s, ok := value(v).(string)
+	if !ok {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return primitive.NewDateTimeFromTime(t), nil
+		}
+	}
+	return nil, fmt.Errorf("$dateFromString can't parse %q", s)
+}
+
+// aggregate runs an aggregation pipeline over documents.
+func aggregate(docs []bson.M, stages bson.A) ([]bson.M, error) {
+	for _, stage := range stages {
+		d, ok := stage.(bson.D)
+		if !ok || len(d) != 1 {
+			return nil, fmt.Errorf("invalid pipeline stage %v", stage)
+		}
+		name, spec := d[0].Key, d[0].Value
+		var err error
+		switch name {
+		case "$match":
+			filter, ok := toValue(spec).(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("$match needs a document")
+			}
+			var kept []bson.M
+			for _, doc := range docs {
+				matched, err := matches(doc, filter)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					kept = append(kept, doc)
+				}
+			}
+			docs = kept
+		case "$sort":
+			keys, ok := spec.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$sort needs a document")
+			}
+			err = sortDocs(docs, nil, keys)
+		case "$skip", "$limit":
+			n, ok := number(spec)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("%s needs a nonnegative number", name)
+			}
+			if name == "$skip" {
+				docs = docs[min(int(n), len(docs)):]
+			} else if int(n) < len(docs) {
+				docs = docs[:int(n)]
+			}
+		case "$set", "$addFields", "$unset":
+			out := make([]bson.M, len(docs))
+			for i, doc := range docs {
+				out[i] = toValue(doc).(bson.M)
+				if err := applyStage(out[i], bson.M{name: toValue(spec)}); err != nil {
+					return nil, err
+				}
+			}
+			docs = out
+		case "$project":
+			out := make([]bson.M, len(docs))
+			for i, doc := range docs {
+				if out[i], err = project(doc, spec); err != nil {
+					return nil, err
+				}
+			}
+			docs = out
+		case "$group":
+			group, ok := toValue(spec).(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("$group needs a document")
+			}
+			docs, err = groupDocs(docs, group)
+		case "$count":
+			field, ok := spec.(string)
+			if !ok {
+				return nil, fmt.Errorf("$count needs a field name")
+			}
+			if len(docs) == 0 {
+				docs = nil
+			} else {
+				docs = []bson.M{{field: int32(len(docs))}}
+			}
+		default:
+			return nil, unsupported("aggregation stage %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// groupDocs runs a $group stage, keeping groups in order of first
+// appearance.
+func groupDocs(docs []bson.M, spec bson.M) ([]bson.M, error) {
+	idExpr, ok := spec["_id"]
+	if !ok {
+		return nil, fmt.Errorf("$group needs an _id")
+	}
+	type accumulator struct {
+		field, op string
+		expr      interface{}
+	}
+	var accumulators []accumulator
+	for field, v := range spec {
+		if field == "_id" {
+			continue
+		}
+		m, ok := v.(bson.M)
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("$group field %s needs one accumulator", field)
+		}
+		for op, expr := range m {
+			accumulators = append(accumulators, accumulator{field, op, expr})
+		}
+	}
+
+	type group struct {
+		id     interface{}
+		values map[string]bson.A
+	}
+	var groups []*group
+	for _, doc := range docs {
+		id, err := eval(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		id = value(id)
+		var g *group
+		for _, existing := range groups {
+			if compare(existing.id, id) == 0 {
+				g = existing
+				break
+			}
+		}
+		if g == nil {
+			g = &group{id: id, values: make(map[string]bson.A)}
+			groups = append(groups, g)
+		}
+		for _, acc := range accumulators {
+			v, err := eval(doc, acc.expr)
+			if err != nil {
+				return nil, err
+			}
+			g.values[acc.field] = append(g.values[acc.field], v)
+		}
+	}
+
+	out := make([]bson.M, len(groups))
+	for i, g := range groups {
+		doc := bson.M{"_id": g.id}
+		for _, acc := range accumulators {
+			v, err := accumulate(acc.op, g.values[acc.field])
+			if err != nil {
+				return nil, err
+			}
+			doc[acc.field] = v
+		}
+		out[i] = doc
+	}
+	return out, nil
+}
+
+func accumulate(op string, values bson.A) (interface{}, error) {
+	switch op {
+	case "$sum", "$avg":
+		var sum bson.A
+		for _, v := range values {
+			if _, ok := number(v); ok {
+				sum = append(sum, v)
+			}
+		}
+		if len(sum) == 0 {
+			if op == "$avg" {
+				return nil, nil
+			}
+			return int32(0), nil
+		}
+		total, err := arithmetic("$add", sum)
+		if err != nil || op == "$sum" {
+			return total, err
+		}
+		f, _ := number(total)
+		return f / float64(len(sum)), nil
+	case "$min", "$max":
+		var best interface{}
+		for _, v := range values {
+			v = value(v)
+			if v == nil {
+				continue
+			}
+			if best == nil || (op == "$min" && compare(v, best) < 0) || (op == "$max" && compare(v, best) > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "$first", "$last":
+		if len(values) == 0 {
+			return nil, nil
+		}
+		if op == "$first" {
+			return value(values[0]), nil
+		}
+		return value(values[len(values)-1]), nil
+	case "$push":
+		out := bson.A{}
+		for _, v := range values {
+			if _, isSentinel := v.(sentinel); !isSentinel {
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	case "$addToSet":
+		out := bson.A{}
+		for _, v := range values {
+			if _, isSentinel := v.(sentinel); isSentinel {
+				continue
+			}
+			seen := false
+			for _, x := range out {
+				seen = seen || compare(x, v) == 0
+			}
+			if !seen {
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	}
+	return nil, unsupported("accumulator %s", op)
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The documents the query tests run against, with the values MongoDB
+// treats specially: arrays, nested documents, missing fields, and numbers
+// and strings that don't compare with each other.
+var testDocs = []interface{}{
+	bson.M{"_id": "a", "n": 1, "s": "alpha", "tags": bson.A{"red", "blue"}, "sub": bson.M{"k": 1}, "t": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+	bson.M{"_id": "b", "n": 2, "s": "beta", "tags": bson.A{"green"}, "sub": bson.M{"k": 2}, "t": time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+	bson.M{"_id": "c", "n": 3, "s": "alpha", "list": bson.A{bson.M{"k": 5}, bson.M{"k": 6}}},
+	bson.M{"_id": "d", "n": 2.5, "s": nil},
+	bson.M{"_id": "e", "n": "3"},
+}
+
+func testCollection(t *testing.T) Collection {
+	t.Helper()
+	c := NewMemory().Collection("test")
+	if _, err := c.InsertMany(context.Background(), testDocs); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// ids returns the _ids of the documents a find returns, in order.
+func ids(t *testing.T, c Collection, filter interface{}, opts ...*options.FindOptions) []string {
+	t.Helper()
+	ctx := context.Background()
+	cursor, err := c.Find(ctx, filter, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		t.Fatal(err)
+	}
+	result := []string{}
+	for _, doc := range docs {
+		result = append(result, doc.ID)
+	}
+	return result
+}
+
+// same reports whether two documents are equal as MongoDB compares them,
+// so numbers of different types are equal if their values are.
+func same(got, want interface{}) bool {
+	g, err := document(bson.M{"v": got})
+	if err != nil {
+		return false
+	}
+	w, err := document(bson.M{"v": want})
+	return err == nil && compare(g, w) == 0
+}
+
+func TestMemoryQuery(t *testing.T) {
+	c := testCollection(t)
+	for _, tc := range []struct {
+		name   string
+		filter bson.M
+		want   []string
+	}{
+		{"empty", bson.M{}, []string{"a", "b", "c", "d", "e"}},
+		{"equal", bson.M{"s": "alpha"}, []string{"a", "c"}},
+		{"equal numbers of any type", bson.M{"n": 2.0}, []string{"b"}},
+		{"equal null matches missing", bson.M{"s": nil}, []string{"d", "e"}},
+		{"equal array element", bson.M{"tags": "blue"}, []string{"a"}},
+		{"equal whole array", bson.M{"tags": bson.A{"green"}}, []string{"b"}},
+		{"dotted path", bson.M{"sub.k": 2}, []string{"b"}},
+		{"dotted path through array", bson.M{"list.k": 6}, []string{"c"}},
+		{"$eq", bson.M{"n": bson.M{"$eq": 3}}, []string{"c"}},
+		{"$ne matches missing", bson.M{"sub.k": bson.M{"$ne": 1}}, []string{"b", "c", "d", "e"}},
+		{"$gt", bson.M{"n": bson.M{"$gt": 2}}, []string{"c", "d"}},
+		{"$gte", bson.M{"n": bson.M{"$gte": 2}}, []string{"b", "c", "d"}},
+		{"$lt", bson.M{"n": bson.M{"$lt": 2}}, []string{"a"}},
+		{"$lte", bson.M{"n": bson.M{"$lte": 2.5}}, []string{"a", "b", "d"}},
+		{"range", bson.M{"n": bson.M{"$gt": 1, "$lt": 3}}, []string{"b", "d"}},
+		{"range of strings", bson.M{"n": bson.M{"$gte": ""}}, []string{"e"}},
+		{"range of dates", bson.M{"t": bson.M{"$gt": time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}}, []string{"b"}},
+		{"range over array elements", bson.M{"list.k": bson.M{"$gt": 5}}, []string{"c"}},
+		{"$in", bson.M{"s": bson.M{"$in": bson.A{"beta", "gamma"}}}, []string{"b"}},
+		{"$in null matches missing", bson.M{"s": bson.M{"$in": bson.A{nil, "beta"}}}, []string{"b", "d", "e"}},
+		{"$in array elements", bson.M{"tags": bson.M{"$in": bson.A{"green", "blue"}}}, []string{"a", "b"}},
+		{"$nin", bson.M{"s": bson.M{"$nin": bson.A{"alpha", nil}}}, []string{"b"}},
+		{"$exists", bson.M{"tags": bson.M{"$exists": true}}, []string{"a", "b"}},
+		{"$exists false", bson.M{"s": bson.M{"$exists": false}}, []string{"e"}},
+		{"$not", bson.M{"n": bson.M{"$not": bson.M{"$gt": 2}}}, []string{"a", "b", "e"}},
+		{"$regex", bson.M{"s": bson.M{"$regex": "^al"}}, []string{"a", "c"}},
+		{"$regex options", bson.M{"s": bson.M{"$regex": "^BE", "$options": "i"}}, []string{"b"}},
+		{"$and", bson.M{"$and": bson.A{bson.M{"s": "alpha"}, bson.M{"n": bson.M{"$gt": 1}}}}, []string{"c"}},
+		{"$or", bson.M{"$or": bson.A{bson.M{"s": "beta"}, bson.M{"n": 3}}}, []string{"b", "c"}},
+		{"$nor", bson.M{"$nor": bson.A{bson.M{"s": "alpha"}, bson.M{"s": nil}}}, []string{"b"}},
+		{"nested $or in $and", bson.M{"$and": bson.A{
+			bson.M{"$or": bson.A{bson.M{"n": bson.M{"$gt": 2}}, bson.M{"_id": "b"}}},
+			bson.M{"$or": bson.A{bson.M{"s": "alpha"}, bson.M{"s": "beta"}}},
+		}}, []string{"b", "c"}},
+		{"fields and operators together", bson.M{"s": "alpha", "$or": bson.A{bson.M{"n": 1}, bson.M{"n": 2}}}, []string{"a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ids(t, c, tc.filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryQueryErrors(t *testing.T) {
+	c := testCollection(t)
+	for _, tc := range []struct {
+		name        string
+		filter      bson.M
+		unsupported bool
+	}{
+		{"unknown operator", bson.M{"n": bson.M{"$mod": bson.A{2, 0}}}, true},
+		{"unknown top-level operator", bson.M{"$where": "true"}, true},
+		{"$in without an array", bson.M{"n": bson.M{"$in": 1}}, false},
+		{"empty $or", bson.M{"$or": bson.A{}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := c.Find(context.Background(), tc.filter)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, ErrUnsupported) != tc.unsupported {
+				t.Errorf("got %v, unsupported %v", err, tc.unsupported)
+			}
+		})
+	}
+}
+
+func TestMemorySort(t *testing.T) {
+	c := testCollection(t)
+	for _, tc := range []struct {
+		name string
+		opts *options.FindOptions
+		want []string
+	}{
+		{"insertion order", options.Find(), []string{"a", "b", "c", "d", "e"}},
+		// Numbers sort before strings, whatever their values
+		{"ascending", options.Find().SetSort(bson.D{{Key: "n", Value: 1}}), []string{"a", "b", "d", "c", "e"}},
+		{"descending", options.Find().SetSort(bson.D{{Key: "n", Value: -1}}), []string{"e", "c", "d", "b", "a"}},
+		// Missing and null values sort first, and ties keep their order
+		{"missing first", options.Find().SetSort(bson.D{{Key: "s", Value: 1}}), []string{"d", "e", "a", "c", "b"}},
+		{"ties broken by later keys", options.Find().SetSort(bson.D{{Key: "s", Value: 1}, {Key: "_id", Value: -1}}), []string{"e", "d", "c", "a", "b"}},
+		{"skip", options.Find().SetSort(bson.D{{Key: "n", Value: 1}}).SetSkip(2), []string{"d", "c", "e"}},
+		{"limit", options.Find().SetSort(bson.D{{Key: "n", Value: 1}}).SetLimit(2), []string{"a", "b"}},
+		{"skip then limit", options.Find().SetSort(bson.D{{Key: "n", Value: -1}}).SetSkip(1).SetLimit(2), []string{"c", "d"}},
+		{"skip past the end", options.Find().SetSkip(10), []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ids(t, c, bson.M{}, tc.opts)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryProjection(t *testing.T) {
+	c := testCollection(t)
+	for _, tc := range []struct {
+		name       string
+		projection bson.M
+		want       bson.M
+	}{
+		{"inclusion keeps _id", bson.M{"n": 1}, bson.M{"_id": "a", "n": 1}},
+		{"inclusion without _id", bson.M{"n": 1, "_id": 0}, bson.M{"n": 1}},
+		{"_id alone", bson.M{"_id": 1}, bson.M{"_id": "a"}},
+		{"nested inclusion", bson.M{"sub.k": 1}, bson.M{"_id": "a", "sub": bson.M{"k": 1}}},
+		{"exclusion", bson.M{"tags": 0, "t": 0, "sub": 0, "s": 0}, bson.M{"_id": "a", "n": 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got bson.M
+			err := c.FindOne(context.Background(), bson.M{"_id": "a"}, options.FindOne().SetProjection(tc.projection)).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !same(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		update interface{}
+		want   bson.M
+	}{
+		{"$set", bson.M{"$set": bson.M{"n": 5, "sub.j": "x"}}, bson.M{"_id": "a", "n": 5, "sub": bson.M{"k": 1, "j": "x"}}},
+		{"$unset", bson.M{"$unset": bson.M{"sub.k": ""}}, bson.M{"_id": "a", "n": 1, "sub": bson.M{}}},
+		{"$inc", bson.M{"$inc": bson.M{"n": 2, "m": 1}}, bson.M{"_id": "a", "n": 3, "m": 1, "sub": bson.M{"k": 1}}},
+		{"$min", bson.M{"$min": bson.M{"n": 0}}, bson.M{"_id": "a", "n": 0, "sub": bson.M{"k": 1}}},
+		{"$max", bson.M{"$max": bson.M{"n": 0}}, bson.M{"_id": "a", "n": 1, "sub": bson.M{"k": 1}}},
+		{"$push", bson.M{"$push": bson.M{"l": "x"}}, bson.M{"_id": "a", "n": 1, "l": bson.A{"x"}, "sub": bson.M{"k": 1}}},
+		{"$setOnInsert ignored", bson.M{"$setOnInsert": bson.M{"n": 9}}, bson.M{"_id": "a", "n": 1, "sub": bson.M{"k": 1}}},
+		{"pipeline", bson.A{
+			bson.M{"$set": bson.M{"n": bson.M{"$add": bson.A{"$n", 1}}, "copy": "$sub.k"}},
+			bson.M{"$unset": "sub"},
+		}, bson.M{"_id": "a", "n": 2, "copy": 1}},
+		{"pipeline $$REMOVE", bson.A{
+			bson.M{"$set": bson.M{"n": "$$REMOVE"}},
+		}, bson.M{"_id": "a", "sub": bson.M{"k": 1}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := NewMemory().Collection("test")
+			if _, err := c.InsertOne(ctx, bson.M{"_id": "a", "n": 1, "sub": bson.M{"k": 1}}); err != nil {
+				t.Fatal(err)
+			}
+			result, err := c.UpdateOne(ctx, bson.M{"_id": "a"}, tc.update)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.MatchedCount != 1 {
+				t.Errorf("matched %d, want 1", result.MatchedCount)
+			}
+			var got bson.M
+			if err := c.FindOne(ctx, bson.M{"_id": "a"}).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !same(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryUpsert(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemory().Collection("test")
+	update := bson.M{"$set": bson.M{"n": 1}, "$setOnInsert": bson.M{"created": true}}
+	result, err := c.UpdateOne(ctx, bson.M{"_id": "a", "s": bson.M{"$eq": "x"}}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UpsertedCount != 1 {
+		t.Fatalf("upserted %d, want 1", result.UpsertedCount)
+	}
+	var got bson.M
+	if err := c.FindOne(ctx, bson.M{"_id": "a"}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"_id": "a", "s": "x", "n": 1, "created": true}
+	if !same(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMemoryAggregate(t *testing.T) {
+	ctx := context.Background()
+	c := testCollection(t)
+	cursor, err := c.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"n": bson.M{"$gte": 1}}},
+		bson.M{"$group": bson.M{"_id": "$s", "count": bson.M{"$sum": 1}, "max": bson.M{"$max": "$n"}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.M{"$skip": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []bson.M
+	if err := cursor.All(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.M{
+		{"_id": nil, "count": 1, "max": 2.5},
+		{"_id": "beta", "count": 1, "max": 2},
+	}
+	if !same(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+// Package store holds the collections the gateway keeps its records in,
+// either in MongoDB or, for tests, in memory.
+package store
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store holds the collections the gateway reads and writes.
+type Store struct {
+	// The MongoDB connection, nil for an in-memory store
+	conn *mongoConn
+
+	Locations  Collection
+	Telemetry  Collection
+	Events     Collection
+	Heartbeats Collection
+	// Raised alerts are kept, whether or not any channel was routed them
+	Alerts Collection
+	// Wind, waves, currents and other conditions, measured or modelled
+	Environment Collection
+
+	Credentials    Collection
+	Settings       Collection
+	Reports        Collection
+	MinuteRollups  Collection
+	HourlyRollups  Collection
+	DailySummaries Collection
+	SurveyPlans    Collection
+	Waypoints      Collection
+	Changes        Collection
+	RawPayloads    Collection
+	// Fixes as they were before reprocessing replaced them
+	LocationVersions Collection
+	// Fixes reprocessed without replacing the stored ones, for review
+	ReparsedLocations Collection
+	// Live stream events shared between gateway instances
+	StreamEvents Collection
+	// Deployment archives built in the background
+	Exports Collection
+	// Windows alerts are held back over
+	Suppressions Collection
+	// Stored fixes waiting to be published to webhooks
+	Outbox Collection
+	// Hours changed by edits and deletes, waiting for the next rollup run
+	DirtyRollups Collection
+
+	open func(name string) Collection
+}
+
+// mongoConn is the client a store's collections are reached through,
+// which Reconnect can replace while they are in use.
+type mongoConn struct {
+	mu     sync.RWMutex
+	client *mongo.Client
+	db     *mongo.Database
+	// Whether the server supports transactions, once asked
+	transactions *bool
+}
+
+func (conn *mongoConn) get() (*mongo.Client, *mongo.Database) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.client, conn.db
+}
+
+// How long a replaced client is kept for the operations already using it
+const reconnectGrace = time.Minute
+
+// NewMongo returns a store keeping its records in db.
+func NewMongo(client *mongo.Client, db *mongo.Database) *Store {
+	conn := &mongoConn{client: client, db: db}
+	return &Store{
+		conn: conn,
+		open: func(name string) Collection {
+			return mongoCollection{conn: conn, name: name}
+		},
+	}
+}
+
+// Client returns the MongoDB client, or nil for an in-memory store.
+func (st *Store) Client() *mongo.Client {
+	if st.conn == nil {
+		return nil
+	}
+	client, _ := st.conn.get()
+	return client
+}
+
+// DB returns the MongoDB database, or nil for an in-memory store.
+func (st *Store) DB() *mongo.Database {
+	if st.conn == nil {
+		return nil
+	}
+	_, db := st.conn.get()
+	return db
+}
+
+// Reconnect switches the store to a new client of the same database, such
+// as one with rotated credentials. The old client is disconnected once the
+// operations already using it have had time to finish.
+func (st *Store) Reconnect(client *mongo.Client) {
+	st.conn.mu.Lock()
+	old := st.conn.client
+	st.conn.client = client
+	st.conn.db = client.Database(st.conn.db.Name())
+	st.conn.transactions = nil
+	st.conn.mu.Unlock()
+
+	time.AfterFunc(reconnectGrace, func() { old.Disconnect(context.Background()) })
+}
+
+// Collection returns the named collection.
+func (st *Store) Collection(name string) Collection {
+	return st.open(name)
+}
+
+// Ping checks that the database can be reached.
+func (st *Store) Ping(ctx context.Context) error {
+	if st.conn == nil {
+		return nil
+	}
+	return st.Client().Ping(ctx, nil)
+}
+
+// WithTransaction runs fn with a context whose writes are made in one
+// MongoDB transaction, committed if fn returns nil and aborted otherwise.
+// fn may be run again if the transaction hits a transient error, such as a
+// write conflict. Transactions need a replica set or sharded cluster; with a
+// standalone server or an in-memory store, fn runs without one, and
+// WithTransaction reports that it did.
+func (st *Store) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	supported, err := st.supportsTransactions(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !supported {
+		return false, fn(ctx)
+	}
+	session, err := st.Client().StartSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return true, err
+}
+
+// supportsTransactions reports whether the server is a replica set member
+// or a mongos, asking it the first time.
+func (st *Store) supportsTransactions(ctx context.Context) (bool, error) {
+	if st.conn == nil {
+		return false, nil
+	}
+	st.conn.mu.RLock()
+	known := st.conn.transactions
+	st.conn.mu.RUnlock()
+	if known != nil {
+		return *known, nil
+	}
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := st.DB().RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	st.conn.mu.Lock()
+	st.conn.transactions = &supported
+	st.conn.mu.Unlock()
+	return supported, nil
+}
+
+// Close disconnects from the database.
+func (st *Store) Close(ctx context.Context) error {
+	if st.conn == nil {
+		return nil
+	}
+	return st.Client().Disconnect(ctx)
+}
+
+// DataCollection is where one type of record is stored. Each type has its
+// own collection, named by an environment variable, with its indexes
+// declared here so they are created and checked the same way.
+type DataCollection struct {
+	DataType string
+	Env      string
+	Name     string
+	Handle   *Collection
+	Indexes  []mongo.IndexModel
+}
+
+// Most records are queried by platform over a time range
+var platformTimeIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "deployment", Value: 1},
+		{Key: "platform", Value: 1},
+		{Key: "timestamp", Value: 1},
+	},
+}
+
+// Collections lists the collection for each type of record.
+func (st *Store) Collections() []DataCollection {
+	return []DataCollection{
+		{"locations", "MONGODB_COLLECTION", "locations", &st.Locations, []mongo.IndexModel{
+			platformTimeIndex,
+			// Fixes sent without a UUID don't have one
+			{Keys: bson.D{{Key: "uuid", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		}},
+		{"telemetry", "MONGODB_TELEMETRY_COLLECTION", "telemetry", &st.Telemetry, []mongo.IndexModel{
+			platformTimeIndex,
+			{Keys: bson.D{{Key: "location_id", Value: 1}}},
+		}},
+		{"events", "MONGODB_EVENTS_COLLECTION", "events", &st.Events, []mongo.IndexModel{
+			platformTimeIndex,
+			{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "type", Value: 1}, {Key: "timestamp", Value: 1}}},
+		}},
+		{"heartbeats", "MONGODB_HEARTBEATS_COLLECTION", "heartbeats", &st.Heartbeats, []mongo.IndexModel{platformTimeIndex}},
+		{"alerts", "MONGODB_ALERTS_COLLECTION", "alerts", &st.Alerts, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "time", Value: 1}}},
+			{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "state", Value: 1}}},
+		}},
+		{"environment", "MONGODB_ENVIRONMENT_COLLECTION", "environment", &st.Environment, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "timestamp", Value: 1}}},
+			{Keys: bson.D{{Key: "deployment", Value: 1}, {Key: "source", Value: 1}, {Key: "timestamp", Value: 1}}},
+		}},
+	}
+}
+
+// Open opens the collection for each type of record. Indexes are left to
+// the caller.
+func (st *Store) Open() {
+	for _, c := range st.Collections() {
+		name := os.Getenv(c.Env)
+		if name == "" {
+			name = c.Name
+		}
+		*c.Handle = st.Collection(name)
+	}
+}